@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/Bug-daulet/FinalSPA/internal/data"
 	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"hash/fnv"
 	"net/http"
+	"time"
 )
 
+// bookSortSafelist is the columns books can be listed in order of.
+var bookSortSafelist = []string{"id", "title", "year", "pages", "rating", "-id", "-title", "-year", "-pages", "-rating"}
+
 func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request) {
 
 	var input struct {
@@ -33,26 +39,34 @@ func (app *application) createBookHandler(w http.ResponseWriter, r *http.Request
 
 	v := validator.New()
 
+	if book.Genres != nil {
+		book.Genres, err = app.normalizeGenres(r.Context(), v, book.Genres)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	if data.ValidateBooks(v, book); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.Books.Insert(book)
+	err = app.models.Books.Insert(r.Context(), book)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	app.bookChanged()
+
 	headers := make(http.Header)
-	headers.Set("Location", fmt.Sprint("/v1/books/%d", book.ID))
+	headers.Set("Location", fmt.Sprintf("/v1/books/%d", book.ID))
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"book": book}, headers)
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"book": book}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-
-	fmt.Fprintf(w, "%+v\n", input)
 }
 
 func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request) {
@@ -63,7 +77,16 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	books, err := app.models.Books.Get(id)
+	fields := app.readCSV(r.URL.Query(), "fields", nil)
+
+	v := validator.New()
+
+	if data.ValidateBookFields(v, fields); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	book, err := app.models.Books.Get(r.Context(), id, fields...)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -74,7 +97,16 @@ func (app *application) showBookHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"books": books}, nil)
+	if app.notModified(w, r, book.UpdatedAt, bookETag(book)) {
+		return
+	}
+
+	var output interface{} = book
+	if len(fields) > 0 {
+		output = book.Select(fields)
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"books": output}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -87,7 +119,7 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	book, err := app.models.Books.Get(id)
+	book, err := app.models.Books.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -121,17 +153,22 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 	if input.Pages != nil {
 		book.Pages = *input.Pages
 	}
-	if input.Genres != nil {
-		book.Genres = input.Genres
-	}
 
 	v := validator.New()
 
+	if input.Genres != nil {
+		book.Genres, err = app.normalizeGenres(r.Context(), v, input.Genres)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
 	if data.ValidateBooks(v, book); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
-	err = app.models.Books.Update(book)
+	err = app.models.Books.Update(r.Context(), book)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -141,7 +178,10 @@ func (app *application) updateBookHandler(w http.ResponseWriter, r *http.Request
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"book": book}, nil)
+
+	app.bookChanged()
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"book": book}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -156,7 +196,7 @@ func (app *application) deleteBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.models.Books.Delete(id)
+	err = app.models.Books.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -167,7 +207,9 @@ func (app *application) deleteBookHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "book successfully deleted"}, nil)
+	app.bookChanged()
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "book successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -192,22 +234,127 @@ func (app *application) listBooksHandler(w http.ResponseWriter, r *http.Request)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "year", "pages", "-id", "-title", "-year", "-pages"}
+	input.Filters.SortSafelist = bookSortSafelist
+
+	input.Filters.YearMin = app.readInt(qs, "year_min", 0, v)
+	input.Filters.YearMax = app.readInt(qs, "year_max", 0, v)
+	input.Filters.PagesMin = app.readInt(qs, "pages_min", 0, v)
+	input.Filters.PagesMax = app.readInt(qs, "pages_max", 0, v)
+	input.Filters.RatingMin = app.readFloat(qs, "rating_min", 0, v)
+	input.Filters.RatingMax = app.readFloat(qs, "rating_max", 0, v)
+	input.Filters.RatingsMin = app.readInt(qs, "ratings_min", 0, v)
+
+	input.Filters.GenresMode = app.readString(qs, "genres_mode", "all")
+	input.Filters.ExcludeGenres = app.readCSV(qs, "exclude_genres", []string{})
+
+	input.Filters.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.Filters.CreatedBefore = app.readTime(qs, "created_before", v)
+
+	input.Filters.Fields = app.readCSV(qs, "fields", nil)
+
+	data.ValidateBookFields(v, input.Filters.Fields)
 
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	books, metadata, err := app.models.Books.GetAll(input.Title, input.Genres, input.Filters)
+	var err error
+
+	input.Genres, _, err = app.models.Genres.Normalize(r.Context(), input.Genres)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	input.Filters.ExcludeGenres, _, err = app.models.Genres.Normalize(r.Context(), input.Filters.ExcludeGenres)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"metadata": metadata, "books": books}, nil)
+	books, metadata, err := app.models.Books.GetAll(r.Context(), input.Title, input.Genres, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.notModified(w, r, lastModified(books), listETag(books, metadata)) {
+		return
+	}
+
+	var output interface{} = books
+	if len(input.Filters.Fields) > 0 {
+		selected := make([]map[string]interface{}, len(books))
+		for i, book := range books {
+			selected[i] = book.Select(input.Filters.Fields)
+		}
+		output = selected
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"metadata": metadata, "books": output}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+}
+
+func (app *application) normalizeGenres(ctx context.Context, v *validator.Validator, genres []string) ([]string, error) {
+	slugs, unknown, err := app.models.Genres.Normalize(ctx, genres)
+	if err != nil {
+		return nil, err
 	}
 
+	if len(unknown) > 0 {
+		v.AddError("genres", fmt.Sprintf("unknown genre %q", unknown[0]))
+	}
+
+	return slugs, nil
+}
+
+// lastModified returns the latest updated_at of books. A deletion doesn't move
+// it, but it does change the listing's ETag, which conditional requests check
+// first.
+func lastModified(books []*data.Book) time.Time {
+	var latest time.Time
+	for _, book := range books {
+		if book.UpdatedAt.After(latest) {
+			latest = book.UpdatedAt
+		}
+	}
+	return latest
+}
+
+// bookETag identifies a book by its version, its rating summary and its copy
+// counts, which reviews, copies and loans change without bumping the version.
+func bookETag(book *data.Book) string {
+	return fmt.Sprintf(`W/"%d-%d-%d-%g-%d-%d"`, book.ID, book.Version, book.RatingsCount, book.AverageRating, book.CopiesTotal, book.CopiesAvailable)
+}
+
+// listETag identifies a page of books by the versions, rating summaries and
+// copy counts of the books on it and the total number of matches.
+func listETag(books []*data.Book, metadata data.Metadata) string {
+	h := fnv.New64a()
+
+	fmt.Fprintf(h, "%d", metadata.TotalRecords)
+	for _, book := range books {
+		fmt.Fprintf(h, ",%d:%d:%d:%g:%d:%d", book.ID, book.Version, book.RatingsCount, book.AverageRating, book.CopiesTotal, book.CopiesAvailable)
+	}
+
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// bookChanged wakes the workers that pass book changes on, so that they
+// don't wait for their next poll. The write itself has already recorded the
+// change for them.
+func (app *application) bookChanged() {
+	if app.relay != nil {
+		app.relay.Notify()
+	}
+	if app.stream != nil {
+		app.stream.notify()
+	}
+	if app.holds != nil {
+		app.holds.notify()
+	}
 }
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const duneJSON = `{"title": "Dune", "year": 1965, "pages": "412 pages", "genres": ["Sci-Fi"]}`
+
+func TestCreateBook(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	rs := ts.do(t, http.MethodPost, "/v1/books", duneJSON)
+
+	if rs.status != http.StatusCreated {
+		t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusCreated, rs.body)
+	}
+	if got := rs.header.Get("Location"); got != "/v1/books/1" {
+		t.Errorf("got Location %q; want %q", got, "/v1/books/1")
+	}
+
+	var env struct {
+		Book map[string]interface{} `json:"book"`
+	}
+	rs.decode(t, &env)
+
+	if env.Book["pages"] != "412 pages" {
+		t.Errorf("got pages %v; want %q", env.Book["pages"], "412 pages")
+	}
+	if fmt.Sprint(env.Book["genres"]) != "[science-fiction]" {
+		t.Errorf("got genres %v; want the alias normalised to [science-fiction]", env.Book["genres"])
+	}
+	if env.Book["version"] != float64(1) {
+		t.Errorf("got version %v; want 1", env.Book["version"])
+	}
+}
+
+func TestReadJSONErrors(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"Syntax error", `{"title": "Dune",}`, "body contains badly-formed JSON (at character 18)"},
+		{"Unexpected EOF", `{"title": "Dune"`, "body contains badly-formed JSON"},
+		{"Wrong field type", `{"title": 1965}`, `body contains incorrect JSON type for field "title"`},
+		{"Wrong document type", `["Dune"]`, "body contains incorrect JSON type (at character 1)"},
+		{"Empty body", "", "body must not be empty"},
+		{"Unknown field", `{"author": "Frank Herbert"}`, `body contains unknown key "author"`},
+		{"Too large", `{"title": "` + strings.Repeat("a", 1_048_576) + `"}`, "body must not be larger than 1048576 bytes"},
+		{"Several values", `{"title": "Dune"}{"title": "Emma"}`, "body must only contain a single JSON value"},
+		{"Pages not a string", `{"pages": 412}`, "invalid pages format"},
+		{"Pages without unit", `{"pages": "412"}`, "invalid pages format"},
+		{"Pages wrong unit", `{"pages": "412 words"}`, "invalid pages format"},
+		{"Pages not a number", `{"pages": "many pages"}`, "invalid pages format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.do(t, http.MethodPost, "/v1/books", tt.body)
+
+			if rs.status != http.StatusBadRequest {
+				t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusBadRequest, rs.body)
+			}
+			if got := rs.errorMessage(t); got != tt.want {
+				t.Errorf("got error %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateBookValidation(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+		want  string
+	}{
+		{"Missing title", `{"year": 1965, "pages": "412 pages", "genres": ["fiction"]}`, "title", "must be provided"},
+		{"Long title", `{"title": "` + strings.Repeat("a", 501) + `", "year": 1965, "pages": "412 pages", "genres": ["fiction"]}`, "title", "must not be more than 500 bytes long"},
+		{"Missing year", `{"title": "Dune", "pages": "412 pages", "genres": ["fiction"]}`, "year", "must be provided"},
+		{"Early year", `{"title": "Dune", "year": 1500, "pages": "412 pages", "genres": ["fiction"]}`, "year", "must be greater than 1888"},
+		{"Future year", `{"title": "Dune", "year": 3000, "pages": "412 pages", "genres": ["fiction"]}`, "year", "must not be in the future"},
+		{"Missing pages", `{"title": "Dune", "year": 1965, "genres": ["fiction"]}`, "pages", "must be provided"},
+		{"Negative pages", `{"title": "Dune", "year": 1965, "pages": "-1 pages", "genres": ["fiction"]}`, "pages", "must be a positive integer"},
+		{"Missing genres", `{"title": "Dune", "year": 1965, "pages": "412 pages"}`, "genres", "must be provided"},
+		{"No genres", `{"title": "Dune", "year": 1965, "pages": "412 pages", "genres": []}`, "genres", "must contain at least 1 genre"},
+		{"Too many genres", `{"title": "Dune", "year": 1965, "pages": "412 pages", "genres": ["fiction", "fantasy", "mystery", "history", "biography", "non-fiction"]}`, "genres", "must not contain more than 5 genres"},
+		{"Duplicate genres", `{"title": "Dune", "year": 1965, "pages": "412 pages", "genres": ["Sci-Fi", "science fiction"]}`, "genres", "must not contain duplicate values"},
+		{"Unknown genre", `{"title": "Dune", "year": 1965, "pages": "412 pages", "genres": ["space western"]}`, "genres", `unknown genre "space western"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.do(t, http.MethodPost, "/v1/books", tt.body)
+
+			if rs.status != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusUnprocessableEntity, rs.body)
+			}
+
+			errs, ok := rs.errorMessage(t).(map[string]interface{})
+			if !ok {
+				t.Fatalf("got error %s; want a map of field errors", rs.body)
+			}
+			if errs[tt.field] != tt.want {
+				t.Errorf("got %s error %q; want %q", tt.field, errs[tt.field], tt.want)
+			}
+		})
+	}
+}
+
+func TestShowBook(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	id := ts.createBook(t, duneJSON)
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantCode int
+	}{
+		{"Valid ID", fmt.Sprintf("/v1/books/%d", id), http.StatusOK},
+		{"Non-existent ID", "/v1/books/2", http.StatusNotFound},
+		{"Negative ID", "/v1/books/-1", http.StatusNotFound},
+		{"Decimal ID", "/v1/books/1.23", http.StatusNotFound},
+		{"String ID", "/v1/books/foo", http.StatusNotFound},
+		{"Unknown field", fmt.Sprintf("/v1/books/%d?fields=author", id), http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.do(t, http.MethodGet, tt.urlPath, "")
+
+			if rs.status != tt.wantCode {
+				t.Errorf("got status %d; want %d; body %s", rs.status, tt.wantCode, rs.body)
+			}
+		})
+	}
+
+	t.Run("Sparse fieldset", func(t *testing.T) {
+		rs := ts.do(t, http.MethodGet, fmt.Sprintf("/v1/books/%d?fields=id,title", id), "")
+
+		var env struct {
+			Books map[string]interface{} `json:"books"`
+		}
+		rs.decode(t, &env)
+
+		if len(env.Books) != 2 || env.Books["title"] != "Dune" {
+			t.Errorf("got %v; want only id and title", env.Books)
+		}
+	})
+}
+
+func TestConditionalRequests(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	id := ts.createBook(t, duneJSON)
+	ts.createBook(t, `{"title": "Emma", "year": 1900, "pages": "474 pages", "genres": ["fiction"]}`)
+
+	bookPath := fmt.Sprintf("/v1/books/%d", id)
+
+	for _, urlPath := range []string{bookPath, "/v1/books"} {
+		t.Run(urlPath, func(t *testing.T) {
+			rs := ts.do(t, http.MethodGet, urlPath, "")
+
+			etag := rs.header.Get("ETag")
+			lastModified := rs.header.Get("Last-Modified")
+			if etag == "" || lastModified == "" || rs.header.Get("Cache-Control") != "no-cache" {
+				t.Fatalf("got headers %v; want ETag, Last-Modified and Cache-Control", rs.header)
+			}
+
+			tests := []struct {
+				name   string
+				header http.Header
+				want   int
+			}{
+				{"If-None-Match", http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+				{"If-None-Match list", http.Header{"If-None-Match": {`W/"stale", ` + etag}}, http.StatusNotModified},
+				{"If-Modified-Since", http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified},
+				{"Modified since", http.Header{"If-Modified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, http.StatusOK},
+				{"ETag over date", http.Header{"If-None-Match": {`W/"stale"`}, "If-Modified-Since": {lastModified}}, http.StatusOK},
+			}
+
+			for _, tt := range tests {
+				rs := ts.doWithHeaders(t, http.MethodGet, urlPath, "", tt.header)
+
+				if rs.status != tt.want {
+					t.Errorf("%s: got status %d; want %d", tt.name, rs.status, tt.want)
+				}
+				if tt.want == http.StatusNotModified && len(rs.body) > 0 {
+					t.Errorf("%s: got body %s; want none", tt.name, rs.body)
+				}
+			}
+		})
+	}
+
+	t.Run("After an update", func(t *testing.T) {
+		before := ts.do(t, http.MethodGet, bookPath, "").header.Get("ETag")
+		beforeList := ts.do(t, http.MethodGet, "/v1/books", "").header.Get("ETag")
+
+		ts.do(t, http.MethodPatch, bookPath, `{"year": 1966}`)
+
+		if rs := ts.doWithHeaders(t, http.MethodGet, bookPath, "", http.Header{"If-None-Match": {before}}); rs.status != http.StatusOK {
+			t.Errorf("got status %d for the book; want %d", rs.status, http.StatusOK)
+		}
+		if rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books", "", http.Header{"If-None-Match": {beforeList}}); rs.status != http.StatusOK {
+			t.Errorf("got status %d for the listing; want %d", rs.status, http.StatusOK)
+		}
+	})
+
+	t.Run("After a delete", func(t *testing.T) {
+		before := ts.do(t, http.MethodGet, "/v1/books", "").header.Get("ETag")
+
+		ts.do(t, http.MethodDelete, "/v1/books/2", "")
+
+		if rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books", "", http.Header{"If-None-Match": {before}}); rs.status != http.StatusOK {
+			t.Errorf("got status %d; want %d", rs.status, http.StatusOK)
+		}
+	})
+}
+
+func TestUpdateBook(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	id := ts.createBook(t, duneJSON)
+	urlPath := fmt.Sprintf("/v1/books/%d", id)
+
+	rs := ts.do(t, http.MethodPatch, urlPath, `{"pages": "500 pages", "genres": ["fantasy"]}`)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusOK, rs.body)
+	}
+
+	var env struct {
+		Book map[string]interface{} `json:"book"`
+	}
+	rs.decode(t, &env)
+
+	if env.Book["title"] != "Dune" || env.Book["pages"] != "500 pages" || env.Book["version"] != float64(2) {
+		t.Errorf("got %v; want the title kept, pages updated and version 2", env.Book)
+	}
+
+	t.Run("Validation failure", func(t *testing.T) {
+		rs := ts.do(t, http.MethodPatch, urlPath, `{"title": ""}`)
+		if rs.status != http.StatusUnprocessableEntity {
+			t.Errorf("got status %d; want %d", rs.status, http.StatusUnprocessableEntity)
+		}
+	})
+
+	t.Run("Bad body", func(t *testing.T) {
+		rs := ts.do(t, http.MethodPatch, urlPath, `{"pages": "lots"}`)
+		if rs.status != http.StatusBadRequest {
+			t.Errorf("got status %d; want %d", rs.status, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		rs := ts.do(t, http.MethodPatch, "/v1/books/99", `{"title": "Emma"}`)
+		if rs.status != http.StatusNotFound {
+			t.Errorf("got status %d; want %d", rs.status, http.StatusNotFound)
+		}
+	})
+}
+
+// racingBookStore updates every book behind the caller's back just before
+// the caller's own update, as a concurrent request would.
+type racingBookStore struct {
+	data.BookStore
+}
+
+func (s racingBookStore) Update(ctx context.Context, book *data.Book) error {
+	other, err := s.BookStore.Get(ctx, book.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.BookStore.Update(ctx, other); err != nil {
+		return err
+	}
+	return s.BookStore.Update(ctx, book)
+}
+
+func TestUpdateBookEditConflict(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Books = racingBookStore{app.models.Books}
+	ts := newTestServer(t, app.routes())
+
+	id := ts.createBook(t, duneJSON)
+
+	rs := ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/books/%d", id), `{"title": "Dune Messiah"}`)
+
+	if rs.status != http.StatusConflict {
+		t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusConflict, rs.body)
+	}
+	want := "unable to update the record due to an edit conflict, please try again"
+	if got := rs.errorMessage(t); got != want {
+		t.Errorf("got error %q; want %q", got, want)
+	}
+}
+
+func TestDeleteBook(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	id := ts.createBook(t, duneJSON)
+	urlPath := fmt.Sprintf("/v1/books/%d", id)
+
+	rs := ts.do(t, http.MethodDelete, urlPath, "")
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusOK, rs.body)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		rs := ts.do(t, method, urlPath, "")
+		if rs.status != http.StatusNotFound {
+			t.Errorf("%s after delete: got status %d; want %d", method, rs.status, http.StatusNotFound)
+		}
+	}
+}
+
+func TestListBooks(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	ts.createBook(t, duneJSON)
+	ts.createBook(t, `{"title": "The Hobbit", "year": 1937, "pages": "310 pages", "genres": ["fantasy"]}`)
+	ts.createBook(t, `{"title": "Dune Messiah", "year": 1969, "pages": "256 pages", "genres": ["sci-fi"]}`)
+	ts.createBook(t, `{"title": "Team of Rivals", "year": 2005, "pages": "944 pages", "genres": ["history", "biography"]}`)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantTitles []string
+	}{
+		{"Default order", "", []string{"Dune", "The Hobbit", "Dune Messiah", "Team of Rivals"}},
+		{"Title search", "?title=dune", []string{"Dune", "Dune Messiah"}},
+		{"Parent genre includes children", "?genres=fiction&sort=title", []string{"Dune", "Dune Messiah", "The Hobbit"}},
+		{"Any genre", "?genres=fantasy,biography&genres_mode=any", []string{"The Hobbit", "Team of Rivals"}},
+		{"All genres", "?genres=history,biography", []string{"Team of Rivals"}},
+		{"Excluded genre", "?exclude_genres=science-fiction", []string{"The Hobbit", "Team of Rivals"}},
+		{"Year range", "?year_min=1960&year_max=1970", []string{"Dune", "Dune Messiah"}},
+		{"Pages range", "?pages_min=300&pages_max=500", []string{"Dune", "The Hobbit"}},
+		{"Descending sort", "?sort=-year", []string{"Team of Rivals", "Dune Messiah", "Dune", "The Hobbit"}},
+		{"Multi-column sort", "?sort=-pages,title", []string{"Team of Rivals", "Dune", "The Hobbit", "Dune Messiah"}},
+		{"Pagination", "?page=2&page_size=3", []string{"Team of Rivals"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.do(t, http.MethodGet, "/v1/books"+tt.query, "")
+			if rs.status != http.StatusOK {
+				t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusOK, rs.body)
+			}
+
+			var env struct {
+				Books []data.Book `json:"books"`
+			}
+			rs.decode(t, &env)
+
+			var titles []string
+			for _, book := range env.Books {
+				titles = append(titles, book.Title)
+			}
+			if fmt.Sprint(titles) != fmt.Sprint(tt.wantTitles) {
+				t.Errorf("got %q; want %q", titles, tt.wantTitles)
+			}
+		})
+	}
+
+	t.Run("Metadata", func(t *testing.T) {
+		rs := ts.do(t, http.MethodGet, "/v1/books?page_size=3", "")
+
+		var env struct {
+			Metadata data.Metadata `json:"metadata"`
+		}
+		rs.decode(t, &env)
+
+		want := data.Metadata{CurrentPage: 1, PageSize: 3, FirstPage: 1, LastPage: 2, TotalRecords: 4}
+		if env.Metadata != want {
+			t.Errorf("got %+v; want %+v", env.Metadata, want)
+		}
+	})
+}
+
+func TestListBooksValidation(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name  string
+		query string
+		field string
+		want  string
+	}{
+		{"Sort not in safelist", "?sort=author", "sort", `invalid sort value "author"`},
+		{"Sort component not in safelist", "?sort=-year,author", "sort", `invalid sort value "author"`},
+		{"Sort repeats a column", "?sort=year,-year", "sort", "must not sort by the same column more than once"},
+		{"Page not an integer", "?page=one", "page", "must be an integer value"},
+		{"Page zero", "?page=0", "page", "must be greater than zero"},
+		{"Page size too large", "?page_size=101", "page_size", "must be a maximum of 100"},
+		{"Inverted year range", "?year_min=2000&year_max=1990", "year_min", "must not be greater than year_max"},
+		{"Bad genres mode", "?genres_mode=some", "genres_mode", "must be either all or any"},
+		{"Bad date", "?created_after=yesterday", "created_after", "must be a date (YYYY-MM-DD) or an RFC 3339 timestamp"},
+		{"Unknown field", "?fields=id,author", "fields", `invalid field "author"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.do(t, http.MethodGet, "/v1/books"+tt.query, "")
+
+			if rs.status != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusUnprocessableEntity, rs.body)
+			}
+
+			errs, ok := rs.errorMessage(t).(map[string]interface{})
+			if !ok {
+				t.Fatalf("got error %s; want a map of field errors", rs.body)
+			}
+			if errs[tt.field] != tt.want {
+				t.Errorf("got %s error %q; want %q", tt.field, errs[tt.field], tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	rs := ts.do(t, http.MethodGet, "/v1/nothing-here", "")
+	if rs.status != http.StatusNotFound {
+		t.Errorf("unknown route: got status %d; want %d", rs.status, http.StatusNotFound)
+	}
+
+	rs = ts.do(t, http.MethodPut, "/v1/books/1", "")
+	if rs.status != http.StatusMethodNotAllowed {
+		t.Errorf("wrong method: got status %d; want %d", rs.status, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCachedModels(t *testing.T) {
+	app := newTestApplication(t)
+	app.models = data.NewCachedModels(app.models, 2, time.Minute)
+	cache := app.models.Books.(*data.CachedBookStore)
+
+	ts := newTestServer(t, app.routes())
+
+	ts.createBook(t, `{"title": "Dune", "year": 1965, "pages": "412 pages", "genres": ["science-fiction"]}`)
+
+	title := func(urlPath string) string {
+		t.Helper()
+
+		var env struct {
+			Books struct {
+				Title string `json:"title"`
+			} `json:"books"`
+		}
+		ts.do(t, http.MethodGet, urlPath, "").decode(t, &env)
+		return env.Books.Title
+	}
+
+	listed := func(urlPath string) int {
+		t.Helper()
+
+		var env struct {
+			Books []struct{} `json:"books"`
+		}
+		ts.do(t, http.MethodGet, urlPath, "").decode(t, &env)
+		return len(env.Books)
+	}
+
+	title("/v1/books/1")
+	title("/v1/books/1?fields=title")
+
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("got %+v; want the second read served from the cache", stats)
+	}
+
+	rs := ts.do(t, http.MethodPatch, "/v1/books/1", `{"title": "Dune Messiah"}`)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	if got := title("/v1/books/1"); got != "Dune Messiah" {
+		t.Errorf("got title %q after the update; want %q", got, "Dune Messiah")
+	}
+
+	t.Run("Listings", func(t *testing.T) {
+		if got := listed("/v1/books?genres=fiction"); got != 1 {
+			t.Fatalf("got %d books; want 1", got)
+		}
+
+		before := cache.Stats()
+		listed("/v1/books?genres=FICTION")
+		if after := cache.Stats(); after.Hits != before.Hits+1 {
+			t.Errorf("got %+v; want the normalised query served from the cache", after)
+		}
+
+		ts.createBook(t, `{"title": "Emma", "year": 1900, "pages": "474 pages", "genres": ["fiction"]}`)
+
+		if got := listed("/v1/books?genres=fiction"); got != 2 {
+			t.Errorf("got %d books after an insert; want 2", got)
+		}
+	})
+
+	t.Run("Genre writes", func(t *testing.T) {
+		ts.createBook(t, `{"title": "Hyperion", "year": 1989, "pages": "482 pages", "genres": ["history"]}`)
+
+		if got := listed("/v1/books?genres=fiction"); got != 2 {
+			t.Fatalf("got %d books; want 2", got)
+		}
+
+		rs := ts.do(t, http.MethodPatch, "/v1/genres/6", `{"parent": "fiction"}`)
+		if rs.status != http.StatusOK {
+			t.Fatalf("got status %d; body %s", rs.status, rs.body)
+		}
+
+		if got := listed("/v1/books?genres=fiction"); got != 3 {
+			t.Errorf("got %d books after moving a genre under fiction; want 3", got)
+		}
+	})
+
+	t.Run("Healthcheck", func(t *testing.T) {
+		for _, urlPath := range []string{"/v1/books/1", "/v1/books/2", "/v1/books/3"} {
+			title(urlPath)
+		}
+
+		var env struct {
+			Cache *data.CacheStats `json:"cache"`
+		}
+		ts.do(t, http.MethodGet, "/v1/healthcheck", "").decode(t, &env)
+
+		if env.Cache == nil || env.Cache.Entries > 4 || env.Cache.Evictions == 0 {
+			t.Errorf("got %+v; want stats for two bounded caches", env.Cache)
+		}
+	})
+}
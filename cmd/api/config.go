@@ -0,0 +1,435 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const envPrefix = "FINALSPA_"
+
+var dsnPasswordRX = regexp.MustCompile(`(password=)('[^']*'|\S+)`)
+
+type config struct {
+	port int
+	env  string
+	db   struct {
+		driver       string
+		dsn          string
+		maxOpenConns int
+		maxIdleConns int
+		maxIdleTime  time.Duration
+		autoMigrate  bool
+		timeouts     data.Timeouts
+	}
+	compression struct {
+		enabled bool
+		minSize int
+	}
+	cache struct {
+		size int
+		ttl  time.Duration
+	}
+	webhooks struct {
+		maxAttempts         int
+		retryBase           time.Duration
+		retryMax            time.Duration
+		timeout             time.Duration
+		allowPrivateTargets bool
+	}
+	outbox struct {
+		sink        string
+		file        string
+		url         string
+		timeout     time.Duration
+		retryBase   time.Duration
+		retryMax    time.Duration
+		maxAttempts int
+	}
+	stream struct {
+		heartbeat time.Duration
+		retention time.Duration
+	}
+	grpc struct {
+		port int
+	}
+	graphql struct {
+		maxDepth      int
+		maxComplexity int
+	}
+	loans struct {
+		period      time.Duration
+		maxRenewals int
+	}
+	holds struct {
+		pickupPeriod  time.Duration
+		checkInterval time.Duration
+		notifier      string
+		notifierFile  string
+	}
+	compactJSON bool
+	migrate     string
+	grant       string
+	printConfig bool
+}
+
+// loadConfig builds the configuration from, in increasing order of
+// precedence: the flag defaults, a YAML file given by -config (or
+// FINALSPA_CONFIG), FINALSPA_* environment variables and the command-line
+// flags themselves. Every flag can be set in all three places; the env
+// variable for -db-max-open-conns is FINALSPA_DB_MAX_OPEN_CONNS and the file
+// key is db.max-open-conns or db.maxOpenConns.
+func loadConfig(fs *flag.FlagSet, args []string) (config, error) {
+	var cfg config
+
+	fs.IntVar(&cfg.port, "port", 4000, "API server port")
+	fs.IntVar(&cfg.grpc.port, "grpc-port", 4001, "gRPC server port, 0 to disable")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+
+	fs.StringVar(&cfg.db.driver, "db-driver", "postgres", "Storage backend (postgres|sqlite|memory)")
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN, or the database file for the sqlite driver (default finalspa.db)")
+
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
+	fs.DurationVar(&cfg.db.maxIdleTime, "db-max-idle-time", 15*time.Minute, "PostgreSQL max connection idle time")
+	fs.DurationVar(&cfg.db.timeouts.Read, "db-read-timeout", 3*time.Second, "PostgreSQL timeout for a single read query")
+	fs.DurationVar(&cfg.db.timeouts.Write, "db-write-timeout", 3*time.Second, "PostgreSQL timeout for a single write query")
+	fs.BoolVar(&cfg.db.autoMigrate, "db-auto-migrate", false, "Apply pending database migrations at startup")
+
+	fs.IntVar(&cfg.cache.size, "cache-size", 0, "Books and book listings to keep in an in-process cache, 0 to disable")
+	fs.DurationVar(&cfg.cache.ttl, "cache-ttl", time.Minute, "How long a cached book or listing is served before it is read again")
+
+	fs.IntVar(&cfg.webhooks.maxAttempts, "webhooks-max-attempts", 8, "Attempts at a webhook delivery before it is marked dead")
+	fs.DurationVar(&cfg.webhooks.retryBase, "webhooks-retry-base", 30*time.Second, "Wait before retrying a failed webhook delivery, doubled on each further failure")
+	fs.DurationVar(&cfg.webhooks.retryMax, "webhooks-retry-max", time.Hour, "Longest wait between webhook delivery attempts")
+	fs.DurationVar(&cfg.webhooks.timeout, "webhooks-timeout", 10*time.Second, "Time a webhook receiver has to respond")
+	fs.BoolVar(&cfg.webhooks.allowPrivateTargets, "webhooks-allow-private-targets", false, "Allow webhooks to private, loopback and link-local addresses, for local development")
+
+	fs.StringVar(&cfg.outbox.sink, "outbox-sink", "none", "Where to publish book events besides webhooks (none|log|file|http)")
+	fs.StringVar(&cfg.outbox.file, "outbox-file", "", "File the file outbox sink appends events to, one JSON object per line")
+	fs.StringVar(&cfg.outbox.url, "outbox-url", "", "URL the http outbox sink posts events to")
+	fs.DurationVar(&cfg.outbox.timeout, "outbox-timeout", 10*time.Second, "Time the http outbox sink waits for a response")
+	fs.DurationVar(&cfg.outbox.retryBase, "outbox-retry-base", time.Second, "Wait before publishing a failed event again, doubled on each further failure")
+	fs.DurationVar(&cfg.outbox.retryMax, "outbox-retry-max", 5*time.Minute, "Longest wait between attempts at publishing an event")
+	fs.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 20, "Attempts at publishing an event before it is dead-lettered")
+
+	fs.DurationVar(&cfg.stream.heartbeat, "stream-heartbeat", 15*time.Second, "Interval between keep-alive comments on an idle change stream")
+	fs.DurationVar(&cfg.stream.retention, "stream-retention", 24*time.Hour, "How long book changes are kept for change stream clients to resume from")
+
+	fs.IntVar(&cfg.graphql.maxDepth, "graphql-max-depth", 8, "Deepest nesting of fields a GraphQL query may have")
+	fs.IntVar(&cfg.graphql.maxComplexity, "graphql-max-complexity", 1000, "Most fields a GraphQL query may resolve, counting those under a list once per row")
+
+	fs.DurationVar(&cfg.loans.period, "loans-period", 14*24*time.Hour, "How long a book is lent for, at checkout and again on each renewal")
+	fs.IntVar(&cfg.loans.maxRenewals, "loans-max-renewals", 2, "Times a loan can be renewed, 0 to disallow renewals")
+
+	fs.DurationVar(&cfg.holds.pickupPeriod, "holds-pickup-period", 72*time.Hour, "How long a copy set aside for a hold waits to be collected")
+	fs.DurationVar(&cfg.holds.checkInterval, "holds-check-interval", time.Minute, "How often holds are checked for expiry and for members to notify")
+	fs.StringVar(&cfg.holds.notifier, "holds-notifier", "log", "How members are told their hold is ready (none|log|file)")
+	fs.StringVar(&cfg.holds.notifierFile, "holds-notifier-file", "", "File the file notifier appends notifications to, one JSON object per line")
+
+	fs.BoolVar(&cfg.compression.enabled, "compression-enabled", true, "Compress responses with gzip, brotli or zstd when the client accepts it")
+	fs.IntVar(&cfg.compression.minSize, "compression-min-size", 1024, "Smallest response body, in bytes, worth compressing")
+	fs.BoolVar(&cfg.compactJSON, "compact-json", false, "Send JSON and XML without indentation (clients can also ask with ?compact=true)")
+
+	fs.StringVar(&cfg.migrate, "migrate", "", "Run database migrations and exit (up [N]|down [N]|version|force N)")
+	fs.StringVar(&cfg.grant, "grant", "", "Grant the user with this email the permissions given as arguments and exit (loans:report, webhooks:manage)")
+
+	configFile := fs.String("config", "", "Path to a YAML configuration file")
+	fs.BoolVar(&cfg.printConfig, "print-config", false, "Print the resolved configuration with secrets redacted and exit")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	explicit["config"] = true
+	explicit["print-config"] = true
+
+	if *configFile == "" {
+		*configFile = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return cfg, err
+		}
+
+		for name, value := range values {
+			if fs.Lookup(name) == nil || name == "config" || name == "print-config" {
+				return cfg, fmt.Errorf("%s: unknown configuration key %q", *configFile, name)
+			}
+			if explicit[name] {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return cfg, fmt.Errorf("%s: invalid value %q for %s: %w", *configFile, value, name, err)
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		key := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		value, ok := os.LookupEnv(key)
+		if !ok || explicit[f.Name] || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("invalid value %q for %s: %w", value, key, err)
+		}
+	})
+	if envErr != nil {
+		return cfg, envErr
+	}
+
+	if cfg.db.driver == "sqlite" && cfg.db.dsn == "" {
+		cfg.db.dsn = "finalspa.db"
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (cfg config) validate() error {
+	var problems []string
+
+	if cfg.port < 1 || cfg.port > 65535 {
+		problems = append(problems, "port must be between 1 and 65535")
+	}
+	if cfg.grpc.port < 0 || cfg.grpc.port > 65535 || cfg.grpc.port == cfg.port {
+		problems = append(problems, "grpc-port must be between 0 and 65535 and differ from port")
+	}
+	switch cfg.env {
+	case "development", "staging", "production":
+	default:
+		problems = append(problems, "env must be development, staging or production")
+	}
+
+	switch cfg.db.driver {
+	case "postgres":
+		if cfg.db.dsn == "" {
+			problems = append(problems, "db-dsn must be provided (flag, "+envPrefix+"DB_DSN or config file)")
+		}
+	case "sqlite", "memory":
+		if cfg.migrate != "" || cfg.db.autoMigrate {
+			problems = append(problems, "migrations are only supported with the postgres driver, the sqlite schema is applied when the file is opened")
+		}
+	default:
+		problems = append(problems, "db-driver must be postgres, sqlite or memory")
+	}
+	if cfg.grant != "" && cfg.db.driver == "memory" {
+		problems = append(problems, "grant needs a database, the memory driver forgets everything on exit")
+	}
+	if cfg.db.maxOpenConns < 1 {
+		problems = append(problems, "db-max-open-conns must be greater than zero")
+	}
+	if cfg.db.maxIdleConns < 0 {
+		problems = append(problems, "db-max-idle-conns must not be negative")
+	}
+	if cfg.db.maxIdleTime < 0 {
+		problems = append(problems, "db-max-idle-time must not be negative")
+	}
+
+	if cfg.db.timeouts.Read <= 0 {
+		problems = append(problems, "db-read-timeout must be greater than zero")
+	}
+	if cfg.db.timeouts.Write <= 0 {
+		problems = append(problems, "db-write-timeout must be greater than zero")
+	}
+
+	if cfg.cache.size < 0 {
+		problems = append(problems, "cache-size must not be negative")
+	}
+	if cfg.cache.size > 0 && cfg.cache.ttl <= 0 {
+		problems = append(problems, "cache-ttl must be greater than zero")
+	}
+
+	if cfg.webhooks.maxAttempts < 1 {
+		problems = append(problems, "webhooks-max-attempts must be greater than zero")
+	}
+	if cfg.webhooks.retryBase <= 0 || cfg.webhooks.retryMax < cfg.webhooks.retryBase {
+		problems = append(problems, "webhooks-retry-base must be greater than zero and no more than webhooks-retry-max")
+	}
+	if cfg.webhooks.timeout <= 0 {
+		problems = append(problems, "webhooks-timeout must be greater than zero")
+	}
+
+	switch cfg.outbox.sink {
+	case "none", "log":
+	case "file":
+		if cfg.outbox.file == "" {
+			problems = append(problems, "outbox-file must be set for the file outbox sink")
+		}
+	case "http":
+		u, err := url.Parse(cfg.outbox.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "outbox-url must be an absolute http or https URL for the http outbox sink")
+		}
+		if cfg.outbox.timeout <= 0 {
+			problems = append(problems, "outbox-timeout must be greater than zero")
+		}
+	default:
+		problems = append(problems, "outbox-sink must be one of none, log, file or http")
+	}
+	if cfg.outbox.retryBase <= 0 || cfg.outbox.retryMax < cfg.outbox.retryBase {
+		problems = append(problems, "outbox-retry-base must be greater than zero and no more than outbox-retry-max")
+	}
+	if cfg.outbox.maxAttempts < 1 {
+		problems = append(problems, "outbox-max-attempts must be greater than zero")
+	}
+
+	if cfg.stream.heartbeat <= 0 {
+		problems = append(problems, "stream-heartbeat must be greater than zero")
+	}
+	if cfg.stream.retention <= 0 {
+		problems = append(problems, "stream-retention must be greater than zero")
+	}
+
+	if cfg.graphql.maxDepth < 1 {
+		problems = append(problems, "graphql-max-depth must be at least 1")
+	}
+	if cfg.graphql.maxComplexity < 1 {
+		problems = append(problems, "graphql-max-complexity must be at least 1")
+	}
+
+	if cfg.loans.period <= 0 {
+		problems = append(problems, "loans-period must be greater than zero")
+	}
+	if cfg.loans.maxRenewals < 0 {
+		problems = append(problems, "loans-max-renewals must not be negative")
+	}
+
+	if cfg.holds.pickupPeriod < time.Second {
+		problems = append(problems, "holds-pickup-period must be at least 1s")
+	}
+	if cfg.holds.checkInterval <= 0 {
+		problems = append(problems, "holds-check-interval must be greater than zero")
+	}
+	switch cfg.holds.notifier {
+	case "none", "log":
+	case "file":
+		if cfg.holds.notifierFile == "" {
+			problems = append(problems, "holds-notifier-file must be set for the file notifier")
+		}
+	default:
+		problems = append(problems, "holds-notifier must be one of none, log or file")
+	}
+
+	if cfg.compression.minSize < 0 {
+		problems = append(problems, "compression-min-size must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// readConfigFile flattens a YAML document into flag names, so that
+// {db: {maxIdleTime: 5m}} becomes "db-max-idle-time" = "5m".
+func readConfigFile(path string) (map[string]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var document map[string]interface{}
+
+	err = yaml.Unmarshal(contents, &document)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flattenConfig("", document, values)
+
+	return values, nil
+}
+
+func flattenConfig(prefix string, document map[string]interface{}, values map[string]string) {
+	for key, value := range document {
+		name := kebabCase(key)
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenConfig(name, value, values)
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(value)
+		}
+	}
+}
+
+func kebabCase(s string) string {
+	var b strings.Builder
+
+	for i, r := range s {
+		switch {
+		case r == '_' || r == '.':
+			b.WriteRune('-')
+		case unicode.IsUpper(r):
+			if i > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+func writeConfig(w io.Writer, fs *flag.FlagSet) {
+	var lines []string
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+
+		value := f.Value.String()
+		if f.Name == "db-dsn" {
+			value = redactDSN(value)
+		}
+		lines = append(lines, fmt.Sprintf("%s: %q", f.Name, value))
+	})
+
+	sort.Strings(lines)
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
+
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		return dsnPasswordRX.ReplaceAllString(dsn, "${1}xxxxx")
+	}
+	if u.User == nil {
+		return dsn
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+
+	return u.String()
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestLoadConfigPrintConfig(t *testing.T) {
+	newFlagSet := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("api", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		return fs
+	}
+
+	cfg, err := loadConfig(newFlagSet(), []string{"-print-config", "-db-driver", "memory"})
+	if err != nil || !cfg.printConfig {
+		t.Errorf("got printConfig %t (%v); want it set on a valid configuration", cfg.printConfig, err)
+	}
+
+	_, err = loadConfig(newFlagSet(), []string{"-print-config", "-db-driver", "memory", "-port", "0"})
+	if err == nil {
+		t.Error("got no error; want an invalid configuration refused before it is printed")
+	}
+}
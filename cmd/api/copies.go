@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"time"
+)
+
+func (app *application) createCopyHandler(w http.ResponseWriter, r *http.Request) {
+
+	bookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Barcode    string     `json:"barcode"`
+		Condition  string     `json:"condition"`
+		Location   string     `json:"location"`
+		AcquiredAt *time.Time `json:"acquired_at"`
+		Status     string     `json:"status"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	c := &data.Copy{
+		BookID:     bookID,
+		Barcode:    input.Barcode,
+		Condition:  input.Condition,
+		Location:   input.Location,
+		AcquiredAt: time.Now(),
+		Status:     input.Status,
+	}
+	if input.AcquiredAt != nil {
+		c.AcquiredAt = *input.AcquiredAt
+	}
+	if c.Condition == "" {
+		c.Condition = data.ConditionGood
+	}
+	if c.Status == "" {
+		c.Status = data.CopyAvailable
+	}
+
+	v := validator.New()
+
+	v.Check(c.Status != data.CopyOnLoan, "status", "is set by checking the copy out")
+	v.Check(c.Status != data.CopyOnHold, "status", "is set when a hold is filled")
+
+	if data.ValidateCopy(v, c); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Copies.Insert(r.Context(), c)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateBarcode):
+			v.AddError("barcode", "a copy with this barcode already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.bookChanged()
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/books/%d/copies/%d", bookID, c.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"copy": c}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCopyHandler(w http.ResponseWriter, r *http.Request) {
+
+	c, ok := app.readCopy(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"copy": c}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCopyByBarcodeHandler looks up a scanned copy, along with the book it is
+// a copy of.
+func (app *application) showCopyByBarcodeHandler(w http.ResponseWriter, r *http.Request) {
+
+	barcode := httprouter.ParamsFromContext(r.Context()).ByName("barcode")
+
+	c, err := app.models.Copies.GetByBarcode(r.Context(), barcode)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	book, err := app.models.Books.Get(r.Context(), c.BookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"copy": c, "book": book}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCopyHandler changes a copy's details. A copy out on loan keeps its
+// status until it is returned, and one set aside for a hold until the hold
+// is collected, cancelled or expires.
+func (app *application) updateCopyHandler(w http.ResponseWriter, r *http.Request) {
+
+	c, ok := app.readCopy(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Barcode    *string    `json:"barcode"`
+		Condition  *string    `json:"condition"`
+		Location   *string    `json:"location"`
+		AcquiredAt *time.Time `json:"acquired_at"`
+		Status     *string    `json:"status"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if input.Status != nil && *input.Status != c.Status {
+		switch c.Status {
+		case data.CopyOnLoan:
+			app.copyOnLoanResponse(w, r)
+			return
+		case data.CopyOnHold:
+			app.copyOnHoldResponse(w, r)
+			return
+		}
+		v.Check(*input.Status != data.CopyOnLoan, "status", "is set by checking the copy out")
+		v.Check(*input.Status != data.CopyOnHold, "status", "is set when a hold is filled")
+		c.Status = *input.Status
+	}
+	if input.Barcode != nil {
+		c.Barcode = *input.Barcode
+	}
+	if input.Condition != nil {
+		c.Condition = *input.Condition
+	}
+	if input.Location != nil {
+		c.Location = *input.Location
+	}
+	if input.AcquiredAt != nil {
+		c.AcquiredAt = *input.AcquiredAt
+	}
+
+	if data.ValidateCopy(v, c); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Copies.Update(r.Context(), c)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateBarcode):
+			v.AddError("barcode", "a copy with this barcode already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.bookChanged()
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"copy": c}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteCopyHandler(w http.ResponseWriter, r *http.Request) {
+
+	bookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	id, err := app.readNamedIDParam(r, "copy_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Copies.Delete(r.Context(), bookID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrCopyOnLoan):
+			app.copyOnLoanResponse(w, r)
+		case errors.Is(err, data.ErrCopyOnHold):
+			app.copyOnHoldResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.bookChanged()
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "copy successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listCopiesHandler(w http.ResponseWriter, r *http.Request) {
+
+	bookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", "")
+	filters := app.readListFilters(qs, data.CopySortSafelist, v)
+
+	v.Check(status == "" || validator.In(status, data.CopyStatuses...), "status", "must be one of available, on-loan, on-hold, in-repair or lost")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Books.Get(r.Context(), bookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	copies, metadata, err := app.models.Copies.GetAll(r.Context(), bookID, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"metadata": metadata, "copies": copies}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readCopy loads the copy named by the copy_id parameter from the book named
+// by the id parameter, sending the error response itself if it can't.
+func (app *application) readCopy(w http.ResponseWriter, r *http.Request) (*data.Copy, bool) {
+	bookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	id, err := app.readNamedIDParam(r, "copy_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	c, err := app.models.Copies.Get(r.Context(), bookID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return c, true
+}
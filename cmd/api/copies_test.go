@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"net/http"
+	"testing"
+)
+
+type copyEnvelope struct {
+	Copy data.Copy `json:"copy"`
+}
+
+// createCopy adds a copy with the given barcode to the book and returns its
+// id.
+func (ts *testServer) createCopy(t *testing.T, bookID int64, barcode string) int64 {
+	t.Helper()
+
+	rs := ts.do(t, http.MethodPost, fmt.Sprintf("/v1/books/%d/copies", bookID), fmt.Sprintf(`{"barcode": %q}`, barcode))
+	if rs.status != http.StatusCreated {
+		t.Fatalf("creating copy: got status %d; body %s", rs.status, rs.body)
+	}
+
+	var env copyEnvelope
+	rs.decode(t, &env)
+	return env.Copy.ID
+}
+
+func TestCopies(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	copies := fmt.Sprintf("/v1/books/%d/copies", dune)
+	bookPath := fmt.Sprintf("/v1/books/%d", dune)
+
+	for _, body := range []string{
+		`{}`,
+		`{"barcode": "has spaces"}`,
+		`{"barcode": "C1", "condition": "mint"}`,
+		`{"barcode": "C1", "status": "on-loan"}`,
+		`{"barcode": "C1", "status": "on-hold"}`,
+		`{"barcode": "C1", "acquired_at": "2999-01-01T00:00:00Z"}`,
+	} {
+		rs := ts.do(t, http.MethodPost, copies, body)
+		if rs.status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got status %d; want %d", body, rs.status, http.StatusUnprocessableEntity)
+		}
+	}
+
+	rs := ts.do(t, http.MethodPost, "/v1/books/99/copies", `{"barcode": "C1"}`)
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d adding a copy of a missing book; want %d", rs.status, http.StatusNotFound)
+	}
+
+	etag := ts.do(t, http.MethodGet, bookPath, "").header.Get("ETag")
+
+	rs = ts.do(t, http.MethodPost, copies, `{"barcode": "C1", "condition": "new", "location": "FIC-HER"}`)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	var created copyEnvelope
+	rs.decode(t, &created)
+	copyPath := fmt.Sprintf("%s/%d", copies, created.Copy.ID)
+	if got := rs.header.Get("Location"); got != copyPath {
+		t.Errorf("got Location %q; want %q", got, copyPath)
+	}
+	if c := created.Copy; c.Condition != "new" || c.Location != "FIC-HER" || c.Status != "available" || c.AcquiredAt.IsZero() {
+		t.Errorf("got copy %+v", c)
+	}
+
+	rs = ts.do(t, http.MethodPost, copies, `{"barcode": "C1"}`)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d reusing a barcode; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+
+	ts.createCopy(t, dune, "C2")
+	ts.createCopy(t, dune, "C3")
+
+	rs = ts.doWithHeaders(t, http.MethodGet, bookPath, "", http.Header{"If-None-Match": {etag}})
+	if rs.status != http.StatusOK {
+		t.Errorf("got status %d for the book's old ETag after adding copies; want %d", rs.status, http.StatusOK)
+	}
+
+	checkCopies := func(total, available int32) {
+		t.Helper()
+
+		var env struct {
+			Books []data.Book `json:"books"`
+		}
+		ts.do(t, http.MethodGet, "/v1/books", "").decode(t, &env)
+		if len(env.Books) != 1 || env.Books[0].CopiesTotal != total || env.Books[0].CopiesAvailable != available {
+			t.Errorf("got %+v; want %d of %d copies available", env.Books, available, total)
+		}
+	}
+
+	checkCopies(3, 3)
+
+	rs = ts.do(t, http.MethodPatch, copyPath, `{"status": "in-repair", "condition": "damaged"}`)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d updating; body %s", rs.status, rs.body)
+	}
+
+	var updated copyEnvelope
+	rs.decode(t, &updated)
+	if c := updated.Copy; c.Status != "in-repair" || c.Condition != "damaged" || c.Barcode != "C1" || c.Version != 2 {
+		t.Errorf("got copy %+v; want it in repair with the barcode kept at version 2", c)
+	}
+
+	checkCopies(3, 2)
+
+	alice := ts.authenticate(t, "alice@example.com")
+	loan := ts.checkout(t, alice, dune)
+	if loan.Barcode != "C2" {
+		t.Errorf("got copy %q lent; want the first available, C2", loan.Barcode)
+	}
+
+	checkCopies(3, 1)
+
+	lentPath := fmt.Sprintf("%s/%d", copies, loan.CopyID)
+
+	rs = ts.do(t, http.MethodPatch, lentPath, `{"status": "lost"}`)
+	if rs.status != http.StatusConflict {
+		t.Errorf("got status %d changing the status of a copy on loan; want %d", rs.status, http.StatusConflict)
+	}
+
+	rs = ts.do(t, http.MethodDelete, lentPath, "")
+	if rs.status != http.StatusConflict {
+		t.Errorf("got status %d deleting a copy on loan; want %d", rs.status, http.StatusConflict)
+	}
+
+	rs = ts.do(t, http.MethodGet, "/v1/copies/C2", "")
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d looking up a barcode; body %s", rs.status, rs.body)
+	}
+
+	var lookup struct {
+		Copy data.Copy `json:"copy"`
+		Book data.Book `json:"book"`
+	}
+	rs.decode(t, &lookup)
+	if lookup.Copy.ID != loan.CopyID || lookup.Copy.Status != "on-loan" || lookup.Book.Title != "Dune" {
+		t.Errorf("got %+v; want copy C2 of Dune, out on loan", lookup)
+	}
+
+	rs = ts.do(t, http.MethodGet, "/v1/copies/NOPE", "")
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown barcode; want %d", rs.status, http.StatusNotFound)
+	}
+
+	tests := []struct {
+		query    string
+		status   int
+		barcodes []string
+	}{
+		{"", http.StatusOK, []string{"C1", "C2", "C3"}},
+		{"?sort=-barcode", http.StatusOK, []string{"C3", "C2", "C1"}},
+		{"?status=available", http.StatusOK, []string{"C3"}},
+		{"?status=on-loan", http.StatusOK, []string{"C2"}},
+		{"?status=gone", http.StatusUnprocessableEntity, nil},
+		{"?sort=condition", http.StatusUnprocessableEntity, nil},
+	}
+
+	for _, tt := range tests {
+		rs := ts.do(t, http.MethodGet, copies+tt.query, "")
+		if rs.status != tt.status {
+			t.Errorf("%s: got status %d; want %d", tt.query, rs.status, tt.status)
+			continue
+		}
+		if tt.barcodes == nil {
+			continue
+		}
+
+		var list struct {
+			Copies []data.Copy `json:"copies"`
+		}
+		rs.decode(t, &list)
+
+		var barcodes []string
+		for _, c := range list.Copies {
+			barcodes = append(barcodes, c.Barcode)
+		}
+		if fmt.Sprint(barcodes) != fmt.Sprint(tt.barcodes) {
+			t.Errorf("%s: got %v; want %v", tt.query, barcodes, tt.barcodes)
+		}
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/loans/%d/return", loan.ID), "", alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d returning; body %s", rs.status, rs.body)
+	}
+
+	checkCopies(3, 2)
+
+	rs = ts.do(t, http.MethodDelete, copyPath, "")
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d deleting; body %s", rs.status, rs.body)
+	}
+
+	rs = ts.do(t, http.MethodGet, copyPath, "")
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d for a deleted copy; want %d", rs.status, http.StatusNotFound)
+	}
+
+	checkCopies(2, 2)
+}
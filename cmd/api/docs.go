@@ -0,0 +1,25 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// docsPage is only the shell of the docs: the browser loads Swagger UI itself
+// from unpkg.com, so /docs needs internet access where it is viewed.
+//
+//go:embed docs.html
+var docsPage []byte
+
+func (app *application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (app *application) docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
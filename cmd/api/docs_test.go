@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type route struct {
+	method string
+	path   string
+}
+
+// registeredRoutes reads every router.HandlerFunc call in routes.go, turning
+// httprouter's :name parameters into OpenAPI's {name}.
+func registeredRoutes(t *testing.T) []route {
+	t.Helper()
+
+	file, err := parser.ParseFile(token.NewFileSet(), "routes.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	param := regexp.MustCompile(`:(\w+)`)
+
+	var routes []route
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) < 2 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "HandlerFunc" {
+			return true
+		}
+
+		method, ok := call.Args[0].(*ast.SelectorExpr)
+		if !ok {
+			t.Fatalf("route method %#v is not an http.Method constant", call.Args[0])
+		}
+		lit, ok := call.Args[1].(*ast.BasicLit)
+		if !ok {
+			t.Fatalf("route path %#v is not a string literal", call.Args[1])
+		}
+		path, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		routes = append(routes, route{
+			method: strings.ToLower(strings.TrimPrefix(method.Sel.Name, "Method")),
+			path:   param.ReplaceAllString(path, "{$1}"),
+		})
+		return true
+	})
+
+	if len(routes) == 0 {
+		t.Fatal("found no routes in routes.go")
+	}
+	return routes
+}
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+
+	documented := make(map[route]bool)
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if method != "parameters" {
+				documented[route{method, path}] = true
+			}
+		}
+	}
+
+	for _, r := range registeredRoutes(t) {
+		if !documented[r] {
+			t.Errorf("route %s %s is missing from openapi.json", strings.ToUpper(r.method), r.path)
+		}
+		delete(documented, r)
+	}
+
+	for r := range documented {
+		t.Errorf("openapi.json documents %s %s, which routes.go doesn't register", strings.ToUpper(r.method), r.path)
+	}
+}
+
+func TestOpenAPISpecReferences(t *testing.T) {
+	var spec map[string]interface{}
+
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				var target interface{} = spec
+				for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+					m, _ := target.(map[string]interface{})
+					target = m[part]
+				}
+				if target == nil {
+					t.Errorf("unresolved reference %s", ref)
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+
+	walk(spec)
+}
+
+func TestDocsEndpoints(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		urlPath     string
+		contentType string
+	}{
+		{"/v1/openapi.json", "application/json"},
+		{"/docs", "text/html; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		rs := ts.do(t, http.MethodGet, tt.urlPath, "")
+
+		if rs.status != http.StatusOK {
+			t.Errorf("%s: got status %d; want %d", tt.urlPath, rs.status, http.StatusOK)
+		}
+		if got := rs.header.Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: got Content-Type %q; want %q", tt.urlPath, got, tt.contentType)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	mediaJSON    = "application/json"
+	mediaXML     = "application/xml"
+	mediaCSV     = "text/csv"
+	mediaMsgpack = "application/msgpack"
+)
+
+// mediaAliases maps the other names clients use for a format to the one we
+// answer with.
+var mediaAliases = map[string]string{
+	"text/xml":                 mediaXML,
+	"application/x-msgpack":    mediaMsgpack,
+	"application/vnd.msgpack":  mediaMsgpack,
+	"application/csv":          mediaCSV,
+	"application/vnd.ms-excel": mediaCSV,
+}
+
+func canonicalMediaType(mediaType string) string {
+	if alias, ok := mediaAliases[mediaType]; ok {
+		return alias
+	}
+	return mediaType
+}
+
+// negotiate picks the response format from the Accept header. CSV is only on
+// offer when the envelope holds a single list of records. It returns false if
+// none of the acceptable types can be produced.
+func negotiate(r *http.Request, data envelope) (string, bool) {
+	offers := []string{mediaJSON, mediaXML, mediaMsgpack}
+	if _, ok := csvRecords(data); ok {
+		offers = append(offers, mediaCSV)
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return mediaJSON, true
+	}
+
+	type acceptRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []acceptRange
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, acceptRange{canonicalMediaType(mediaType), q})
+		}
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	for _, ar := range ranges {
+		for _, offer := range offers {
+			switch {
+			case ar.mediaType == offer,
+				ar.mediaType == "*/*",
+				strings.HasSuffix(ar.mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(ar.mediaType, "*")):
+				return offer, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// writeResponse sends data in the format negotiated from the Accept header,
+// or a 406 if there is no format the client will take.
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	mediaType, ok := negotiate(r, data)
+	if !ok {
+		app.notAcceptableResponse(w, r)
+		return nil
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	compact := app.compact(r)
+
+	if mediaType == mediaJSON {
+		js, err := marshalJSON(data, compact)
+		if err != nil {
+			return err
+		}
+		return writeBody(w, status, mediaJSON, js, headers)
+	}
+
+	// The other formats are converted from the JSON form, so that they carry
+	// exactly the same fields and values, including Pages as "412 pages".
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+
+	switch mediaType {
+	case mediaXML:
+		body, err = jsonToXML(js, compact)
+	case mediaMsgpack:
+		body, err = jsonToMsgpack(js)
+	case mediaCSV:
+		records, _ := csvRecords(data)
+		body, err = recordsToCSV(records)
+		paginationHeaders(w, r, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeBody(w, status, mediaType, body, headers)
+}
+
+func writeBody(w http.ResponseWriter, status int, mediaType string, body []byte, headers http.Header) error {
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(status)
+	w.Write(body)
+
+	return nil
+}
+
+// paginationHeaders carries a list's metadata in headers, for CSV, whose body
+// has room for nothing but the records: the total in X-Total-Count, and the
+// first, previous, next and last pages in a Link header.
+func paginationHeaders(w http.ResponseWriter, r *http.Request, env envelope) {
+	metadata, ok := env["metadata"].(data.Metadata)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(metadata.TotalRecords))
+
+	if metadata.LastPage == 0 {
+		return
+	}
+
+	link := func(page int, rel string) string {
+		qs := r.URL.Query()
+		qs.Set("page", strconv.Itoa(page))
+		u := url.URL{Path: r.URL.Path, RawQuery: qs.Encode()}
+		return fmt.Sprintf("<%s>; rel=%q", u.String(), rel)
+	}
+
+	links := []string{link(metadata.FirstPage, "first")}
+	if metadata.CurrentPage > metadata.FirstPage {
+		links = append(links, link(metadata.CurrentPage-1, "prev"))
+	}
+	if metadata.CurrentPage < metadata.LastPage {
+		links = append(links, link(metadata.CurrentPage+1, "next"))
+	}
+	links = append(links, link(metadata.LastPage, "last"))
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// csvRecords returns the envelope's only value when that is a list, which
+// makes it the rows of a CSV document. Other values such as metadata are left
+// out.
+func csvRecords(data envelope) (interface{}, bool) {
+	var records interface{}
+
+	for _, value := range data {
+		kind := reflect.ValueOf(value).Kind()
+		if kind != reflect.Slice && kind != reflect.Array {
+			continue
+		}
+		if records != nil {
+			return nil, false
+		}
+		records = value
+	}
+
+	return records, records != nil
+}
+
+func recordsToCSV(records interface{}) ([]byte, error) {
+	js, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []json.RawMessage
+	if err := json.Unmarshal(js, &rows); err != nil {
+		return nil, err
+	}
+
+	var columns []string
+	seen := make(map[string]bool)
+	values := make([]map[string]json.RawMessage, len(rows))
+
+	for i, row := range rows {
+		keys, err := objectKeys(row)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				columns = append(columns, key)
+			}
+		}
+		if err := json.Unmarshal(row, &values[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write(columns)
+
+	for _, row := range values {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = csvValue(row[column])
+		}
+		cw.Write(record)
+	}
+
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// objectKeys returns the keys of a JSON object in the order they appear.
+func objectKeys(object json.RawMessage) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(object))
+
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key.(string))
+
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// csvValue flattens a JSON value into a cell: strings unquoted, lists of
+// strings joined with semicolons and anything else as JSON.
+func csvValue(value json.RawMessage) string {
+	if len(value) == 0 || string(value) == "null" {
+		return ""
+	}
+
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		return s
+	}
+
+	var list []string
+	if json.Unmarshal(value, &list) == nil {
+		return strings.Join(list, ";")
+	}
+
+	return string(value)
+}
+
+// jsonToXML rewrites a JSON document as XML under a <response> element.
+// Object keys become element names and list items become <item> elements.
+func jsonToXML(js []byte, compact bool) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	if !compact {
+		enc.Indent("", "\t")
+	}
+
+	err := writeXMLValue(enc, dec, "response")
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func writeXMLValue(enc *xml.Encoder, dec *json.Decoder, name string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	start := xml.StartElement{Name: xml.Name{Local: xmlName(name)}}
+
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch tok := tok.(type) {
+	case json.Delim:
+		for dec.More() {
+			childName := "item"
+			if tok == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				childName = key.(string)
+			}
+			if err := writeXMLValue(enc, dec, childName); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(fmt.Sprint(tok))); err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// xmlName replaces the characters of a JSON key that can't appear in an XML
+// element name.
+func xmlName(key string) string {
+	name := []rune(key)
+	for i, r := range name {
+		valid := r == '_' || r == '-' || r == '.' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+		if !valid || i == 0 && (r == '-' || r == '.' || r >= '0' && r <= '9') {
+			name[i] = '_'
+		}
+	}
+	if len(name) == 0 {
+		return "_"
+	}
+	return string(name)
+}
+
+func jsonToMsgpack(js []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+
+	if err := enc.Encode(msgpackValue(value)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// msgpackValue swaps json.Numbers for integers or floats, so they are encoded
+// as MessagePack numbers rather than strings.
+func msgpackValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			value[key] = msgpackValue(child)
+		}
+	case []interface{}:
+		for i, child := range value {
+			value[i] = msgpackValue(child)
+		}
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	}
+	return value
+}
+
+// requestBodyToJSON converts an XML or MessagePack request body to JSON, so
+// that readJSON can decode and check it the same way as a JSON body. dst
+// guides the XML conversion, since XML doesn't say which values are numbers.
+func requestBodyToJSON(mediaType string, body io.Reader, dst interface{}) ([]byte, error) {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, io.EOF
+	}
+
+	switch mediaType {
+	case mediaMsgpack:
+		var value interface{}
+		if err := msgpack.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("body contains badly-formed MessagePack: %w", err)
+		}
+		return json.Marshal(value)
+
+	default:
+		var root xmlNode
+		if err := xml.Unmarshal(raw, &root); err != nil {
+			return nil, fmt.Errorf("body contains badly-formed XML: %w", err)
+		}
+		return json.Marshal(root.toJSON(reflect.TypeOf(dst)))
+	}
+}
+
+type xmlNode struct {
+	XMLName  xml.Name
+	Content  string    `xml:",chardata"`
+	Children []xmlNode `xml:",any"`
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// toJSON turns the node into a value that marshals to the JSON the type t
+// expects: child elements become object keys, repeated or <item> children
+// become lists, and text becomes a number or boolean where t calls for one.
+func (n xmlNode) toJSON(t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t != nil && reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return strings.TrimSpace(n.Content)
+	}
+
+	kind := reflect.Invalid
+	if t != nil {
+		kind = t.Kind()
+	}
+
+	switch kind {
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, 0, len(n.Children))
+		for _, child := range n.Children {
+			items = append(items, child.toJSON(t.Elem()))
+		}
+		return items
+
+	case reflect.Struct, reflect.Map:
+		object := make(map[string]interface{})
+		for _, child := range n.Children {
+			key := child.XMLName.Local
+			object[key] = child.toJSON(jsonFieldType(t, key))
+		}
+		return object
+
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		text := strings.TrimSpace(n.Content)
+		if json.Valid([]byte(text)) {
+			return json.RawMessage(text)
+		}
+		return text
+	}
+
+	if len(n.Children) > 0 {
+		return n.toJSON(reflect.TypeOf(map[string]interface{}{}))
+	}
+	return n.Content
+}
+
+// jsonFieldType finds the type of the field that the JSON key key decodes
+// into, or nil if there is none.
+func jsonFieldType(t reflect.Type, key string) reflect.Type {
+	if t.Kind() == reflect.Map {
+		return t.Elem()
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if ft := jsonFieldType(field.Type, key); ft != nil {
+				return ft
+			}
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field.Type
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"github.com/vmihailenco/msgpack/v5"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	list := envelope{"books": []string{}, "metadata": struct{}{}}
+	single := envelope{"book": struct{}{}}
+
+	tests := []struct {
+		name   string
+		accept string
+		data   envelope
+		want   string
+		ok     bool
+	}{
+		{"No header", "", single, mediaJSON, true},
+		{"Wildcard", "*/*", single, mediaJSON, true},
+		{"XML", "application/xml", single, mediaXML, true},
+		{"Alias", "application/x-msgpack", single, mediaMsgpack, true},
+		{"Quality", "application/json;q=0.5, text/csv", list, mediaCSV, true},
+		{"CSV for a single record", "text/csv", single, "", false},
+		{"CSV falls back", "text/csv, application/xml;q=0.1", single, mediaXML, true},
+		{"Subtype wildcard", "text/*", list, mediaCSV, true},
+		{"Refused", "application/json;q=0, text/html", single, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", tt.accept)
+
+			got, ok := negotiate(r, tt.data)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("got %q, %t; want %q, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestResponseFormats(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	id := ts.createBook(t, `{"title": "Dune", "year": 1965, "pages": "412 pages", "genres": ["science-fiction", "fantasy"]}`)
+
+	t.Run("XML", func(t *testing.T) {
+		rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books/1", "", http.Header{"Accept": {"application/xml"}})
+
+		if got := rs.header.Get("Content-Type"); got != mediaXML {
+			t.Fatalf("got Content-Type %q; want %q", got, mediaXML)
+		}
+
+		var doc struct {
+			Book struct {
+				ID     int64    `xml:"id"`
+				Pages  string   `xml:"pages"`
+				Genres []string `xml:"genres>item"`
+			} `xml:"books"`
+		}
+		if err := xml.Unmarshal(rs.body, &doc); err != nil {
+			t.Fatal(err)
+		}
+
+		if doc.Book.ID != id || doc.Book.Pages != "412 pages" || len(doc.Book.Genres) != 2 {
+			t.Errorf("got %+v", doc.Book)
+		}
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books?fields=id,title,genres", "", http.Header{"Accept": {"text/csv"}})
+
+		if got := rs.header.Get("Content-Type"); got != mediaCSV {
+			t.Fatalf("got Content-Type %q; want %q", got, mediaCSV)
+		}
+
+		records, err := csv.NewReader(strings.NewReader(string(rs.body))).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := [][]string{{"genres", "id", "title"}, {"science-fiction;fantasy", "1", "Dune"}}
+		if len(records) != 2 || strings.Join(records[0], ",") != strings.Join(want[0], ",") || strings.Join(records[1], ",") != strings.Join(want[1], ",") {
+			t.Errorf("got %q; want %q", records, want)
+		}
+	})
+
+	t.Run("CSV pagination", func(t *testing.T) {
+		ts.createBook(t, `{"title": "Hyperion", "year": 1989, "pages": "482 pages", "genres": ["science-fiction"]}`)
+
+		rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books?page_size=1&sort=id", "", http.Header{"Accept": {"text/csv"}})
+
+		if got := rs.header.Get("X-Total-Count"); got != "2" {
+			t.Errorf("got X-Total-Count %q; want %q", got, "2")
+		}
+
+		want := `</v1/books?page=1&page_size=1&sort=id>; rel="first", </v1/books?page=2&page_size=1&sort=id>; rel="next", </v1/books?page=2&page_size=1&sort=id>; rel="last"`
+		if got := rs.header.Get("Link"); got != want {
+			t.Errorf("got Link %q; want %q", got, want)
+		}
+
+		rs = ts.do(t, http.MethodGet, "/v1/books?page_size=1&sort=id", "")
+		if got := rs.header.Get("Link"); got != "" {
+			t.Errorf("got Link %q on a JSON response; want none", got)
+		}
+	})
+
+	t.Run("MessagePack", func(t *testing.T) {
+		rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books/1", "", http.Header{"Accept": {"application/msgpack"}})
+
+		var env struct {
+			Book struct {
+				ID    int64  `msgpack:"id"`
+				Title string `msgpack:"title"`
+			} `msgpack:"books"`
+		}
+		if err := msgpack.Unmarshal(rs.body, &env); err != nil {
+			t.Fatal(err)
+		}
+
+		if env.Book.ID != id || env.Book.Title != "Dune" {
+			t.Errorf("got %+v", env.Book)
+		}
+	})
+
+	t.Run("Not acceptable", func(t *testing.T) {
+		rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books/1", "", http.Header{"Accept": {"text/csv"}})
+
+		if rs.status != http.StatusNotAcceptable {
+			t.Fatalf("got status %d; want %d", rs.status, http.StatusNotAcceptable)
+		}
+		if got := rs.header.Get("Content-Type"); got != mediaJSON {
+			t.Errorf("got Content-Type %q; want the error as JSON", got)
+		}
+	})
+}
+
+func TestRequestFormats(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	body, err := msgpack.Marshal(map[string]interface{}{
+		"title":  "Emma",
+		"year":   1916,
+		"pages":  "474 pages",
+		"genres": []string{"fiction"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"XML", "application/xml", `<book><title>Persuasion</title><year>1918</year><pages>249 pages</pages><genres><item>fiction</item></genres></book>`, http.StatusCreated},
+		{"MessagePack", "application/msgpack", string(body), http.StatusCreated},
+		{"JSON with charset", "application/json; charset=utf-8", `{"title": "Sanditon", "year": 1918, "pages": "160 pages", "genres": ["fiction"]}`, http.StatusCreated},
+		{"Bad XML", "application/xml", `<book><title>`, http.StatusBadRequest},
+		{"XML with wrong type", "application/xml", `<book><year>soon</year></book>`, http.StatusBadRequest},
+		{"Unknown XML element", "application/xml", `<book><author>Austen</author></book>`, http.StatusBadRequest},
+		{"Form-labelled JSON", "application/x-www-form-urlencoded", `{"title": "Lady Susan", "year": 1894, "pages": "80 pages", "genres": ["fiction"]}`, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.doWithHeaders(t, http.MethodPost, "/v1/books", tt.body, http.Header{"Content-Type": {tt.contentType}})
+
+			if rs.status != tt.status {
+				t.Errorf("got status %d; want %d; body %s", rs.status, tt.status, rs.body)
+			}
+		})
+	}
+}
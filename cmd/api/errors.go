@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 )
 
+// statusClientClosedRequest is the non-standard status nginx uses for a
+// request the client gave up on before the server responded.
+const statusClientClosedRequest = 499
+
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
 	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
 }
@@ -16,7 +22,13 @@ func (app *application) logError(r *http.Request, err error) {
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	env := envelope{"error": message}
 
-	err := app.writeJSON(w, status, env, nil)
+	// Errors fall back to JSON rather than becoming a 406 themselves.
+	var err error
+	if _, ok := negotiate(r, env); ok {
+		err = app.writeResponse(w, r, status, env, nil)
+	} else {
+		err = app.writeJSON(w, status, env, nil)
+	}
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -24,6 +36,16 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		app.clientClosedRequestResponse(w, r)
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		app.logError(r, err)
+		app.timeoutResponse(w, r)
+		return
+	}
+
 	app.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
 	app.errorResponse(w, r, http.StatusInternalServerError, message)
@@ -47,3 +69,82 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	message := "unable to update the record due to an edit conflict, please try again"
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
+
+func (app *application) clientClosedRequestResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the request was cancelled before it could be completed"
+	app.errorResponse(w, r, statusClientClosedRequest, message)
+}
+
+func (app *application) timeoutResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server took too long to process your request, please try again"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) serviceUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server is shutting down, please try again shortly"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the requested resource is only available as application/json, application/xml, application/msgpack or, for lists, text/csv"
+	app.errorResponse(w, r, http.StatusNotAcceptable, message)
+}
+
+func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid authentication credentials"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "you must be authenticated to access this resource"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) bookUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "no copy of the book is available to borrow"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) copyOnLoanResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the copy is out on loan, it must be returned first"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) loanClosedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the loan has already been returned"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) copyOnHoldResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the copy is set aside for a hold, which must be collected, cancelled or expire first"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) bookAvailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a copy of the book is available, check it out instead of placing a hold"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) holdClosedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the hold has already been collected, cancelled or expired"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) genreInUseResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the genre is used by books, which must be moved to another genre first"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"net/http"
+)
+
+func (app *application) createGenreHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Slug    string   `json:"slug"`
+		Name    string   `json:"name"`
+		Aliases []string `json:"aliases"`
+		Parent  string   `json:"parent"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	genre := &data.Genre{
+		Slug:    input.Slug,
+		Name:    input.Name,
+		Aliases: genreKeys(input.Aliases),
+		Parent:  input.Parent,
+	}
+
+	v := validator.New()
+
+	err = app.checkGenreVocabulary(r.Context(), v, genre, genre.Slug)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if data.ValidateGenre(v, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Genres.Insert(r.Context(), genre)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateGenre):
+			v.AddError("slug", "a genre with this slug already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/genres/%d", genre.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"genre": genre}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showGenreHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	genre, err := app.models.Genres.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"genre": genre}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateGenreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	genre, err := app.models.Genres.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Slug    *string  `json:"slug"`
+		Name    *string  `json:"name"`
+		Aliases []string `json:"aliases"`
+		Parent  *string  `json:"parent"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	currentSlug := genre.Slug
+
+	if input.Slug != nil {
+		genre.Slug = *input.Slug
+	}
+	if input.Name != nil {
+		genre.Name = *input.Name
+	}
+	if input.Aliases != nil {
+		genre.Aliases = genreKeys(input.Aliases)
+	}
+
+	v := validator.New()
+
+	if input.Parent != nil {
+		genre.Parent = *input.Parent
+	}
+
+	err = app.checkGenreVocabulary(r.Context(), v, genre, currentSlug)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if genre.Parent != "" {
+		descendants, err := app.models.Genres.Descendants(r.Context(), currentSlug)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		v.Check(!validator.In(genre.Parent, descendants...), "parent", "must not be a descendant of the genre")
+	}
+
+	if data.ValidateGenre(v, genre); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Genres.Update(r.Context(), genre)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateGenre):
+			v.AddError("slug", "a genre with this slug already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"genre": genre}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteGenreHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Genres.Delete(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrGenreInUse):
+			app.genreInUseResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "genre successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+
+	genres, err := app.models.Genres.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"genres": genres}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkGenreVocabulary makes sure the genre's name and aliases don't already
+// belong to a genre other than currentSlug, and resolves its parent to a
+// canonical slug.
+func (app *application) checkGenreVocabulary(ctx context.Context, v *validator.Validator, genre *data.Genre, currentSlug string) error {
+	names := append([]string{genre.Name}, genre.Aliases...)
+
+	slugs, unknown, err := app.models.Genres.Normalize(ctx, names)
+	if err != nil {
+		return err
+	}
+
+	for i, slug := range slugs {
+		if slug != currentSlug && !validator.In(names[i], unknown...) {
+			v.AddError("aliases", fmt.Sprintf("%q already belongs to the genre %q", names[i], slug))
+			break
+		}
+	}
+
+	if genre.Parent == "" {
+		return nil
+	}
+
+	parents, unknown, err := app.models.Genres.Normalize(ctx, []string{genre.Parent})
+	if err != nil {
+		return err
+	}
+
+	v.Check(len(unknown) == 0, "parent", "must be an existing genre")
+	genre.Parent = parents[0]
+
+	return nil
+}
+
+func genreKeys(names []string) []string {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = data.GenreKey(name)
+	}
+	return keys
+}
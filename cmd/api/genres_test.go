@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGenres(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	rs := ts.do(t, http.MethodPost, "/v1/genres", `{"slug": "space-opera", "name": "Space Opera", "aliases": ["Space  Opera!"], "parent": "Sci-Fi"}`)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusCreated, rs.body)
+	}
+
+	var env struct {
+		Genre struct {
+			ID      int64    `json:"id"`
+			Aliases []string `json:"aliases"`
+			Parent  string   `json:"parent"`
+		} `json:"genre"`
+	}
+	rs.decode(t, &env)
+
+	if env.Genre.Parent != "science-fiction" {
+		t.Errorf("got parent %q; want the alias resolved to %q", env.Genre.Parent, "science-fiction")
+	}
+	if len(env.Genre.Aliases) != 1 || env.Genre.Aliases[0] != "space opera!" {
+		t.Errorf("got aliases %q; want them normalised", env.Genre.Aliases)
+	}
+
+	t.Run("Books under the grandparent", func(t *testing.T) {
+		ts.createBook(t, `{"title": "Hyperion", "year": 1989, "pages": "482 pages", "genres": ["space-opera"]}`)
+
+		rs := ts.do(t, http.MethodGet, "/v1/books?genres=fiction&fields=title", "")
+
+		var env struct {
+			Books []map[string]string `json:"books"`
+		}
+		rs.decode(t, &env)
+
+		if len(env.Books) != 1 || env.Books[0]["title"] != "Hyperion" {
+			t.Errorf("got %v; want Hyperion", env.Books)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+		want  string
+	}{
+		{"Alias of another genre", `{"slug": "sf", "name": "SF", "aliases": []}`, "aliases", `"SF" already belongs to the genre "science-fiction"`},
+		{"Duplicate slug", `{"slug": "fantasy", "name": "High Fantasy", "aliases": []}`, "slug", "a genre with this slug already exists"},
+		{"Bad slug", `{"slug": "High Fantasy", "name": "High Fantasy", "aliases": []}`, "slug", "must contain only lowercase letters, digits and single hyphens"},
+		{"Unknown parent", `{"slug": "cozy", "name": "Cozy", "aliases": [], "parent": "nope"}`, "parent", "must be an existing genre"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.do(t, http.MethodPost, "/v1/genres", tt.body)
+
+			if rs.status != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusUnprocessableEntity, rs.body)
+			}
+
+			errs, _ := rs.errorMessage(t).(map[string]interface{})
+			if errs[tt.field] != tt.want {
+				t.Errorf("got %s error %q; want %q", tt.field, errs[tt.field], tt.want)
+			}
+		})
+	}
+
+	t.Run("Parent cycle", func(t *testing.T) {
+		rs := ts.do(t, http.MethodPatch, "/v1/genres/1", `{"parent": "space-opera"}`)
+
+		if rs.status != http.StatusUnprocessableEntity {
+			t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusUnprocessableEntity, rs.body)
+		}
+	})
+}
+
+// genreID looks up the id of the genre with the slug.
+func (ts *testServer) genreID(t *testing.T, slug string) int64 {
+	t.Helper()
+
+	var env struct {
+		Genres []data.Genre `json:"genres"`
+	}
+	ts.do(t, http.MethodGet, "/v1/genres", "").decode(t, &env)
+
+	for _, genre := range env.Genres {
+		if genre.Slug == slug {
+			return genre.ID
+		}
+	}
+
+	t.Fatalf("no genre %q", slug)
+	return 0
+}
+
+func TestRenameGenre(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	spqr := ts.createBook(t, `{"title": "SPQR", "year": 2015, "pages": "608 pages", "genres": ["history"]}`)
+
+	rs := ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/genres/%d", ts.genreID(t, "science-fiction")), `{"slug": "speculative-fiction"}`)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusOK, rs.body)
+	}
+
+	var env struct {
+		Book data.Book `json:"books"`
+	}
+	ts.do(t, http.MethodGet, fmt.Sprintf("/v1/books/%d", dune), "").decode(t, &env)
+
+	if fmt.Sprint(env.Book.Genres) != "[speculative-fiction]" || env.Book.Version != 2 {
+		t.Errorf("got genres %v at version %d; want the slug renamed in a new version of the book", env.Book.Genres, env.Book.Version)
+	}
+
+	for _, genres := range []string{"speculative-fiction", "sci-fi", "fiction"} {
+		var list struct {
+			Books []data.Book `json:"books"`
+		}
+		ts.do(t, http.MethodGet, "/v1/books?genres="+genres, "").decode(t, &list)
+
+		if len(list.Books) != 1 || list.Books[0].ID != dune {
+			t.Errorf("got %d books filtering by %s; want Dune", len(list.Books), genres)
+		}
+	}
+
+	// Only Dune changed, and subscribers hear about it as about any update.
+	sink := &recordingSink{}
+	relayOutbox(t, app, sink)
+
+	var events []string
+	for _, message := range sink.messages {
+		events = append(events, fmt.Sprintf("%s %d", message.Event, message.AggregateID))
+
+		if message.Event == data.EventBookUpdated && !strings.Contains(string(message.Payload), `"speculative-fiction"`) {
+			t.Errorf("got payload %s; want the book with its genre renamed", message.Payload)
+		}
+	}
+
+	want := fmt.Sprintf("[book.created %d book.created %d book.updated %d]", dune, spqr, dune)
+	if fmt.Sprint(events) != want {
+		t.Errorf("got events %v; want %s", events, want)
+	}
+}
+
+func TestDeleteGenreInUse(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	book := ts.createBook(t, `{"title": "The Big Sleep", "year": 1939, "pages": "231 pages", "genres": ["crime"]}`)
+	path := fmt.Sprintf("/v1/genres/%d", ts.genreID(t, "mystery"))
+
+	rs := ts.do(t, http.MethodDelete, path, "")
+	if rs.status != http.StatusConflict {
+		t.Fatalf("got status %d deleting a genre books have; want %d", rs.status, http.StatusConflict)
+	}
+	if rs := ts.do(t, http.MethodGet, path, ""); rs.status != http.StatusOK {
+		t.Errorf("got status %d; want the genre kept", rs.status)
+	}
+
+	ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/books/%d", book), "")
+
+	if rs := ts.do(t, http.MethodDelete, path, ""); rs.status != http.StatusOK {
+		t.Errorf("got status %d once no book has the genre; want %d", rs.status, http.StatusOK)
+	}
+}
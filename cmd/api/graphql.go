@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/location"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// graphQLError is an error with a machine-readable code, and for failed
+// validation the per-field messages, under its extensions.
+type graphQLError struct {
+	message    string
+	extensions map[string]interface{}
+}
+
+func (e graphQLError) Error() string {
+	return e.message
+}
+
+func (e graphQLError) Extensions() map[string]interface{} {
+	return e.extensions
+}
+
+func validationError(errors map[string]string) error {
+	return graphQLError{"validation failed", map[string]interface{}{"code": "VALIDATION_FAILED", "fields": errors}}
+}
+
+var (
+	errGraphQLNotFound     = graphQLError{"the requested resource could not be found", map[string]interface{}{"code": "NOT_FOUND"}}
+	errGraphQLEditConflict = graphQLError{"unable to update the record due to an edit conflict, please try again", map[string]interface{}{"code": "EDIT_CONFLICT"}}
+	errGraphQLServer       = graphQLError{"the server encountered a problem and could not process your request", map[string]interface{}{"code": "INTERNAL_SERVER_ERROR"}}
+)
+
+// graphqlHandler serves the GraphQL API. Queries go through the same models
+// and validation as the REST endpoints, and are measured against the
+// configured depth and complexity limits before they run.
+func (app *application) graphqlHandler() http.HandlerFunc {
+	schema, err := app.graphqlSchema()
+	if err != nil {
+		panic(err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+			Extensions    map[string]interface{} `json:"extensions"`
+		}
+
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		result := app.executeGraphQL(r.Context(), schema, input.Query, input.OperationName, input.Variables)
+
+		env := envelope{"data": result.Data}
+		if len(result.Errors) > 0 {
+			env["errors"] = result.Errors
+		}
+
+		err = app.writeResponse(w, r, http.StatusOK, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+func (app *application) executeGraphQL(ctx context.Context, schema graphql.Schema, query, operationName string, variables map[string]interface{}) *graphql.Result {
+	doc, err := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(query), Name: "GraphQL request"}),
+	})
+	if err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+
+	validation := graphql.ValidateDocument(&schema, doc, nil)
+	if !validation.IsValid {
+		return &graphql.Result{Errors: validation.Errors}
+	}
+
+	depth, complexity := measureQuery(doc, operationName, variables)
+
+	switch {
+	case depth > app.config.graphql.maxDepth:
+		err = fmt.Errorf("query is %d levels deep, more than the limit of %d", depth, app.config.graphql.maxDepth)
+	case complexity > app.config.graphql.maxComplexity:
+		err = fmt.Errorf("query has a complexity of %d, more than the limit of %d", complexity, app.config.graphql.maxComplexity)
+	}
+	if err != nil {
+		return &graphql.Result{Errors: []gqlerrors.FormattedError{{
+			Message:    err.Error(),
+			Locations:  []location.SourceLocation{},
+			Extensions: map[string]interface{}{"code": "QUERY_TOO_COMPLEX"},
+		}}}
+	}
+
+	return graphql.Execute(graphql.ExecuteParams{
+		Schema:        schema,
+		AST:           doc,
+		OperationName: operationName,
+		Args:          variables,
+		Context:       ctx,
+	})
+}
+
+// complexityCeiling is where measureQuery stops counting, so that fragments
+// that spread each other many times over can't overflow the complexity back
+// under the limit.
+const complexityCeiling = 1 << 30
+
+// measureQuery returns how deeply the operation nests fields and how many it
+// may resolve. Everything under a paginated field counts once per row of its
+// page. Introspection is left out, since its depth is fixed by the schema.
+// Each fragment is measured once however often it is spread, which keeps a
+// chain of fragments that each spread the next twice from taking time that
+// doubles with every link.
+func measureQuery(doc *ast.Document, operationName string, variables map[string]interface{}) (int, int) {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	var operation *ast.OperationDefinition
+
+	for _, definition := range doc.Definitions {
+		switch definition := definition.(type) {
+		case *ast.FragmentDefinition:
+			fragments[definition.Name.Value] = definition
+		case *ast.OperationDefinition:
+			if operation == nil || (definition.Name != nil && definition.Name.Value == operationName) {
+				operation = definition
+			}
+		}
+	}
+
+	if operation == nil {
+		return 0, 0
+	}
+
+	type spread struct {
+		name string
+		root bool
+	}
+	type measurement struct {
+		depth, complexity int
+	}
+	measured := make(map[spread]measurement)
+
+	var measure func(set *ast.SelectionSet, root bool) (int, int)
+	measure = func(set *ast.SelectionSet, root bool) (int, int) {
+		depth, complexity := 0, 0
+		if set == nil {
+			return depth, complexity
+		}
+
+		for _, selection := range set.Selections {
+			var d, c int
+
+			switch selection := selection.(type) {
+			case *ast.Field:
+				if strings.HasPrefix(selection.Name.Value, "__") {
+					continue
+				}
+				d, c = measure(selection.SelectionSet, false)
+				if rows := rowsPerPage(selection, root, variables); c > complexityCeiling/rows {
+					d, c = d+1, complexityCeiling
+				} else {
+					d, c = d+1, 1+c*rows
+				}
+			case *ast.InlineFragment:
+				d, c = measure(selection.SelectionSet, root)
+			case *ast.FragmentSpread:
+				// Validation has already rejected fragment cycles.
+				key := spread{selection.Name.Value, root}
+				if m, ok := measured[key]; ok {
+					d, c = m.depth, m.complexity
+				} else if fragment, ok := fragments[key.name]; ok {
+					d, c = measure(fragment.SelectionSet, root)
+					measured[key] = measurement{d, c}
+				}
+			}
+
+			if d > depth {
+				depth = d
+			}
+			complexity += c
+			if complexity > complexityCeiling {
+				complexity = complexityCeiling
+			}
+		}
+
+		return depth, complexity
+	}
+
+	return measure(operation.SelectionSet, true)
+}
+
+// rowsPerPage is the page size a top-level books field asks for, and 1 for
+// every other field.
+func rowsPerPage(field *ast.Field, root bool, variables map[string]interface{}) int {
+	if !root || field.Name.Value != "books" {
+		return 1
+	}
+
+	for _, argument := range field.Arguments {
+		if argument.Name.Value != "pageSize" {
+			continue
+		}
+
+		switch value := argument.Value.(type) {
+		case *ast.IntValue:
+			if n, err := strconv.Atoi(value.Value); err == nil && n > 0 {
+				return n
+			}
+		case *ast.Variable:
+			if n, ok := variables[value.Name.Value].(float64); ok && n > 0 {
+				return int(math.Min(n, complexityCeiling))
+			}
+		}
+	}
+
+	return 20
+}
+
+// graphqlSchema builds the schema. Field names follow GraphQL's camelCase
+// convention; everything else mirrors the REST resources.
+func (app *application) graphqlSchema() (graphql.Schema, error) {
+	bookType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Book",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"createdAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"updatedAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"title":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"year":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"pages": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return int(p.Source.(*data.Book).Pages), nil
+				},
+			},
+			"genres":          &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"version":         &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Pass to updateBook to only apply the update to this version."},
+			"averageRating":   &graphql.Field{Type: graphql.NewNonNull(graphql.Float), Description: "Mean of the book's review ratings, or 0 if it has none."},
+			"ratingsCount":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"copiesTotal":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Number of copies the library owns."},
+			"copiesAvailable": &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Number of copies on the shelf to lend."},
+			"available":       &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean), Description: "Whether a copy can be checked out now, rather than held."},
+		},
+	})
+
+	metadataType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Metadata",
+		Fields: graphql.Fields{
+			"currentPage":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"pageSize":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"firstPage":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"lastPage":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"totalRecords": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	bookPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "BookPage",
+		Fields: graphql.Fields{
+			"metadata": &graphql.Field{Type: graphql.NewNonNull(metadataType)},
+			"books":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(bookType)))},
+		},
+	})
+
+	createBookInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CreateBookInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"year":   &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"pages":  &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"genres": &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+		},
+	})
+
+	updateBookInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UpdateBookInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"title":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"year":    &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"pages":   &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"genres":  &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			"version": &graphql.InputObjectFieldConfig{Type: graphql.Int, Description: "Fail with EDIT_CONFLICT unless the book is still at this version."},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"book": &graphql.Field{
+				Type: bookType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: app.resolveBook,
+			},
+			"books": &graphql.Field{
+				Type: graphql.NewNonNull(bookPageType),
+				Args: graphql.FieldConfigArgument{
+					"title":    &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: ""},
+					"genres":   &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+					"sort":     &graphql.ArgumentConfig{Type: graphql.String, DefaultValue: "id"},
+					"page":     &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 1},
+					"pageSize": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 20},
+				},
+				Resolve: app.resolveBooks,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createBook": &graphql.Field{
+				Type: graphql.NewNonNull(bookType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createBookInput)},
+				},
+				Resolve: app.resolveCreateBook,
+			},
+			"updateBook": &graphql.Field{
+				Type: graphql.NewNonNull(bookType),
+				Args: graphql.FieldConfigArgument{
+					"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateBookInput)},
+				},
+				Resolve: app.resolveUpdateBook,
+			},
+			"deleteBook": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.ID),
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: app.resolveDeleteBook,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// graphqlServerError logs err and returns the error the client sees in its
+// place, except for a cancelled request, which has nobody to report to.
+func (app *application) graphqlServerError(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		app.logger.Print(err)
+	}
+	return errGraphQLServer
+}
+
+func (app *application) resolveBook(p graphql.ResolveParams) (interface{}, error) {
+	id, ok := graphqlID(p.Args["id"])
+	if !ok {
+		return nil, nil
+	}
+
+	book, err := app.models.Books.Get(p.Context, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, nil
+		default:
+			return nil, app.graphqlServerError(p.Context, err)
+		}
+	}
+
+	return book, nil
+}
+
+func (app *application) resolveBooks(p graphql.ResolveParams) (interface{}, error) {
+	v := validator.New()
+
+	title, _ := p.Args["title"].(string)
+	genres := graphqlStrings(p.Args["genres"])
+
+	var filters data.Filters
+	filters.Page, _ = p.Args["page"].(int)
+	filters.PageSize, _ = p.Args["pageSize"].(int)
+	filters.Sort, _ = p.Args["sort"].(string)
+	filters.SortSafelist = bookSortSafelist
+	filters.GenresMode = "all"
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, validationError(v.Errors)
+	}
+
+	genres, _, err := app.models.Genres.Normalize(p.Context, genres)
+	if err != nil {
+		return nil, app.graphqlServerError(p.Context, err)
+	}
+
+	books, metadata, err := app.models.Books.GetAll(p.Context, title, genres, filters)
+	if err != nil {
+		return nil, app.graphqlServerError(p.Context, err)
+	}
+
+	return map[string]interface{}{"metadata": metadata, "books": books}, nil
+}
+
+func (app *application) resolveCreateBook(p graphql.ResolveParams) (interface{}, error) {
+	input, _ := p.Args["input"].(map[string]interface{})
+
+	book := &data.Book{}
+	if title, ok := input["title"].(string); ok {
+		book.Title = title
+	}
+	if year, ok := input["year"].(int); ok {
+		book.Year = int32(year)
+	}
+	if pages, ok := input["pages"].(int); ok {
+		book.Pages = data.Pages(pages)
+	}
+
+	v := validator.New()
+
+	if genres, ok := input["genres"]; ok && genres != nil {
+		var err error
+		book.Genres, err = app.normalizeGenres(p.Context, v, graphqlStrings(genres))
+		if err != nil {
+			return nil, app.graphqlServerError(p.Context, err)
+		}
+	}
+
+	if data.ValidateBooks(v, book); !v.Valid() {
+		return nil, validationError(v.Errors)
+	}
+
+	err := app.models.Books.Insert(p.Context, book)
+	if err != nil {
+		return nil, app.graphqlServerError(p.Context, err)
+	}
+
+	app.bookChanged()
+	return book, nil
+}
+
+func (app *application) resolveUpdateBook(p graphql.ResolveParams) (interface{}, error) {
+	id, ok := graphqlID(p.Args["id"])
+	if !ok {
+		return nil, errGraphQLNotFound
+	}
+
+	book, err := app.models.Books.Get(p.Context, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, errGraphQLNotFound
+		default:
+			return nil, app.graphqlServerError(p.Context, err)
+		}
+	}
+
+	input, _ := p.Args["input"].(map[string]interface{})
+
+	// With a version, the update only goes through if nobody has changed
+	// the book since the client read it; without one, it only checks
+	// against the read above.
+	if version, ok := input["version"].(int); ok {
+		book.Version = int32(version)
+	}
+
+	if title, ok := input["title"].(string); ok {
+		book.Title = title
+	}
+	if year, ok := input["year"].(int); ok {
+		book.Year = int32(year)
+	}
+	if pages, ok := input["pages"].(int); ok {
+		book.Pages = data.Pages(pages)
+	}
+
+	v := validator.New()
+
+	if genres, ok := input["genres"]; ok && genres != nil {
+		book.Genres, err = app.normalizeGenres(p.Context, v, graphqlStrings(genres))
+		if err != nil {
+			return nil, app.graphqlServerError(p.Context, err)
+		}
+	}
+
+	if data.ValidateBooks(v, book); !v.Valid() {
+		return nil, validationError(v.Errors)
+	}
+
+	err = app.models.Books.Update(p.Context, book)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return nil, errGraphQLEditConflict
+		default:
+			return nil, app.graphqlServerError(p.Context, err)
+		}
+	}
+
+	app.bookChanged()
+	return book, nil
+}
+
+func (app *application) resolveDeleteBook(p graphql.ResolveParams) (interface{}, error) {
+	id, ok := graphqlID(p.Args["id"])
+	if !ok {
+		return nil, errGraphQLNotFound
+	}
+
+	err := app.models.Books.Delete(p.Context, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, errGraphQLNotFound
+		default:
+			return nil, app.graphqlServerError(p.Context, err)
+		}
+	}
+
+	app.bookChanged()
+	return id, nil
+}
+
+// graphqlID parses an ID argument, which arrives as a string.
+func graphqlID(arg interface{}) (int64, bool) {
+	s, _ := arg.(string)
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id < 1 {
+		return 0, false
+	}
+	return id, true
+}
+
+func graphqlStrings(arg interface{}) []string {
+	values, _ := arg.([]interface{})
+
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type graphqlResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// code returns the extensions code of the first error, or "" if there were
+// none.
+func (rs graphqlResponse) code() string {
+	if len(rs.Errors) == 0 {
+		return ""
+	}
+	code, _ := rs.Errors[0].Extensions["code"].(string)
+	return code
+}
+
+func (ts *testServer) graphql(t *testing.T, query string, variables map[string]interface{}) graphqlResponse {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := ts.do(t, http.MethodPost, "/v1/graphql", string(body))
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusOK, rs.body)
+	}
+
+	var out graphqlResponse
+	rs.decode(t, &out)
+	return out
+}
+
+func TestGraphQLQueries(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	ts.createBook(t, `{"title": "Emma", "year": 1900, "pages": "474 pages", "genres": ["fiction"]}`)
+
+	rs := ts.graphql(t, `query($id: ID!) { book(id: $id) { id title year pages genres version } }`, map[string]interface{}{"id": dune})
+	if len(rs.Errors) > 0 {
+		t.Fatalf("got errors %+v", rs.Errors)
+	}
+
+	var book struct {
+		ID      string `json:"id"`
+		Title   string `json:"title"`
+		Pages   int    `json:"pages"`
+		Version int    `json:"version"`
+	}
+	if err := json.Unmarshal(rs.Data["book"], &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.ID != fmt.Sprint(dune) || book.Title != "Dune" || book.Pages != 412 || book.Version != 1 {
+		t.Errorf("got book %s; want Dune", rs.Data["book"])
+	}
+
+	rs = ts.graphql(t, `{ book(id: "999") { id } }`, nil)
+	if len(rs.Errors) > 0 || string(rs.Data["book"]) != "null" {
+		t.Errorf("got %s and errors %+v for a missing book; want null", rs.Data["book"], rs.Errors)
+	}
+
+	rs = ts.graphql(t, `{ books(sort: "-title", pageSize: 1) { metadata { totalRecords lastPage } books { title } } }`, nil)
+	if len(rs.Errors) > 0 {
+		t.Fatalf("got errors %+v", rs.Errors)
+	}
+
+	var page struct {
+		Metadata struct {
+			TotalRecords int `json:"totalRecords"`
+			LastPage     int `json:"lastPage"`
+		} `json:"metadata"`
+		Books []struct {
+			Title string `json:"title"`
+		} `json:"books"`
+	}
+	if err := json.Unmarshal(rs.Data["books"], &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Metadata.TotalRecords != 2 || page.Metadata.LastPage != 2 || len(page.Books) != 1 || page.Books[0].Title != "Emma" {
+		t.Errorf("got page %s; want Emma first of 2", rs.Data["books"])
+	}
+
+	rs = ts.graphql(t, `{ books(sort: "author") { books { id } } }`, nil)
+	if rs.code() != "VALIDATION_FAILED" {
+		t.Errorf("got errors %+v for an unknown sort; want VALIDATION_FAILED", rs.Errors)
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	rs := ts.graphql(t, `mutation { createBook(input: {title: "Dune", year: 1965, pages: 412, genres: ["Sci-Fi"]}) { id version } }`, nil)
+	if len(rs.Errors) > 0 {
+		t.Fatalf("got errors %+v", rs.Errors)
+	}
+
+	var created struct {
+		ID      string `json:"id"`
+		Version int    `json:"version"`
+	}
+	if err := json.Unmarshal(rs.Data["createBook"], &created); err != nil {
+		t.Fatal(err)
+	}
+
+	update := `mutation($id: ID!, $input: UpdateBookInput!) { updateBook(id: $id, input: $input) { title version } }`
+
+	rs = ts.graphql(t, update, map[string]interface{}{"id": created.ID, "input": map[string]interface{}{"title": "Dune Messiah", "version": created.Version}})
+	if len(rs.Errors) > 0 {
+		t.Fatalf("got errors %+v", rs.Errors)
+	}
+
+	var updated struct {
+		Title   string `json:"title"`
+		Version int    `json:"version"`
+	}
+	if err := json.Unmarshal(rs.Data["updateBook"], &updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Title != "Dune Messiah" || updated.Version != created.Version+1 {
+		t.Fatalf("got %s; want the update applied", rs.Data["updateBook"])
+	}
+
+	// The book has moved on from the version this update was based on.
+	rs = ts.graphql(t, update, map[string]interface{}{"id": created.ID, "input": map[string]interface{}{"title": "Children of Dune", "version": created.Version}})
+	if rs.code() != "EDIT_CONFLICT" {
+		t.Errorf("got errors %+v for a stale version; want EDIT_CONFLICT", rs.Errors)
+	}
+
+	rs = ts.graphql(t, `mutation { createBook(input: {year: 3000, genres: ["nope"]}) { id } }`, nil)
+	if rs.code() != "VALIDATION_FAILED" {
+		t.Fatalf("got errors %+v; want VALIDATION_FAILED", rs.Errors)
+	}
+	fields, _ := rs.Errors[0].Extensions["fields"].(map[string]interface{})
+	for _, field := range []string{"title", "year", "pages", "genres"} {
+		if fields[field] == nil {
+			t.Errorf("got fields %v; want an error for %q", fields, field)
+		}
+	}
+
+	rs = ts.graphql(t, `mutation($id: ID!) { deleteBook(id: $id) }`, map[string]interface{}{"id": created.ID})
+	if len(rs.Errors) > 0 {
+		t.Fatalf("got errors %+v", rs.Errors)
+	}
+
+	rs = ts.graphql(t, `mutation($id: ID!) { deleteBook(id: $id) }`, map[string]interface{}{"id": created.ID})
+	if rs.code() != "NOT_FOUND" {
+		t.Errorf("got errors %+v deleting a deleted book; want NOT_FOUND", rs.Errors)
+	}
+}
+
+func TestGraphQLLimits(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.graphql.maxComplexity = 50
+	ts := newTestServer(t, app.routes())
+
+	// Each fragment spreads the next twice, so the query asks for 2^40 ids.
+	var chain strings.Builder
+	chain.WriteString(`{ book(id: "1") { ...F0 } }`)
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&chain, " fragment F%d on Book { ...F%d ...F%d }", i, i+1, i+1)
+	}
+	chain.WriteString(" fragment F40 on Book { id }")
+
+	tests := []struct {
+		name      string
+		maxDepth  int
+		query     string
+		variables map[string]interface{}
+		code      string
+	}{
+		{"Within limits", 2, `{ book(id: "1") { id title } }`, nil, ""},
+		{"Too deep", 2, `{ books { books { id } } }`, nil, "QUERY_TOO_COMPLEX"},
+		{"Too deep through fragments", 2, `{ books { ...Page } } fragment Page on BookPage { books { ...Fields } } fragment Fields on Book { id }`, nil, "QUERY_TOO_COMPLEX"},
+		{"Introspection", 2, `{ __schema { types { name fields { name type { name ofType { name } } } } } }`, nil, ""},
+		{"Few rows", 3, `{ books(pageSize: 5) { books { id title } } }`, nil, ""},
+		{"Too many rows", 3, `{ books(pageSize: 50) { books { id title } } }`, nil, "QUERY_TOO_COMPLEX"},
+		{"Too many rows by variable", 3, `query($n: Int) { books(pageSize: $n) { books { id title } } }`, map[string]interface{}{"n": 50}, "QUERY_TOO_COMPLEX"},
+		{"Fragments spread over and over", 2, chain.String(), nil, "QUERY_TOO_COMPLEX"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app.config.graphql.maxDepth = tt.maxDepth
+
+			rs := ts.graphql(t, tt.query, tt.variables)
+			if rs.code() != tt.code {
+				t.Errorf("got errors %+v; want code %q", rs.Errors, tt.code)
+			}
+		})
+	}
+}
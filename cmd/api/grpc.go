@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/Bug-daulet/FinalSPA/internal/bookspb"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"sort"
+)
+
+// bookService serves the gRPC BookService from the same models and
+// validation as the HTTP handlers.
+type bookService struct {
+	bookspb.UnimplementedBookServiceServer
+	app *application
+}
+
+func (app *application) grpcServer() *grpc.Server {
+	srv := grpc.NewServer()
+	bookspb.RegisterBookServiceServer(srv, &bookService{app: app})
+	return srv
+}
+
+// grpcError turns an error from the models into the status a client sees,
+// logging those that are the server's fault.
+func (app *application) grpcError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return status.Error(codes.NotFound, "the requested resource could not be found")
+	case errors.Is(err, data.ErrEditConflict):
+		return status.Error(codes.Aborted, "unable to update the record due to an edit conflict, please try again")
+	case ctx.Err() != nil:
+		return status.FromContextError(ctx.Err()).Err()
+	default:
+		app.logger.Print(err)
+		return status.Error(codes.Internal, "the server encountered a problem and could not process your request")
+	}
+}
+
+// grpcValidationError reports failed validation as INVALID_ARGUMENT, with
+// the message for each field in a BadRequest detail.
+func grpcValidationError(errors map[string]string) error {
+	fields := make([]string, 0, len(errors))
+	for field := range errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	details := &errdetails.BadRequest{}
+	for _, field := range fields {
+		details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: errors[field],
+		})
+	}
+
+	st, err := status.New(codes.InvalidArgument, "validation failed").WithDetails(details)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "validation failed")
+	}
+	return st.Err()
+}
+
+func bookMessage(book *data.Book) *bookspb.Book {
+	return &bookspb.Book{
+		Id:        book.ID,
+		CreatedAt: timestamppb.New(book.CreatedAt),
+		UpdatedAt: timestamppb.New(book.UpdatedAt),
+		Title:     book.Title,
+		Year:      book.Year,
+		Pages:     int32(book.Pages),
+		Genres:    book.Genres,
+		Version:   book.Version,
+	}
+}
+
+var changeOps = map[string]bookspb.BookChange_Op{
+	data.ChangeCreated: bookspb.BookChange_OP_CREATED,
+	data.ChangeUpdated: bookspb.BookChange_OP_UPDATED,
+	data.ChangeDeleted: bookspb.BookChange_OP_DELETED,
+}
+
+func changeMessage(event *changeEvent) *bookspb.BookChange {
+	book := &bookspb.Book{Id: event.bookID}
+	if event.book != nil {
+		book = bookMessage(event.book)
+	}
+
+	return &bookspb.BookChange{Id: event.id, Op: changeOps[event.op], Book: book}
+}
+
+func (s *bookService) Get(ctx context.Context, req *bookspb.GetRequest) (*bookspb.Book, error) {
+	if req.Id < 1 {
+		return nil, s.app.grpcError(ctx, data.ErrRecordNotFound)
+	}
+
+	book, err := s.app.models.Books.Get(ctx, req.Id)
+	if err != nil {
+		return nil, s.app.grpcError(ctx, err)
+	}
+
+	return bookMessage(book), nil
+}
+
+func (s *bookService) List(ctx context.Context, req *bookspb.ListRequest) (*bookspb.ListResponse, error) {
+	filters := data.Filters{
+		Page:         int(req.Page),
+		PageSize:     int(req.PageSize),
+		Sort:         req.Sort,
+		SortSafelist: bookSortSafelist,
+		GenresMode:   "all",
+	}
+
+	// Unset fields take the defaults GET /v1/books has.
+	if filters.Page == 0 {
+		filters.Page = 1
+	}
+	if filters.PageSize == 0 {
+		filters.PageSize = 20
+	}
+	if filters.Sort == "" {
+		filters.Sort = "id"
+	}
+
+	v := validator.New()
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	genres, _, err := s.app.models.Genres.Normalize(ctx, req.Genres)
+	if err != nil {
+		return nil, s.app.grpcError(ctx, err)
+	}
+
+	books, metadata, err := s.app.models.Books.GetAll(ctx, req.Title, genres, filters)
+	if err != nil {
+		return nil, s.app.grpcError(ctx, err)
+	}
+
+	res := &bookspb.ListResponse{
+		Metadata: &bookspb.Metadata{
+			CurrentPage:  int32(metadata.CurrentPage),
+			PageSize:     int32(metadata.PageSize),
+			FirstPage:    int32(metadata.FirstPage),
+			LastPage:     int32(metadata.LastPage),
+			TotalRecords: int32(metadata.TotalRecords),
+		},
+		Books: make([]*bookspb.Book, len(books)),
+	}
+	for i, book := range books {
+		res.Books[i] = bookMessage(book)
+	}
+
+	return res, nil
+}
+
+func (s *bookService) Create(ctx context.Context, req *bookspb.CreateRequest) (*bookspb.Book, error) {
+	book := &data.Book{
+		Title: req.Title,
+		Year:  req.Year,
+		Pages: data.Pages(req.Pages),
+	}
+
+	v := validator.New()
+
+	if len(req.Genres) > 0 {
+		var err error
+		book.Genres, err = s.app.normalizeGenres(ctx, v, req.Genres)
+		if err != nil {
+			return nil, s.app.grpcError(ctx, err)
+		}
+	}
+
+	if data.ValidateBooks(v, book); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	err := s.app.models.Books.Insert(ctx, book)
+	if err != nil {
+		return nil, s.app.grpcError(ctx, err)
+	}
+
+	s.app.bookChanged()
+	return bookMessage(book), nil
+}
+
+func (s *bookService) Update(ctx context.Context, req *bookspb.UpdateRequest) (*bookspb.Book, error) {
+	if req.Id < 1 {
+		return nil, s.app.grpcError(ctx, data.ErrRecordNotFound)
+	}
+
+	book, err := s.app.models.Books.Get(ctx, req.Id)
+	if err != nil {
+		return nil, s.app.grpcError(ctx, err)
+	}
+
+	// Update only goes through if the book is still at the version it was
+	// read at, so passing the version the client read extends that check
+	// back to the client's read.
+	if req.Version != nil {
+		book.Version = *req.Version
+	}
+
+	if req.Title != nil {
+		book.Title = *req.Title
+	}
+	if req.Year != nil {
+		book.Year = *req.Year
+	}
+	if req.Pages != nil {
+		book.Pages = data.Pages(*req.Pages)
+	}
+
+	v := validator.New()
+
+	if req.Genres != nil {
+		book.Genres, err = s.app.normalizeGenres(ctx, v, req.Genres.Names)
+		if err != nil {
+			return nil, s.app.grpcError(ctx, err)
+		}
+	}
+
+	if data.ValidateBooks(v, book); !v.Valid() {
+		return nil, grpcValidationError(v.Errors)
+	}
+
+	err = s.app.models.Books.Update(ctx, book)
+	if err != nil {
+		return nil, s.app.grpcError(ctx, err)
+	}
+
+	s.app.bookChanged()
+	return bookMessage(book), nil
+}
+
+func (s *bookService) Delete(ctx context.Context, req *bookspb.DeleteRequest) (*bookspb.DeleteResponse, error) {
+	if req.Id < 1 {
+		return nil, s.app.grpcError(ctx, data.ErrRecordNotFound)
+	}
+
+	err := s.app.models.Books.Delete(ctx, req.Id)
+	if err != nil {
+		return nil, s.app.grpcError(ctx, err)
+	}
+
+	s.app.bookChanged()
+	return &bookspb.DeleteResponse{}, nil
+}
+
+// Watch sends book changes from the same broadcaster as the HTTP change
+// stream. A watcher that falls too far behind, or is still watching when the
+// server shuts down, gets UNAVAILABLE and should call again with the id of
+// the last change it got.
+func (s *bookService) Watch(req *bookspb.WatchRequest, stream bookspb.BookService_WatchServer) error {
+	ctx := stream.Context()
+	v := validator.New()
+
+	after := int64(-1)
+	if req.AfterId != nil {
+		v.Check(*req.AfterId >= 0, "after_id", "must not be negative")
+		after = *req.AfterId
+	}
+
+	match, err := s.app.matchGenres(ctx, v, req.Genres)
+	if err != nil {
+		return s.app.grpcError(ctx, err)
+	}
+
+	if !v.Valid() {
+		return grpcValidationError(v.Errors)
+	}
+
+	if s.app.stream == nil {
+		return status.Error(codes.Unimplemented, "book changes are not being followed")
+	}
+
+	sub, from := s.app.stream.subscribe(match)
+	if sub == nil {
+		return status.Error(codes.Unavailable, "the server is shutting down, please try again shortly")
+	}
+	defer s.app.stream.unsubscribe(sub)
+
+	send := func(event *changeEvent) error {
+		return stream.Send(changeMessage(event))
+	}
+
+	if after >= 0 && after < from {
+		err = s.app.stream.replay(ctx, sub, after, from, send)
+		if err != nil {
+			return s.app.grpcError(ctx, err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-sub.events:
+			if !ok {
+				return status.Error(codes.Unavailable, "the change stream was closed, resume from the last change received")
+			}
+			if event.id <= after {
+				continue
+			}
+
+			err = send(event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
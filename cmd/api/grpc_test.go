@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"github.com/Bug-daulet/FinalSPA/internal/bookspb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+	"time"
+)
+
+// newGRPCClient serves app's gRPC API over an in-memory connection.
+func newGRPCClient(t *testing.T, app *application) bookspb.BookServiceClient {
+	listener := bufconn.Listen(1 << 20)
+
+	srv := app.grpcServer()
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return bookspb.NewBookServiceClient(conn)
+}
+
+func TestGRPCBooks(t *testing.T) {
+	app := newTestApplication(t)
+	client := newGRPCClient(t, app)
+	ctx := context.Background()
+
+	created, err := client.Create(ctx, &bookspb.CreateRequest{Title: "Dune", Year: 1965, Pages: 412, Genres: []string{"Sci-Fi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == 0 || created.Version != 1 || created.CreatedAt.AsTime().IsZero() {
+		t.Errorf("got %v; want a created book", created)
+	}
+
+	got, err := client.Get(ctx, &bookspb.GetRequest{Id: created.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Dune" || got.Pages != 412 {
+		t.Errorf("got %v; want Dune", got)
+	}
+
+	if _, err := client.Create(ctx, &bookspb.CreateRequest{Title: "Emma", Year: 1900, Pages: 474, Genres: []string{"fiction"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := client.List(ctx, &bookspb.ListRequest{Sort: "-title", PageSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Metadata.TotalRecords != 2 || list.Metadata.LastPage != 2 || len(list.Books) != 1 || list.Books[0].Title != "Emma" {
+		t.Errorf("got %v; want Emma first of 2", list)
+	}
+
+	title, version := "Dune Messiah", created.Version
+	updated, err := client.Update(ctx, &bookspb.UpdateRequest{Id: created.Id, Title: &title, Version: &version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Title != title || updated.Version != version+1 || updated.Year != 1965 {
+		t.Errorf("got %v; want only the title changed", updated)
+	}
+
+	// The book has moved on from the version this update was based on.
+	_, err = client.Update(ctx, &bookspb.UpdateRequest{Id: created.Id, Title: &title, Version: &version})
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("got %v for a stale version; want %s", err, codes.Aborted)
+	}
+
+	if _, err := client.Delete(ctx, &bookspb.DeleteRequest{Id: created.Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, call := range map[string]func() error{
+		"Get":    func() error { _, err := client.Get(ctx, &bookspb.GetRequest{Id: created.Id}); return err },
+		"Update": func() error { _, err := client.Update(ctx, &bookspb.UpdateRequest{Id: created.Id}); return err },
+		"Delete": func() error { _, err := client.Delete(ctx, &bookspb.DeleteRequest{Id: created.Id}); return err },
+	} {
+		if code := status.Code(call()); code != codes.NotFound {
+			t.Errorf("%s of a deleted book: got %s; want %s", name, code, codes.NotFound)
+		}
+	}
+}
+
+func TestGRPCValidation(t *testing.T) {
+	app := newTestApplication(t)
+	client := newGRPCClient(t, app)
+
+	_, err := client.Create(context.Background(), &bookspb.CreateRequest{Year: 3000, Genres: []string{"nope"}})
+
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("got %v; want %s", err, codes.InvalidArgument)
+	}
+
+	violations := map[string]bool{}
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.FieldViolations {
+				violations[violation.Field] = true
+			}
+		}
+	}
+	for _, field := range []string{"title", "year", "pages", "genres"} {
+		if !violations[field] {
+			t.Errorf("got violations %v; want one for %q", violations, field)
+		}
+	}
+
+	_, err = client.List(context.Background(), &bookspb.ListRequest{Sort: "author"})
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Errorf("got %v for an unknown sort; want %s", err, codes.InvalidArgument)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	app := newStreamingApplication(t, time.Hour)
+	client := newGRPCClient(t, app)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dune, err := client.Create(ctx, &bookspb.CreateRequest{Title: "Dune", Year: 1965, Pages: 412, Genres: []string{"Sci-Fi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replays the change made before watching, then follows new ones,
+	// leaving out Emma, which isn't science fiction.
+	after := int64(0)
+	watch, err := client.Watch(ctx, &bookspb.WatchRequest{Genres: []string{"sci-fi"}, AfterId: &after})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Create(ctx, &bookspb.CreateRequest{Title: "Emma", Year: 1900, Pages: 474, Genres: []string{"fiction"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []bookspb.BookChange_Op{bookspb.BookChange_OP_CREATED, bookspb.BookChange_OP_DELETED} {
+		change, err := watch.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change.Op != op || change.Book.Id != dune.Id {
+			t.Errorf("got change %v; want %s of book %d", change, op, dune.Id)
+		}
+
+		// Dune is deleted only once its creation has been seen, since a
+		// change to a book deleted by the time it's sent is left out.
+		if op == bookspb.BookChange_OP_CREATED {
+			if _, err := client.Delete(ctx, &bookspb.DeleteRequest{Id: dune.Id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	app.stream.close()
+
+	if _, err := watch.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v once the stream closed; want %s", err, codes.Unavailable)
+	}
+}
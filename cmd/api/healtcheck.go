@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/Bug-daulet/FinalSPA/internal/data"
 	"net/http"
 )
 
@@ -14,7 +15,11 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		},
 	}
 
-	err := app.writeJSON(w, http.StatusOK, env, nil)
+	if cache, ok := app.models.Books.(*data.CachedBookStore); ok {
+		env["cache"] = cache.Stats()
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
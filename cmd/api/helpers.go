@@ -1,26 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Bug-daulet/FinalSPA/internal/validator"
 	"github.com/julienschmidt/httprouter"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type envelope map[string]interface{}
 
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readNamedIDParam(r, "id")
+}
+
+// readNamedIDParam reads an id from the named route parameter, for routes
+// that carry more than one.
+func (app *application) readNamedIDParam(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
 
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 
 	return id, nil
@@ -28,13 +37,11 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 
-	js, err := json.MarshalIndent(data, "", "\t")
+	js, err := marshalJSON(data, app.config.compactJSON)
 	if err != nil {
 		return err
 	}
 
-	js = append(js, '\n')
-
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
@@ -46,11 +53,57 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
+func marshalJSON(data envelope, compact bool) ([]byte, error) {
+	var js []byte
+	var err error
+
+	if compact {
+		js, err = json.Marshal(data)
+	} else {
+		js, err = json.MarshalIndent(data, "", "\t")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return append(js, '\n'), nil
+}
+
+// compact reports whether the response should leave out indentation, which
+// the client can ask for with ?compact=true whatever the server default.
+func (app *application) compact(r *http.Request) bool {
+	compact, err := strconv.ParseBool(r.URL.Query().Get("compact"))
+	if err != nil {
+		return app.config.compactJSON
+	}
+	return compact
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	maxBytes := 1_048_576
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
-	dec := json.NewDecoder(r.Body)
+	var body io.Reader = r.Body
+
+	// Bodies are JSON unless they say otherwise; clients such as curl label
+	// JSON as a form by default, so other content types are read as JSON too.
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType = canonicalMediaType(mediaType); mediaType {
+	case mediaXML, mediaMsgpack:
+		js, err := requestBodyToJSON(mediaType, r.Body, dst)
+		switch {
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+		case err != nil && err.Error() == "http: request body too large":
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		case err != nil:
+			return err
+		}
+		body = bytes.NewReader(js)
+	}
+
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 
 	err := dec.Decode(dst)
@@ -98,6 +151,51 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// notModified sets the caching headers for a response last changed at
+// lastModified and identified by etag, and answers 304 Not Modified if the
+// request's conditional headers show that the client's copy is current. The
+// caller must not write anything further when it returns true.
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, lastModified time.Time, etag string) bool {
+	lastModified = lastModified.UTC().Truncate(time.Second)
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	// If-None-Match takes precedence, since the ETag also changes on edits
+	// made within the second Last-Modified can't tell apart.
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				writeNotModified(w)
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.IsZero() || lastModified.After(since) {
+		return false
+	}
+
+	writeNotModified(w)
+	return true
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	// A 304 carries the Vary header the full response would have had.
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(http.StatusNotModified)
+}
+
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
 	s := qs.Get(key)
 
@@ -133,3 +231,37 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 
 	return i
 }
+
+func (app *application) readFloat(qs url.Values, key string, defaultValue float64, v *validator.Validator) float64 {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		v.AddError(key, "must be a number")
+		return defaultValue
+	}
+
+	return f
+}
+
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return time.Time{}
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+
+	v.AddError(key, "must be a date (YYYY-MM-DD) or an RFC 3339 timestamp")
+	return time.Time{}
+}
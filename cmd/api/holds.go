@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/notify"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"log"
+	"net/http"
+	"time"
+)
+
+// holdMonitor expires the ready holds that weren't collected in time and
+// tells members when their holds become ready. It checks when woken by
+// notify, which bookChanged calls after copies move, and otherwise every
+// interval.
+type holdMonitor struct {
+	holds    data.HoldStore
+	notifier notify.Notifier
+	logger   *log.Logger
+	// expired is called after holds expire, since their copies moved on.
+	expired func()
+	wake    chan struct{}
+}
+
+func newHoldMonitor(holds data.HoldStore, notifier notify.Notifier, logger *log.Logger, expired func()) *holdMonitor {
+	return &holdMonitor{
+		holds:    holds,
+		notifier: notifier,
+		logger:   logger,
+		expired:  expired,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (m *holdMonitor) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run checks the holds every interval, or sooner when woken, until ctx is
+// cancelled.
+func (m *holdMonitor) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := m.check(ctx)
+		if err != nil && ctx.Err() == nil {
+			m.logger.Printf("holds: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// check expires the holds that are due and notifies the members of holds
+// that became ready. A hold is only recorded as notified once the notifier
+// has taken it, so one that fails is tried again on the next check.
+func (m *holdMonitor) check(ctx context.Context) error {
+	expired, err := m.holds.Expire(ctx)
+	if len(expired) > 0 {
+		m.logger.Printf("holds: %d expired uncollected", len(expired))
+		if m.expired != nil {
+			m.expired()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("expiring: %w", err)
+	}
+
+	ready, err := m.holds.Unnotified(ctx)
+	if err != nil {
+		return fmt.Errorf("reading ready holds: %w", err)
+	}
+
+	for _, hold := range ready {
+		if m.notifier != nil {
+			err := m.notifier.HoldReady(ctx, hold)
+			if err != nil {
+				return fmt.Errorf("notifying hold %d: %w", hold.ID, err)
+			}
+		}
+
+		err := m.holds.MarkNotified(ctx, hold.ID)
+		if err != nil {
+			return fmt.Errorf("recording hold %d notified: %w", hold.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// placeHoldHandler queues the user for a book that has no copy to lend.
+func (app *application) placeHoldHandler(w http.ResponseWriter, r *http.Request) {
+
+	bookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	hold := &data.Hold{
+		UserID:       user.ID,
+		Member:       user.Name,
+		Email:        user.Email,
+		BookID:       bookID,
+		PickupPeriod: app.config.holds.pickupPeriod,
+	}
+
+	err = app.models.Holds.Insert(r.Context(), hold)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrBookAvailable):
+			app.bookAvailableResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateHold):
+			v := validator.New()
+			v.AddError("book_id", "you already have a hold on this book")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/holds/%d", hold.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"hold": hold}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listBookHoldsHandler shows the book's queue, the ready holds and then the
+// waiting ones, in the order they were placed.
+func (app *application) listBookHoldsHandler(w http.ResponseWriter, r *http.Request) {
+
+	bookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	filters := app.readListFilters(r.URL.Query(), []string{"id"}, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Books.Get(r.Context(), bookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	holds, metadata, err := app.models.Holds.GetAll(r.Context(), 0, bookID, data.HoldOpen, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"metadata": metadata, "holds": holds}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listMyHoldsHandler(w http.ResponseWriter, r *http.Request) {
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", "")
+	filters := app.readListFilters(qs, data.HoldSortSafelist, v)
+
+	v.Check(status == "" || validator.In(status, data.HoldStatuses...), "status", "must be one of open, waiting, ready, collected, cancelled or expired")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	holds, metadata, err := app.models.Holds.GetAll(r.Context(), app.contextGetUser(r).ID, 0, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"metadata": metadata, "holds": holds}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showHoldHandler(w http.ResponseWriter, r *http.Request) {
+
+	hold, ok := app.readHold(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"hold": hold}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// cancelHoldHandler takes the user out of the queue. A copy set aside for
+// them goes to the next hold in line.
+func (app *application) cancelHoldHandler(w http.ResponseWriter, r *http.Request) {
+
+	hold, ok := app.readHold(w, r)
+	if !ok {
+		return
+	}
+
+	if hold.Status != data.HoldWaiting && hold.Status != data.HoldReady {
+		app.holdClosedResponse(w, r)
+		return
+	}
+
+	ready := hold.Status == data.HoldReady
+
+	err := app.models.Holds.Cancel(r.Context(), hold)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if ready {
+		app.bookChanged()
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"hold": hold}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readHold loads the authenticated user's hold named by the id parameter,
+// sending the error response itself if it can't. Other users' holds are
+// reported as missing.
+func (app *application) readHold(w http.ResponseWriter, r *http.Request) (*data.Hold, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	hold, err := app.models.Holds.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if hold.UserID != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return hold, true
+}
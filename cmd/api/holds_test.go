@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type holdEnvelope struct {
+	Hold data.Hold `json:"hold"`
+}
+
+type holdsEnvelope struct {
+	Holds []data.Hold `json:"holds"`
+}
+
+// recordingNotifier remembers the holds it has been told are ready.
+type recordingNotifier struct {
+	mu    sync.Mutex
+	holds []*data.Hold
+}
+
+func (n *recordingNotifier) HoldReady(ctx context.Context, hold *data.Hold) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.holds = append(n.holds, hold)
+	return nil
+}
+
+func (n *recordingNotifier) take() []*data.Hold {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	holds := n.holds
+	n.holds = nil
+	return holds
+}
+
+// placeHold queues the user the headers authenticate for the book and
+// returns the hold.
+func (ts *testServer) placeHold(t *testing.T, headers http.Header, bookID int64) data.Hold {
+	t.Helper()
+
+	rs := ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/books/%d/holds", bookID), "", headers)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("placing hold: got status %d; body %s", rs.status, rs.body)
+	}
+
+	var env holdEnvelope
+	rs.decode(t, &env)
+	return env.Hold
+}
+
+func (ts *testServer) getHold(t *testing.T, headers http.Header, id int64) data.Hold {
+	t.Helper()
+
+	rs := ts.doWithHeaders(t, http.MethodGet, fmt.Sprintf("/v1/holds/%d", id), "", headers)
+	if rs.status != http.StatusOK {
+		t.Fatalf("getting hold: got status %d; body %s", rs.status, rs.body)
+	}
+
+	var env holdEnvelope
+	rs.decode(t, &env)
+	return env.Hold
+}
+
+func (ts *testServer) bookAvailable(t *testing.T, bookID int64) bool {
+	t.Helper()
+
+	var env struct {
+		Book data.Book `json:"books"`
+	}
+	ts.do(t, http.MethodGet, fmt.Sprintf("/v1/books/%d", bookID), "").decode(t, &env)
+	return env.Book.Available
+}
+
+func TestHolds(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	notifier := &recordingNotifier{}
+	monitor := newHoldMonitor(app.models.Holds, notifier, log.New(io.Discard, "", 0), nil)
+	ctx := context.Background()
+
+	dune := ts.createBook(t, duneJSON)
+	if ts.bookAvailable(t, dune) {
+		t.Errorf("got a book with no copies available")
+	}
+
+	ts.createCopy(t, dune, "DUNE-1")
+	if !ts.bookAvailable(t, dune) {
+		t.Errorf("got a book with a copy on the shelf unavailable")
+	}
+
+	alice := ts.authenticate(t, "alice@example.com")
+	bob := ts.authenticate(t, "bob@example.com")
+	carol := ts.authenticate(t, "carol@example.com")
+
+	holdsPath := fmt.Sprintf("/v1/books/%d/holds", dune)
+
+	rs := ts.do(t, http.MethodPost, holdsPath, "")
+	if rs.status != http.StatusUnauthorized {
+		t.Errorf("got status %d holding anonymously; want %d", rs.status, http.StatusUnauthorized)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, holdsPath, "", bob)
+	if rs.status != http.StatusConflict {
+		t.Errorf("got status %d holding an available book; want %d", rs.status, http.StatusConflict)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, "/v1/books/99/holds", "", bob)
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d holding a missing book; want %d", rs.status, http.StatusNotFound)
+	}
+
+	loan := ts.checkout(t, alice, dune)
+	if ts.bookAvailable(t, dune) {
+		t.Errorf("got a book with its only copy on loan available")
+	}
+
+	bobs := ts.placeHold(t, bob, dune)
+	if bobs.Status != data.HoldWaiting || bobs.Position != 1 || bobs.Title != "Dune" {
+		t.Errorf("got hold %+v; want the first waiting hold on Dune", bobs)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, holdsPath, "", bob)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d holding a book twice; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+
+	carols := ts.placeHold(t, carol, dune)
+	if carols.Position != 2 {
+		t.Errorf("got position %d for the second hold; want 2", carols.Position)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, fmt.Sprintf("/v1/holds/%d", bobs.ID), "", carol)
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d reading another user's hold; want %d", rs.status, http.StatusNotFound)
+	}
+
+	var queue holdsEnvelope
+	ts.doWithHeaders(t, http.MethodGet, holdsPath, "", alice).decode(t, &queue)
+	if len(queue.Holds) != 2 || queue.Holds[0].ID != bobs.ID || queue.Holds[1].ID != carols.ID {
+		t.Errorf("got queue %+v; want bob's hold then carol's", queue.Holds)
+	}
+
+	loanPath := fmt.Sprintf("/v1/loans/%d", loan.ID)
+
+	rs = ts.doWithHeaders(t, http.MethodPost, loanPath+"/renew", "", alice)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d renewing a book others are waiting for; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, loanPath+"/return", "", alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d returning; body %s", rs.status, rs.body)
+	}
+
+	bobs = ts.getHold(t, bob, bobs.ID)
+	if bobs.Status != data.HoldReady || bobs.Barcode != "DUNE-1" || bobs.ExpiresAt == nil || bobs.Position != 0 {
+		t.Errorf("got hold %+v; want it ready with DUNE-1", bobs)
+	}
+	if carols = ts.getHold(t, carol, carols.ID); carols.Position != 1 {
+		t.Errorf("got position %d for carol's hold; want 1 once bob's is ready", carols.Position)
+	}
+	if ts.bookAvailable(t, dune) {
+		t.Errorf("got a book with its only copy set aside available")
+	}
+
+	err := monitor.check(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := notifier.take(); len(sent) != 1 || sent[0].ID != bobs.ID || sent[0].Email != "bob@example.com" {
+		t.Errorf("got notifications %+v; want one for bob's hold", sent)
+	}
+
+	err = monitor.check(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := notifier.take(); len(sent) != 0 {
+		t.Errorf("got %d notifications on the second check; want none", len(sent))
+	}
+
+	// The copy set aside for bob is neither for others to borrow nor for the
+	// catalogue to change.
+	rs = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/books/%d/checkout", dune), "", carol)
+	if rs.status != http.StatusConflict {
+		t.Errorf("got status %d borrowing a copy held for another user; want %d", rs.status, http.StatusConflict)
+	}
+
+	rs = ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/books/%d/copies/%d", dune, *bobs.CopyID), `{"status": "lost"}`)
+	if rs.status != http.StatusConflict {
+		t.Errorf("got status %d changing a held copy's status; want %d", rs.status, http.StatusConflict)
+	}
+
+	rs = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/books/%d/copies/%d", dune, *bobs.CopyID), "")
+	if rs.status != http.StatusConflict {
+		t.Errorf("got status %d deleting a held copy; want %d", rs.status, http.StatusConflict)
+	}
+
+	// Cancelling a ready hold passes the copy on to the next in line.
+	rs = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/holds/%d/cancel", bobs.ID), "", bob)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d cancelling; body %s", rs.status, rs.body)
+	}
+
+	var cancelled holdEnvelope
+	rs.decode(t, &cancelled)
+	if cancelled.Hold.Status != data.HoldCancelled {
+		t.Errorf("got hold %+v; want it cancelled", cancelled.Hold)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/holds/%d/cancel", bobs.ID), "", bob)
+	if rs.status != http.StatusConflict {
+		t.Errorf("got status %d cancelling twice; want %d", rs.status, http.StatusConflict)
+	}
+
+	if carols = ts.getHold(t, carol, carols.ID); carols.Status != data.HoldReady {
+		t.Errorf("got hold %+v; want carol's ready once bob's is cancelled", carols)
+	}
+
+	borrowed := ts.checkout(t, carol, dune)
+	if borrowed.Barcode != "DUNE-1" {
+		t.Errorf("got loan of %s; want the copy held for carol", borrowed.Barcode)
+	}
+	if carols = ts.getHold(t, carol, carols.ID); carols.Status != data.HoldCollected {
+		t.Errorf("got hold %+v; want it collected by checking out", carols)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 1},
+		{"?status=open", 0},
+		{"?status=collected", 1},
+		{"?status=ready", 0},
+	}
+
+	for _, tt := range tests {
+		rs := ts.doWithHeaders(t, http.MethodGet, "/v1/me/holds"+tt.query, "", carol)
+		if rs.status != http.StatusOK {
+			t.Fatalf("%s: got status %d; body %s", tt.query, rs.status, rs.body)
+		}
+
+		var list holdsEnvelope
+		rs.decode(t, &list)
+		if len(list.Holds) != tt.want {
+			t.Errorf("%s: got %d of carol's holds; want %d", tt.query, len(list.Holds), tt.want)
+		}
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, "/v1/me/holds?status=lost", "", carol)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an unknown status; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestHoldExpiry(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.holds.pickupPeriod = time.Second
+	ts := newTestServer(t, app.routes())
+
+	changed := 0
+	monitor := newHoldMonitor(app.models.Holds, nil, log.New(io.Discard, "", 0), func() { changed++ })
+	ctx := context.Background()
+
+	dune := ts.createBook(t, duneJSON)
+	ts.createCopy(t, dune, "DUNE-1")
+
+	alice := ts.authenticate(t, "alice@example.com")
+	bob := ts.authenticate(t, "bob@example.com")
+	carol := ts.authenticate(t, "carol@example.com")
+
+	loan := ts.checkout(t, alice, dune)
+	bobs := ts.placeHold(t, bob, dune)
+	carols := ts.placeHold(t, carol, dune)
+
+	rs := ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/loans/%d/return", loan.ID), "", alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d returning; body %s", rs.status, rs.body)
+	}
+
+	err := monitor.check(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 0 {
+		t.Errorf("got holds expired before their pickup period ended")
+	}
+
+	// Hold times may be stored to the second, so rather than sleep for the
+	// longest the hold could take to expire, check until it does.
+	deadline := time.Now().Add(3 * time.Second)
+	for changed == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+
+		err = monitor.check(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if changed != 1 {
+		t.Errorf("got %d calls after holds expired; want 1", changed)
+	}
+
+	if bobs = ts.getHold(t, bob, bobs.ID); bobs.Status != data.HoldExpired {
+		t.Errorf("got hold %+v; want it expired", bobs)
+	}
+	if carols = ts.getHold(t, carol, carols.ID); carols.Status != data.HoldReady || carols.Barcode != "DUNE-1" {
+		t.Errorf("got hold %+v; want the copy passed on to carol", carols)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/holds/%d/cancel", carols.ID), "", carol)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d cancelling; body %s", rs.status, rs.body)
+	}
+	if !ts.bookAvailable(t, dune) {
+		t.Errorf("got the book unavailable with its copy back on the shelf")
+	}
+}
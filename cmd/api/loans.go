@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"net/http"
+	"time"
+)
+
+func (app *application) checkoutBookHandler(w http.ResponseWriter, r *http.Request) {
+
+	bookID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	loan := &data.Loan{
+		UserID:   user.ID,
+		Borrower: user.Name,
+		BookID:   bookID,
+		DueAt:    time.Now().Add(app.config.loans.period).Truncate(time.Second),
+	}
+
+	err = app.models.Loans.Checkout(r.Context(), loan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrBookUnavailable):
+			app.bookUnavailableResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.bookChanged()
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/loans/%d", loan.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"loan": loan}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showLoanHandler(w http.ResponseWriter, r *http.Request) {
+
+	loan, ok := app.readLoan(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"loan": loan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) returnLoanHandler(w http.ResponseWriter, r *http.Request) {
+
+	loan, ok := app.readLoan(w, r)
+	if !ok {
+		return
+	}
+
+	if loan.ReturnedAt != nil {
+		app.loanClosedResponse(w, r)
+		return
+	}
+
+	now := time.Now().Truncate(time.Second)
+	loan.ReturnedAt = &now
+
+	app.updateLoan(w, r, loan)
+}
+
+// renewLoanHandler lends the book for another loan period from now, as long
+// as the loan isn't overdue, has renewals left and nobody is waiting for the
+// book.
+func (app *application) renewLoanHandler(w http.ResponseWriter, r *http.Request) {
+
+	loan, ok := app.readLoan(w, r)
+	if !ok {
+		return
+	}
+
+	if loan.ReturnedAt != nil {
+		app.loanClosedResponse(w, r)
+		return
+	}
+
+	waiting, err := app.models.Holds.CountWaiting(r.Context(), loan.BookID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	now := time.Now()
+
+	v := validator.New()
+
+	v.Check(!loan.Overdue(now), "loan", "is overdue and can't be renewed, please return the book")
+	v.Check(int(loan.Renewals) < app.config.loans.maxRenewals, "loan", fmt.Sprintf("has already been renewed the most times allowed (%d)", app.config.loans.maxRenewals))
+	v.Check(waiting == 0, "loan", "can't be renewed while other members are waiting for the book")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	loan.DueAt = now.Add(app.config.loans.period).Truncate(time.Second)
+	loan.Renewals++
+
+	app.updateLoan(w, r, loan)
+}
+
+func (app *application) updateLoan(w http.ResponseWriter, r *http.Request, loan *data.Loan) {
+	err := app.models.Loans.Update(r.Context(), loan)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if loan.ReturnedAt != nil {
+		app.bookChanged()
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"loan": loan}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listMyLoansHandler(w http.ResponseWriter, r *http.Request) {
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", "")
+	filters := app.readListFilters(qs, data.LoanSortSafelist, v)
+
+	v.Check(status == "" || validator.In(status, data.LoanStatuses...), "status", "must be one of active, overdue or returned")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	loans, metadata, err := app.models.Loans.GetAll(r.Context(), app.contextGetUser(r).ID, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"metadata": metadata, "loans": loans}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// overdueLoansHandler reports every user's overdue loans, longest overdue
+// first unless another sort is asked for. It is for staff with the
+// loans:report permission, since it names the borrowers.
+func (app *application) overdueLoansHandler(w http.ResponseWriter, r *http.Request) {
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := app.readListFilters(qs, data.LoanSortSafelist, v)
+	filters.Sort = app.readString(qs, "sort", "due_at")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	loans, metadata, err := app.models.Loans.GetAll(r.Context(), 0, data.LoanOverdue, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"metadata": metadata, "loans": loans}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readLoan loads the authenticated user's loan named by the id parameter,
+// sending the error response itself if it can't. Other users' loans are
+// reported as missing.
+func (app *application) readLoan(w http.ResponseWriter, r *http.Request) (*data.Loan, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	loan, err := app.models.Loans.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if loan.UserID != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return loan, true
+}
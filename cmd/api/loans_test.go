@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+type loanEnvelope struct {
+	Loan data.Loan `json:"loan"`
+}
+
+// checkout borrows the book as the user the headers authenticate and returns
+// the loan.
+func (ts *testServer) checkout(t *testing.T, headers http.Header, bookID int64) data.Loan {
+	t.Helper()
+
+	rs := ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/books/%d/checkout", bookID), "", headers)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("checking out: got status %d; body %s", rs.status, rs.body)
+	}
+
+	var env loanEnvelope
+	rs.decode(t, &env)
+	return env.Loan
+}
+
+func TestLoans(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	ts.createCopy(t, dune, "DUNE-1")
+
+	alice := ts.authenticate(t, "alice@example.com")
+	bob := ts.authenticate(t, "bob@example.com")
+
+	checkoutPath := fmt.Sprintf("/v1/books/%d/checkout", dune)
+
+	rs := ts.do(t, http.MethodPost, checkoutPath, "")
+	if rs.status != http.StatusUnauthorized {
+		t.Errorf("got status %d checking out anonymously; want %d", rs.status, http.StatusUnauthorized)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, "/v1/books/99/checkout", "", alice)
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d checking out a missing book; want %d", rs.status, http.StatusNotFound)
+	}
+
+	before := time.Now()
+	loan := ts.checkout(t, alice, dune)
+	if loan.Title != "Dune" || loan.Barcode != "DUNE-1" || loan.Borrower != "Test User" || loan.ReturnedAt != nil {
+		t.Errorf("got loan %+v; want an open loan of Dune", loan)
+	}
+	if due := loan.DueAt.Sub(before); due < app.config.loans.period-time.Second || due > app.config.loans.period+time.Second {
+		t.Errorf("got due date %v; want one loan period from now", loan.DueAt)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, checkoutPath, "", bob)
+	if rs.status != http.StatusConflict {
+		t.Errorf("got status %d borrowing a book with no copy left; want %d", rs.status, http.StatusConflict)
+	}
+
+	loanPath := fmt.Sprintf("/v1/loans/%d", loan.ID)
+
+	// Another user's loan is as good as missing.
+	for _, path := range []string{loanPath, loanPath + "/return", loanPath + "/renew"} {
+		method := http.MethodPost
+		if path == loanPath {
+			method = http.MethodGet
+		}
+		rs := ts.doWithHeaders(t, method, path, "", bob)
+		if rs.status != http.StatusNotFound {
+			t.Errorf("%s %s as another user: got status %d; want %d", method, path, rs.status, http.StatusNotFound)
+		}
+	}
+
+	for i := 1; i <= app.config.loans.maxRenewals; i++ {
+		rs = ts.doWithHeaders(t, http.MethodPost, loanPath+"/renew", "", alice)
+		if rs.status != http.StatusOK {
+			t.Fatalf("renewal %d: got status %d; body %s", i, rs.status, rs.body)
+		}
+
+		var renewed loanEnvelope
+		rs.decode(t, &renewed)
+		if renewed.Loan.Renewals != int32(i) || renewed.Loan.DueAt.Before(loan.DueAt) {
+			t.Errorf("renewal %d: got loan %+v", i, renewed.Loan)
+		}
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, loanPath+"/renew", "", alice)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d renewing too often; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, loanPath+"/return", "", alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d returning; body %s", rs.status, rs.body)
+	}
+
+	var returned loanEnvelope
+	rs.decode(t, &returned)
+	if returned.Loan.ReturnedAt == nil {
+		t.Errorf("got loan %+v; want it returned", returned.Loan)
+	}
+
+	for _, action := range []string{"/return", "/renew"} {
+		rs := ts.doWithHeaders(t, http.MethodPost, loanPath+action, "", alice)
+		if rs.status != http.StatusConflict {
+			t.Errorf("%s of a returned loan: got status %d; want %d", action, rs.status, http.StatusConflict)
+		}
+	}
+
+	ts.checkout(t, bob, dune)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 1},
+		{"?status=returned", 1},
+		{"?status=active", 0},
+		{"?status=overdue", 0},
+	}
+
+	for _, tt := range tests {
+		rs := ts.doWithHeaders(t, http.MethodGet, "/v1/me/loans"+tt.query, "", alice)
+		if rs.status != http.StatusOK {
+			t.Fatalf("%s: got status %d; body %s", tt.query, rs.status, rs.body)
+		}
+
+		var list struct {
+			Loans []data.Loan `json:"loans"`
+		}
+		rs.decode(t, &list)
+		if len(list.Loans) != tt.want {
+			t.Errorf("%s: got %d of alice's loans; want %d", tt.query, len(list.Loans), tt.want)
+		}
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, "/v1/me/loans?status=lost", "", alice)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an unknown status; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestOverdueLoans(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	emma := ts.createBook(t, `{"title": "Emma", "year": 1900, "pages": "474 pages", "genres": ["fiction"]}`)
+	ulysses := ts.createBook(t, `{"title": "Ulysses", "year": 1922, "pages": "730 pages", "genres": ["fiction"]}`)
+
+	for i, book := range []int64{dune, emma, ulysses} {
+		ts.createCopy(t, book, fmt.Sprintf("C%d", i))
+	}
+
+	alice := ts.authenticate(t, "alice@example.com")
+
+	current := ts.checkout(t, alice, ulysses)
+
+	// Loans that fell due in the past can only be made through the store.
+	for _, loan := range []*data.Loan{
+		{BookID: dune, DueAt: time.Now().Add(-24 * time.Hour)},
+		{BookID: emma, DueAt: time.Now().Add(-48 * time.Hour)},
+	} {
+		loan.UserID = current.UserID
+		err := app.models.Loans.Checkout(context.Background(), loan)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs := ts.do(t, http.MethodGet, "/v1/reports/overdue-loans", "")
+	if rs.status != http.StatusUnauthorized {
+		t.Errorf("got status %d anonymously; want %d", rs.status, http.StatusUnauthorized)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, "/v1/reports/overdue-loans", "", alice)
+	if rs.status != http.StatusForbidden {
+		t.Errorf("got status %d as a member; want %d", rs.status, http.StatusForbidden)
+	}
+
+	staff := ts.authenticate(t, "staff@example.com")
+	app.grant(t, "staff@example.com", data.PermissionLoansReport)
+
+	rs = ts.doWithHeaders(t, http.MethodGet, "/v1/reports/overdue-loans", "", staff)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	var report struct {
+		Metadata data.Metadata `json:"metadata"`
+		Loans    []data.Loan   `json:"loans"`
+	}
+	rs.decode(t, &report)
+	if report.Metadata.TotalRecords != 2 || len(report.Loans) != 2 || report.Loans[0].Title != "Emma" || report.Loans[1].Title != "Dune" {
+		t.Errorf("got %+v; want Emma then Dune, the longest overdue first", report)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, "/v1/me/loans?status=overdue", "", alice)
+	var mine struct {
+		Loans []data.Loan `json:"loans"`
+	}
+	rs.decode(t, &mine)
+	if len(mine.Loans) != 2 {
+		t.Errorf("got %d overdue loans; want 2", len(mine.Loans))
+	}
+
+	overdue := fmt.Sprintf("/v1/loans/%d/renew", mine.Loans[0].ID)
+	rs = ts.doWithHeaders(t, http.MethodPost, overdue, "", alice)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d renewing an overdue loan; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+}
+
+// TestConcurrentCheckout has more borrowers than copies ask for a book at
+// once. Each copy must go to exactly one of them.
+func TestConcurrentCheckout(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	ts.createCopy(t, dune, "DUNE-1")
+	ts.createCopy(t, dune, "DUNE-2")
+
+	const borrowers = 8
+
+	headers := make([]http.Header, borrowers)
+	for i := range headers {
+		headers[i] = ts.authenticate(t, fmt.Sprintf("user%d@example.com", i))
+	}
+
+	var wg sync.WaitGroup
+	statuses := make([]int, borrowers)
+
+	for i := range headers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/books/%d/checkout", dune), "", headers[i]).status
+		}(i)
+	}
+	wg.Wait()
+
+	counts := make(map[int]int)
+	for _, status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusCreated] != 2 || counts[http.StatusConflict] != borrowers-2 {
+		t.Errorf("got statuses %v; want two checkouts and the rest refused", counts)
+	}
+
+	var env struct {
+		Metadata data.Metadata `json:"metadata"`
+	}
+	ts.do(t, http.MethodGet, fmt.Sprintf("/v1/books/%d/copies?status=on-loan", dune), "").decode(t, &env)
+	if env.Metadata.TotalRecords != 2 {
+		t.Errorf("got %d copies on loan; want 2", env.Metadata.TotalRecords)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// encodings lists the content codings compress can produce, in the order it
+// prefers them when the client rates several equally.
+var encodings = []string{"br", "zstd", "gzip"}
+
+var encoderPools = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	}},
+	"zstd": {New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// compress encodes response bodies of at least cfg.compression.minSize bytes
+// with the best coding the client accepts. Smaller bodies go out as they are,
+// since compressing them saves little and costs a round of CPU.
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.compression.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			minSize:        app.config.compression.minSize,
+		}
+		defer func() {
+			err := cw.Close()
+			if err != nil {
+				app.logError(r, err)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks a coding from an Accept-Encoding header, returning
+// "" when the body should be sent unencoded.
+func negotiateEncoding(header string) string {
+	weights := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		weights[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := weights[encoding]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter holds back the start of a body until it knows whether the
+// body reaches minSize. A Flush from a streaming handler commits to
+// compression straight away, so that every flushed chunk reaches the client.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status      int
+	wroteHeader bool
+	buf         []byte
+	enc         encoder
+	passthrough bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+
+	// Bodiless responses, bodies the handler has already encoded and event
+	// streams, whose events must not wait on the encoder, are passed straight
+	// through.
+	h := cw.Header()
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified || h.Get("Content-Encoding") != "" ||
+		strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		cw.passthrough = true
+		cw.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	switch {
+	case cw.passthrough:
+		return cw.ResponseWriter.Write(b)
+	case cw.enc != nil:
+		return cw.enc.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.startEncoding(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+func (cw *compressWriter) startEncoding() error {
+	h := cw.Header()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	cw.enc = encoderPools[cw.encoding].Get().(encoder)
+	cw.enc.Reset(cw.ResponseWriter)
+
+	_, err := cw.enc.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.passthrough {
+		if cw.enc == nil {
+			if err := cw.startEncoding(); err != nil {
+				return
+			}
+		}
+		if err := cw.enc.Flush(); err != nil {
+			return
+		}
+	}
+
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the body: a short one is written out unencoded, a long one
+// has its encoder closed, which writes the end of the stream. Only an encoder
+// that closed cleanly goes back to the pool, detached from the response; one
+// that failed part way through a stream is left for the garbage collector.
+func (cw *compressWriter) Close() error {
+	switch {
+	case !cw.wroteHeader || cw.passthrough:
+		return nil
+	case cw.enc == nil:
+		cw.ResponseWriter.WriteHeader(cw.status)
+		_, err := cw.ResponseWriter.Write(cw.buf)
+		return err
+	}
+
+	enc := cw.enc
+	cw.enc = nil
+
+	err := enc.Close()
+	if err != nil {
+		return err
+	}
+
+	enc.Reset(io.Discard)
+	encoderPools[cw.encoding].Put(enc)
+	return nil
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// authenticate identifies the user by the bearer token in the Authorization
+// header. A request without one goes on as the anonymous user, while one with
+// a token that is malformed, unknown or expired is turned away.
+func (app *application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		authorizationHeader := r.Header.Get("Authorization")
+
+		if authorizationHeader == "" {
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		token := headerParts[1]
+
+		v := validator.New()
+
+		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		r = app.contextSetUser(r, user)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if user.IsAnonymous() {
+			app.authenticationRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requirePermission lets through only authenticated users who have been
+// granted the permission with the given code.
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, *", "zstd"},
+		{"*;q=0", ""},
+		{"GZIP;q=0.8", "gzip"},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.want {
+			t.Errorf("%q: got %q; want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func decompress(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+
+	var r io.Reader
+	var err error
+
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		var dec *zstd.Decoder
+		dec, err = zstd.NewReader(bytes.NewReader(body))
+		if err == nil {
+			defer dec.Close()
+		}
+		r = dec
+	default:
+		return body
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func TestCompress(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compression.enabled = true
+	app.config.compression.minSize = 1024
+
+	ts := newTestServer(t, app.routes())
+
+	for i := 0; i < 20; i++ {
+		ts.createBook(t, fmt.Sprintf(`{"title": "Book %d", "year": 1990, "pages": "100 pages", "genres": ["fiction"]}`, i))
+	}
+
+	for _, encoding := range encodings {
+		t.Run(encoding, func(t *testing.T) {
+			rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books", "", http.Header{"Accept-Encoding": {encoding}})
+
+			if got := rs.header.Get("Content-Encoding"); got != encoding {
+				t.Fatalf("got Content-Encoding %q; want %q", got, encoding)
+			}
+			if got := rs.header.Values("Vary"); !strings.Contains(strings.Join(got, ","), "Accept-Encoding") {
+				t.Errorf("got Vary %q; want Accept-Encoding", got)
+			}
+
+			rs.body = decompress(t, encoding, rs.body)
+
+			var env struct {
+				Books []struct{} `json:"books"`
+			}
+			rs.decode(t, &env)
+
+			if len(env.Books) != 20 {
+				t.Errorf("got %d books; want 20", len(env.Books))
+			}
+		})
+	}
+
+	t.Run("Small body", func(t *testing.T) {
+		rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books/1", "", http.Header{"Accept-Encoding": {"gzip"}})
+
+		if got := rs.header.Get("Content-Encoding"); got != "" {
+			t.Errorf("got Content-Encoding %q; want none below the threshold", got)
+		}
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books/1?compact=true", "", http.Header{"Accept-Encoding": {"identity"}})
+
+		if bytes.ContainsAny(rs.body, "\n\t") {
+			t.Errorf("got indented body %s", rs.body)
+		}
+	})
+}
+
+// TestCompressTrailingWhitespace sends a body whose zstd stream ends in a
+// space byte, which must reach the client intact.
+func TestCompressTrailingWhitespace(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compression.enabled = true
+	app.config.compression.minSize = 1024
+
+	body := strings.Repeat("page ", 300) + " 16"
+
+	ts := newTestServer(t, app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})))
+
+	rs := ts.doWithHeaders(t, http.MethodGet, "/", "", http.Header{"Accept-Encoding": {"zstd"}})
+
+	if !bytes.HasSuffix(rs.body, []byte(" ")) {
+		t.Fatalf("got an encoded body that doesn't end in a space; it was trimmed, or the encoder's output changed")
+	}
+	if got := string(decompress(t, "zstd", rs.body)); got != body {
+		t.Errorf("got body %q; want %q", got, body)
+	}
+}
+
+func TestCompressStreaming(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compression.enabled = true
+	app.config.compression.minSize = 1024
+
+	handler := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("data: second\n\n"))
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, r)
+
+	if !rr.Flushed {
+		t.Error("the flush didn't reach the underlying writer")
+	}
+	if got := rr.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q; want a flushed stream compressed whatever its size", got)
+	}
+
+	want := "data: first\n\ndata: second\n\n"
+	if got := string(decompress(t, "gzip", rr.Body.Bytes())); got != want {
+		t.Errorf("got body %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/migrations"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/httpfs"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationLockID is the key of the advisory lock held while migrations are
+// auto-applied at startup, so that only one instance migrates at a time.
+const migrationLockID = 7_340_134_026
+
+func newMigrator(cfg config) (*migrate.Migrate, error) {
+	source, err := httpfs.New(http.FS(migrations.FS), ".")
+	if err != nil {
+		return nil, err
+	}
+
+	// The migrator closes its database handle when it is closed, so it gets a
+	// pool of its own rather than sharing the application's.
+	db, err := sql.Open("postgres", cfg.db.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return migrate.NewWithInstance("httpfs", source, "postgres", driver)
+}
+
+// runMigrateCommand carries out one of the -migrate modes: "up [N]",
+// "down [N]", "version" or "force N".
+func (app *application) runMigrateCommand(command string, args []string) error {
+	m, err := newMigrator(app.config)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	var n int
+	if len(args) > 0 {
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid migration argument %q", args[0])
+		}
+	}
+
+	switch command {
+	case "up":
+		if n > 0 {
+			err = m.Steps(n)
+		} else {
+			err = m.Up()
+		}
+	case "down":
+		if n > 0 {
+			err = m.Steps(-n)
+		} else {
+			err = m.Down()
+		}
+	case "force":
+		if len(args) == 0 {
+			return errors.New("force requires a version, for example -migrate=force 3")
+		}
+		err = m.Force(n)
+	case "version":
+	default:
+		return fmt.Errorf("unknown migrate mode %q (must be up, down, version or force)", command)
+	}
+
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	version, dirty, err := m.Version()
+	switch {
+	case errors.Is(err, migrate.ErrNilVersion):
+		app.logger.Printf("database has no migrations applied")
+	case err != nil:
+		return err
+	default:
+		app.logger.Printf("database migration version %d (dirty: %t)", version, dirty)
+	}
+
+	return nil
+}
+
+// autoMigrate applies any pending migrations while holding an advisory lock on
+// db, so that instances starting at the same time don't race each other.
+func (app *application) autoMigrate(db *sql.DB) error {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lockCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	_, err = conn.ExecContext(lockCtx, "SELECT pg_advisory_lock($1)", migrationLockID)
+	if err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	m, err := newMigrator(app.config)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	err = m.Up()
+	switch {
+	case errors.Is(err, migrate.ErrNoChange):
+		app.logger.Printf("database migrations up to date")
+	case err != nil:
+		return err
+	default:
+		app.logger.Printf("database migrations applied")
+	}
+
+	return nil
+}
+
+// migrateSQLite applies the migrations/sqlite files that are newer than the
+// database's user_version, each in its own transaction. SQLite can only
+// change some constraints by rebuilding the table, so, as its documentation
+// advises, foreign keys are off while migrations run and each one is checked
+// for broken references before it commits. The pragma applies to a single
+// connection outside a transaction, so the migrations keep to one.
+func migrateSQLite(db *sql.DB) error {
+	files, err := fs.Glob(migrations.SQLiteFS, "sqlite/*.up.sql")
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF")
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	var current int
+	err = conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := strings.TrimPrefix(file, "sqlite/")
+
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return fmt.Errorf("invalid migration file name %q", name)
+		}
+		if version <= current {
+			continue
+		}
+
+		script, err := fs.ReadFile(migrations.SQLiteFS, file)
+		if err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(string(script))
+		if err == nil {
+			err = checkSQLiteForeignKeys(tx)
+		}
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSQLiteForeignKeys fails if any row refers to one that doesn't exist.
+func checkSQLiteForeignKeys(tx *sql.Tx) error {
+	var (
+		table, parent string
+		rowID         sql.NullInt64
+		fkID          int
+	)
+
+	err := tx.QueryRow("PRAGMA foreign_key_check").Scan(&table, &rowID, &parent, &fkID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return err
+	default:
+		return fmt.Errorf("row %d of %s refers to a missing %s row", rowID.Int64, table, parent)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/outbox"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink remembers the messages it publishes, failing the first
+// attempt at each message in failOnce and every attempt at those in
+// failAlways.
+type recordingSink struct {
+	mu         sync.Mutex
+	failOnce   map[int64]bool
+	failAlways map[int64]bool
+	published  []int64
+	messages   []*data.OutboxMessage
+}
+
+func (s *recordingSink) Publish(ctx context.Context, message *data.OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failOnce[message.ID] {
+		delete(s.failOnce, message.ID)
+		return errors.New("sink unavailable")
+	}
+	if s.failAlways[message.ID] {
+		return errors.New("sink rejected the message")
+	}
+
+	s.published = append(s.published, message.ID)
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func TestOutboxRecordsBookWrites(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	id := ts.createBook(t, duneJSON)
+	ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/books/%d", id), `{"pages": "500 pages"}`)
+	ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/books/%d", id), `{"year": 1}`)
+	ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/books/%d", id), "")
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sink, err := outbox.NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	relayOutbox(t, app, sink)
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var events []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var message struct {
+			AggregateID int64  `json:"aggregate_id"`
+			Event       string `json:"event"`
+			Payload     struct {
+				Event string `json:"event"`
+				Data  struct {
+					Book struct {
+						ID    int64  `json:"id"`
+						Pages string `json:"pages"`
+					} `json:"book"`
+				} `json:"data"`
+			} `json:"payload"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			t.Fatalf("decoding %q: %v", scanner.Text(), err)
+		}
+		if message.AggregateID != id || message.Payload.Event != message.Event || message.Payload.Data.Book.ID != id {
+			t.Errorf("got message %s; want one about book %d", scanner.Text(), id)
+		}
+		if message.Event == data.EventBookUpdated && message.Payload.Data.Book.Pages != "500 pages" {
+			t.Errorf("got updated book %s; want it as it was after the update", scanner.Text())
+		}
+		events = append(events, message.Event)
+	}
+
+	// The rejected update wrote nothing, so it recorded nothing either.
+	if want := "[book.created book.updated book.deleted]"; fmt.Sprint(events) != want {
+		t.Errorf("got events %v; want %s", events, want)
+	}
+}
+
+func TestOutboxRelayOrderingAndRetries(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/books/%d", dune), `{"pages": "500 pages"}`)
+	ts.createBook(t, `{"title": "Emma", "year": 1900, "pages": "474 pages", "genres": ["fiction"]}`)
+
+	// Messages 1 and 2 are Dune's, 3 is Emma's.
+	sink := &recordingSink{failOnce: map[int64]bool{1: true}}
+	relay := outbox.New(app.models.Outbox, log.New(io.Discard, "", 0), outbox.Config{
+		RetryBase: 20 * time.Millisecond,
+		RetryMax:  20 * time.Millisecond,
+	}, sink)
+
+	for i := 0; i < 3; i++ {
+		if _, err := relay.RunOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := fmt.Sprint(sink.published); got != "[3]" {
+		t.Fatalf("got %s published; want only Emma's message while Dune's first one waits to be retried", got)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	relayOutbox(t, app, sink)
+
+	if got := fmt.Sprint(sink.published); got != "[3 1 2]" {
+		t.Errorf("got %s published; want Dune's messages retried in order", got)
+	}
+
+	n, err := relay.RunOnce(context.Background())
+	if err != nil || n != 0 {
+		t.Errorf("got %d messages (%v) after everything was published; want 0", n, err)
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/books/%d", dune), `{"pages": "500 pages"}`)
+
+	// Message 1, Dune's first, never gets through.
+	sink := &recordingSink{failAlways: map[int64]bool{1: true}}
+	relay := outbox.New(app.models.Outbox, log.New(io.Discard, "", 0), outbox.Config{
+		RetryBase:   time.Millisecond,
+		RetryMax:    time.Millisecond,
+		MaxAttempts: 2,
+	}, sink)
+
+	for i := 0; i < 4; i++ {
+		time.Sleep(2 * time.Millisecond)
+		if _, err := relay.RunOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := fmt.Sprint(sink.published); got != "[2]" {
+		t.Errorf("got %s published; want Dune's second message once the first was given up on", got)
+	}
+
+	n, err := relay.RunOnce(context.Background())
+	if err != nil || n != 0 {
+		t.Errorf("got %d messages (%v) after the first was dead-lettered; want 0", n, err)
+	}
+}
+
+func TestOutboxRetryDoesNotDuplicateWebhookDeliveries(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	ops := ts.manageWebhooks(t, app)
+	hook := ts.createWebhook(t, ops, `{"url": "https://example.com/hooks", "events": ["book.created"]}`)
+	ts.createBook(t, duneJSON)
+
+	// The webhooks take the message, then the other sink fails it, so the
+	// whole message is published again.
+	dispatcher := newTestDispatcher(app, 3)
+	sink := &recordingSink{failOnce: map[int64]bool{1: true}}
+	relay := outbox.New(app.models.Outbox, log.New(io.Discard, "", 0), outbox.Config{
+		RetryBase: time.Millisecond,
+		RetryMax:  time.Millisecond,
+	}, dispatcher, sink)
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(2 * time.Millisecond)
+		if _, err := relay.RunOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := fmt.Sprint(sink.published); got != "[1]" {
+		t.Fatalf("got %s published; want the message retried until the sink took it", got)
+	}
+	if got := len(ts.deliveries(t, ops, hook.ID)); got != 1 {
+		t.Errorf("got %d deliveries; want 1 however often the message is published", got)
+	}
+}
+
+func TestOutboxHTTPSink(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	receiver, received := newReceiver(t, http.StatusAccepted)
+
+	ts.createBook(t, duneJSON)
+	relayOutbox(t, app, outbox.NewHTTPSink(receiver.URL, 5*time.Second))
+
+	got := received()
+	if len(got) != 1 {
+		t.Fatalf("receiver got %d requests; want 1", len(got))
+	}
+	if id, event := got[0].header.Get(outbox.MessageIDHeader), got[0].header.Get(outbox.EventHeader); id != "1" || event != data.EventBookCreated {
+		t.Errorf("got message id %q and event %q; want 1 and %s", id, event, data.EventBookCreated)
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(got[0].body, &payload); err != nil || payload["event"] != data.EventBookCreated {
+		t.Errorf("got body %s; want the event's payload", got[0].body)
+	}
+}
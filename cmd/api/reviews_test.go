@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"net/http"
+	"testing"
+)
+
+func TestReviews(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	reviews := fmt.Sprintf("/v1/books/%d/reviews", dune)
+	bookPath := fmt.Sprintf("/v1/books/%d", dune)
+
+	alice := ts.authenticate(t, "alice@example.com")
+	bob := ts.authenticate(t, "bob@example.com")
+
+	type reviewEnvelope struct {
+		Review data.Review `json:"review"`
+	}
+
+	rs := ts.do(t, http.MethodPost, reviews, `{"rating": 5}`)
+	if rs.status != http.StatusUnauthorized {
+		t.Errorf("got status %d reviewing anonymously; want %d", rs.status, http.StatusUnauthorized)
+	}
+
+	for _, body := range []string{`{"rating": 0}`, `{"rating": 6}`, `{"text": "No rating"}`} {
+		rs := ts.doWithHeaders(t, http.MethodPost, reviews, body, alice)
+		if rs.status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got status %d; want %d", body, rs.status, http.StatusUnprocessableEntity)
+		}
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, "/v1/books/99/reviews", `{"rating": 5}`, alice)
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d reviewing a missing book; want %d", rs.status, http.StatusNotFound)
+	}
+
+	etag := ts.do(t, http.MethodGet, bookPath, "").header.Get("ETag")
+
+	rs = ts.doWithHeaders(t, http.MethodPost, reviews, `{"rating": 5, "text": "A classic."}`, alice)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	var created reviewEnvelope
+	rs.decode(t, &created)
+	reviewPath := fmt.Sprintf("%s/%d", reviews, created.Review.ID)
+	if got := rs.header.Get("Location"); got != reviewPath {
+		t.Errorf("got Location %q; want %q", got, reviewPath)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, reviews, `{"rating": 1}`, alice)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d reviewing a book twice; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, reviews, `{"rating": 2}`, bob)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, bookPath, "", http.Header{"If-None-Match": {etag}})
+	if rs.status != http.StatusOK {
+		t.Errorf("got status %d for the book's old ETag after a review; want %d", rs.status, http.StatusOK)
+	}
+
+	checkRating := func(average float64, count int32) {
+		t.Helper()
+
+		var env struct {
+			Book data.Book `json:"books"`
+		}
+		ts.do(t, http.MethodGet, bookPath, "").decode(t, &env)
+		if env.Book.AverageRating != average || env.Book.RatingsCount != count {
+			t.Errorf("got average %v of %d ratings; want %v of %d", env.Book.AverageRating, env.Book.RatingsCount, average, count)
+		}
+	}
+
+	checkRating(3.5, 2)
+
+	// Only the author may change or delete a review.
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		rs := ts.doWithHeaders(t, method, reviewPath, `{"rating": 1}`, bob)
+		if rs.status != http.StatusForbidden {
+			t.Errorf("%s of another user's review: got status %d; want %d", method, rs.status, http.StatusForbidden)
+		}
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPatch, reviewPath, `{"rating": 4}`, alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d updating; body %s", rs.status, rs.body)
+	}
+
+	var updated reviewEnvelope
+	rs.decode(t, &updated)
+	if updated.Review.Rating != 4 || updated.Review.Text != "A classic." || updated.Review.Version != 2 {
+		t.Errorf("got review %+v; want rating 4 with the text kept at version 2", updated.Review)
+	}
+
+	checkRating(3, 2)
+
+	rs = ts.do(t, http.MethodGet, reviews+"?sort=-rating", "")
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d listing; body %s", rs.status, rs.body)
+	}
+
+	var list struct {
+		Metadata data.Metadata `json:"metadata"`
+		Reviews  []data.Review `json:"reviews"`
+	}
+	rs.decode(t, &list)
+	if list.Metadata.TotalRecords != 2 || len(list.Reviews) != 2 || list.Reviews[0].Rating != 4 {
+		t.Errorf("got %+v; want both reviews, highest rating first", list)
+	}
+
+	rs = ts.do(t, http.MethodGet, "/v1/books/99/reviews", "")
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d listing reviews of a missing book; want %d", rs.status, http.StatusNotFound)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodDelete, reviewPath, "", alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d deleting; body %s", rs.status, rs.body)
+	}
+
+	rs = ts.do(t, http.MethodGet, reviewPath, "")
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d for a deleted review; want %d", rs.status, http.StatusNotFound)
+	}
+
+	checkRating(2, 1)
+}
+
+func TestListBooksByRating(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	emma := ts.createBook(t, `{"title": "Emma", "year": 1900, "pages": "474 pages", "genres": ["fiction"]}`)
+	ts.createBook(t, `{"title": "Ulysses", "year": 1922, "pages": "730 pages", "genres": ["fiction"]}`)
+
+	alice := ts.authenticate(t, "alice@example.com")
+	bob := ts.authenticate(t, "bob@example.com")
+
+	for _, review := range []struct {
+		book    int64
+		rating  int
+		headers http.Header
+	}{
+		{dune, 4, alice},
+		{dune, 5, bob},
+		{emma, 3, alice},
+	} {
+		rs := ts.doWithHeaders(t, http.MethodPost, fmt.Sprintf("/v1/books/%d/reviews", review.book), fmt.Sprintf(`{"rating": %d}`, review.rating), review.headers)
+		if rs.status != http.StatusCreated {
+			t.Fatalf("got status %d; body %s", rs.status, rs.body)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		titles []string
+	}{
+		{"highest rated first", "?sort=-rating", http.StatusOK, []string{"Dune", "Emma", "Ulysses"}},
+		{"lowest rated first", "?sort=rating", http.StatusOK, []string{"Ulysses", "Emma", "Dune"}},
+		{"rating_min", "?rating_min=3.5", http.StatusOK, []string{"Dune"}},
+		{"rating_max", "?rating_max=3", http.StatusOK, []string{"Emma", "Ulysses"}},
+		{"rating_max of rated books", "?rating_max=3&ratings_min=1", http.StatusOK, []string{"Emma"}},
+		{"ratings_min", "?ratings_min=2", http.StatusOK, []string{"Dune"}},
+		{"rating_min out of range", "?rating_min=6", http.StatusUnprocessableEntity, nil},
+		{"rating_min above rating_max", "?rating_min=4&rating_max=3", http.StatusUnprocessableEntity, nil},
+		{"rating_min not a number", "?rating_min=high", http.StatusUnprocessableEntity, nil},
+		{"negative ratings_min", "?ratings_min=-1", http.StatusUnprocessableEntity, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.do(t, http.MethodGet, "/v1/books"+tt.query, "")
+			if rs.status != tt.status {
+				t.Fatalf("got status %d; want %d; body %s", rs.status, tt.status, rs.body)
+			}
+			if tt.titles == nil {
+				return
+			}
+
+			var env struct {
+				Books []data.Book `json:"books"`
+			}
+			rs.decode(t, &env)
+
+			var titles []string
+			for _, book := range env.Books {
+				titles = append(titles, book.Title)
+			}
+			if fmt.Sprint(titles) != fmt.Sprint(tt.titles) {
+				t.Errorf("got %v; want %v", titles, tt.titles)
+			}
+		})
+	}
+}
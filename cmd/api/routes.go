@@ -1,22 +1,85 @@
 package main
 
 import (
+	"github.com/Bug-daulet/FinalSPA/internal/data"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 )
 
-func (app *application) routes() *httprouter.Router {
+func (app *application) routes() http.Handler {
 	router := httprouter.New()
 
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/openapi.json", app.openAPIHandler)
+	router.HandlerFunc(http.MethodGet, "/docs", app.docsHandler)
 
 	router.HandlerFunc(http.MethodGet, "/v1/books", app.listBooksHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/books", app.createBookHandler)
 	router.HandlerFunc(http.MethodGet, "/v1/books/:id", app.showBookHandler)
 	router.HandlerFunc(http.MethodPatch, "/v1/books/:id", app.updateBookHandler)
 	router.HandlerFunc(http.MethodDelete, "/v1/books/:id", app.deleteBookHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/checkout", app.requireAuthenticatedUser(app.checkoutBookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/copies", app.listCopiesHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/copies", app.createCopyHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/copies/:copy_id", app.showCopyHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/books/:id/copies/:copy_id", app.updateCopyHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/books/:id/copies/:copy_id", app.deleteCopyHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/holds", app.requireAuthenticatedUser(app.listBookHoldsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/holds", app.requireAuthenticatedUser(app.placeHoldHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/reviews", app.listReviewsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/books/:id/reviews", app.requireAuthenticatedUser(app.createReviewHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/books/:id/reviews/:review_id", app.showReviewHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/books/:id/reviews/:review_id", app.requireAuthenticatedUser(app.updateReviewHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/books/:id/reviews/:review_id", app.requireAuthenticatedUser(app.deleteReviewHandler))
 
-	return router
+	router.HandlerFunc(http.MethodGet, "/v1/copies/:barcode", app.showCopyByBarcodeHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/genres", app.listGenresHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/genres", app.createGenreHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/genres/:id", app.showGenreHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/genres/:id", app.updateGenreHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/genres/:id", app.deleteGenreHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.requirePermission(data.PermissionWebhooksManage, app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.requirePermission(data.PermissionWebhooksManage, app.createWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.requirePermission(data.PermissionWebhooksManage, app.showWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.requirePermission(data.PermissionWebhooksManage, app.updateWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.requirePermission(data.PermissionWebhooksManage, app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requirePermission(data.PermissionWebhooksManage, app.listWebhookDeliveriesHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/me/shelves", app.requireAuthenticatedUser(app.listShelvesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/me/shelves", app.requireAuthenticatedUser(app.createShelfHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/me/shelves/:id", app.requireAuthenticatedUser(app.showShelfHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/me/shelves/:id", app.requireAuthenticatedUser(app.updateShelfHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/me/shelves/:id", app.requireAuthenticatedUser(app.deleteShelfHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/me/shelves/:id/items", app.requireAuthenticatedUser(app.listShelfItemsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/me/shelves/:id/items", app.requireAuthenticatedUser(app.createShelfItemHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/me/shelves/:id/items/:item_id", app.requireAuthenticatedUser(app.showShelfItemHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/me/shelves/:id/items/:item_id", app.requireAuthenticatedUser(app.updateShelfItemHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/me/shelves/:id/items/:item_id", app.requireAuthenticatedUser(app.deleteShelfItemHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/me/loans", app.requireAuthenticatedUser(app.listMyLoansHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/loans/:id", app.requireAuthenticatedUser(app.showLoanHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/loans/:id/return", app.requireAuthenticatedUser(app.returnLoanHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/loans/:id/renew", app.requireAuthenticatedUser(app.renewLoanHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/me/holds", app.requireAuthenticatedUser(app.listMyHoldsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/holds/:id", app.requireAuthenticatedUser(app.showHoldHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/holds/:id/cancel", app.requireAuthenticatedUser(app.cancelHoldHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/reports/overdue-loans", app.requirePermission(data.PermissionLoansReport, app.overdueLoansHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/graphql", app.graphqlHandler())
+
+	// httprouter won't register /v1/books/stream beside /v1/books/:id, so
+	// the stream gets a router of its own in front of the main one.
+	streams := httprouter.New()
+	streams.HandleMethodNotAllowed = false
+	streams.NotFound = router
+	streams.HandlerFunc(http.MethodGet, "/v1/books/stream", app.streamBooksHandler)
+
+	return app.compress(app.authenticate(streams))
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long requests in flight get to finish once the
+// server is asked to stop.
+const shutdownTimeout = 20 * time.Second
+
+// serve runs the HTTP server, and the gRPC server unless it is disabled,
+// until it gets SIGINT or SIGTERM, then stops taking requests and waits for
+// those in flight. Change streams are ended first, since they would
+// otherwise never finish.
+func (app *application) serve() error {
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Handler:      app.routes(),
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	if app.stream != nil {
+		srv.RegisterOnShutdown(app.stream.close)
+	}
+
+	var grpcSrv *grpc.Server
+
+	if app.config.grpc.port > 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", app.config.grpc.port))
+		if err != nil {
+			return err
+		}
+
+		grpcSrv = app.grpcServer()
+
+		go func() {
+			app.logger.Printf("starting gRPC server on %s", listener.Addr())
+
+			err := grpcSrv.Serve(listener)
+			if err != nil {
+				app.logger.Printf("gRPC server: %v", err)
+			}
+		}()
+	}
+
+	shutdownError := make(chan error)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		s := <-quit
+
+		app.logger.Printf("shutting down server after %s", s)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+
+		if grpcSrv != nil {
+			if app.stream != nil {
+				app.stream.close()
+			}
+
+			stopped := make(chan struct{})
+			go func() {
+				grpcSrv.GracefulStop()
+				close(stopped)
+			}()
+
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				grpcSrv.Stop()
+			}
+		}
+
+		shutdownError <- err
+	}()
+
+	app.logger.Printf("starting %s server on %s", app.config.env, srv.Addr)
+
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	err = <-shutdownError
+	if err != nil {
+		return err
+	}
+
+	app.logger.Printf("stopped server")
+	return nil
+}
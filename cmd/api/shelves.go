@@ -0,0 +1,482 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func (app *application) createShelfHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	shelf := &data.Shelf{
+		UserID: app.contextGetUser(r).ID,
+		Name:   input.Name,
+	}
+
+	v := validator.New()
+
+	if data.ValidateShelf(v, shelf); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Shelves.Insert(r.Context(), shelf)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateShelf):
+			v.AddError("name", "you already have a shelf with this name")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/me/shelves/%d", shelf.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"shelf": shelf}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showShelfHandler(w http.ResponseWriter, r *http.Request) {
+
+	shelf, ok := app.readShelf(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"shelf": shelf}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateShelfHandler(w http.ResponseWriter, r *http.Request) {
+
+	shelf, ok := app.readShelf(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Name *string `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		shelf.Name = *input.Name
+	}
+
+	v := validator.New()
+
+	if data.ValidateShelf(v, shelf); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Shelves.Update(r.Context(), shelf)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateShelf):
+			v.AddError("name", "you already have a shelf with this name")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"shelf": shelf}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteShelfHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Shelves.Delete(r.Context(), app.contextGetUser(r).ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "shelf successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listShelvesHandler(w http.ResponseWriter, r *http.Request) {
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	filters := app.readListFilters(qs, data.ShelfSortSafelist, v)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	shelves, metadata, err := app.models.Shelves.GetAll(r.Context(), app.contextGetUser(r).ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"metadata": metadata, "shelves": shelves}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createShelfItemHandler(w http.ResponseWriter, r *http.Request) {
+
+	shelf, ok := app.readShelf(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		BookID     int64      `json:"book_id"`
+		Status     *string    `json:"status"`
+		StartedAt  *time.Time `json:"started_at"`
+		FinishedAt *time.Time `json:"finished_at"`
+		PagesRead  *int32     `json:"pages_read"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	book, err := app.models.Books.Get(r.Context(), input.BookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("book_id", "must refer to an existing book")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	item := &data.ShelfItem{
+		ShelfID: shelf.ID,
+		BookID:  book.ID,
+		Title:   book.Title,
+	}
+
+	status := data.StatusWantToRead
+	if input.Status != nil {
+		status = *input.Status
+	}
+	setShelfItemStatus(item, status, book)
+
+	applyShelfItemInput(item, input.StartedAt, input.FinishedAt, input.PagesRead)
+
+	if data.ValidateShelfItem(v, item, book); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Shelves.InsertItem(r.Context(), item)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateShelfItem):
+			v.AddError("book_id", "this book is already on the shelf")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/me/shelves/%d/items/%d", shelf.ID, item.ID))
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"item": item}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showShelfItemHandler(w http.ResponseWriter, r *http.Request) {
+
+	item, ok := app.readShelfItem(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"item": item}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateShelfItemHandler(w http.ResponseWriter, r *http.Request) {
+
+	item, ok := app.readShelfItem(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Status     *string    `json:"status"`
+		StartedAt  *time.Time `json:"started_at"`
+		FinishedAt *time.Time `json:"finished_at"`
+		PagesRead  *int32     `json:"pages_read"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	book, err := app.models.Books.Get(r.Context(), item.BookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.Status != nil && *input.Status != item.Status {
+		setShelfItemStatus(item, *input.Status, book)
+	}
+
+	applyShelfItemInput(item, input.StartedAt, input.FinishedAt, input.PagesRead)
+
+	v := validator.New()
+
+	if data.ValidateShelfItem(v, item, book); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Shelves.UpdateItem(r.Context(), item)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"item": item}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteShelfItemHandler(w http.ResponseWriter, r *http.Request) {
+
+	shelf, ok := app.readShelf(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := app.readNamedIDParam(r, "item_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Shelves.DeleteItem(r.Context(), shelf.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "book successfully removed from the shelf"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listShelfItemsHandler(w http.ResponseWriter, r *http.Request) {
+
+	shelf, ok := app.readShelf(w, r)
+	if !ok {
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	status := app.readString(qs, "status", "")
+	filters := app.readListFilters(qs, data.ShelfItemSortSafelist, v)
+
+	v.Check(status == "" || validator.In(status, data.ShelfStatuses...), "status", "must be one of want-to-read, reading or read")
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	items, metadata, err := app.models.Shelves.GetItems(r.Context(), shelf.ID, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"metadata": metadata, "items": items}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setShelfItemStatus moves the item to status, filling in the dates and
+// progress that go with it: starting a book stamps when it was started,
+// finishing it stamps when and counts every page as read, and going back
+// clears whatever no longer applies.
+func setShelfItemStatus(item *data.ShelfItem, status string, book *data.Book) {
+	now := time.Now().Truncate(time.Second)
+
+	item.Status = status
+
+	switch status {
+	case data.StatusWantToRead:
+		item.StartedAt = nil
+		item.FinishedAt = nil
+	case data.StatusReading:
+		if item.StartedAt == nil {
+			item.StartedAt = &now
+		}
+		item.FinishedAt = nil
+	case data.StatusRead:
+		if item.FinishedAt == nil {
+			item.FinishedAt = &now
+		}
+		item.PagesRead = int32(book.Pages)
+	}
+}
+
+func applyShelfItemInput(item *data.ShelfItem, startedAt, finishedAt *time.Time, pagesRead *int32) {
+	if startedAt != nil {
+		t := startedAt.Truncate(time.Second)
+		item.StartedAt = &t
+	}
+	if finishedAt != nil {
+		t := finishedAt.Truncate(time.Second)
+		item.FinishedAt = &t
+	}
+	if pagesRead != nil {
+		item.PagesRead = *pagesRead
+	}
+}
+
+// readListFilters reads the page and sort parameters lists outside of
+// /v1/books share.
+func (app *application) readListFilters(qs url.Values, sortSafelist []string, v *validator.Validator) data.Filters {
+	var filters data.Filters
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = app.readString(qs, "sort", "id")
+	filters.SortSafelist = sortSafelist
+	filters.GenresMode = "all"
+
+	return filters
+}
+
+// readShelf loads the authenticated user's shelf named by the id parameter,
+// sending the error response itself if it can't.
+func (app *application) readShelf(w http.ResponseWriter, r *http.Request) (*data.Shelf, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	shelf, err := app.models.Shelves.Get(r.Context(), app.contextGetUser(r).ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return shelf, true
+}
+
+// readShelfItem loads the item named by the item_id parameter from the shelf
+// readShelf loads.
+func (app *application) readShelfItem(w http.ResponseWriter, r *http.Request) (*data.ShelfItem, bool) {
+	shelf, ok := app.readShelf(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	id, err := app.readNamedIDParam(r, "item_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	item, err := app.models.Shelves.GetItem(r.Context(), shelf.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return item, true
+}
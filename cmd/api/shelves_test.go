@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"net/http"
+	"testing"
+)
+
+// createShelf makes a shelf as the user the headers authenticate and returns
+// its id.
+func (ts *testServer) createShelf(t *testing.T, headers http.Header, name string) int64 {
+	t.Helper()
+
+	rs := ts.doWithHeaders(t, http.MethodPost, "/v1/me/shelves", fmt.Sprintf(`{"name": %q}`, name), headers)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("creating shelf: got status %d; body %s", rs.status, rs.body)
+	}
+
+	var env struct {
+		Shelf data.Shelf `json:"shelf"`
+	}
+	rs.decode(t, &env)
+	return env.Shelf.ID
+}
+
+func TestShelves(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	alice := ts.authenticate(t, "alice@example.com")
+	bob := ts.authenticate(t, "bob@example.com")
+
+	summer := ts.createShelf(t, alice, "Summer")
+	ts.createShelf(t, alice, "Classics")
+	ts.createShelf(t, bob, "Summer")
+
+	rs := ts.doWithHeaders(t, http.MethodPost, "/v1/me/shelves", `{"name": "SUMMER"}`, alice)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for a duplicate name; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, "/v1/me/shelves?sort=name", "", alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	var list struct {
+		Metadata data.Metadata `json:"metadata"`
+		Shelves  []data.Shelf  `json:"shelves"`
+	}
+	rs.decode(t, &list)
+	if list.Metadata.TotalRecords != 2 || len(list.Shelves) != 2 || list.Shelves[0].Name != "Classics" {
+		t.Errorf("got %+v; want alice's two shelves by name", list)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, "/v1/me/shelves?sort=title", "", alice)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an unknown sort; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+
+	// Another user's shelf is as good as missing.
+	path := fmt.Sprintf("/v1/me/shelves/%d", summer)
+	for _, method := range []string{http.MethodGet, http.MethodPatch, http.MethodDelete} {
+		rs := ts.doWithHeaders(t, method, path, `{"name": "Mine now"}`, bob)
+		if rs.status != http.StatusNotFound {
+			t.Errorf("%s of another user's shelf: got status %d; want %d", method, rs.status, http.StatusNotFound)
+		}
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPatch, path, `{"name": "Beach"}`, alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d renaming; body %s", rs.status, rs.body)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodDelete, path, "", alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d deleting; body %s", rs.status, rs.body)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, path, "", alice)
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d for a deleted shelf; want %d", rs.status, http.StatusNotFound)
+	}
+}
+
+func TestShelfItems(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	dune := ts.createBook(t, duneJSON)
+	emma := ts.createBook(t, `{"title": "Emma", "year": 1900, "pages": "474 pages", "genres": ["fiction"]}`)
+
+	alice := ts.authenticate(t, "alice@example.com")
+	shelf := ts.createShelf(t, alice, "Favourites")
+	items := fmt.Sprintf("/v1/me/shelves/%d/items", shelf)
+
+	type itemEnvelope struct {
+		Item data.ShelfItem `json:"item"`
+	}
+
+	rs := ts.doWithHeaders(t, http.MethodPost, items, fmt.Sprintf(`{"book_id": %d}`, dune), alice)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	var created itemEnvelope
+	rs.decode(t, &created)
+	if created.Item.Status != data.StatusWantToRead || created.Item.Title != "Dune" || created.Item.StartedAt != nil {
+		t.Errorf("got item %+v; want Dune, not yet started", created.Item)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, items, fmt.Sprintf(`{"book_id": %d}`, dune), alice)
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d adding a book twice; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"Unknown book", `{"book_id": 999}`, "book_id"},
+		{"Unknown status", fmt.Sprintf(`{"book_id": %d, "status": "abandoned"}`, emma), "status"},
+		{"Past the last page", fmt.Sprintf(`{"book_id": %d, "status": "reading", "pages_read": 475}`, emma), "pages_read"},
+		{"Started before wanting to", fmt.Sprintf(`{"book_id": %d, "started_at": "2020-01-01T00:00:00Z"}`, emma), "started_at"},
+		{"Finished before starting", fmt.Sprintf(`{"book_id": %d, "status": "read", "started_at": "2020-02-01T00:00:00Z", "finished_at": "2020-01-01T00:00:00Z"}`, emma), "finished_at"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.doWithHeaders(t, http.MethodPost, items, tt.body, alice)
+			if rs.status != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusUnprocessableEntity, rs.body)
+			}
+			errs, _ := rs.errorMessage(t).(map[string]interface{})
+			if errs[tt.field] == nil {
+				t.Errorf("got errors %v; want one for %q", errs, tt.field)
+			}
+		})
+	}
+
+	item := fmt.Sprintf("%s/%d", items, created.Item.ID)
+
+	rs = ts.doWithHeaders(t, http.MethodPatch, item, `{"status": "reading", "pages_read": 100}`, alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	var reading itemEnvelope
+	rs.decode(t, &reading)
+	if reading.Item.StartedAt == nil || reading.Item.PagesRead != 100 || reading.Item.Version != created.Item.Version+1 {
+		t.Errorf("got item %+v; want started, 100 pages in", reading.Item)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPatch, item, `{"status": "read"}`, alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	var read itemEnvelope
+	rs.decode(t, &read)
+	if read.Item.FinishedAt == nil || read.Item.PagesRead != 412 || !read.Item.StartedAt.Equal(*reading.Item.StartedAt) {
+		t.Errorf("got item %+v; want finished with every page read", read.Item)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPost, items, fmt.Sprintf(`{"book_id": %d, "status": "reading", "pages_read": 20}`, emma), alice)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	var list struct {
+		Metadata data.Metadata    `json:"metadata"`
+		Items    []data.ShelfItem `json:"items"`
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, items+"?sort=-pages_read", "", alice)
+	rs.decode(t, &list)
+	if list.Metadata.TotalRecords != 2 || list.Items[0].Title != "Dune" || list.Items[1].Title != "Emma" {
+		t.Errorf("got %+v; want Dune then Emma", list)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, items+"?status=reading", "", alice)
+	rs.decode(t, &list)
+	if len(list.Items) != 1 || list.Items[0].Title != "Emma" {
+		t.Errorf("got %+v; want only Emma", list.Items)
+	}
+
+	// Another user can't reach the items through a shelf that isn't theirs.
+	bob := ts.authenticate(t, "bob@example.com")
+	rs = ts.doWithHeaders(t, http.MethodGet, item, "", bob)
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d for another user's item; want %d", rs.status, http.StatusNotFound)
+	}
+
+	// Deleting a book takes it off every shelf.
+	rs = ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/books/%d", emma), "")
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d deleting book; body %s", rs.status, rs.body)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, items, "", alice)
+	rs.decode(t, &list)
+	if list.Metadata.TotalRecords != 1 || list.Items[0].Title != "Dune" {
+		t.Errorf("got %+v; want only Dune left", list)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodDelete, item, "", alice)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; body %s", rs.status, rs.body)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, item, "", alice)
+	if rs.status != http.StatusNotFound {
+		t.Errorf("got status %d for a removed item; want %d", rs.status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// changeBatch is how many logged changes are read at a time.
+const changeBatch = 100
+
+// changeEvent is a logged book change ready to send to subscribers: as a
+// server-sent event with its name and data, or to a gRPC watcher with the
+// book itself, which is nil for a delete.
+type changeEvent struct {
+	id     int64
+	op     string
+	name   string
+	bookID int64
+	book   *data.Book
+	genres []string
+	data   []byte
+}
+
+type subscriber struct {
+	// genres is nil for a subscriber that wants every change.
+	genres map[string]bool
+	events chan *changeEvent
+}
+
+func (s *subscriber) wants(event *changeEvent) bool {
+	if s.genres == nil {
+		return true
+	}
+	for _, genre := range event.genres {
+		if s.genres[genre] {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcaster follows the book change log and passes each new change on to
+// every subscribed stream. It reads the log when woken by notify, which a
+// Postgres listener calls for changes made by any server, and otherwise every
+// few seconds.
+type broadcaster struct {
+	books        data.BookStore
+	logger       *log.Logger
+	retention    time.Duration
+	pollInterval time.Duration
+	wake         chan struct{}
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	last        int64
+	closed      bool
+}
+
+func newBroadcaster(books data.BookStore, logger *log.Logger, retention time.Duration) *broadcaster {
+	return &broadcaster{
+		books:        books,
+		logger:       logger,
+		retention:    retention,
+		pollInterval: 5 * time.Second,
+		wake:         make(chan struct{}, 1),
+		subscribers:  make(map[*subscriber]struct{}),
+	}
+}
+
+func (b *broadcaster) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run broadcasts changes until ctx is cancelled, pruning the log of changes
+// older than the retention period along the way.
+func (b *broadcaster) run(ctx context.Context) {
+	ticker := time.NewTicker(b.pollInterval)
+	defer ticker.Stop()
+
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		err := b.catchUp(ctx)
+		if err != nil && ctx.Err() == nil {
+			b.logger.Printf("stream: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		case <-prune.C:
+			err := b.books.PruneChanges(ctx, time.Now().Add(-b.retention))
+			if err != nil && ctx.Err() == nil {
+				b.logger.Printf("stream: pruning changes: %v", err)
+			}
+		}
+	}
+}
+
+// listen wakes the broadcaster whenever the database announces a change.
+// After the listener loses its connection it wakes it too, to pick up
+// whatever was announced in the meantime.
+func (b *broadcaster) listen(ctx context.Context, dsn string) error {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			b.logger.Printf("stream: listener: %v", err)
+		}
+	})
+
+	err := listener.Listen(data.BookChangesChannel)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		defer listener.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-listener.Notify:
+				b.notify()
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *broadcaster) catchUp(ctx context.Context) error {
+	for {
+		changes, err := b.books.Changes(ctx, b.last, changeBatch)
+		if err != nil {
+			return err
+		}
+
+		for _, change := range changes {
+			var event *changeEvent
+
+			if b.hasSubscribers() {
+				event, err = b.event(ctx, change)
+				if err != nil {
+					return err
+				}
+			}
+
+			b.broadcast(change.ID, event)
+		}
+
+		if len(changes) < changeBatch {
+			return nil
+		}
+	}
+}
+
+func (b *broadcaster) hasSubscribers() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subscribers) > 0
+}
+
+// event turns a change into the event sent for it, carrying the book as it
+// is now. It returns nil for a created or updated book that has since been
+// deleted, since the delete has its own event.
+func (b *broadcaster) event(ctx context.Context, change *data.BookChange) (*changeEvent, error) {
+	var (
+		book    *data.Book
+		payload envelope
+	)
+
+	switch change.Op {
+	case data.ChangeDeleted:
+		payload = envelope{"book": envelope{"id": change.BookID}}
+	default:
+		var err error
+		book, err = b.books.Get(ctx, change.BookID)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		payload = envelope{"book": book}
+	}
+
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &changeEvent{
+		id:     change.ID,
+		op:     change.Op,
+		name:   "book." + change.Op,
+		bookID: change.BookID,
+		book:   book,
+		genres: change.Genres,
+		data:   js,
+	}, nil
+}
+
+// broadcast sends event to the subscribers that want it and moves past id.
+// A subscriber too far behind to take the event is dropped; its client
+// reconnects and resumes from the last event it got.
+func (b *broadcaster) broadcast(id int64, event *changeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.last = id
+
+	if event == nil {
+		return
+	}
+
+	for s := range b.subscribers {
+		if !s.wants(event) {
+			continue
+		}
+
+		select {
+		case s.events <- event:
+		default:
+			delete(b.subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+// subscribe registers a stream for changes after the one it returns, or
+// returns nil once the broadcaster has been closed.
+func (b *broadcaster) subscribe(genres map[string]bool) (*subscriber, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, 0
+	}
+
+	s := &subscriber{genres: genres, events: make(chan *changeEvent, 64)}
+	b.subscribers[s] = struct{}{}
+
+	return s, b.last
+}
+
+func (b *broadcaster) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+}
+
+// close ends every stream, so that the server can shut down without waiting
+// for clients to hang up.
+func (b *broadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for s := range b.subscribers {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+}
+
+// streamBooksHandler sends book changes as server-sent events. A client that
+// reconnects with a Last-Event-ID header (or a last_event_id parameter) first
+// gets the changes it missed, as far back as the change log is kept.
+func (app *application) streamBooksHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	genres := app.readCSV(qs, "genres", []string{})
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = app.readString(qs, "last_event_id", "")
+	}
+
+	after := int64(-1)
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		v.Check(err == nil && id >= 0, "last_event_id", "must be a non-negative integer")
+		after = id
+	}
+
+	match, err := app.matchGenres(r.Context(), v, genres)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	sub, from := app.stream.subscribe(match)
+	if sub == nil {
+		app.serviceUnavailableResponse(w, r)
+		return
+	}
+	defer app.stream.unsubscribe(sub)
+
+	// A stream outlives the server's write timeout.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	err = rc.Flush()
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+
+	if after >= 0 && after < from {
+		err = app.stream.replay(r.Context(), sub, after, from, func(event *changeEvent) error {
+			return writeEvent(w, event)
+		})
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(app.config.stream.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if event.id <= after {
+				continue
+			}
+			err = writeEvent(w, event)
+
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// replay passes send the changes after the given id, up to the one a
+// subscriber's live events start from, that the subscriber wants.
+func (b *broadcaster) replay(ctx context.Context, sub *subscriber, after, until int64, send func(*changeEvent) error) error {
+	for after < until {
+		changes, err := b.books.Changes(ctx, after, changeBatch)
+		if err != nil || len(changes) == 0 {
+			return err
+		}
+
+		for _, change := range changes {
+			if change.ID > until {
+				return nil
+			}
+			after = change.ID
+
+			event, err := b.event(ctx, change)
+			if err != nil {
+				return err
+			}
+			if event == nil || !sub.wants(event) {
+				continue
+			}
+
+			err = send(event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchGenres returns the set of genres a stream of changes to books in the
+// given genres matches, or nil to match every change. A genre also matches
+// books filed under its subgenres.
+func (app *application) matchGenres(ctx context.Context, v *validator.Validator, genres []string) (map[string]bool, error) {
+	if len(genres) == 0 {
+		return nil, nil
+	}
+
+	slugs, unknown, err := app.models.Genres.Normalize(ctx, genres)
+	if err != nil {
+		return nil, err
+	}
+	if len(unknown) > 0 {
+		v.AddError("genres", fmt.Sprintf("unknown genre %q", unknown[0]))
+	}
+
+	match := make(map[string]bool)
+	for _, slug := range slugs {
+		match[slug] = true
+
+		descendants, err := app.models.Genres.Descendants(ctx, slug)
+		if err != nil {
+			return nil, err
+		}
+		for _, descendant := range descendants {
+			match[descendant] = true
+		}
+	}
+
+	return match, nil
+}
+
+func writeEvent(w http.ResponseWriter, event *changeEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.id, event.name, event.data)
+	return err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id, name, data string
+}
+
+type sseStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// newStreamingApplication returns a test application with a running
+// broadcaster, stopped when the test ends.
+func newStreamingApplication(t *testing.T, heartbeat time.Duration) *application {
+	app := newTestApplication(t)
+	app.config.stream.heartbeat = heartbeat
+	app.stream = newBroadcaster(app.models.Books, app.logger, time.Hour)
+	app.stream.pollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go app.stream.run(ctx)
+
+	return app
+}
+
+func (ts *testServer) openStream(t *testing.T, urlPath string, headers http.Header) *sseStream {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+urlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header[key] = value
+	}
+
+	client := ts.Client()
+	client.Timeout = 5 * time.Second
+
+	rs, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rs.Body.Close() })
+
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rs.StatusCode, http.StatusOK)
+	}
+	if got := rs.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("got Content-Type %q; want text/event-stream", got)
+	}
+
+	return &sseStream{body: rs.Body, scanner: bufio.NewScanner(rs.Body)}
+}
+
+// next returns the next event, or a comment as an event with only data set.
+func (s *sseStream) next(t *testing.T) (sseEvent, bool) {
+	t.Helper()
+
+	var event sseEvent
+
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+
+		switch {
+		case line == "":
+			return event, true
+		case strings.HasPrefix(line, ":"):
+			event.data = line
+		default:
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				event.id = value
+			case "event":
+				event.name = value
+			case "data":
+				event.data = value
+			}
+		}
+	}
+
+	return event, false
+}
+
+func (s *sseStream) nextEvent(t *testing.T) sseEvent {
+	t.Helper()
+
+	for {
+		event, ok := s.next(t)
+		if !ok {
+			t.Fatal("stream ended before the next event")
+		}
+		if event.name != "" {
+			return event
+		}
+	}
+}
+
+func TestStreamBooks(t *testing.T) {
+	app := newStreamingApplication(t, time.Minute)
+	ts := newTestServer(t, app.routes())
+
+	stream := ts.openStream(t, "/v1/books/stream", nil)
+
+	id := ts.createBook(t, duneJSON)
+	ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/books/%d", id), `{"pages": "500 pages"}`)
+	ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/books/%d", id), "")
+
+	tests := []struct {
+		id, name, data string
+	}{
+		{"1", "book.created", `"title":"Dune"`},
+		{"2", "book.updated", `"version":2`},
+		{"3", "book.deleted", `{"book":{"id":1}}`},
+	}
+
+	for _, tt := range tests {
+		event := stream.nextEvent(t)
+
+		if event.id != tt.id || event.name != tt.name {
+			t.Errorf("got event %s %s; want %s %s", event.id, event.name, tt.id, tt.name)
+		}
+		if tt.name != "book.updated" && !strings.Contains(event.data, tt.data) {
+			t.Errorf("got %s data %s; want it to contain %s", event.name, event.data, tt.data)
+		}
+	}
+}
+
+func TestStreamBooksGenreFilter(t *testing.T) {
+	app := newStreamingApplication(t, time.Minute)
+	ts := newTestServer(t, app.routes())
+
+	stream := ts.openStream(t, "/v1/books/stream?genres=fiction", nil)
+
+	ts.createBook(t, `{"title": "SPQR", "year": 2015, "pages": "608 pages", "genres": ["history"]}`)
+	ts.createBook(t, duneJSON)
+
+	event := stream.nextEvent(t)
+	if event.id != "2" || !strings.Contains(event.data, `"title":"Dune"`) {
+		t.Errorf("got event %s %s; want Dune, filed under a subgenre of fiction, and not SPQR", event.id, event.data)
+	}
+
+	rs := ts.do(t, http.MethodGet, "/v1/books/stream?genres=poetry", "")
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for an unknown genre; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestStreamBooksResume(t *testing.T) {
+	app := newStreamingApplication(t, time.Minute)
+	ts := newTestServer(t, app.routes())
+
+	ts.createBook(t, duneJSON)
+	ts.createBook(t, `{"title": "Emma", "year": 1900, "pages": "474 pages", "genres": ["fiction"]}`)
+	ts.createBook(t, `{"title": "Persuasion", "year": 1918, "pages": "249 pages", "genres": ["fiction"]}`)
+
+	stream := ts.openStream(t, "/v1/books/stream", http.Header{"Last-Event-Id": {"1"}})
+
+	for _, want := range []string{"Emma", "Persuasion"} {
+		event := stream.nextEvent(t)
+		if !strings.Contains(event.data, want) {
+			t.Errorf("got event %s %s; want the missed change to %s", event.id, event.data, want)
+		}
+	}
+
+	ts.createBook(t, `{"title": "Middlemarch", "year": 1900, "pages": "880 pages", "genres": ["fiction"]}`)
+
+	if event := stream.nextEvent(t); event.id != "4" {
+		t.Errorf("got event %s; want the live change 4 after the replay", event.id)
+	}
+
+	rs := ts.doWithHeaders(t, http.MethodGet, "/v1/books/stream", "", http.Header{"Last-Event-Id": {"abc"}})
+	if rs.status != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for a bad Last-Event-ID; want %d", rs.status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestStreamBooksHeartbeatAndClose(t *testing.T) {
+	app := newStreamingApplication(t, 10*time.Millisecond)
+	ts := newTestServer(t, app.routes())
+
+	stream := ts.openStream(t, "/v1/books/stream", http.Header{"Accept-Encoding": {"gzip"}})
+
+	event, ok := stream.next(t)
+	if !ok || event.data != ": heartbeat" {
+		t.Fatalf("got %+v; want a heartbeat comment", event)
+	}
+
+	app.stream.close()
+
+	for {
+		if _, ok := stream.next(t); !ok {
+			break
+		}
+	}
+
+	rs := ts.do(t, http.MethodGet, "/v1/books/stream", "")
+	if rs.status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d after close; want %d", rs.status, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testDriver is the storage every test application uses. TestMain runs the
+// tests once with each driver.
+var testDriver = "memory"
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if code == 0 {
+		testDriver = "sqlite"
+		code = m.Run()
+	}
+	os.Exit(code)
+}
+
+func newTestApplication(t *testing.T) *application {
+	var cfg config
+	cfg.env = "testing"
+	cfg.graphql.maxDepth = 8
+	cfg.graphql.maxComplexity = 1000
+	cfg.loans.period = 14 * 24 * time.Hour
+	cfg.loans.maxRenewals = 2
+	cfg.holds.pickupPeriod = 72 * time.Hour
+	cfg.holds.checkInterval = time.Minute
+
+	app := &application{
+		config: cfg,
+		logger: log.New(io.Discard, "", 0),
+	}
+
+	switch testDriver {
+	case "sqlite":
+		t.Log("using a sqlite database")
+
+		cfg.db.dsn = filepath.Join(t.TempDir(), "test.db")
+
+		db, err := openSQLite(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		err = migrateSQLite(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		app.models = data.NewSQLiteModels(db, cfg.db.timeouts)
+	default:
+		app.models = data.NewMemoryModels()
+	}
+
+	return app
+}
+
+type testServer struct {
+	*httptest.Server
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return &testServer{ts}
+}
+
+type testResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (ts *testServer) do(t *testing.T, method, urlPath string, body string) testResponse {
+	t.Helper()
+	return ts.doWithHeaders(t, method, urlPath, body, nil)
+}
+
+func (ts *testServer) doWithHeaders(t *testing.T, method, urlPath string, body string, headers http.Header) testResponse {
+	t.Helper()
+
+	var reader io.Reader
+	if body != "" {
+		reader = bytes.NewBufferString(body)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+urlPath, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range headers {
+		req.Header[key] = value
+	}
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	rsBody, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An encoded body is binary, and trimming it could cut off the end of
+	// the stream.
+	if rs.Header.Get("Content-Encoding") == "" {
+		rsBody = bytes.TrimSpace(rsBody)
+	}
+
+	return testResponse{status: rs.StatusCode, header: rs.Header, body: rsBody}
+}
+
+// decode unmarshals the response body into dst, failing the test if the body
+// isn't a single JSON document.
+func (rs testResponse) decode(t *testing.T, dst interface{}) {
+	t.Helper()
+
+	dec := json.NewDecoder(bytes.NewReader(rs.body))
+	if err := dec.Decode(dst); err != nil {
+		t.Fatalf("decoding response %q: %v", rs.body, err)
+	}
+	if dec.More() {
+		t.Fatalf("response %q contains more than one JSON value", rs.body)
+	}
+}
+
+// errorMessage returns the "error" value of an error envelope.
+func (rs testResponse) errorMessage(t *testing.T) interface{} {
+	t.Helper()
+
+	var env struct {
+		Error interface{} `json:"error"`
+	}
+	rs.decode(t, &env)
+	return env.Error
+}
+
+// createBook inserts a book through the API and returns its id.
+func (ts *testServer) createBook(t *testing.T, body string) int64 {
+	t.Helper()
+
+	rs := ts.do(t, http.MethodPost, "/v1/books", body)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("creating book: got status %d; body %s", rs.status, rs.body)
+	}
+
+	var env struct {
+		Book data.Book `json:"book"`
+	}
+	rs.decode(t, &env)
+	return env.Book.ID
+}
+
+// authenticate registers a user with the given email address and returns the
+// headers that authenticate requests as them.
+func (ts *testServer) authenticate(t *testing.T, email string) http.Header {
+	t.Helper()
+
+	credentials := fmt.Sprintf(`{"email": %q, "password": "pa55word1234"}`, email)
+
+	rs := ts.do(t, http.MethodPost, "/v1/users", fmt.Sprintf(`{"name": "Test User", "email": %q, "password": "pa55word1234"}`, email))
+	if rs.status != http.StatusCreated {
+		t.Fatalf("registering user: got status %d; body %s", rs.status, rs.body)
+	}
+
+	rs = ts.do(t, http.MethodPost, "/v1/tokens/authentication", credentials)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("creating token: got status %d; body %s", rs.status, rs.body)
+	}
+
+	var env struct {
+		Token data.Token `json:"authentication_token"`
+	}
+	rs.decode(t, &env)
+
+	return http.Header{"Authorization": {"Bearer " + env.Token.Plaintext}}
+}
+
+// grant gives the registered user with the email address the permissions with
+// the given codes.
+func (app *application) grant(t *testing.T, email string, codes ...string) {
+	t.Helper()
+
+	user, err := app.models.Users.GetByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = app.models.Permissions.AddForUser(context.Background(), user.ID, codes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"net/http"
+)
+
+func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := &data.User{
+		Name:  input.Name,
+		Email: input.Email,
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Insert(r.Context(), user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runGrantCommand carries out -grant, giving the user with the email address
+// the permissions with the given codes.
+func (app *application) runGrantCommand(email string, codes []string) error {
+	if len(codes) == 0 {
+		return errors.New("grant requires permission codes, for example -grant=ann@example.com loans:report")
+	}
+	for _, code := range codes {
+		if !validator.In(code, data.PermissionCodes...) {
+			return fmt.Errorf("unknown permission %q", code)
+		}
+	}
+
+	ctx := context.Background()
+
+	user, err := app.models.Users.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return fmt.Errorf("no user with email %s", email)
+		}
+		return err
+	}
+
+	err = app.models.Permissions.AddForUser(ctx, user.ID, codes...)
+	if err != nil {
+		return err
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	app.logger.Printf("%s now has the permissions %v", user.Email, permissions)
+	return nil
+}
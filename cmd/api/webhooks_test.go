@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"github.com/Bug-daulet/FinalSPA/internal/outbox"
+	"github.com/Bug-daulet/FinalSPA/internal/webhook"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedDelivery is a request made to a receiver set up by newReceiver.
+type receivedDelivery struct {
+	header http.Header
+	body   []byte
+}
+
+// newReceiver starts a server that records every request it gets and answers
+// with status.
+func newReceiver(t *testing.T, status int) (*httptest.Server, func() []receivedDelivery) {
+	var (
+		mu       sync.Mutex
+		received []receivedDelivery
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		received = append(received, receivedDelivery{header: r.Header.Clone(), body: body})
+		mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []receivedDelivery {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]receivedDelivery{}, received...)
+	}
+}
+
+func newTestDispatcher(app *application, maxAttempts int) *webhook.Dispatcher {
+	return webhook.New(app.models.Webhooks, log.New(io.Discard, "", 0), webhook.Config{
+		MaxAttempts:         maxAttempts,
+		RetryBase:           time.Nanosecond,
+		RetryMax:            time.Nanosecond,
+		Timeout:             5 * time.Second,
+		AllowPrivateTargets: true,
+	})
+}
+
+// relayOutbox publishes every message in the outbox to sinks, one batch at a
+// time until none are left.
+func relayOutbox(t *testing.T, app *application, sinks ...outbox.Sink) {
+	t.Helper()
+
+	relay := outbox.New(app.models.Outbox, log.New(io.Discard, "", 0), outbox.Config{}, sinks...)
+
+	for {
+		n, err := relay.RunOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return
+		}
+	}
+}
+
+// manageWebhooks registers a user who has been granted webhooks:manage and
+// returns the headers that authenticate requests as them.
+func (ts *testServer) manageWebhooks(t *testing.T, app *application) http.Header {
+	t.Helper()
+
+	headers := ts.authenticate(t, "ops@example.com")
+	app.grant(t, "ops@example.com", data.PermissionWebhooksManage)
+	return headers
+}
+
+func (ts *testServer) createWebhook(t *testing.T, headers http.Header, body string) data.Webhook {
+	t.Helper()
+
+	rs := ts.doWithHeaders(t, http.MethodPost, "/v1/webhooks", body, headers)
+	if rs.status != http.StatusCreated {
+		t.Fatalf("creating webhook: got status %d; body %s", rs.status, rs.body)
+	}
+
+	var env struct {
+		Webhook data.Webhook `json:"webhook"`
+	}
+	rs.decode(t, &env)
+	return env.Webhook
+}
+
+func (ts *testServer) deliveries(t *testing.T, headers http.Header, webhookID int64) []data.WebhookDelivery {
+	t.Helper()
+
+	rs := ts.doWithHeaders(t, http.MethodGet, fmt.Sprintf("/v1/webhooks/%d/deliveries", webhookID), "", headers)
+	if rs.status != http.StatusOK {
+		t.Fatalf("listing deliveries: got status %d; body %s", rs.status, rs.body)
+	}
+
+	var env struct {
+		Deliveries []data.WebhookDelivery `json:"deliveries"`
+	}
+	rs.decode(t, &env)
+	return env.Deliveries
+}
+
+func TestWebhookCRUD(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	rs := ts.do(t, http.MethodGet, "/v1/webhooks", "")
+	if rs.status != http.StatusUnauthorized {
+		t.Errorf("got status %d listing webhooks anonymously; want %d", rs.status, http.StatusUnauthorized)
+	}
+
+	member := ts.authenticate(t, "alice@example.com")
+	rs = ts.doWithHeaders(t, http.MethodPost, "/v1/webhooks", `{"url": "https://example.com/hooks", "events": ["book.created"]}`, member)
+	if rs.status != http.StatusForbidden {
+		t.Errorf("got status %d creating a webhook as a member; want %d", rs.status, http.StatusForbidden)
+	}
+
+	ops := ts.manageWebhooks(t, app)
+	created := ts.createWebhook(t, ops, `{"url": "https://example.com/hooks", "events": ["book.created"]}`)
+
+	if len(created.Secret) != 64 {
+		t.Errorf("got secret %q; want a generated 64 character secret", created.Secret)
+	}
+	if !created.Active {
+		t.Error("got an inactive webhook; want it active by default")
+	}
+
+	path := fmt.Sprintf("/v1/webhooks/%d", created.ID)
+
+	rs = ts.doWithHeaders(t, http.MethodGet, path, "", ops)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rs.status, http.StatusOK)
+	}
+
+	var env struct {
+		Webhook map[string]interface{} `json:"webhook"`
+	}
+	rs.decode(t, &env)
+	if _, ok := env.Webhook["secret"]; ok {
+		t.Errorf("got secret in %s; want it only shown on create", rs.body)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodPatch, path, `{"events": ["book.updated", "book.deleted"], "active": false}`, ops)
+	if rs.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusOK, rs.body)
+	}
+	env.Webhook = nil
+	rs.decode(t, &env)
+	if fmt.Sprint(env.Webhook["events"]) != "[book.updated book.deleted]" || env.Webhook["active"] != false {
+		t.Errorf("got %s; want the events replaced and the webhook deactivated", rs.body)
+	}
+
+	rs = ts.doWithHeaders(t, http.MethodGet, "/v1/webhooks", "", ops)
+	var list struct {
+		Webhooks []map[string]interface{} `json:"webhooks"`
+	}
+	rs.decode(t, &list)
+	if len(list.Webhooks) != 1 {
+		t.Fatalf("got %d webhooks; want 1", len(list.Webhooks))
+	}
+	if _, ok := list.Webhooks[0]["secret"]; ok {
+		t.Errorf("got secret in %s; want it only shown on create", rs.body)
+	}
+
+	if rs := ts.doWithHeaders(t, http.MethodDelete, path, "", member); rs.status != http.StatusForbidden {
+		t.Errorf("got status %d deleting a webhook as a member; want %d", rs.status, http.StatusForbidden)
+	}
+	if rs := ts.doWithHeaders(t, http.MethodDelete, path, "", ops); rs.status != http.StatusOK {
+		t.Fatalf("got status %d; want %d", rs.status, http.StatusOK)
+	}
+	if rs := ts.doWithHeaders(t, http.MethodGet, path, "", ops); rs.status != http.StatusNotFound {
+		t.Errorf("got status %d after delete; want %d", rs.status, http.StatusNotFound)
+	}
+}
+
+func TestCreateWebhookValidation(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	tests := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"Missing URL", `{"events": ["book.created"]}`, "url"},
+		{"Relative URL", `{"url": "/hooks", "events": ["book.created"]}`, "url"},
+		{"Other scheme", `{"url": "ftp://example.com/hooks", "events": ["book.created"]}`, "url"},
+		{"No events", `{"url": "https://example.com/hooks", "events": []}`, "events"},
+		{"Unknown event", `{"url": "https://example.com/hooks", "events": ["book.read"]}`, "events"},
+		{"Duplicate events", `{"url": "https://example.com/hooks", "events": ["book.created", "book.created"]}`, "events"},
+		{"Short secret", `{"url": "https://example.com/hooks", "events": ["book.created"], "secret": "short"}`, "secret"},
+		{"Loopback", `{"url": "http://127.0.0.1:8080/hooks", "events": ["book.created"]}`, "url"},
+		{"Localhost", `{"url": "http://localhost/hooks", "events": ["book.created"]}`, "url"},
+		{"Private", `{"url": "http://10.0.0.5/hooks", "events": ["book.created"]}`, "url"},
+		{"Link-local", `{"url": "http://169.254.169.254/latest/meta-data", "events": ["book.created"]}`, "url"},
+		{"IPv6 loopback", `{"url": "http://[::1]/hooks", "events": ["book.created"]}`, "url"},
+	}
+
+	headers := ts.manageWebhooks(t, app)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := ts.doWithHeaders(t, http.MethodPost, "/v1/webhooks", tt.body, headers)
+
+			if rs.status != http.StatusUnprocessableEntity {
+				t.Fatalf("got status %d; want %d; body %s", rs.status, http.StatusUnprocessableEntity, rs.body)
+			}
+
+			errs, ok := rs.errorMessage(t).(map[string]interface{})
+			if !ok || errs[tt.field] == nil {
+				t.Errorf("got errors %s; want one for %q", rs.body, tt.field)
+			}
+		})
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	receiver, received := newReceiver(t, http.StatusNoContent)
+	app.config.webhooks.allowPrivateTargets = true
+	ops := ts.manageWebhooks(t, app)
+
+	const secret = "0123456789abcdef0123"
+	hook := ts.createWebhook(t, ops, fmt.Sprintf(`{"url": %q, "events": ["book.created", "book.deleted"], "secret": %q}`, receiver.URL, secret))
+	ts.createWebhook(t, ops, fmt.Sprintf(`{"url": %q, "events": ["book.created"], "active": false}`, receiver.URL))
+
+	id := ts.createBook(t, duneJSON)
+	ts.do(t, http.MethodPatch, fmt.Sprintf("/v1/books/%d", id), `{"pages": "500 pages"}`)
+	ts.do(t, http.MethodDelete, fmt.Sprintf("/v1/books/%d", id), "")
+
+	dispatcher := newTestDispatcher(app, 3)
+	relayOutbox(t, app, dispatcher)
+
+	n, err := dispatcher.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("got %d deliveries; want 2 (created and deleted, to the active webhook only)", n)
+	}
+
+	got := received()
+	if len(got) != 2 {
+		t.Fatalf("receiver got %d requests; want 2", len(got))
+	}
+
+	events := map[string]bool{}
+	for _, d := range got {
+		timestamp, err := strconv.ParseInt(d.header.Get(webhook.TimestampHeader), 10, 64)
+		if err != nil {
+			t.Fatalf("bad timestamp header: %v", err)
+		}
+		if sig := d.header.Get(webhook.SignatureHeader); sig != webhook.Sign(secret, timestamp, d.body) {
+			t.Errorf("got signature %q; want it to match the body", sig)
+		}
+
+		var payload struct {
+			Event string `json:"event"`
+			Data  struct {
+				Book struct {
+					ID int64 `json:"id"`
+				} `json:"book"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(d.body, &payload); err != nil {
+			t.Fatalf("decoding payload %q: %v", d.body, err)
+		}
+		if payload.Event != d.header.Get(webhook.EventHeader) || payload.Data.Book.ID != id {
+			t.Errorf("got payload %s with event header %q; want book %d", d.body, d.header.Get(webhook.EventHeader), id)
+		}
+		events[payload.Event] = true
+	}
+	if !events["book.created"] || !events["book.deleted"] {
+		t.Errorf("got events %v; want book.created and book.deleted", events)
+	}
+
+	for _, d := range ts.deliveries(t, ops, hook.ID) {
+		if d.Status != data.DeliverySucceeded || d.Attempts != 1 || d.ResponseStatus != http.StatusNoContent {
+			t.Errorf("got delivery %+v; want it succeeded on the first attempt", d)
+		}
+	}
+}
+
+func TestWebhookDeliveryRetries(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	receiver, received := newReceiver(t, http.StatusInternalServerError)
+	app.config.webhooks.allowPrivateTargets = true
+	ops := ts.manageWebhooks(t, app)
+
+	hook := ts.createWebhook(t, ops, fmt.Sprintf(`{"url": %q, "events": ["book.created"]}`, receiver.URL))
+	ts.createBook(t, duneJSON)
+
+	dispatcher := newTestDispatcher(app, 2)
+	relayOutbox(t, app, dispatcher)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		time.Sleep(time.Millisecond)
+		if _, err := dispatcher.RunOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := len(received()); got != 2 {
+		t.Errorf("receiver got %d requests; want 2 before the delivery is given up", got)
+	}
+
+	deliveries := ts.deliveries(t, ops, hook.ID)
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries; want 1", len(deliveries))
+	}
+	if d := deliveries[0]; d.Status != data.DeliveryDead || d.Attempts != 2 || d.ResponseStatus != http.StatusInternalServerError || d.LastError == "" {
+		t.Errorf("got delivery %+v; want it dead after 2 failed attempts", d)
+	}
+
+	rs := ts.doWithHeaders(t, http.MethodGet, fmt.Sprintf("/v1/webhooks/%d/deliveries?status=pending", hook.ID), "", ops)
+	var env struct {
+		Deliveries []data.WebhookDelivery `json:"deliveries"`
+	}
+	rs.decode(t, &env)
+	if len(env.Deliveries) != 0 {
+		t.Errorf("got %d pending deliveries; want 0", len(env.Deliveries))
+	}
+}
+
+func TestWebhookDeliveryRefusesPrivateTargets(t *testing.T) {
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	// The webhook is saved while private targets are allowed, as it would be
+	// if its name later came to resolve to a private address.
+	receiver, received := newReceiver(t, http.StatusNoContent)
+	app.config.webhooks.allowPrivateTargets = true
+	ops := ts.manageWebhooks(t, app)
+
+	hook := ts.createWebhook(t, ops, fmt.Sprintf(`{"url": %q, "events": ["book.created"]}`, receiver.URL))
+	ts.createBook(t, duneJSON)
+
+	dispatcher := webhook.New(app.models.Webhooks, log.New(io.Discard, "", 0), webhook.Config{
+		MaxAttempts: 1,
+		RetryBase:   time.Nanosecond,
+		RetryMax:    time.Nanosecond,
+		Timeout:     5 * time.Second,
+	})
+	relayOutbox(t, app, dispatcher)
+
+	if _, err := dispatcher.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(received()); got != 0 {
+		t.Errorf("receiver got %d requests; want the connection refused", got)
+	}
+
+	deliveries := ts.deliveries(t, ops, hook.ID)
+	if len(deliveries) != 1 || deliveries[0].Status != data.DeliveryDead || !strings.Contains(deliveries[0].LastError, "private") {
+		t.Errorf("got deliveries %+v; want one dead delivery refused for its private address", deliveries)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := webhook.New(nil, nil, webhook.Config{RetryBase: 30 * time.Second, RetryMax: 5 * time.Minute})
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{20, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := d.Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %v; want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Command webhook-receiver is a local endpoint for trying out webhooks. It
+// logs every delivery it gets and checks its signature, answering 401 when the
+// signature doesn't match the secret and -fail's status when asked to fail.
+package main
+
+import (
+	"crypto/hmac"
+	"flag"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/webhook"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "Address to listen on")
+	secret := flag.String("secret", "", "The webhook's secret, to check signatures with")
+	tolerance := flag.Duration("tolerance", 5*time.Minute, "Oldest timestamp accepted, to reject replayed deliveries")
+	fail := flag.Int("fail", 0, "Answer every delivery with this status, to try out retries")
+	flag.Parse()
+
+	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Printf("delivery %s: %s %s", r.Header.Get(webhook.DeliveryHeader), r.Header.Get(webhook.EventHeader), body)
+
+		if *secret != "" {
+			if err := verify(r.Header, body, *secret, *tolerance); err != nil {
+				logger.Printf("rejected: %v", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if *fail != 0 {
+			w.WriteHeader(*fail)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	logger.Printf("receiving webhooks on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func verify(header http.Header, body []byte, secret string, tolerance time.Duration) error {
+	timestamp, err := strconv.ParseInt(header.Get(webhook.TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad %s header", webhook.TimestampHeader)
+	}
+
+	if age := time.Since(time.Unix(timestamp, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp is %v away", age.Round(time.Second))
+	}
+
+	want := webhook.Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(header.Get(webhook.SignatureHeader)), []byte(want)) {
+		return fmt.Errorf("signature does not match")
+	}
+
+	return nil
+}
@@ -0,0 +1,5 @@
+// Package bookspb holds the protobuf messages and gRPC stubs generated from
+// books.proto. Regenerate them after editing it with go generate.
+package bookspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative books.proto
@@ -7,20 +7,148 @@ import (
 	"fmt"
 	"github.com/Bug-daulet/FinalSPA/internal/validator"
 	"github.com/lib/pq"
+	"strings"
 	"time"
 )
 
 type BookModel struct {
-	DB *sql.DB
+	DB       *sql.DB
+	Timeouts Timeouts
 }
 type Book struct {
 	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 	Title     string    `json:"title"`
 	Year      int32     `json:"year,omitempty"`
 	Pages     Pages     `json:"pages,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
 	Version   int32     `json:"version"`
+
+	// AverageRating and RatingsCount summarise the book's reviews. They are
+	// kept up to date by the review store, not by Update.
+	AverageRating float64 `json:"average_rating"`
+	RatingsCount  int32   `json:"ratings_count"`
+
+	// CopiesTotal and CopiesAvailable count the library's copies of the book
+	// and those on the shelf to lend. They are kept up to date by the copy
+	// and loan stores.
+	CopiesTotal     int32 `json:"copies_total"`
+	CopiesAvailable int32 `json:"copies_available"`
+
+	// Available is true while a copy can be checked out. A copy that comes
+	// back while holds are waiting goes to the next of them, so the book
+	// only becomes available again once its queue is empty.
+	Available bool `json:"available"`
+}
+
+var BookFieldSafelist = []string{"id", "created_at", "updated_at", "title", "year", "pages", "genres", "version", "average_rating", "ratings_count", "copies_total", "copies_available", "available"}
+
+// bookSortColumns maps the book sort values that aren't column names.
+var bookSortColumns = map[string]string{"rating": "average_rating"}
+
+func ValidateBookFields(v *validator.Validator, fields []string) {
+	for _, field := range fields {
+		if !validator.In(field, BookFieldSafelist...) {
+			v.AddError("fields", fmt.Sprintf("invalid field %q", field))
+			break
+		}
+	}
+	v.Check(validator.Unique(fields), "fields", "must not contain duplicate values")
+}
+
+// Select returns the book as a map holding only the given JSON fields.
+func (b *Book) Select(fields []string) map[string]interface{} {
+	selected := make(map[string]interface{}, len(fields))
+
+	for _, field := range fields {
+		switch field {
+		case "id":
+			selected[field] = b.ID
+		case "created_at":
+			selected[field] = b.CreatedAt
+		case "updated_at":
+			selected[field] = b.UpdatedAt
+		case "title":
+			selected[field] = b.Title
+		case "year":
+			selected[field] = b.Year
+		case "pages":
+			selected[field] = b.Pages
+		case "genres":
+			selected[field] = b.Genres
+		case "version":
+			selected[field] = b.Version
+		case "average_rating":
+			selected[field] = b.AverageRating
+		case "ratings_count":
+			selected[field] = b.RatingsCount
+		case "copies_total":
+			selected[field] = b.CopiesTotal
+		case "copies_available":
+			selected[field] = b.CopiesAvailable
+		case "available":
+			selected[field] = b.Available
+		}
+	}
+
+	return selected
+}
+
+// bookColumns returns the columns to select for the given fields along with
+// the matching scan destinations in book. No fields means every column, and
+// array adapts the genres column to the driver's array encoding. The id,
+// updated_at, version, rating and copy count columns are always read, since
+// responses are validated by them for HTTP caching.
+func bookColumns(book *Book, fields []string, array func(*[]string) interface{}) (string, []interface{}) {
+	if len(fields) == 0 {
+		fields = BookFieldSafelist
+	} else {
+		fields = fields[:len(fields):len(fields)]
+		for _, field := range []string{"id", "updated_at", "version", "average_rating", "ratings_count", "copies_total", "copies_available"} {
+			if !validator.In(field, fields...) {
+				fields = append(fields, field)
+			}
+		}
+	}
+
+	dest := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		switch field {
+		case "id":
+			dest = append(dest, &book.ID)
+		case "created_at":
+			dest = append(dest, &book.CreatedAt)
+		case "updated_at":
+			dest = append(dest, &book.UpdatedAt)
+		case "title":
+			dest = append(dest, &book.Title)
+		case "year":
+			dest = append(dest, &book.Year)
+		case "pages":
+			dest = append(dest, &book.Pages)
+		case "genres":
+			dest = append(dest, array(&book.Genres))
+		case "version":
+			dest = append(dest, &book.Version)
+		case "average_rating":
+			dest = append(dest, &book.AverageRating)
+		case "ratings_count":
+			dest = append(dest, &book.RatingsCount)
+		case "copies_total":
+			dest = append(dest, &book.CopiesTotal)
+		case "copies_available":
+			dest = append(dest, &book.CopiesAvailable)
+		case "available":
+			dest = append(dest, &book.Available)
+		}
+	}
+
+	return strings.Join(fields, ", "), dest
+}
+
+func pgArray(a *[]string) interface{} {
+	return pq.Array(a)
 }
 
 func ValidateBooks(v *validator.Validator, input *Book) {
@@ -41,61 +169,71 @@ func ValidateBooks(v *validator.Validator, input *Book) {
 	v.Check(validator.Unique(input.Genres), "genres", "must not contain duplicate values")
 }
 
-func (b BookModel) Insert(book *Book) error {
+func (b BookModel) Insert(ctx context.Context, book *Book) error {
 	query := `INSERT INTO books (title, year, pages, genres)
 				VALUES ($1, $2, $3, $4)
-				RETURNING id, created_at, version`
+				RETURNING id, created_at, updated_at, version`
 
 	args := []interface{}{book.Title, book.Year, book.Pages, pq.Array(book.Genres)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := b.Timeouts.write(ctx)
 	defer cancel()
 
-	return b.DB.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.Version)
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.UpdatedAt, &book.Version)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	err = insertOutbox(ctx, tx, EventBookCreated, book.ID, bookEventData(book))
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
 
 }
 
-func (b BookModel) Get(id int64) (*Book, error) {
+func (b BookModel) Get(ctx context.Context, id int64, fields ...string) (*Book, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
-	query := `SELECT  id, created_at, title, year, pages, genres, version
-				FROM books
-				WHERE id = $1`
 
 	var book Book
+	columns, dest := bookColumns(&book, fields, pgArray)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	query := fmt.Sprintf(`SELECT %s
+				FROM books
+				WHERE id = $1`, columns)
+
+	ctx, cancel := b.Timeouts.read(ctx)
 	defer cancel()
 
-	err := b.DB.QueryRowContext(ctx, query, id).Scan(
-		&book.ID,
-		&book.CreatedAt,
-		&book.Title,
-		&book.Year,
-		&book.Pages,
-		pq.Array(&book.Genres),
-		&book.Version,
-	)
+	err := b.DB.QueryRowContext(ctx, query, id).Scan(dest...)
 
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
 	return &book, nil
 
 }
-func (b BookModel) Update(book *Book) error {
+func (b BookModel) Update(ctx context.Context, book *Book) error {
 	query := `
 		UPDATE books
-		SET title = $1, year = $2, pages = $3, genres = $4, version = version + 1
+		SET title = $1, year = $2, pages = $3, genres = $4, updated_at = NOW(), version = version + 1
 		WHERE id = $5 AND version = $6
-		RETURNING version`
+		RETURNING updated_at, version`
 	args := []interface{}{
 		book.Title,
 		book.Year,
@@ -105,22 +243,34 @@ func (b BookModel) Update(book *Book) error {
 		book.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := b.Timeouts.write(ctx)
 	defer cancel()
 
-	err := b.DB.QueryRowContext(ctx, query, args...).Scan(&book.Version)
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&book.UpdatedAt, &book.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return contextError(ctx, err)
 		}
 	}
-	return nil
+
+	err = insertOutbox(ctx, tx, EventBookUpdated, book.ID, bookEventData(book))
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
 }
 
-func (b BookModel) Delete(id int64) error {
+func (b BookModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -128,43 +278,104 @@ func (b BookModel) Delete(id int64) error {
 	query := `DELETE FROM books
 				WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := b.Timeouts.write(ctx)
 	defer cancel()
 
-	result, err := b.DB.ExecContext(ctx, query, id)
+	tx, err := b.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return contextError(ctx, err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return contextError(ctx, err)
 	}
 
 	if rowsAffected == 0 {
 		return ErrRecordNotFound
 	}
-	return nil
+
+	err = insertOutbox(ctx, tx, EventBookDeleted, id, deletedBookEventData(id))
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
 
 }
 
-func (b BookModel) GetAll(title string, genres []string, filters Filters) ([]*Book, Metadata, error) {
+func (b BookModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Book, Metadata, error) {
+	filters.sortColumns = bookSortColumns
+	where := &whereClause{}
+
+	if title != "" {
+		where.add("to_tsvector('simple', title) @@ plainto_tsquery('simple', ?)", title)
+	}
+	if len(genres) > 0 {
+		matches := make([]string, len(genres))
+		for i, genre := range genres {
+			matches[i] = fmt.Sprintf("genres && genre_descendants(%s)", where.placeholder(genre))
+		}
+		if filters.GenresMode == "any" {
+			where.add("(" + strings.Join(matches, " OR ") + ")")
+		} else {
+			where.add(strings.Join(matches, " AND "))
+		}
+	}
+	for _, genre := range filters.ExcludeGenres {
+		where.add("NOT genres && genre_descendants(?)", genre)
+	}
+	if filters.YearMin > 0 {
+		where.add("year >= ?", filters.YearMin)
+	}
+	if filters.YearMax > 0 {
+		where.add("year <= ?", filters.YearMax)
+	}
+	if filters.PagesMin > 0 {
+		where.add("pages >= ?", filters.PagesMin)
+	}
+	if filters.PagesMax > 0 {
+		where.add("pages <= ?", filters.PagesMax)
+	}
+	if filters.RatingMin > 0 {
+		where.add("average_rating >= ?", filters.RatingMin)
+	}
+	if filters.RatingMax > 0 {
+		where.add("average_rating <= ?", filters.RatingMax)
+	}
+	if filters.RatingsMin > 0 {
+		where.add("ratings_count >= ?", filters.RatingsMin)
+	}
+	if !filters.CreatedAfter.IsZero() {
+		where.add("created_at >= ?", filters.CreatedAfter)
+	}
+	if !filters.CreatedBefore.IsZero() {
+		where.add("created_at < ?", filters.CreatedBefore)
+	}
+
+	columns, _ := bookColumns(&Book{}, filters.Fields, pgArray)
+
 	query := fmt.Sprintf(`
-			SELECT count(*) OVER(), id, created_at, title, year, pages, genres, version
+			SELECT count(*) OVER(), %s
 			FROM books
-			WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-			AND (genres @> $2 OR $2 = '{}')
-			ORDER BY %s %s, id ASC
-			LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+			%s
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		columns, where, filters.orderBy(),
+		where.placeholder(filters.limit()), where.placeholder(filters.offset()))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := b.Timeouts.read(ctx)
 	defer cancel()
 
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
-
-	rows, err := b.DB.QueryContext(ctx, query, args...)
+	rows, err := b.DB.QueryContext(ctx, query, where.args...)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, contextError(ctx, err)
 	}
 
 	defer rows.Close()
@@ -174,20 +385,12 @@ func (b BookModel) GetAll(title string, genres []string, filters Filters) ([]*Bo
 
 	for rows.Next() {
 		var book Book
+		_, dest := bookColumns(&book, filters.Fields, pgArray)
 
-		err := rows.Scan(
-			&totalRecords,
-			&book.ID,
-			&book.CreatedAt,
-			&book.Title,
-			&book.Year,
-			&book.Pages,
-			pq.Array(&book.Genres),
-			&book.Version,
-		)
+		err := rows.Scan(append([]interface{}{&totalRecords}, dest...)...)
 
 		if err != nil {
-			return nil, Metadata{}, err
+			return nil, Metadata{}, contextError(ctx, err)
 		}
 
 		books = append(books, &book)
@@ -195,7 +398,7 @@ func (b BookModel) GetAll(title string, genres []string, filters Filters) ([]*Bo
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, contextError(ctx, err)
 	}
 
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
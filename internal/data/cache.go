@@ -0,0 +1,403 @@
+package data
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats counts lookups against a CachedBookStore since it was created.
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+}
+
+// lruCache is a fixed-size map that drops the least recently used entry to
+// make room, and treats entries older than ttl as absent.
+type lruCache struct {
+	// The counters come first to keep them 64-bit aligned for the atomic
+	// functions on 32-bit platforms.
+	hits, misses, evictions uint64
+
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+
+	// generation changes whenever entries are invalidated, so that a lookup
+	// which raced with a write doesn't store what it read before the write.
+	generation uint64
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the value stored under key, along with the generation to pass
+// to put if there is none.
+func (c *lruCache) get(key string) (interface{}, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry)
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(el)
+			atomic.AddUint64(&c.hits, 1)
+			return entry.value, c.generation, true
+		}
+		c.removeElement(el)
+	}
+
+	atomic.AddUint64(&c.misses, 1)
+	return nil, c.generation, false
+}
+
+// put stores value unless entries have been invalidated since generation was
+// read.
+func (c *lruCache) put(key string, value interface{}, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: time.Now().Add(c.ttl)})
+
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *lruCache) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*lruEntry).key)
+}
+
+func (c *lruCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// CachedBookStore keeps recently read books and book listings in memory in
+// front of another BookStore. Writes through it invalidate what they affect,
+// but writes made by other processes are only seen once the TTL runs out.
+type CachedBookStore struct {
+	store BookStore
+	books *lruCache
+	lists *lruCache
+}
+
+type cachedList struct {
+	books    []*Book
+	metadata Metadata
+}
+
+// NewCachedModels wraps models with a cache of up to size books and size
+// listings, each kept for at most ttl. Genre writes clear the cached listings,
+// since a new parent changes which books a genre filter matches, and a new
+// slug clears the cached books too, as it is renamed in theirs. Review, copy,
+// loan and hold writes drop the book and the listings, since they change its
+// rating, copy counts or availability.
+func NewCachedModels(models Models, size int, ttl time.Duration) Models {
+	books := &CachedBookStore{
+		store: models.Books,
+		books: newLRUCache(size, ttl),
+		lists: newLRUCache(size, ttl),
+	}
+
+	invalidator := bookInvalidator{books: books.books, lists: books.lists}
+
+	return Models{
+		Books:       books,
+		Genres:      invalidatingGenreStore{GenreStore: models.Genres, books: books.books, lists: books.lists},
+		Webhooks:    models.Webhooks,
+		Outbox:      models.Outbox,
+		Users:       models.Users,
+		Tokens:      models.Tokens,
+		Permissions: models.Permissions,
+		Shelves:     models.Shelves,
+		Reviews:     invalidatingReviewStore{ReviewStore: models.Reviews, bookInvalidator: invalidator},
+		Copies:      invalidatingCopyStore{CopyStore: models.Copies, bookInvalidator: invalidator},
+		Loans:       invalidatingLoanStore{LoanStore: models.Loans, bookInvalidator: invalidator},
+		Holds:       invalidatingHoldStore{HoldStore: models.Holds, bookInvalidator: invalidator},
+	}
+}
+
+// Stats adds up the counters of the book and listing caches.
+func (c *CachedBookStore) Stats() CacheStats {
+	var stats CacheStats
+
+	for _, cache := range []*lruCache{c.books, c.lists} {
+		stats.Hits += atomic.LoadUint64(&cache.hits)
+		stats.Misses += atomic.LoadUint64(&cache.misses)
+		stats.Evictions += atomic.LoadUint64(&cache.evictions)
+		stats.Entries += cache.len()
+	}
+
+	return stats
+}
+
+func (c *CachedBookStore) Insert(ctx context.Context, book *Book) error {
+	err := c.store.Insert(ctx, book)
+	if err == nil {
+		c.lists.clear()
+	}
+	return err
+}
+
+// Get caches whole books, so a request for some fields is served from the
+// same entry as a request for all of them.
+func (c *CachedBookStore) Get(ctx context.Context, id int64, fields ...string) (*Book, error) {
+	key := fmt.Sprint(id)
+
+	value, generation, ok := c.books.get(key)
+	if ok {
+		return copyBook(value.(*Book)), nil
+	}
+
+	book, err := c.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c.books.put(key, copyBook(book), generation)
+	return book, nil
+}
+
+func (c *CachedBookStore) Update(ctx context.Context, book *Book) error {
+	err := c.store.Update(ctx, book)
+
+	// An edit conflict means the cached copy is out of date too.
+	c.books.remove(fmt.Sprint(book.ID))
+	c.lists.clear()
+
+	return err
+}
+
+func (c *CachedBookStore) Delete(ctx context.Context, id int64) error {
+	err := c.store.Delete(ctx, id)
+	if err == nil {
+		c.books.remove(fmt.Sprint(id))
+		c.lists.clear()
+	}
+	return err
+}
+
+func (c *CachedBookStore) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Book, Metadata, error) {
+	key := listKey(title, genres, filters)
+
+	value, generation, ok := c.lists.get(key)
+	if ok {
+		list := value.(cachedList)
+		return copyBooks(list.books), list.metadata, nil
+	}
+
+	books, metadata, err := c.store.GetAll(ctx, title, genres, filters)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	c.lists.put(key, cachedList{books: copyBooks(books), metadata: metadata}, generation)
+	return books, metadata, nil
+}
+
+func (c *CachedBookStore) Changes(ctx context.Context, after int64, limit int) ([]*BookChange, error) {
+	return c.store.Changes(ctx, after, limit)
+}
+
+func (c *CachedBookStore) PruneChanges(ctx context.Context, before time.Time) error {
+	return c.store.PruneChanges(ctx, before)
+}
+
+// listKey normalises a listing query, so that requests which only differ in
+// letter case or the order of their genres share a cache entry.
+func listKey(title string, genres []string, f Filters) string {
+	sorted := func(values []string) string {
+		values = append([]string{}, values...)
+		sort.Strings(values)
+		return strings.Join(values, ",")
+	}
+
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+
+	return strings.Join([]string{
+		strings.ToLower(strings.Join(strings.Fields(title), " ")),
+		sorted(genres),
+		f.GenresMode,
+		sorted(f.ExcludeGenres),
+		f.Sort,
+		fmt.Sprint(f.Page, f.PageSize, f.YearMin, f.YearMax, f.PagesMin, f.PagesMax, f.RatingMin, f.RatingMax, f.RatingsMin),
+		timestamp(f.CreatedAfter),
+		timestamp(f.CreatedBefore),
+		sorted(f.Fields),
+	}, "|")
+}
+
+func copyBooks(books []*Book) []*Book {
+	copies := make([]*Book, len(books))
+	for i, book := range books {
+		copies[i] = copyBook(book)
+	}
+	return copies
+}
+
+type invalidatingGenreStore struct {
+	GenreStore
+	books *lruCache
+	lists *lruCache
+}
+
+func (s invalidatingGenreStore) Insert(ctx context.Context, genre *Genre) error {
+	defer s.lists.clear()
+	return s.GenreStore.Insert(ctx, genre)
+}
+
+func (s invalidatingGenreStore) Update(ctx context.Context, genre *Genre) error {
+	defer s.lists.clear()
+	defer s.books.clear()
+	return s.GenreStore.Update(ctx, genre)
+}
+
+func (s invalidatingGenreStore) Delete(ctx context.Context, id int64) error {
+	defer s.lists.clear()
+	return s.GenreStore.Delete(ctx, id)
+}
+
+// bookInvalidator drops a book and the listings from the cache, for the
+// stores whose writes change a summary kept on the book.
+type bookInvalidator struct {
+	books *lruCache
+	lists *lruCache
+}
+
+func (i bookInvalidator) invalidate(bookID int64) {
+	i.books.remove(fmt.Sprint(bookID))
+	i.lists.clear()
+}
+
+type invalidatingReviewStore struct {
+	ReviewStore
+	bookInvalidator
+}
+
+func (s invalidatingReviewStore) Insert(ctx context.Context, review *Review) error {
+	defer s.invalidate(review.BookID)
+	return s.ReviewStore.Insert(ctx, review)
+}
+
+func (s invalidatingReviewStore) Update(ctx context.Context, review *Review) error {
+	defer s.invalidate(review.BookID)
+	return s.ReviewStore.Update(ctx, review)
+}
+
+func (s invalidatingReviewStore) Delete(ctx context.Context, bookID, id int64) error {
+	defer s.invalidate(bookID)
+	return s.ReviewStore.Delete(ctx, bookID, id)
+}
+
+type invalidatingCopyStore struct {
+	CopyStore
+	bookInvalidator
+}
+
+func (s invalidatingCopyStore) Insert(ctx context.Context, c *Copy) error {
+	defer s.invalidate(c.BookID)
+	return s.CopyStore.Insert(ctx, c)
+}
+
+func (s invalidatingCopyStore) Update(ctx context.Context, c *Copy) error {
+	defer s.invalidate(c.BookID)
+	return s.CopyStore.Update(ctx, c)
+}
+
+func (s invalidatingCopyStore) Delete(ctx context.Context, bookID, id int64) error {
+	defer s.invalidate(bookID)
+	return s.CopyStore.Delete(ctx, bookID, id)
+}
+
+type invalidatingLoanStore struct {
+	LoanStore
+	bookInvalidator
+}
+
+func (s invalidatingLoanStore) Checkout(ctx context.Context, loan *Loan) error {
+	defer s.invalidate(loan.BookID)
+	return s.LoanStore.Checkout(ctx, loan)
+}
+
+func (s invalidatingLoanStore) Update(ctx context.Context, loan *Loan) error {
+	defer s.invalidate(loan.BookID)
+	return s.LoanStore.Update(ctx, loan)
+}
+
+// invalidatingHoldStore drops the books whose copies moved when a ready hold
+// was cancelled or expired.
+type invalidatingHoldStore struct {
+	HoldStore
+	bookInvalidator
+}
+
+func (s invalidatingHoldStore) Cancel(ctx context.Context, hold *Hold) error {
+	defer s.invalidate(hold.BookID)
+	return s.HoldStore.Cancel(ctx, hold)
+}
+
+func (s invalidatingHoldStore) Expire(ctx context.Context) ([]*Hold, error) {
+	expired, err := s.HoldStore.Expire(ctx)
+	for _, hold := range expired {
+		s.invalidate(hold.BookID)
+	}
+	return expired, err
+}
@@ -0,0 +1,81 @@
+package data
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"time"
+)
+
+// BookChangesChannel is the Postgres notification channel a change's id is
+// sent on once it has been logged.
+const BookChangesChannel = "book_changes"
+
+// Change operations, named after the webhook events they correspond to.
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// BookChange is one entry in the log of writes to books, which a database
+// trigger keeps. Genres are the book's after the change, or before it for a
+// delete.
+type BookChange struct {
+	ID        int64
+	CreatedAt time.Time
+	Op        string
+	BookID    int64
+	Genres    []string
+}
+
+// Changes returns up to limit logged changes with an id greater than after,
+// oldest first.
+func (b BookModel) Changes(ctx context.Context, after int64, limit int) ([]*BookChange, error) {
+	query := `SELECT id, created_at, op, book_id, genres
+				FROM book_changes
+				WHERE id > $1
+				ORDER BY id ASC
+				LIMIT $2`
+
+	ctx, cancel := b.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := b.DB.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	changes := []*BookChange{}
+
+	for rows.Next() {
+		var change BookChange
+
+		err := rows.Scan(&change.ID, &change.CreatedAt, &change.Op, &change.BookID, pq.Array(&change.Genres))
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		changes = append(changes, &change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return changes, nil
+}
+
+// PruneChanges deletes changes logged before the given time, which clients
+// can then no longer resume from.
+func (b BookModel) PruneChanges(ctx context.Context, before time.Time) error {
+	query := `DELETE FROM book_changes
+				WHERE created_at < $1`
+
+	ctx, cancel := b.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := b.DB.ExecContext(ctx, query, before)
+	return contextError(ctx, err)
+}
@@ -0,0 +1,342 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"regexp"
+	"time"
+)
+
+var (
+	ErrDuplicateBarcode = errors.New("duplicate barcode")
+	ErrCopyOnLoan       = errors.New("copy on loan")
+	ErrCopyOnHold       = errors.New("copy on hold")
+)
+
+// Conditions a copy can be in, from best to worst.
+const (
+	ConditionNew     = "new"
+	ConditionGood    = "good"
+	ConditionFair    = "fair"
+	ConditionPoor    = "poor"
+	ConditionDamaged = "damaged"
+)
+
+var CopyConditions = []string{ConditionNew, ConditionGood, ConditionFair, ConditionPoor, ConditionDamaged}
+
+// Statuses of a copy. Only available copies can be checked out, and only
+// checkouts and returns move a copy into and out of on-loan. A copy that
+// becomes available while the book has holds waiting is on-hold instead,
+// until its hold is collected, cancelled or expires.
+const (
+	CopyAvailable = "available"
+	CopyOnLoan    = "on-loan"
+	CopyOnHold    = "on-hold"
+	CopyInRepair  = "in-repair"
+	CopyLost      = "lost"
+)
+
+var CopyStatuses = []string{CopyAvailable, CopyOnLoan, CopyOnHold, CopyInRepair, CopyLost}
+
+var CopySortSafelist = []string{"id", "barcode", "location", "acquired_at", "-id", "-barcode", "-location", "-acquired_at"}
+
+var BarcodeRX = regexp.MustCompile("^[A-Za-z0-9-]+$")
+
+type CopyModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Copy is one physical copy of a book, identified by the barcode on it.
+// Location is the shelf code it is kept under.
+type Copy struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	BookID     int64     `json:"book_id"`
+	Barcode    string    `json:"barcode"`
+	Condition  string    `json:"condition"`
+	Location   string    `json:"location"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	Status     string    `json:"status"`
+	Version    int32     `json:"version"`
+}
+
+func ValidateCopy(v *validator.Validator, c *Copy) {
+	v.Check(c.Barcode != "", "barcode", "must be provided")
+	v.Check(len(c.Barcode) <= 64, "barcode", "must not be more than 64 bytes long")
+	v.Check(validator.Matches(c.Barcode, BarcodeRX), "barcode", "must contain only letters, digits and hyphens")
+
+	v.Check(validator.In(c.Condition, CopyConditions...), "condition", "must be one of new, good, fair, poor or damaged")
+	v.Check(len(c.Location) <= 50, "location", "must not be more than 50 bytes long")
+	v.Check(!c.AcquiredAt.After(time.Now()), "acquired_at", "must not be in the future")
+	v.Check(validator.In(c.Status, CopyStatuses...), "status", "must be one of available, on-loan, on-hold, in-repair or lost")
+}
+
+// refreshCopiesQuery recounts a book's copies and those available to lend,
+// and sets its available flag. Its updated_at moves too, so that
+// conditional requests see the change.
+const refreshCopiesQuery = `
+		UPDATE books
+		SET copies_total = (SELECT count(*) FROM copies WHERE book_id = $1),
+			copies_available = (SELECT count(*) FROM copies WHERE book_id = $1 AND status = 'available'),
+			available = EXISTS (SELECT 1 FROM copies WHERE book_id = $1 AND status = 'available'),
+			updated_at = NOW()
+		WHERE id = $1`
+
+const copyColumns = "id, created_at, book_id, barcode, condition, location, acquired_at, status, version"
+
+func copyDest(c *Copy) []interface{} {
+	return []interface{}{
+		&c.ID,
+		&c.CreatedAt,
+		&c.BookID,
+		&c.Barcode,
+		&c.Condition,
+		&c.Location,
+		&c.AcquiredAt,
+		&c.Status,
+		&c.Version,
+	}
+}
+
+func (m CopyModel) Insert(ctx context.Context, c *Copy) error {
+	query := `INSERT INTO copies (book_id, barcode, condition, location, acquired_at, status)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id, created_at, version`
+
+	args := []interface{}{c.BookID, c.Barcode, c.Condition, c.Location, c.AcquiredAt, c.Status}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = lockBook(ctx, tx, c.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&c.ID, &c.CreatedAt, &c.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateBarcode
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = refreshCopies(ctx, tx, c.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (m CopyModel) Get(ctx context.Context, bookID, id int64) (*Copy, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`SELECT %s
+				FROM copies
+				WHERE id = $1 AND book_id = $2`, copyColumns)
+
+	return m.get(ctx, query, id, bookID)
+}
+
+func (m CopyModel) GetByBarcode(ctx context.Context, barcode string) (*Copy, error) {
+	query := fmt.Sprintf(`SELECT %s
+				FROM copies
+				WHERE barcode = $1`, copyColumns)
+
+	return m.get(ctx, query, barcode)
+}
+
+func (m CopyModel) get(ctx context.Context, query string, args ...interface{}) (*Copy, error) {
+	var c Copy
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(copyDest(&c)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &c, nil
+}
+
+// GetAll lists the book's copies in the given status, or any status if it is
+// empty.
+func (m CopyModel) GetAll(ctx context.Context, bookID int64, status string, filters Filters) ([]*Copy, Metadata, error) {
+	where := &whereClause{}
+	where.add("book_id = ?", bookID)
+	if status != "" {
+		where.add("status = ?", status)
+	}
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), %s
+			FROM copies
+			%s
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		copyColumns, where, filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	copies := []*Copy{}
+
+	for rows.Next() {
+		var c Copy
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, copyDest(&c)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		copies = append(copies, &c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return copies, metadata, nil
+}
+
+// Update saves the copy's details. A checkout or return in the meantime
+// changes the copy's version, so it makes this an edit conflict.
+func (m CopyModel) Update(ctx context.Context, c *Copy) error {
+	query := `
+		UPDATE copies
+		SET barcode = $1, condition = $2, location = $3, acquired_at = $4, status = $5, version = version + 1
+		WHERE id = $6 AND book_id = $7 AND version = $8
+		RETURNING version`
+	args := []interface{}{
+		c.Barcode,
+		c.Condition,
+		c.Location,
+		c.AcquiredAt,
+		c.Status,
+		c.ID,
+		c.BookID,
+		c.Version,
+	}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = lockBook(ctx, tx, c.BookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&c.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case isUniqueViolation(err):
+			return ErrDuplicateBarcode
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = refreshCopies(ctx, tx, c.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+// Delete removes the copy along with its past loans. It returns ErrCopyOnLoan
+// or ErrCopyOnHold rather than delete a copy that is out on loan or set
+// aside for a hold.
+func (m CopyModel) Delete(ctx context.Context, bookID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM copies
+				WHERE id = $1 AND book_id = $2
+				RETURNING status`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = lockBook(ctx, tx, bookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	var status string
+
+	err = tx.QueryRowContext(ctx, query, id, bookID).Scan(&status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	switch status {
+	case CopyOnLoan:
+		return ErrCopyOnLoan
+	case CopyOnHold:
+		return ErrCopyOnHold
+	}
+
+	err = refreshCopies(ctx, tx, bookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
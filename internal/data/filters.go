@@ -1,9 +1,11 @@
 package data
 
 import (
+	"fmt"
 	"github.com/Bug-daulet/FinalSPA/internal/validator"
 	"math"
 	"strings"
+	"time"
 )
 
 type Metadata struct {
@@ -28,10 +30,26 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 }
 
 type Filters struct {
-	Page         int
-	PageSize     int
-	Sort         string
-	SortSafelist []string
+	Page          int
+	PageSize      int
+	Sort          string
+	SortSafelist  []string
+	YearMin       int
+	YearMax       int
+	PagesMin      int
+	PagesMax      int
+	RatingMin     float64
+	RatingMax     float64
+	RatingsMin    int
+	GenresMode    string
+	ExcludeGenres []string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Fields        []string
+
+	// sortColumns maps the sort values that aren't named after the column
+	// they sort by. The store running the query sets it.
+	sortColumns map[string]string
 }
 
 func (f Filters) limit() int {
@@ -42,27 +60,117 @@ func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
 
-func (f Filters) sortColumn() string {
-	for _, safeValue := range f.SortSafelist {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
-		}
+func (f Filters) sortValues() []string {
+	return strings.Split(f.Sort, ",")
+}
+
+func (f Filters) sortColumn(value string) (string, bool) {
+	if !validator.In(value, f.SortSafelist...) {
+		return "", false
 	}
-	panic("unsafe sort parameter: " + f.Sort)
+
+	column := strings.TrimPrefix(value, "-")
+	if c, ok := f.sortColumns[column]; ok {
+		column = c
+	}
+	return column, true
 }
 
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
+func sortDirection(value string) string {
+	if strings.HasPrefix(value, "-") {
 		return "DESC"
 	}
 	return "ASC"
 }
 
+func (f Filters) orderBy() string {
+	var clauses []string
+	seenID := false
+
+	for _, value := range f.sortValues() {
+		column, ok := f.sortColumn(value)
+		if !ok {
+			continue
+		}
+		if column == "id" {
+			seenID = true
+		}
+		clauses = append(clauses, fmt.Sprintf("%s %s", column, sortDirection(value)))
+	}
+
+	if !seenID {
+		clauses = append(clauses, "id ASC")
+	}
+
+	return strings.Join(clauses, ", ")
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page > 0, "page", "must be greater than zero")
 	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 
-	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	columns := make([]string, 0, len(f.sortValues()))
+	for _, value := range f.sortValues() {
+		column, ok := f.sortColumn(value)
+		if !ok {
+			v.AddError("sort", fmt.Sprintf("invalid sort value %q", value))
+			break
+		}
+		columns = append(columns, column)
+	}
+	v.Check(validator.Unique(columns), "sort", "must not sort by the same column more than once")
+
+	v.Check(f.YearMin >= 0, "year_min", "must not be negative")
+	v.Check(f.YearMax >= 0, "year_max", "must not be negative")
+	if f.YearMin != 0 && f.YearMax != 0 {
+		v.Check(f.YearMin <= f.YearMax, "year_min", "must not be greater than year_max")
+	}
+
+	v.Check(f.PagesMin >= 0, "pages_min", "must not be negative")
+	v.Check(f.PagesMax >= 0, "pages_max", "must not be negative")
+	if f.PagesMin != 0 && f.PagesMax != 0 {
+		v.Check(f.PagesMin <= f.PagesMax, "pages_min", "must not be greater than pages_max")
+	}
+
+	v.Check(f.RatingMin >= 0 && f.RatingMin <= 5, "rating_min", "must be between 0 and 5")
+	v.Check(f.RatingMax >= 0 && f.RatingMax <= 5, "rating_max", "must be between 0 and 5")
+	if f.RatingMin != 0 && f.RatingMax != 0 {
+		v.Check(f.RatingMin <= f.RatingMax, "rating_min", "must not be greater than rating_max")
+	}
+	v.Check(f.RatingsMin >= 0, "ratings_min", "must not be negative")
+
+	v.Check(validator.In(f.GenresMode, "all", "any"), "genres_mode", "must be either all or any")
+	v.Check(validator.Unique(f.ExcludeGenres), "exclude_genres", "must not contain duplicate values")
+
+	if !f.CreatedAfter.IsZero() && !f.CreatedBefore.IsZero() {
+		v.Check(f.CreatedAfter.Before(f.CreatedBefore), "created_after", "must be earlier than created_before")
+	}
+}
+
+// whereClause numbers the '?' in each condition as a $n placeholder, so values never end up in the query text.
+type whereClause struct {
+	conditions []string
+	args       []interface{}
+}
+
+func (w *whereClause) add(condition string, args ...interface{}) {
+	for _, arg := range args {
+		w.args = append(w.args, arg)
+		condition = strings.Replace(condition, "?", fmt.Sprintf("$%d", len(w.args)), 1)
+	}
+	w.conditions = append(w.conditions, condition)
+}
+
+func (w *whereClause) placeholder(arg interface{}) string {
+	w.args = append(w.args, arg)
+	return fmt.Sprintf("$%d", len(w.args))
+}
+
+func (w *whereClause) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(w.conditions, "\n\t\t\tAND ")
 }
@@ -0,0 +1,402 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"github.com/lib/pq"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var SlugRX = regexp.MustCompile("^[a-z0-9]+(?:-[a-z0-9]+)*$")
+
+var (
+	ErrDuplicateGenre = errors.New("duplicate genre")
+	ErrGenreInUse     = errors.New("genre in use")
+)
+
+type GenreModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+type Genre struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	Aliases   []string  `json:"aliases"`
+	Parent    string    `json:"parent,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+// GenreKey is the form genre names and aliases are compared in.
+func GenreKey(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), " ")
+}
+
+func ValidateGenre(v *validator.Validator, genre *Genre) {
+	v.Check(genre.Slug != "", "slug", "must be provided")
+	v.Check(len(genre.Slug) <= 100, "slug", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(genre.Slug, SlugRX), "slug", "must contain only lowercase letters, digits and single hyphens")
+
+	v.Check(genre.Name != "", "name", "must be provided")
+	v.Check(len(genre.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(genre.Aliases) <= 20, "aliases", "must not contain more than 20 aliases")
+	v.Check(validator.Unique(genre.Aliases), "aliases", "must not contain duplicate values")
+	v.Check(!validator.In(genre.Slug, genre.Aliases...), "aliases", "must not contain the slug")
+
+	v.Check(genre.Parent != genre.Slug, "parent", "must not be the genre itself")
+}
+
+func (g GenreModel) Insert(ctx context.Context, genre *Genre) error {
+	query := `INSERT INTO genres (slug, name, aliases, parent_id)
+				VALUES ($1, $2, $3, (SELECT id FROM genres WHERE slug = $4))
+				RETURNING id, created_at, version`
+
+	args := []interface{}{genre.Slug, genre.Name, pq.Array(genre.Aliases), genre.Parent}
+
+	ctx, cancel := g.Timeouts.write(ctx)
+	defer cancel()
+
+	err := g.DB.QueryRowContext(ctx, query, args...).Scan(&genre.ID, &genre.CreatedAt, &genre.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateGenre
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (g GenreModel) Get(ctx context.Context, id int64) (*Genre, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `SELECT g.id, g.created_at, g.slug, g.name, g.aliases, coalesce(p.slug, ''), g.version
+				FROM genres g
+				LEFT JOIN genres p ON p.id = g.parent_id
+				WHERE g.id = $1`
+
+	var genre Genre
+
+	ctx, cancel := g.Timeouts.read(ctx)
+	defer cancel()
+
+	err := g.DB.QueryRowContext(ctx, query, id).Scan(
+		&genre.ID,
+		&genre.CreatedAt,
+		&genre.Slug,
+		&genre.Name,
+		pq.Array(&genre.Aliases),
+		&genre.Parent,
+		&genre.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &genre, nil
+}
+
+// Update saves the genre, and if its slug changed, renames it in the genres
+// of every book that has it, recording a book.updated event for each, as part
+// of the same transaction.
+func (g GenreModel) Update(ctx context.Context, genre *Genre) error {
+	query := `
+		UPDATE genres
+		SET slug = $1, name = $2, aliases = $3, parent_id = (SELECT id FROM genres WHERE slug = $4), version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+	args := []interface{}{
+		genre.Slug,
+		genre.Name,
+		pq.Array(genre.Aliases),
+		genre.Parent,
+		genre.ID,
+		genre.Version,
+	}
+
+	ctx, cancel := g.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := g.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var slug string
+
+	err = tx.QueryRowContext(ctx, `SELECT slug FROM genres WHERE id = $1`, genre.ID).Scan(&slug)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&genre.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case isUniqueViolation(err):
+			return ErrDuplicateGenre
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	if slug != genre.Slug {
+		query := `
+			UPDATE books
+			SET genres = array_replace(genres, $1, $2), updated_at = NOW(), version = version + 1
+			WHERE $1 = ANY (genres)
+			RETURNING %s`
+
+		err = updateBooks(ctx, tx, query, pgArray, slug, genre.Slug)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+// updateBooks runs query, an UPDATE of books whose RETURNING clause is left
+// as %s for their columns, and records a book.updated event for every book it
+// changed as part of tx. The statement is the same for Postgres and SQLite
+// but for array, which adapts the genres column to the driver.
+func updateBooks(ctx context.Context, tx *sql.Tx, query string, array func(*[]string) interface{}, args ...interface{}) error {
+	columns, _ := bookColumns(&Book{}, nil, array)
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(query, columns), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var books []*Book
+
+	for rows.Next() {
+		var book Book
+		_, dest := bookColumns(&book, nil, array)
+
+		err := rows.Scan(dest...)
+		if err != nil {
+			return err
+		}
+
+		books = append(books, &book)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// The rows have to be closed before the connection can take the inserts.
+	rows.Close()
+
+	for _, book := range books {
+		err := insertOutbox(ctx, tx, EventBookUpdated, book.ID, bookEventData(book))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the genre, or fails with ErrGenreInUse while any book has
+// it, since the book would be left with a slug that no longer means anything.
+func (g GenreModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM genres
+				WHERE id = $1
+				RETURNING slug`
+
+	ctx, cancel := g.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := g.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var slug string
+
+	err = tx.QueryRowContext(ctx, query, id).Scan(&slug)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	var inUse bool
+
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM books WHERE $1 = ANY (genres))`, slug).Scan(&inUse)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if inUse {
+		return ErrGenreInUse
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (g GenreModel) GetAll(ctx context.Context) ([]*Genre, error) {
+	query := `SELECT g.id, g.created_at, g.slug, g.name, g.aliases, coalesce(p.slug, ''), g.version
+				FROM genres g
+				LEFT JOIN genres p ON p.id = g.parent_id
+				ORDER BY g.slug ASC`
+
+	ctx, cancel := g.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := g.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	genres := []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(
+			&genre.ID,
+			&genre.CreatedAt,
+			&genre.Slug,
+			&genre.Name,
+			pq.Array(&genre.Aliases),
+			&genre.Parent,
+			&genre.Version,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return genres, nil
+}
+
+// Descendants returns the slugs of every genre below slug in the hierarchy.
+func (g GenreModel) Descendants(ctx context.Context, slug string) ([]string, error) {
+	query := `SELECT genre_descendants($1)`
+
+	ctx, cancel := g.Timeouts.read(ctx)
+	defer cancel()
+
+	var slugs []string
+
+	err := g.DB.QueryRowContext(ctx, query, slug).Scan(pq.Array(&slugs))
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	descendants := []string{}
+	for _, s := range slugs {
+		if s != slug {
+			descendants = append(descendants, s)
+		}
+	}
+
+	return descendants, nil
+}
+
+// Normalize maps each name to the slug of the genre it is the slug, name or an
+// alias of. Names that match no genre are returned in unknown and passed
+// through as their GenreKey.
+func (g GenreModel) Normalize(ctx context.Context, names []string) (slugs []string, unknown []string, err error) {
+	query := `SELECT k.key, g.slug
+				FROM unnest($1::text[]) AS k(key)
+				LEFT JOIN genres g ON g.slug = k.key OR lower(g.name) = k.key OR k.key = ANY (g.aliases)`
+
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = GenreKey(name)
+	}
+
+	ctx, cancel := g.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := g.DB.QueryContext(ctx, query, pq.Array(keys))
+	if err != nil {
+		return nil, nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	canonical := make(map[string]string, len(keys))
+
+	for rows.Next() {
+		var key string
+		var slug sql.NullString
+
+		if err := rows.Scan(&key, &slug); err != nil {
+			return nil, nil, contextError(ctx, err)
+		}
+		if slug.Valid {
+			canonical[key] = slug.String
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, contextError(ctx, err)
+	}
+
+	slugs, unknown = resolveGenres(names, canonical)
+	return slugs, unknown, nil
+}
+
+func resolveGenres(names []string, canonical map[string]string) ([]string, []string) {
+	slugs := make([]string, len(names))
+	unknown := []string{}
+
+	for i, name := range names {
+		slug, ok := canonical[GenreKey(name)]
+		if !ok {
+			slug = GenreKey(name)
+			unknown = append(unknown, name)
+		}
+		slugs[i] = slug
+	}
+
+	return slugs, unknown
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,554 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrDuplicateHold = errors.New("duplicate hold")
+	ErrBookAvailable = errors.New("book available")
+)
+
+// Statuses of a hold. A hold waits in the book's queue until a copy is set
+// aside for it, then is ready until it is collected by checking the book
+// out, or expires.
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldCollected = "collected"
+	HoldCancelled = "cancelled"
+	HoldExpired   = "expired"
+)
+
+// HoldOpen lists the holds that are waiting or ready.
+const HoldOpen = "open"
+
+var HoldStatuses = []string{HoldOpen, HoldWaiting, HoldReady, HoldCollected, HoldCancelled, HoldExpired}
+
+var HoldSortSafelist = []string{"id", "created_at", "title", "-id", "-created_at", "-title"}
+
+type HoldModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Hold is a user's place in the queue for a book that has no copy to lend.
+// Copies that come back are set aside for the book's holds in the order they
+// were placed, and a hold is then ready to collect until ExpiresAt. Position
+// counts the waiting holds up to and including this one. Member, Email,
+// Title and Barcode are read along with the hold.
+type Hold struct {
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UserID    int64      `json:"user_id"`
+	Member    string     `json:"member"`
+	Email     string     `json:"-"`
+	BookID    int64      `json:"book_id"`
+	Title     string     `json:"title"`
+	Status    string     `json:"status"`
+	Position  int32      `json:"position,omitempty"`
+	CopyID    *int64     `json:"copy_id,omitempty"`
+	Barcode   string     `json:"barcode,omitempty"`
+	ReadyAt   *time.Time `json:"ready_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Version   int32      `json:"version"`
+
+	// PickupPeriod is how long a copy set aside for the hold waits to be
+	// collected. It is fixed when the hold is placed.
+	PickupPeriod time.Duration `json:"-"`
+}
+
+// holdsQuery selects holds along with their member's name and email, their
+// book's title, their copy's barcode and their place in the queue, from a
+// subquery so that the sort columns need no table prefix.
+const holdsQuery = `
+			SELECT %s id, created_at, user_id, member, email, book_id, title, status, position, copy_id, barcode, ready_at, expires_at, version
+			FROM (
+				SELECT holds.*, users.name AS member, users.email, books.title, COALESCE(copies.barcode, '') AS barcode,
+					CASE WHEN holds.status = 'waiting' THEN (
+						SELECT count(*) FROM holds AS ahead
+						WHERE ahead.book_id = holds.book_id AND ahead.status = 'waiting' AND ahead.id <= holds.id
+					) ELSE 0 END AS position
+				FROM holds
+				INNER JOIN users ON users.id = holds.user_id
+				INNER JOIN books ON books.id = holds.book_id
+				LEFT JOIN copies ON copies.id = holds.copy_id
+			) AS holds
+			%s`
+
+func holdDest(hold *Hold) []interface{} {
+	return []interface{}{
+		&hold.ID,
+		&hold.CreatedAt,
+		&hold.UserID,
+		&hold.Member,
+		&hold.Email,
+		&hold.BookID,
+		&hold.Title,
+		&hold.Status,
+		&hold.Position,
+		&hold.CopyID,
+		&hold.Barcode,
+		&hold.ReadyAt,
+		&hold.ExpiresAt,
+		&hold.Version,
+	}
+}
+
+// holdFilter narrows a holds query to a user's holds and a book's, or
+// everyone's and every book's for zero ids, in the given status, or any
+// status if it is empty.
+func holdFilter(where *whereClause, userID, bookID int64, status string) {
+	if userID != 0 {
+		where.add("user_id = ?", userID)
+	}
+	if bookID != 0 {
+		where.add("book_id = ?", bookID)
+	}
+
+	switch status {
+	case "":
+	case HoldOpen:
+		where.add("status IN ('waiting', 'ready')")
+	default:
+		where.add("status = ?", status)
+	}
+}
+
+// fillHoldQuery sets the copy aside for the book's oldest waiting hold, if it
+// has one, to be collected within the hold's pickup period.
+const fillHoldQuery = `
+		UPDATE holds
+		SET status = 'ready', copy_id = $2, ready_at = NOW(), expires_at = NOW() + make_interval(secs => pickup_seconds), version = version + 1
+		WHERE id = (
+			SELECT id FROM holds
+			WHERE book_id = $1 AND status = 'waiting'
+			ORDER BY id
+			LIMIT 1
+		)`
+
+// releaseCopyQuery puts a copy that was set aside for a hold back on the
+// shelf, for the next hold in line to take if there is one.
+const releaseCopyQuery = `
+		UPDATE copies
+		SET status = 'available', version = version + 1
+		WHERE id = $1 AND status = 'on-hold'`
+
+// fillHolds sets the book's available copies aside for its waiting holds, one
+// each, using the backend's fillHoldQuery.
+func fillHolds(ctx context.Context, tx *sql.Tx, fillHoldQuery string, bookID int64) error {
+	for {
+		var copyID int64
+
+		err := tx.QueryRowContext(ctx, `SELECT id FROM copies WHERE book_id = $1 AND status = 'available' ORDER BY id LIMIT 1`, bookID).Scan(&copyID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, fillHoldQuery, bookID, copyID)
+		if err != nil {
+			return err
+		}
+
+		filled, err := result.RowsAffected()
+		if err != nil || filled == 0 {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE copies SET status = 'on-hold', version = version + 1 WHERE id = $1`, copyID)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// refreshCopies hands the book's available copies to its waiting holds and
+// then recounts its copies. It runs in the transaction that changed one of
+// them, after the book has been locked.
+func refreshCopies(ctx context.Context, tx *sql.Tx, bookID int64) error {
+	err := fillHolds(ctx, tx, fillHoldQuery, bookID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, refreshCopiesQuery, bookID)
+	return err
+}
+
+// collectHoldQuery closes the user's ready hold on the book, returning the
+// copy that was set aside for it.
+const collectHoldQuery = `
+		UPDATE holds
+		SET status = 'collected', version = version + 1
+		WHERE book_id = $1 AND user_id = $2 AND status = 'ready'
+		RETURNING copy_id`
+
+// takeCopy marks a copy of the book as lent to loan.UserID: the one set aside
+// for their hold if they have one ready, or else the first available.
+func takeCopy(ctx context.Context, tx *sql.Tx, loan *Loan) error {
+	var heldID int64
+
+	err := tx.QueryRowContext(ctx, collectHoldQuery, loan.BookID, loan.UserID).Scan(&heldID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		err = tx.QueryRowContext(ctx, checkoutCopyQuery, loan.BookID).Scan(&loan.CopyID, &loan.Barcode)
+	case err == nil:
+		err = tx.QueryRowContext(ctx, `UPDATE copies SET status = 'on-loan', version = version + 1 WHERE id = $1 RETURNING id, barcode`, heldID).Scan(&loan.CopyID, &loan.Barcode)
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrBookUnavailable
+	}
+	return err
+}
+
+// Insert queues the user for the book. It returns ErrBookAvailable if the
+// book has a copy to lend, which should be checked out instead.
+func (m HoldModel) Insert(ctx context.Context, hold *Hold) error {
+	query := `INSERT INTO holds (user_id, book_id, pickup_seconds)
+				VALUES ($1, $2, $3)
+				RETURNING id, created_at, status, version`
+
+	args := []interface{}{hold.UserID, hold.BookID, int64(hold.PickupPeriod / time.Second)}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// Holding the book's row means a copy can't come back between the check
+	// and the insert, and go to the shelf rather than to this hold.
+	var available bool
+
+	err = tx.QueryRowContext(ctx, `SELECT title, available FROM books WHERE id = $1 FOR UPDATE`, hold.BookID).Scan(&hold.Title, &available)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	if available {
+		return ErrBookAvailable
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&hold.ID, &hold.CreatedAt, &hold.Status, &hold.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateHold
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM holds WHERE book_id = $1 AND status = 'waiting'`, hold.BookID).Scan(&hold.Position)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (m HoldModel) Get(ctx context.Context, id int64) (*Hold, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(holdsQuery, "", "WHERE id = $1")
+
+	var hold Hold
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(holdDest(&hold)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &hold, nil
+}
+
+// GetAll lists the holds of the user on the book, either of which can be 0
+// for any, in the given status, or any status if it is empty.
+func (m HoldModel) GetAll(ctx context.Context, userID, bookID int64, status string, filters Filters) ([]*Hold, Metadata, error) {
+	where := &whereClause{}
+	holdFilter(where, userID, bookID, status)
+
+	query := fmt.Sprintf(holdsQuery, "count(*) OVER(),", where) + fmt.Sprintf(`
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	holds := []*Hold{}
+
+	for rows.Next() {
+		var hold Hold
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, holdDest(&hold)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		holds = append(holds, &hold)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return holds, metadata, nil
+}
+
+// CountWaiting returns how many holds are waiting for a copy of the book.
+func (m HoldModel) CountWaiting(ctx context.Context, bookID int64) (int, error) {
+	var waiting int
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, `SELECT count(*) FROM holds WHERE book_id = $1 AND status = 'waiting'`, bookID).Scan(&waiting)
+	return waiting, contextError(ctx, err)
+}
+
+// Cancel takes the hold out of the queue, passing a copy set aside for it on
+// to the next hold in line or back to the shelf. Only open holds can be
+// cancelled, so cancelling one that was collected or expired in the meantime
+// is an edit conflict.
+func (m HoldModel) Cancel(ctx context.Context, hold *Hold) error {
+	query := `
+		UPDATE holds
+		SET status = 'cancelled', version = version + 1
+		WHERE id = $1 AND version = $2 AND status IN ('waiting', 'ready')
+		RETURNING version`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = lockBook(ctx, tx, hold.BookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, query, hold.ID, hold.Version).Scan(&hold.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	if hold.Status == HoldReady && hold.CopyID != nil {
+		_, err = tx.ExecContext(ctx, releaseCopyQuery, *hold.CopyID)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+
+		err = refreshCopies(ctx, tx, hold.BookID)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	hold.Status = HoldCancelled
+	hold.Position = 0
+	return nil
+}
+
+// Expire closes the ready holds that weren't collected in time, passing their
+// copies on, and returns them.
+func (m HoldModel) Expire(ctx context.Context) ([]*Hold, error) {
+	query := `SELECT id, user_id, book_id, copy_id
+				FROM holds
+				WHERE status = 'ready' AND expires_at < NOW()
+				ORDER BY id`
+
+	readCtx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(readCtx, query)
+	if err != nil {
+		return nil, contextError(readCtx, err)
+	}
+
+	defer rows.Close()
+
+	var due []*Hold
+
+	for rows.Next() {
+		var hold Hold
+
+		err := rows.Scan(&hold.ID, &hold.UserID, &hold.BookID, &hold.CopyID)
+		if err != nil {
+			return nil, contextError(readCtx, err)
+		}
+
+		due = append(due, &hold)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(readCtx, err)
+	}
+
+	rows.Close()
+
+	expired := []*Hold{}
+
+	for _, hold := range due {
+		ok, err := m.expire(ctx, hold)
+		if err != nil {
+			return expired, err
+		}
+		if ok {
+			hold.Status = HoldExpired
+			expired = append(expired, hold)
+		}
+	}
+
+	return expired, nil
+}
+
+// expire closes the hold if it is still ready, reporting whether it was.
+func (m HoldModel) expire(ctx context.Context, hold *Hold) (bool, error) {
+	query := `
+		UPDATE holds
+		SET status = 'expired', version = version + 1
+		WHERE id = $1 AND status = 'ready'`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = lockBook(ctx, tx, hold.BookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, contextError(ctx, err)
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, query, hold.ID)
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
+
+	closed, err := result.RowsAffected()
+	if err != nil || closed == 0 {
+		return false, contextError(ctx, err)
+	}
+
+	if hold.CopyID != nil {
+		_, err = tx.ExecContext(ctx, releaseCopyQuery, *hold.CopyID)
+		if err != nil {
+			return false, contextError(ctx, err)
+		}
+	}
+
+	err = refreshCopies(ctx, tx, hold.BookID)
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
+
+	return true, contextError(ctx, tx.Commit())
+}
+
+// Unnotified returns the ready holds whose members haven't been told yet,
+// oldest first.
+func (m HoldModel) Unnotified(ctx context.Context) ([]*Hold, error) {
+	query := fmt.Sprintf(holdsQuery, "", "WHERE status = 'ready' AND notified_at IS NULL ORDER BY id")
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	holds := []*Hold{}
+
+	for rows.Next() {
+		var hold Hold
+
+		err := rows.Scan(holdDest(&hold)...)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		holds = append(holds, &hold)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return holds, nil
+}
+
+// MarkNotified records that the hold's member has been told it is ready.
+func (m HoldModel) MarkNotified(ctx context.Context, id int64) error {
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE holds SET notified_at = NOW() WHERE id = $1`, id)
+	return contextError(ctx, err)
+}
@@ -0,0 +1,297 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrBookUnavailable = errors.New("book unavailable")
+
+// Statuses loans can be listed by. Overdue loans are also active.
+const (
+	LoanActive   = "active"
+	LoanOverdue  = "overdue"
+	LoanReturned = "returned"
+)
+
+var LoanStatuses = []string{LoanActive, LoanOverdue, LoanReturned}
+
+var LoanSortSafelist = []string{"id", "checked_out_at", "due_at", "title", "-id", "-checked_out_at", "-due_at", "-title"}
+
+type LoanModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Loan records a user borrowing a copy of a book. It is open until ReturnedAt
+// is set, and a copy can be out on only one open loan at a time. Borrower,
+// Title and Barcode are the user's name, the book's title and the copy's
+// barcode, read along with the loan.
+type Loan struct {
+	ID           int64      `json:"id"`
+	CheckedOutAt time.Time  `json:"checked_out_at"`
+	UserID       int64      `json:"user_id"`
+	Borrower     string     `json:"borrower"`
+	BookID       int64      `json:"book_id"`
+	Title        string     `json:"title"`
+	CopyID       int64      `json:"copy_id"`
+	Barcode      string     `json:"barcode"`
+	DueAt        time.Time  `json:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at,omitempty"`
+	Renewals     int32      `json:"renewals"`
+	Version      int32      `json:"version"`
+}
+
+func (l *Loan) Overdue(now time.Time) bool {
+	return l.ReturnedAt == nil && l.DueAt.Before(now)
+}
+
+// loansQuery selects loans along with their borrower's name, their book's
+// title and their copy's barcode, from a subquery so that the sort columns
+// need no table prefix.
+const loansQuery = `
+			SELECT %s id, checked_out_at, user_id, borrower, book_id, title, copy_id, barcode, due_at, returned_at, renewals, version
+			FROM (
+				SELECT loans.*, users.name AS borrower, books.title, copies.barcode
+				FROM loans
+				INNER JOIN users ON users.id = loans.user_id
+				INNER JOIN books ON books.id = loans.book_id
+				INNER JOIN copies ON copies.id = loans.copy_id
+			) AS loans
+			%s`
+
+func loanDest(loan *Loan) []interface{} {
+	return []interface{}{
+		&loan.ID,
+		&loan.CheckedOutAt,
+		&loan.UserID,
+		&loan.Borrower,
+		&loan.BookID,
+		&loan.Title,
+		&loan.CopyID,
+		&loan.Barcode,
+		&loan.DueAt,
+		&loan.ReturnedAt,
+		&loan.Renewals,
+		&loan.Version,
+	}
+}
+
+// loanFilter narrows a loans query to a user's loans, or everyone's if userID
+// is 0, in the given status, or any status if it is empty.
+func loanFilter(where *whereClause, userID int64, status string, now interface{}) {
+	if userID != 0 {
+		where.add("user_id = ?", userID)
+	}
+
+	switch status {
+	case LoanActive:
+		where.add("returned_at IS NULL")
+	case LoanOverdue:
+		where.add("returned_at IS NULL")
+		where.add("due_at < ?", now)
+	case LoanReturned:
+		where.add("returned_at IS NOT NULL")
+	}
+}
+
+// checkoutCopyQuery takes the book's first available copy off the shelf.
+const checkoutCopyQuery = `
+		UPDATE copies
+		SET status = 'on-loan', version = version + 1
+		WHERE id = (
+			SELECT id FROM copies
+			WHERE book_id = $1 AND status = 'available'
+			ORDER BY id
+			LIMIT 1
+		)
+		RETURNING id, barcode`
+
+// returnCopyQuery puts a returned loan's copy back on the shelf.
+const returnCopyQuery = `
+		UPDATE copies
+		SET status = 'available', version = version + 1
+		WHERE id = $1 AND status = 'on-loan'`
+
+// Checkout lends a copy of the book to loan.UserID until loan.DueAt, which is
+// the one set aside for their hold if they have one ready. It returns
+// ErrBookUnavailable if no copy is left for them.
+func (m LoanModel) Checkout(ctx context.Context, loan *Loan) error {
+	query := `INSERT INTO loans (user_id, book_id, copy_id, due_at)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, checked_out_at, renewals, version`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	// Checkouts of the same book queue up on its row, so the one that goes
+	// second sees which copies the first one took. The unique index on open
+	// loans would refuse a copy lent twice regardless.
+	err = tx.QueryRowContext(ctx, `SELECT title FROM books WHERE id = $1 FOR UPDATE`, loan.BookID).Scan(&loan.Title)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = takeCopy(ctx, tx, loan)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	args := []interface{}{loan.UserID, loan.BookID, loan.CopyID, loan.DueAt}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&loan.ID, &loan.CheckedOutAt, &loan.Renewals, &loan.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrBookUnavailable
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = refreshCopies(ctx, tx, loan.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (m LoanModel) Get(ctx context.Context, id int64) (*Loan, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(loansQuery, "", "WHERE id = $1")
+
+	var loan Loan
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(loanDest(&loan)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &loan, nil
+}
+
+// GetAll lists the loans of the user, or of everyone if userID is 0, in the
+// given status, or any status if it is empty.
+func (m LoanModel) GetAll(ctx context.Context, userID int64, status string, filters Filters) ([]*Loan, Metadata, error) {
+	where := &whereClause{}
+	loanFilter(where, userID, status, time.Now())
+
+	query := fmt.Sprintf(loansQuery, "count(*) OVER(),", where) + fmt.Sprintf(`
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	loans := []*Loan{}
+
+	for rows.Next() {
+		var loan Loan
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, loanDest(&loan)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		loans = append(loans, &loan)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return loans, metadata, nil
+}
+
+// Update saves a renewal or return, putting the copy back on the shelf, or
+// aside for the next hold, if the loan is returned. Only open loans can
+// change, so updating a loan that has been returned in the meantime is an edit
+// conflict.
+func (m LoanModel) Update(ctx context.Context, loan *Loan) error {
+	query := `
+		UPDATE loans
+		SET due_at = $1, returned_at = $2, renewals = $3, version = version + 1
+		WHERE id = $4 AND version = $5 AND returned_at IS NULL
+		RETURNING version`
+	args := []interface{}{loan.DueAt, loan.ReturnedAt, loan.Renewals, loan.ID, loan.Version}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = lockBook(ctx, tx, loan.BookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&loan.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	if loan.ReturnedAt != nil {
+		_, err = tx.ExecContext(ctx, returnCopyQuery, loan.CopyID)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+
+		err = refreshCopies(ctx, tx, loan.BookID)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	return contextError(ctx, tx.Commit())
+}
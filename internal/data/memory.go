@@ -0,0 +1,2087 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// defaultGenres is the vocabulary the genres migration seeds, used to seed the
+// in-memory store the same way.
+var defaultGenres = []Genre{
+	{Slug: "fiction", Name: "Fiction", Aliases: []string{}},
+	{Slug: "non-fiction", Name: "Non-fiction", Aliases: []string{"nonfiction", "non fiction"}},
+	{Slug: "science-fiction", Name: "Science Fiction", Aliases: []string{"sci-fi", "scifi", "science fiction", "sf"}, Parent: "fiction"},
+	{Slug: "fantasy", Name: "Fantasy", Aliases: []string{}, Parent: "fiction"},
+	{Slug: "mystery", Name: "Mystery", Aliases: []string{"crime", "detective"}, Parent: "fiction"},
+	{Slug: "history", Name: "History", Aliases: []string{}, Parent: "non-fiction"},
+	{Slug: "biography", Name: "Biography", Aliases: []string{"memoir", "autobiography"}, Parent: "non-fiction"},
+}
+
+// NewMemoryModels returns models that keep everything in process memory, for
+// tests and for running the API without a database.
+func NewMemoryModels() Models {
+	genres := &MemoryGenreStore{genres: make(map[int64]*Genre)}
+	for _, genre := range defaultGenres {
+		genre := genre
+		genres.Insert(context.Background(), &genre)
+	}
+
+	outbox := &MemoryOutboxStore{}
+	books := &MemoryBookStore{books: make(map[int64]*Book), genres: genres, outbox: outbox}
+	genres.books = books
+	users := &MemoryUserStore{users: make(map[int64]*User), tokens: make(map[string]*Token)}
+	copies := &MemoryCopyStore{copies: make(map[int64]*Copy), books: books}
+	holds := &MemoryHoldStore{holds: make(map[int64]*Hold), notified: make(map[int64]bool), books: books, copies: copies, users: users}
+	copies.holds = holds
+
+	return Models{
+		Books:       books,
+		Genres:      genres,
+		Webhooks:    &MemoryWebhookStore{webhooks: make(map[int64]*Webhook)},
+		Outbox:      outbox,
+		Users:       users,
+		Tokens:      &MemoryTokenStore{users: users},
+		Permissions: &MemoryPermissionStore{grants: make(map[int64]map[string]bool)},
+		Shelves:     &MemoryShelfStore{shelves: make(map[int64]*Shelf), items: make(map[int64]*ShelfItem), books: books},
+		Reviews:     &MemoryReviewStore{reviews: make(map[int64]*Review), books: books},
+		Copies:      copies,
+		Loans:       &MemoryLoanStore{loans: make(map[int64]*Loan), books: books, copies: copies, users: users},
+		Holds:       holds,
+	}
+}
+
+type MemoryBookStore struct {
+	mu      sync.RWMutex
+	books   map[int64]*Book
+	nextID  int64
+	genres  GenreStore
+	changes []*BookChange
+	outbox  *MemoryOutboxStore
+}
+
+func copyBook(book *Book) *Book {
+	c := *book
+	if book.Genres != nil {
+		c.Genres = append([]string{}, book.Genres...)
+	}
+	return &c
+}
+
+func (m *MemoryBookStore) Insert(ctx context.Context, book *Book) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	book.ID = m.nextID
+	book.CreatedAt = time.Now().Truncate(time.Second)
+	book.UpdatedAt = book.CreatedAt
+	book.Version = 1
+
+	m.books[book.ID] = copyBook(book)
+	m.logChange(ChangeCreated, book)
+	return m.outbox.add(EventBookCreated, book.ID, bookEventData(book))
+}
+
+func (m *MemoryBookStore) Get(ctx context.Context, id int64, fields ...string) (*Book, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	book, ok := m.books[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyBook(book), nil
+}
+
+func (m *MemoryBookStore) Update(ctx context.Context, book *Book) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.books[book.ID]
+	if !ok || stored.Version != book.Version {
+		return ErrEditConflict
+	}
+
+	book.AverageRating = stored.AverageRating
+	book.RatingsCount = stored.RatingsCount
+	book.CopiesTotal = stored.CopiesTotal
+	book.CopiesAvailable = stored.CopiesAvailable
+	book.Available = stored.Available
+	book.UpdatedAt = time.Now().Truncate(time.Second)
+	book.Version++
+	m.books[book.ID] = copyBook(book)
+	m.logChange(ChangeUpdated, book)
+	return m.outbox.add(EventBookUpdated, book.ID, bookEventData(book))
+}
+
+func (m *MemoryBookStore) Delete(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	book, ok := m.books[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.books, id)
+	m.logChange(ChangeDeleted, book)
+	return m.outbox.add(EventBookDeleted, id, deletedBookEventData(id))
+}
+
+// logChange does what the change-logging trigger does for the databases. The
+// caller must hold m.mu.
+func (m *MemoryBookStore) logChange(op string, book *Book) {
+	var id int64 = 1
+	if n := len(m.changes); n > 0 {
+		id = m.changes[n-1].ID + 1
+	}
+
+	m.changes = append(m.changes, &BookChange{
+		ID:        id,
+		CreatedAt: time.Now().Truncate(time.Second),
+		Op:        op,
+		BookID:    book.ID,
+		Genres:    append([]string{}, book.Genres...),
+	})
+}
+
+func (m *MemoryBookStore) Changes(ctx context.Context, after int64, limit int) ([]*BookChange, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := sort.Search(len(m.changes), func(i int) bool {
+		return m.changes[i].ID > after
+	})
+
+	changes := []*BookChange{}
+	for ; i < len(m.changes) && len(changes) < limit; i++ {
+		change := *m.changes[i]
+		changes = append(changes, &change)
+	}
+
+	return changes, nil
+}
+
+func (m *MemoryBookStore) PruneChanges(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := sort.Search(len(m.changes), func(i int) bool {
+		return !m.changes[i].CreatedAt.Before(before)
+	})
+
+	// The last change is kept so that ids carry on from it.
+	if i == len(m.changes) && i > 0 {
+		i--
+	}
+	m.changes = append([]*BookChange{}, m.changes[i:]...)
+	return nil
+}
+
+func (m *MemoryBookStore) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Book, Metadata, error) {
+	matchGenres, err := m.expandGenres(ctx, genres)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	excludeGenres, err := m.expandGenres(ctx, filters.ExcludeGenres)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	titleTerms := searchTerms(title)
+
+	var matches []*Book
+
+	for _, book := range m.books {
+		if !containsAll(searchTerms(book.Title), titleTerms) {
+			continue
+		}
+		if len(matchGenres) > 0 && !matchesGenres(book.Genres, matchGenres, filters.GenresMode == "any") {
+			continue
+		}
+		if matchesGenres(book.Genres, excludeGenres, true) {
+			continue
+		}
+		if !inRange(int(book.Year), filters.YearMin, filters.YearMax) ||
+			!inRange(int(book.Pages), filters.PagesMin, filters.PagesMax) {
+			continue
+		}
+		if (filters.RatingMin > 0 && book.AverageRating < filters.RatingMin) ||
+			(filters.RatingMax > 0 && book.AverageRating > filters.RatingMax) ||
+			int(book.RatingsCount) < filters.RatingsMin {
+			continue
+		}
+		if !filters.CreatedAfter.IsZero() && book.CreatedAt.Before(filters.CreatedAfter) {
+			continue
+		}
+		if !filters.CreatedBefore.IsZero() && !book.CreatedAt.Before(filters.CreatedBefore) {
+			continue
+		}
+		matches = append(matches, book)
+	}
+
+	sortBooks(matches, filters)
+
+	totalRecords := len(matches)
+	books := []*Book{}
+
+	for i := filters.offset(); i < totalRecords && i < filters.offset()+filters.limit(); i++ {
+		books = append(books, copyBook(matches[i]))
+	}
+
+	return books, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// expandGenres returns, for each genre, the genre together with its
+// descendants, mirroring genre_descendants() in Postgres.
+func (m *MemoryBookStore) expandGenres(ctx context.Context, genres []string) ([][]string, error) {
+	expanded := make([][]string, len(genres))
+
+	for i, genre := range genres {
+		descendants, err := m.genres.Descendants(ctx, genre)
+		if err != nil {
+			return nil, err
+		}
+		expanded[i] = append(descendants, genre)
+	}
+
+	return expanded, nil
+}
+
+func matchesGenres(bookGenres []string, groups [][]string, any bool) bool {
+	if len(groups) == 0 {
+		return false
+	}
+
+	for _, group := range groups {
+		matched := false
+		for _, genre := range group {
+			if containsAll(bookGenres, []string{genre}) {
+				matched = true
+				break
+			}
+		}
+		if matched && any {
+			return true
+		}
+		if !matched && !any {
+			return false
+		}
+	}
+
+	return !any
+}
+
+func inRange(value, min, max int) bool {
+	return (min == 0 || value >= min) && (max == 0 || value <= max)
+}
+
+// searchTerms splits s the way the 'simple' text search configuration does.
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func containsAll(values, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, value := range values {
+			if value == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func sortBooks(books []*Book, filters Filters) {
+	sortRecords(books, filters, func(i, j int, column string) int {
+		return compareBooks(books[i], books[j], column)
+	})
+}
+
+// sortRecords sorts slice by the filters' sort columns and then by id, the
+// way orderBy does, with compare returning how elements i and j compare in
+// a column.
+func sortRecords(slice interface{}, filters Filters, compare func(i, j int, column string) int) {
+	var columns []string
+	for _, value := range filters.sortValues() {
+		if _, ok := filters.sortColumn(value); ok {
+			columns = append(columns, value)
+		}
+	}
+	columns = append(columns, "id")
+
+	sort.SliceStable(slice, func(i, j int) bool {
+		for _, value := range columns {
+			column := strings.TrimPrefix(value, "-")
+
+			c := compare(i, j, column)
+			if c == 0 {
+				continue
+			}
+			if sortDirection(value) == "DESC" {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+func compareBooks(a, b *Book, column string) int {
+	switch column {
+	case "id":
+		return compareInts(a.ID, b.ID)
+	case "title":
+		return strings.Compare(a.Title, b.Title)
+	case "year":
+		return compareInts(int64(a.Year), int64(b.Year))
+	case "pages":
+		return compareInts(int64(a.Pages), int64(b.Pages))
+	case "rating":
+		return compareFloats(a.AverageRating, b.AverageRating)
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// MemoryGenreStore takes the book store's lock before its own when it writes
+// to both, the order the book store takes them in while it expands genres.
+type MemoryGenreStore struct {
+	mu     sync.RWMutex
+	genres map[int64]*Genre
+	nextID int64
+	books  *MemoryBookStore
+}
+
+func copyGenre(genre *Genre) *Genre {
+	c := *genre
+	c.Aliases = append([]string{}, genre.Aliases...)
+	return &c
+}
+
+func (m *MemoryGenreStore) bySlug(slug string) *Genre {
+	for _, genre := range m.genres {
+		if genre.Slug == slug {
+			return genre
+		}
+	}
+	return nil
+}
+
+func (m *MemoryGenreStore) Insert(ctx context.Context, genre *Genre) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.bySlug(genre.Slug) != nil {
+		return ErrDuplicateGenre
+	}
+	if m.bySlug(genre.Parent) == nil {
+		genre.Parent = ""
+	}
+
+	m.nextID++
+	genre.ID = m.nextID
+	genre.CreatedAt = time.Now().Truncate(time.Second)
+	genre.Version = 1
+
+	m.genres[genre.ID] = copyGenre(genre)
+	return nil
+}
+
+func (m *MemoryGenreStore) Get(ctx context.Context, id int64) (*Genre, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	genre, ok := m.genres[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyGenre(genre), nil
+}
+
+func (m *MemoryGenreStore) Update(ctx context.Context, genre *Genre) error {
+	m.books.mu.Lock()
+	defer m.books.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.genres[genre.ID]
+	if !ok || stored.Version != genre.Version {
+		return ErrEditConflict
+	}
+	if other := m.bySlug(genre.Slug); other != nil && other.ID != genre.ID {
+		return ErrDuplicateGenre
+	}
+	if m.bySlug(genre.Parent) == nil {
+		genre.Parent = ""
+	}
+
+	// Children refer to their parent by slug here rather than by id, so they
+	// have to follow a rename.
+	for _, child := range m.genres {
+		if child.Parent == stored.Slug {
+			child.Parent = genre.Slug
+		}
+	}
+
+	if stored.Slug != genre.Slug {
+		for _, book := range m.books.books {
+			renamed := false
+			for i := range book.Genres {
+				if book.Genres[i] == stored.Slug {
+					book.Genres[i] = genre.Slug
+					renamed = true
+				}
+			}
+			if renamed {
+				book.UpdatedAt = time.Now().Truncate(time.Second)
+				book.Version++
+				m.books.logChange(ChangeUpdated, book)
+
+				err := m.books.outbox.add(EventBookUpdated, book.ID, bookEventData(book))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	genre.Version++
+	m.genres[genre.ID] = copyGenre(genre)
+	return nil
+}
+
+func (m *MemoryGenreStore) Delete(ctx context.Context, id int64) error {
+	m.books.mu.RLock()
+	defer m.books.mu.RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	genre, ok := m.genres[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	for _, book := range m.books.books {
+		if validator.In(genre.Slug, book.Genres...) {
+			return ErrGenreInUse
+		}
+	}
+
+	for _, child := range m.genres {
+		if child.Parent == genre.Slug {
+			child.Parent = ""
+		}
+	}
+
+	delete(m.genres, id)
+	return nil
+}
+
+func (m *MemoryGenreStore) GetAll(ctx context.Context) ([]*Genre, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	genres := []*Genre{}
+	for _, genre := range m.genres {
+		genres = append(genres, copyGenre(genre))
+	}
+
+	sort.Slice(genres, func(i, j int) bool {
+		return genres[i].Slug < genres[j].Slug
+	})
+
+	return genres, nil
+}
+
+func (m *MemoryGenreStore) Descendants(ctx context.Context, slug string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	descendants := []string{}
+	seen := map[string]bool{slug: true}
+	queue := []string{slug}
+
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		for _, genre := range m.genres {
+			if genre.Parent == parent && !seen[genre.Slug] {
+				seen[genre.Slug] = true
+				descendants = append(descendants, genre.Slug)
+				queue = append(queue, genre.Slug)
+			}
+		}
+	}
+
+	return descendants, nil
+}
+
+func (m *MemoryGenreStore) Normalize(ctx context.Context, names []string) ([]string, []string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	canonical := make(map[string]string)
+
+	for _, genre := range m.genres {
+		canonical[genre.Slug] = genre.Slug
+		canonical[GenreKey(genre.Name)] = genre.Slug
+		for _, alias := range genre.Aliases {
+			canonical[alias] = genre.Slug
+		}
+	}
+
+	slugs, unknown := resolveGenres(names, canonical)
+	return slugs, unknown, nil
+}
+
+type MemoryWebhookStore struct {
+	mu             sync.Mutex
+	webhooks       map[int64]*Webhook
+	nextID         int64
+	deliveries     []*WebhookDelivery
+	nextDeliveryID int64
+}
+
+func copyWebhook(webhook *Webhook) *Webhook {
+	c := *webhook
+	c.Events = append([]string{}, webhook.Events...)
+	return &c
+}
+
+func (m *MemoryWebhookStore) Insert(ctx context.Context, webhook *Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	webhook.ID = m.nextID
+	webhook.CreatedAt = time.Now().Truncate(time.Second)
+	webhook.Version = 1
+
+	m.webhooks[webhook.ID] = copyWebhook(webhook)
+	return nil
+}
+
+func (m *MemoryWebhookStore) Get(ctx context.Context, id int64) (*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	webhook, ok := m.webhooks[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return copyWebhook(webhook), nil
+}
+
+func (m *MemoryWebhookStore) Update(ctx context.Context, webhook *Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.webhooks[webhook.ID]
+	if !ok || stored.Version != webhook.Version {
+		return ErrEditConflict
+	}
+
+	webhook.Version++
+	m.webhooks[webhook.ID] = copyWebhook(webhook)
+	return nil
+}
+
+func (m *MemoryWebhookStore) Delete(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.webhooks[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.webhooks, id)
+
+	kept := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if d.WebhookID != id {
+			kept = append(kept, d)
+		}
+	}
+	m.deliveries = kept
+
+	return nil
+}
+
+func (m *MemoryWebhookStore) GetAll(ctx context.Context) ([]*Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	webhooks := make([]*Webhook, 0, len(m.webhooks))
+	for _, webhook := range m.webhooks {
+		webhooks = append(webhooks, copyWebhook(webhook))
+	}
+
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].ID < webhooks[j].ID
+	})
+
+	return webhooks, nil
+}
+
+func (m *MemoryWebhookStore) Enqueue(ctx context.Context, message *OutboxMessage) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+
+	enqueued := make(map[int64]bool)
+	for _, d := range m.deliveries {
+		if d.outboxID == message.ID {
+			enqueued[d.WebhookID] = true
+		}
+	}
+
+	for id := int64(1); id <= m.nextID; id++ {
+		webhook, ok := m.webhooks[id]
+		if !ok || !webhook.Active || !validator.In(message.Event, webhook.Events...) || enqueued[id] {
+			continue
+		}
+
+		m.nextDeliveryID++
+		m.deliveries = append(m.deliveries, &WebhookDelivery{
+			ID:            m.nextDeliveryID,
+			CreatedAt:     now.Truncate(time.Second),
+			WebhookID:     id,
+			Event:         message.Event,
+			Payload:       append(json.RawMessage{}, message.Payload...),
+			Status:        DeliveryPending,
+			NextAttemptAt: now,
+			outboxID:      message.ID,
+		})
+		n++
+	}
+
+	return n, nil
+}
+
+func (m *MemoryWebhookStore) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	var due []*WebhookDelivery
+	for _, d := range m.deliveries {
+		if d.Status == DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]*WebhookDelivery, len(due))
+	for i, d := range due {
+		d.NextAttemptAt = now.Add(lease)
+
+		c := *d
+		c.URL = m.webhooks[d.WebhookID].URL
+		c.Secret = m.webhooks[d.WebhookID].Secret
+		claimed[i] = &c
+	}
+
+	return claimed, nil
+}
+
+func (m *MemoryWebhookStore) UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range m.deliveries {
+		if d.ID == delivery.ID {
+			d.Status = delivery.Status
+			d.Attempts = delivery.Attempts
+			d.NextAttemptAt = delivery.NextAttemptAt
+			d.ResponseStatus = delivery.ResponseStatus
+			d.LastError = delivery.LastError
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryWebhookStore) GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []*WebhookDelivery
+	for i := len(m.deliveries) - 1; i >= 0; i-- {
+		d := m.deliveries[i]
+		if d.WebhookID == webhookID && (status == "" || d.Status == status) {
+			c := *d
+			matches = append(matches, &c)
+		}
+	}
+
+	totalRecords := len(matches)
+	deliveries := []*WebhookDelivery{}
+
+	for i := filters.offset(); i < totalRecords && i < filters.offset()+filters.limit(); i++ {
+		deliveries = append(deliveries, matches[i])
+	}
+
+	return deliveries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+type MemoryOutboxStore struct {
+	mu       sync.Mutex
+	messages []*OutboxMessage
+	dead     map[int64]bool
+	nextID   int64
+}
+
+// add is called by MemoryBookStore while it holds its own lock, so that the
+// message is recorded along with the write.
+func (m *MemoryOutboxStore) add(event string, aggregateID int64, data interface{}) error {
+	payload, err := outboxPayload(event, data)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	m.nextID++
+	m.messages = append(m.messages, &OutboxMessage{
+		ID:          m.nextID,
+		CreatedAt:   now.Truncate(time.Second),
+		AggregateID: aggregateID,
+		Event:       event,
+		Payload:     json.RawMessage(payload),
+		AvailableAt: now,
+	})
+	return nil
+}
+
+func (m *MemoryOutboxStore) Claim(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	seen := make(map[int64]bool)
+	messages := []*OutboxMessage{}
+
+	for _, message := range m.messages {
+		if len(messages) == limit {
+			break
+		}
+
+		if m.dead[message.ID] {
+			continue
+		}
+
+		// Only the oldest message of each book can be claimed.
+		first := !seen[message.AggregateID]
+		seen[message.AggregateID] = true
+		if !first || message.AvailableAt.After(now) {
+			continue
+		}
+
+		message.AvailableAt = now.Add(lease)
+		c := *message
+		messages = append(messages, &c)
+	}
+
+	return messages, nil
+}
+
+func (m *MemoryOutboxStore) Delete(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, message := range m.messages {
+		if message.ID == id {
+			m.messages = append(m.messages[:i], m.messages[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryOutboxStore) Retry(ctx context.Context, message *OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stored := range m.messages {
+		if stored.ID == message.ID {
+			stored.Attempts = message.Attempts
+			stored.AvailableAt = message.AvailableAt
+			stored.LastError = message.LastError
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryOutboxStore) DeadLetter(ctx context.Context, message *OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stored := range m.messages {
+		if stored.ID == message.ID {
+			stored.Attempts = message.Attempts
+			stored.LastError = message.LastError
+			if m.dead == nil {
+				m.dead = make(map[int64]bool)
+			}
+			m.dead[message.ID] = true
+			break
+		}
+	}
+	return nil
+}
+
+type MemoryUserStore struct {
+	mu     sync.Mutex
+	users  map[int64]*User
+	tokens map[string]*Token
+	nextID int64
+}
+
+func (m *MemoryUserStore) Insert(ctx context.Context, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range m.users {
+		if strings.EqualFold(other.Email, user.Email) {
+			return ErrDuplicateEmail
+		}
+	}
+
+	m.nextID++
+	user.ID = m.nextID
+	user.CreatedAt = time.Now().Truncate(time.Second)
+	user.Version = 1
+
+	c := *user
+	m.users[user.ID] = &c
+	return nil
+}
+
+func (m *MemoryUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if strings.EqualFold(user.Email, email) {
+			c := *user
+			return &c, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m *MemoryUserStore) GetForToken(ctx context.Context, scope, plaintext string) (*User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	token, ok := m.tokens[string(hash[:])]
+	if !ok || token.Scope != scope || !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+
+	user, ok := m.users[token.UserID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	c := *user
+	return &c, nil
+}
+
+// MemoryTokenStore keeps its tokens in the user store, which looks them up
+// when authenticating.
+type MemoryTokenStore struct {
+	users *MemoryUserStore
+}
+
+func (m *MemoryTokenStore) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	m.users.mu.Lock()
+	defer m.users.mu.Unlock()
+
+	c := *token
+	c.Plaintext = ""
+	m.users.tokens[string(token.Hash)] = &c
+	return token, nil
+}
+
+func (m *MemoryTokenStore) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	m.users.mu.Lock()
+	defer m.users.mu.Unlock()
+
+	for hash, token := range m.users.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			delete(m.users.tokens, hash)
+		}
+	}
+	return nil
+}
+
+// MemoryPermissionStore grants permissions by code, knowing only the codes in
+// PermissionCodes, as the databases only know those they were migrated with.
+type MemoryPermissionStore struct {
+	mu     sync.Mutex
+	grants map[int64]map[string]bool
+}
+
+func (m *MemoryPermissionStore) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var permissions Permissions
+	for _, code := range PermissionCodes {
+		if m.grants[userID][code] {
+			permissions = append(permissions, code)
+		}
+	}
+	return permissions, nil
+}
+
+func (m *MemoryPermissionStore) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.grants[userID] == nil {
+		m.grants[userID] = make(map[string]bool)
+	}
+	for _, code := range codes {
+		for _, known := range PermissionCodes {
+			if code == known {
+				m.grants[userID][code] = true
+			}
+		}
+	}
+	return nil
+}
+
+type MemoryShelfStore struct {
+	mu         sync.Mutex
+	shelves    map[int64]*Shelf
+	nextID     int64
+	items      map[int64]*ShelfItem
+	nextItemID int64
+	books      *MemoryBookStore
+}
+
+func (m *MemoryShelfStore) sameName(shelf *Shelf) bool {
+	for _, other := range m.shelves {
+		if other.ID != shelf.ID && other.UserID == shelf.UserID && strings.EqualFold(other.Name, shelf.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryShelfStore) Insert(ctx context.Context, shelf *Shelf) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sameName(shelf) {
+		return ErrDuplicateShelf
+	}
+
+	m.nextID++
+	shelf.ID = m.nextID
+	shelf.CreatedAt = time.Now().Truncate(time.Second)
+	shelf.Version = 1
+
+	c := *shelf
+	m.shelves[shelf.ID] = &c
+	return nil
+}
+
+func (m *MemoryShelfStore) Get(ctx context.Context, userID, id int64) (*Shelf, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	shelf, ok := m.shelves[id]
+	if !ok || shelf.UserID != userID {
+		return nil, ErrRecordNotFound
+	}
+	c := *shelf
+	return &c, nil
+}
+
+func (m *MemoryShelfStore) GetAll(ctx context.Context, userID int64, filters Filters) ([]*Shelf, Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []*Shelf
+	for _, shelf := range m.shelves {
+		if shelf.UserID == userID {
+			c := *shelf
+			matches = append(matches, &c)
+		}
+	}
+
+	sortRecords(matches, filters, func(i, j int, column string) int {
+		a, b := matches[i], matches[j]
+		switch column {
+		case "id":
+			return compareInts(a.ID, b.ID)
+		case "name":
+			return strings.Compare(a.Name, b.Name)
+		case "created_at":
+			return compareInts(a.CreatedAt.Unix(), b.CreatedAt.Unix())
+		}
+		return 0
+	})
+
+	totalRecords := len(matches)
+	shelves := []*Shelf{}
+
+	for i := filters.offset(); i < totalRecords && i < filters.offset()+filters.limit(); i++ {
+		shelves = append(shelves, matches[i])
+	}
+
+	return shelves, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m *MemoryShelfStore) Update(ctx context.Context, shelf *Shelf) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.shelves[shelf.ID]
+	if !ok || stored.UserID != shelf.UserID || stored.Version != shelf.Version {
+		return ErrEditConflict
+	}
+	if m.sameName(shelf) {
+		return ErrDuplicateShelf
+	}
+
+	shelf.Version++
+	c := *shelf
+	m.shelves[shelf.ID] = &c
+	return nil
+}
+
+func (m *MemoryShelfStore) Delete(ctx context.Context, userID, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	shelf, ok := m.shelves[id]
+	if !ok || shelf.UserID != userID {
+		return ErrRecordNotFound
+	}
+	delete(m.shelves, id)
+
+	for itemID, item := range m.items {
+		if item.ShelfID == id {
+			delete(m.items, itemID)
+		}
+	}
+	return nil
+}
+
+// item returns a copy of the item with its book's title, or false if the
+// book has since been deleted, which in the databases deletes the item too.
+// The caller must hold m.mu.
+func (m *MemoryShelfStore) item(item *ShelfItem) (*ShelfItem, bool) {
+	m.books.mu.RLock()
+	book, ok := m.books.books[item.BookID]
+	m.books.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	c := *item
+	c.Title = book.Title
+	return &c, true
+}
+
+func (m *MemoryShelfStore) InsertItem(ctx context.Context, item *ShelfItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, other := range m.items {
+		if _, ok := m.item(other); ok && other.ShelfID == item.ShelfID && other.BookID == item.BookID {
+			return ErrDuplicateShelfItem
+		}
+	}
+
+	m.nextItemID++
+	item.ID = m.nextItemID
+	item.CreatedAt = time.Now().Truncate(time.Second)
+	item.UpdatedAt = item.CreatedAt
+	item.Version = 1
+
+	c := *item
+	m.items[item.ID] = &c
+	return nil
+}
+
+func (m *MemoryShelfStore) GetItem(ctx context.Context, shelfID, id int64) (*ShelfItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.items[id]
+	if !ok || stored.ShelfID != shelfID {
+		return nil, ErrRecordNotFound
+	}
+
+	item, ok := m.item(stored)
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return item, nil
+}
+
+func (m *MemoryShelfStore) GetItems(ctx context.Context, shelfID int64, status string, filters Filters) ([]*ShelfItem, Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []*ShelfItem
+	for _, stored := range m.items {
+		if stored.ShelfID != shelfID || (status != "" && stored.Status != status) {
+			continue
+		}
+		if item, ok := m.item(stored); ok {
+			matches = append(matches, item)
+		}
+	}
+
+	sortRecords(matches, filters, func(i, j int, column string) int {
+		a, b := matches[i], matches[j]
+		switch column {
+		case "id":
+			return compareInts(a.ID, b.ID)
+		case "title":
+			return strings.Compare(a.Title, b.Title)
+		case "updated_at":
+			return compareInts(a.UpdatedAt.Unix(), b.UpdatedAt.Unix())
+		case "pages_read":
+			return compareInts(int64(a.PagesRead), int64(b.PagesRead))
+		}
+		return 0
+	})
+
+	totalRecords := len(matches)
+	items := []*ShelfItem{}
+
+	for i := filters.offset(); i < totalRecords && i < filters.offset()+filters.limit(); i++ {
+		items = append(items, matches[i])
+	}
+
+	return items, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m *MemoryShelfStore) UpdateItem(ctx context.Context, item *ShelfItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.items[item.ID]
+	if !ok || stored.ShelfID != item.ShelfID || stored.Version != item.Version {
+		return ErrEditConflict
+	}
+	if _, ok := m.item(stored); !ok {
+		return ErrEditConflict
+	}
+
+	item.UpdatedAt = time.Now().Truncate(time.Second)
+	item.Version++
+	c := *item
+	m.items[item.ID] = &c
+	return nil
+}
+
+func (m *MemoryShelfStore) DeleteItem(ctx context.Context, shelfID, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.items[id]
+	if !ok || stored.ShelfID != shelfID {
+		return ErrRecordNotFound
+	}
+	delete(m.items, id)
+
+	if _, ok := m.item(stored); !ok {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+type MemoryReviewStore struct {
+	mu      sync.Mutex
+	reviews map[int64]*Review
+	nextID  int64
+	books   *MemoryBookStore
+}
+
+// refreshRatings recomputes the book's rating summary the way
+// refreshRatingsQuery does. It returns false if the book has been deleted,
+// which in the databases deletes its reviews too. The caller must hold m.mu.
+func (m *MemoryReviewStore) refreshRatings(bookID int64) bool {
+	m.books.mu.Lock()
+	defer m.books.mu.Unlock()
+
+	book, ok := m.books.books[bookID]
+	if !ok {
+		return false
+	}
+
+	var sum, count int64
+	for _, review := range m.reviews {
+		if review.BookID == bookID {
+			sum += int64(review.Rating)
+			count++
+		}
+	}
+
+	book.AverageRating = 0
+	if count > 0 {
+		book.AverageRating = math.Round(float64(sum)/float64(count)*100) / 100
+	}
+	book.RatingsCount = int32(count)
+	book.UpdatedAt = time.Now().Truncate(time.Second)
+	m.books.logChange(ChangeUpdated, book)
+	return true
+}
+
+func (m *MemoryReviewStore) bookExists(bookID int64) bool {
+	m.books.mu.RLock()
+	defer m.books.mu.RUnlock()
+
+	_, ok := m.books.books[bookID]
+	return ok
+}
+
+func (m *MemoryReviewStore) Insert(ctx context.Context, review *Review) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.bookExists(review.BookID) {
+		return ErrRecordNotFound
+	}
+	for _, other := range m.reviews {
+		if other.UserID == review.UserID && other.BookID == review.BookID {
+			return ErrDuplicateReview
+		}
+	}
+
+	m.nextID++
+	review.ID = m.nextID
+	review.CreatedAt = time.Now().Truncate(time.Second)
+	review.UpdatedAt = review.CreatedAt
+	review.Version = 1
+
+	c := *review
+	m.reviews[review.ID] = &c
+	m.refreshRatings(review.BookID)
+	return nil
+}
+
+func (m *MemoryReviewStore) Get(ctx context.Context, bookID, id int64) (*Review, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	review, ok := m.reviews[id]
+	if !ok || review.BookID != bookID || !m.bookExists(bookID) {
+		return nil, ErrRecordNotFound
+	}
+	c := *review
+	return &c, nil
+}
+
+func (m *MemoryReviewStore) GetAll(ctx context.Context, bookID int64, filters Filters) ([]*Review, Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []*Review
+	if m.bookExists(bookID) {
+		for _, review := range m.reviews {
+			if review.BookID == bookID {
+				c := *review
+				matches = append(matches, &c)
+			}
+		}
+	}
+
+	sortRecords(matches, filters, func(i, j int, column string) int {
+		a, b := matches[i], matches[j]
+		switch column {
+		case "id":
+			return compareInts(a.ID, b.ID)
+		case "rating":
+			return compareInts(int64(a.Rating), int64(b.Rating))
+		case "created_at":
+			return compareInts(a.CreatedAt.Unix(), b.CreatedAt.Unix())
+		case "updated_at":
+			return compareInts(a.UpdatedAt.Unix(), b.UpdatedAt.Unix())
+		}
+		return 0
+	})
+
+	totalRecords := len(matches)
+	reviews := []*Review{}
+
+	for i := filters.offset(); i < totalRecords && i < filters.offset()+filters.limit(); i++ {
+		reviews = append(reviews, matches[i])
+	}
+
+	return reviews, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m *MemoryReviewStore) Update(ctx context.Context, review *Review) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.reviews[review.ID]
+	if !ok || stored.BookID != review.BookID || stored.Version != review.Version || !m.bookExists(review.BookID) {
+		return ErrEditConflict
+	}
+
+	review.UpdatedAt = time.Now().Truncate(time.Second)
+	review.Version++
+	c := *review
+	m.reviews[review.ID] = &c
+	m.refreshRatings(review.BookID)
+	return nil
+}
+
+func (m *MemoryReviewStore) Delete(ctx context.Context, bookID, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	review, ok := m.reviews[id]
+	if !ok || review.BookID != bookID {
+		return ErrRecordNotFound
+	}
+	delete(m.reviews, id)
+
+	if !m.refreshRatings(bookID) {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// MemoryCopyStore's mutex also guards its holds, since filling a hold sets a
+// copy aside.
+type MemoryCopyStore struct {
+	mu     sync.Mutex
+	copies map[int64]*Copy
+	nextID int64
+	books  *MemoryBookStore
+	holds  *MemoryHoldStore
+}
+
+// firstAvailable returns the book's available copy with the lowest id, or nil
+// if it has none. The caller must hold m.mu.
+func (m *MemoryCopyStore) firstAvailable(bookID int64) *Copy {
+	var first *Copy
+	for _, c := range m.copies {
+		if c.BookID == bookID && c.Status == CopyAvailable && (first == nil || c.ID < first.ID) {
+			first = c
+		}
+	}
+	return first
+}
+
+// fillHolds sets the book's available copies aside for its waiting holds,
+// oldest first, as fillHolds does. The caller must hold m.mu.
+func (m *MemoryCopyStore) fillHolds(bookID int64) {
+	for {
+		c := m.firstAvailable(bookID)
+		hold := m.holds.nextWaiting(bookID)
+		if c == nil || hold == nil {
+			return
+		}
+
+		now := time.Now().Truncate(time.Second)
+		expires := now.Add(hold.PickupPeriod).Truncate(time.Second)
+		copyID := c.ID
+
+		c.Status = CopyOnHold
+		c.Version++
+
+		hold.Status = HoldReady
+		hold.CopyID = &copyID
+		hold.ReadyAt = &now
+		hold.ExpiresAt = &expires
+		hold.Version++
+	}
+}
+
+// refreshCopies hands the book's available copies to its waiting holds and
+// recounts its copies, the way refreshCopies does. The caller must hold m.mu.
+func (m *MemoryCopyStore) refreshCopies(bookID int64) {
+	m.fillHolds(bookID)
+
+	m.books.mu.Lock()
+	defer m.books.mu.Unlock()
+
+	book, ok := m.books.books[bookID]
+	if !ok {
+		return
+	}
+
+	book.CopiesTotal, book.CopiesAvailable = 0, 0
+	for _, c := range m.copies {
+		if c.BookID == bookID {
+			book.CopiesTotal++
+			if c.Status == CopyAvailable {
+				book.CopiesAvailable++
+			}
+		}
+	}
+	book.Available = book.CopiesAvailable > 0
+	book.UpdatedAt = time.Now().Truncate(time.Second)
+	m.books.logChange(ChangeUpdated, book)
+}
+
+// bookExists reports whether the book is still there, its copies going with
+// it in the databases. The caller must hold m.mu.
+func (m *MemoryCopyStore) bookExists(bookID int64) bool {
+	m.books.mu.RLock()
+	defer m.books.mu.RUnlock()
+
+	_, ok := m.books.books[bookID]
+	return ok
+}
+
+func (m *MemoryCopyStore) sameBarcode(c *Copy) bool {
+	for _, other := range m.copies {
+		if other.ID != c.ID && other.Barcode == c.Barcode && m.bookExists(other.BookID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryCopyStore) Insert(ctx context.Context, c *Copy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.bookExists(c.BookID) {
+		return ErrRecordNotFound
+	}
+	if m.sameBarcode(c) {
+		return ErrDuplicateBarcode
+	}
+
+	m.nextID++
+	c.ID = m.nextID
+	c.CreatedAt = time.Now().Truncate(time.Second)
+	c.AcquiredAt = c.AcquiredAt.Truncate(time.Second)
+	c.Version = 1
+
+	stored := *c
+	m.copies[c.ID] = &stored
+	m.refreshCopies(c.BookID)
+	return nil
+}
+
+func (m *MemoryCopyStore) Get(ctx context.Context, bookID, id int64) (*Copy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.copies[id]
+	if !ok || c.BookID != bookID || !m.bookExists(bookID) {
+		return nil, ErrRecordNotFound
+	}
+	found := *c
+	return &found, nil
+}
+
+func (m *MemoryCopyStore) GetByBarcode(ctx context.Context, barcode string) (*Copy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.copies {
+		if c.Barcode == barcode && m.bookExists(c.BookID) {
+			found := *c
+			return &found, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+func (m *MemoryCopyStore) GetAll(ctx context.Context, bookID int64, status string, filters Filters) ([]*Copy, Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []*Copy
+	if m.bookExists(bookID) {
+		for _, c := range m.copies {
+			if c.BookID == bookID && (status == "" || c.Status == status) {
+				found := *c
+				matches = append(matches, &found)
+			}
+		}
+	}
+
+	sortRecords(matches, filters, func(i, j int, column string) int {
+		a, b := matches[i], matches[j]
+		switch column {
+		case "id":
+			return compareInts(a.ID, b.ID)
+		case "barcode":
+			return strings.Compare(a.Barcode, b.Barcode)
+		case "location":
+			return strings.Compare(a.Location, b.Location)
+		case "acquired_at":
+			return compareInts(a.AcquiredAt.Unix(), b.AcquiredAt.Unix())
+		}
+		return 0
+	})
+
+	totalRecords := len(matches)
+	copies := []*Copy{}
+
+	for i := filters.offset(); i < totalRecords && i < filters.offset()+filters.limit(); i++ {
+		copies = append(copies, matches[i])
+	}
+
+	return copies, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m *MemoryCopyStore) Update(ctx context.Context, c *Copy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.copies[c.ID]
+	if !ok || stored.BookID != c.BookID || stored.Version != c.Version || !m.bookExists(c.BookID) {
+		return ErrEditConflict
+	}
+	if m.sameBarcode(c) {
+		return ErrDuplicateBarcode
+	}
+
+	c.AcquiredAt = c.AcquiredAt.Truncate(time.Second)
+	c.Version++
+	updated := *c
+	m.copies[c.ID] = &updated
+	m.refreshCopies(c.BookID)
+	return nil
+}
+
+func (m *MemoryCopyStore) Delete(ctx context.Context, bookID, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.copies[id]
+	if !ok || c.BookID != bookID || !m.bookExists(bookID) {
+		return ErrRecordNotFound
+	}
+	switch c.Status {
+	case CopyOnLoan:
+		return ErrCopyOnLoan
+	case CopyOnHold:
+		return ErrCopyOnHold
+	}
+
+	delete(m.copies, id)
+	m.refreshCopies(bookID)
+	return nil
+}
+
+type MemoryLoanStore struct {
+	mu     sync.Mutex
+	loans  map[int64]*Loan
+	nextID int64
+	books  *MemoryBookStore
+	copies *MemoryCopyStore
+	users  *MemoryUserStore
+}
+
+// loan returns a copy of the loan with its borrower's name, book's title and
+// copy's barcode, or false if the book or copy has since been deleted, which
+// in the databases deletes the loan too. The caller must hold m.mu.
+func (m *MemoryLoanStore) loan(loan *Loan) (*Loan, bool) {
+	m.books.mu.RLock()
+	book, ok := m.books.books[loan.BookID]
+	m.books.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	m.copies.mu.Lock()
+	lent, ok := m.copies.copies[loan.CopyID]
+	m.copies.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	m.users.mu.Lock()
+	user := m.users.users[loan.UserID]
+	m.users.mu.Unlock()
+
+	c := *loan
+	c.Title = book.Title
+	c.Barcode = lent.Barcode
+	if user != nil {
+		c.Borrower = user.Name
+	}
+	return &c, true
+}
+
+func (m *MemoryLoanStore) Checkout(ctx context.Context, loan *Loan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.books.mu.RLock()
+	book, ok := m.books.books[loan.BookID]
+	m.books.mu.RUnlock()
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	m.copies.mu.Lock()
+	defer m.copies.mu.Unlock()
+
+	// The copy set aside for the user's hold, or else the book's first
+	// available copy, as takeCopy takes.
+	lent := m.copies.holds.collect(loan.BookID, loan.UserID)
+	if lent == nil {
+		lent = m.copies.firstAvailable(loan.BookID)
+	}
+	if lent == nil {
+		return ErrBookUnavailable
+	}
+
+	lent.Status = CopyOnLoan
+	lent.Version++
+	m.copies.refreshCopies(loan.BookID)
+
+	m.nextID++
+	loan.ID = m.nextID
+	loan.CheckedOutAt = time.Now().Truncate(time.Second)
+	loan.DueAt = loan.DueAt.Truncate(time.Second)
+	loan.Title = book.Title
+	loan.CopyID = lent.ID
+	loan.Barcode = lent.Barcode
+	loan.Renewals = 0
+	loan.Version = 1
+
+	c := *loan
+	m.loans[loan.ID] = &c
+	return nil
+}
+
+func (m *MemoryLoanStore) Get(ctx context.Context, id int64) (*Loan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.loans[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	loan, ok := m.loan(stored)
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return loan, nil
+}
+
+func (m *MemoryLoanStore) GetAll(ctx context.Context, userID int64, status string, filters Filters) ([]*Loan, Metadata, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	var matches []*Loan
+	for _, stored := range m.loans {
+		if userID != 0 && stored.UserID != userID {
+			continue
+		}
+		switch {
+		case status == LoanActive && stored.ReturnedAt != nil,
+			status == LoanOverdue && !stored.Overdue(now),
+			status == LoanReturned && stored.ReturnedAt == nil:
+			continue
+		}
+		if loan, ok := m.loan(stored); ok {
+			matches = append(matches, loan)
+		}
+	}
+
+	sortRecords(matches, filters, func(i, j int, column string) int {
+		a, b := matches[i], matches[j]
+		switch column {
+		case "id":
+			return compareInts(a.ID, b.ID)
+		case "checked_out_at":
+			return compareInts(a.CheckedOutAt.Unix(), b.CheckedOutAt.Unix())
+		case "due_at":
+			return compareInts(a.DueAt.Unix(), b.DueAt.Unix())
+		case "title":
+			return strings.Compare(a.Title, b.Title)
+		}
+		return 0
+	})
+
+	totalRecords := len(matches)
+	loans := []*Loan{}
+
+	for i := filters.offset(); i < totalRecords && i < filters.offset()+filters.limit(); i++ {
+		loans = append(loans, matches[i])
+	}
+
+	return loans, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m *MemoryLoanStore) Update(ctx context.Context, loan *Loan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.loans[loan.ID]
+	if !ok || stored.Version != loan.Version || stored.ReturnedAt != nil {
+		return ErrEditConflict
+	}
+	if _, ok := m.loan(stored); !ok {
+		return ErrEditConflict
+	}
+
+	loan.DueAt = loan.DueAt.Truncate(time.Second)
+	if loan.ReturnedAt != nil {
+		t := loan.ReturnedAt.Truncate(time.Second)
+		loan.ReturnedAt = &t
+
+		m.copies.mu.Lock()
+		if lent, ok := m.copies.copies[loan.CopyID]; ok && lent.Status == CopyOnLoan {
+			lent.Status = CopyAvailable
+			lent.Version++
+			m.copies.refreshCopies(loan.BookID)
+		}
+		m.copies.mu.Unlock()
+	}
+	loan.Version++
+	c := *loan
+	m.loans[loan.ID] = &c
+	return nil
+}
+
+// MemoryHoldStore keeps its holds under the copy store's mutex, since filling,
+// collecting and releasing a hold all move a copy.
+type MemoryHoldStore struct {
+	holds    map[int64]*Hold
+	notified map[int64]bool
+	nextID   int64
+	books    *MemoryBookStore
+	copies   *MemoryCopyStore
+	users    *MemoryUserStore
+}
+
+// nextWaiting returns the book's oldest waiting hold, or nil if it has none.
+// The caller must hold m.copies.mu.
+func (m *MemoryHoldStore) nextWaiting(bookID int64) *Hold {
+	var next *Hold
+	for _, hold := range m.holds {
+		if hold.BookID == bookID && hold.Status == HoldWaiting && (next == nil || hold.ID < next.ID) {
+			next = hold
+		}
+	}
+	return next
+}
+
+// collect closes the user's ready hold on the book and returns the copy set
+// aside for it, or nil if they have none. The caller must hold m.copies.mu.
+func (m *MemoryHoldStore) collect(bookID, userID int64) *Copy {
+	for _, hold := range m.holds {
+		if hold.BookID != bookID || hold.UserID != userID || hold.Status != HoldReady || hold.CopyID == nil {
+			continue
+		}
+
+		held, ok := m.copies.copies[*hold.CopyID]
+		if !ok {
+			return nil
+		}
+
+		hold.Status = HoldCollected
+		hold.Version++
+		return held
+	}
+	return nil
+}
+
+// release puts the copy set aside for a hold back on the shelf, for the next
+// hold in line to take. The caller must hold m.copies.mu.
+func (m *MemoryHoldStore) release(hold *Hold) {
+	if hold.CopyID != nil {
+		if held, ok := m.copies.copies[*hold.CopyID]; ok && held.Status == CopyOnHold {
+			held.Status = CopyAvailable
+			held.Version++
+		}
+	}
+	m.copies.refreshCopies(hold.BookID)
+}
+
+// hold returns a copy of the hold with its member's name and email, book's
+// title, copy's barcode and place in the queue, or false if the book has
+// since been deleted, which in the databases deletes the hold too. The
+// caller must hold m.copies.mu.
+func (m *MemoryHoldStore) hold(hold *Hold) (*Hold, bool) {
+	m.books.mu.RLock()
+	book, ok := m.books.books[hold.BookID]
+	m.books.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	m.users.mu.Lock()
+	user := m.users.users[hold.UserID]
+	m.users.mu.Unlock()
+
+	c := *hold
+	c.Title = book.Title
+	if user != nil {
+		c.Member = user.Name
+		c.Email = user.Email
+	}
+	if hold.CopyID != nil {
+		if held, ok := m.copies.copies[*hold.CopyID]; ok {
+			c.Barcode = held.Barcode
+		}
+	}
+	if hold.Status == HoldWaiting {
+		for _, other := range m.holds {
+			if other.BookID == hold.BookID && other.Status == HoldWaiting && other.ID <= hold.ID {
+				c.Position++
+			}
+		}
+	}
+	return &c, true
+}
+
+func (m *MemoryHoldStore) Insert(ctx context.Context, hold *Hold) error {
+	m.copies.mu.Lock()
+	defer m.copies.mu.Unlock()
+
+	m.books.mu.RLock()
+	book, ok := m.books.books[hold.BookID]
+	m.books.mu.RUnlock()
+	if !ok {
+		return ErrRecordNotFound
+	}
+	if book.Available {
+		return ErrBookAvailable
+	}
+
+	for _, other := range m.holds {
+		if other.BookID == hold.BookID && other.UserID == hold.UserID && (other.Status == HoldWaiting || other.Status == HoldReady) {
+			return ErrDuplicateHold
+		}
+	}
+
+	m.nextID++
+	hold.ID = m.nextID
+	hold.CreatedAt = time.Now().Truncate(time.Second)
+	hold.Title = book.Title
+	hold.Status = HoldWaiting
+	hold.Version = 1
+
+	c := *hold
+	m.holds[hold.ID] = &c
+
+	stored, _ := m.hold(&c)
+	hold.Position = stored.Position
+	return nil
+}
+
+func (m *MemoryHoldStore) Get(ctx context.Context, id int64) (*Hold, error) {
+	m.copies.mu.Lock()
+	defer m.copies.mu.Unlock()
+
+	stored, ok := m.holds[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	hold, ok := m.hold(stored)
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	return hold, nil
+}
+
+func (m *MemoryHoldStore) GetAll(ctx context.Context, userID, bookID int64, status string, filters Filters) ([]*Hold, Metadata, error) {
+	m.copies.mu.Lock()
+	defer m.copies.mu.Unlock()
+
+	var matches []*Hold
+	for _, stored := range m.holds {
+		if userID != 0 && stored.UserID != userID || bookID != 0 && stored.BookID != bookID {
+			continue
+		}
+		switch {
+		case status == HoldOpen && stored.Status != HoldWaiting && stored.Status != HoldReady,
+			status != "" && status != HoldOpen && stored.Status != status:
+			continue
+		}
+		if hold, ok := m.hold(stored); ok {
+			matches = append(matches, hold)
+		}
+	}
+
+	sortRecords(matches, filters, func(i, j int, column string) int {
+		a, b := matches[i], matches[j]
+		switch column {
+		case "id":
+			return compareInts(a.ID, b.ID)
+		case "created_at":
+			return compareInts(a.CreatedAt.Unix(), b.CreatedAt.Unix())
+		case "title":
+			return strings.Compare(a.Title, b.Title)
+		}
+		return 0
+	})
+
+	totalRecords := len(matches)
+	holds := []*Hold{}
+
+	for i := filters.offset(); i < totalRecords && i < filters.offset()+filters.limit(); i++ {
+		holds = append(holds, matches[i])
+	}
+
+	return holds, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func (m *MemoryHoldStore) CountWaiting(ctx context.Context, bookID int64) (int, error) {
+	m.copies.mu.Lock()
+	defer m.copies.mu.Unlock()
+
+	waiting := 0
+	for _, hold := range m.holds {
+		if hold.BookID == bookID && hold.Status == HoldWaiting {
+			waiting++
+		}
+	}
+	return waiting, nil
+}
+
+func (m *MemoryHoldStore) Cancel(ctx context.Context, hold *Hold) error {
+	m.copies.mu.Lock()
+	defer m.copies.mu.Unlock()
+
+	stored, ok := m.holds[hold.ID]
+	if !ok || stored.Version != hold.Version || (stored.Status != HoldWaiting && stored.Status != HoldReady) {
+		return ErrEditConflict
+	}
+	if _, ok := m.hold(stored); !ok {
+		return ErrEditConflict
+	}
+
+	ready := stored.Status == HoldReady
+
+	stored.Status = HoldCancelled
+	stored.Version++
+
+	if ready {
+		m.release(stored)
+	}
+
+	hold.Status = HoldCancelled
+	hold.Position = 0
+	hold.Version = stored.Version
+	return nil
+}
+
+func (m *MemoryHoldStore) Expire(ctx context.Context) ([]*Hold, error) {
+	m.copies.mu.Lock()
+	defer m.copies.mu.Unlock()
+
+	now := time.Now()
+
+	var due []*Hold
+	for _, hold := range m.holds {
+		if hold.Status == HoldReady && hold.ExpiresAt != nil && hold.ExpiresAt.Before(now) {
+			if _, ok := m.hold(hold); ok {
+				due = append(due, hold)
+			}
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+
+	expired := []*Hold{}
+	for _, hold := range due {
+		hold.Status = HoldExpired
+		hold.Version++
+		m.release(hold)
+
+		c := *hold
+		expired = append(expired, &c)
+	}
+
+	return expired, nil
+}
+
+func (m *MemoryHoldStore) Unnotified(ctx context.Context) ([]*Hold, error) {
+	m.copies.mu.Lock()
+	defer m.copies.mu.Unlock()
+
+	holds := []*Hold{}
+	for _, stored := range m.holds {
+		if stored.Status != HoldReady || m.notified[stored.ID] {
+			continue
+		}
+		if hold, ok := m.hold(stored); ok {
+			holds = append(holds, hold)
+		}
+	}
+	sort.Slice(holds, func(i, j int) bool { return holds[i].ID < holds[j].ID })
+
+	return holds, nil
+}
+
+func (m *MemoryHoldStore) MarkNotified(ctx context.Context, id int64) error {
+	m.copies.mu.Lock()
+	defer m.copies.mu.Unlock()
+
+	m.notified[id] = true
+	return nil
+}
@@ -1,8 +1,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -10,12 +12,190 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+const defaultTimeout = 3 * time.Second
+
+// Timeouts bounds how long a single query may run, on top of any deadline the
+// caller's context already carries. A zero value falls back to three seconds.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+func (t Timeouts) read(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Read)
+}
+
+func (t Timeouts) write(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, t.Write)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError reports the context's error in place of err when the query
+// failed because the request was cancelled or ran out of time, since the
+// driver's own error for that case doesn't say so.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+type BookStore interface {
+	Insert(ctx context.Context, book *Book) error
+	Get(ctx context.Context, id int64, fields ...string) (*Book, error)
+	Update(ctx context.Context, book *Book) error
+	Delete(ctx context.Context, id int64) error
+	GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Book, Metadata, error)
+	Changes(ctx context.Context, after int64, limit int) ([]*BookChange, error)
+	PruneChanges(ctx context.Context, before time.Time) error
+}
+
+type GenreStore interface {
+	Insert(ctx context.Context, genre *Genre) error
+	Get(ctx context.Context, id int64) (*Genre, error)
+	Update(ctx context.Context, genre *Genre) error
+	Delete(ctx context.Context, id int64) error
+	GetAll(ctx context.Context) ([]*Genre, error)
+	Descendants(ctx context.Context, slug string) ([]string, error)
+	Normalize(ctx context.Context, names []string) (slugs []string, unknown []string, err error)
+}
+
+type WebhookStore interface {
+	Insert(ctx context.Context, webhook *Webhook) error
+	Get(ctx context.Context, id int64) (*Webhook, error)
+	Update(ctx context.Context, webhook *Webhook) error
+	Delete(ctx context.Context, id int64) error
+	GetAll(ctx context.Context) ([]*Webhook, error)
+	Enqueue(ctx context.Context, message *OutboxMessage) (int, error)
+	ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error)
+	UpdateDelivery(ctx context.Context, delivery *WebhookDelivery) error
+	GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error)
+}
+
+// OutboxStore hands out each book's messages in order. A dead message is
+// kept for inspection but no longer claimed, nor does it hold up the book's
+// later messages.
+type OutboxStore interface {
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error)
+	Delete(ctx context.Context, id int64) error
+	Retry(ctx context.Context, message *OutboxMessage) error
+	DeadLetter(ctx context.Context, message *OutboxMessage) error
+}
+
+type UserStore interface {
+	Insert(ctx context.Context, user *User) error
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	GetForToken(ctx context.Context, scope, plaintext string) (*User, error)
+}
+
+type TokenStore interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+}
+
+type PermissionStore interface {
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+}
+
+// ShelfStore scopes shelves by the user they belong to, and items by their
+// shelf, so callers look up the shelf before touching its items.
+type ShelfStore interface {
+	Insert(ctx context.Context, shelf *Shelf) error
+	Get(ctx context.Context, userID, id int64) (*Shelf, error)
+	GetAll(ctx context.Context, userID int64, filters Filters) ([]*Shelf, Metadata, error)
+	Update(ctx context.Context, shelf *Shelf) error
+	Delete(ctx context.Context, userID, id int64) error
+	InsertItem(ctx context.Context, item *ShelfItem) error
+	GetItem(ctx context.Context, shelfID, id int64) (*ShelfItem, error)
+	GetItems(ctx context.Context, shelfID int64, status string, filters Filters) ([]*ShelfItem, Metadata, error)
+	UpdateItem(ctx context.Context, item *ShelfItem) error
+	DeleteItem(ctx context.Context, shelfID, id int64) error
+}
+
+// ReviewStore keeps each book's average_rating and ratings_count in step with
+// its reviews as part of every write.
+type ReviewStore interface {
+	Insert(ctx context.Context, review *Review) error
+	Get(ctx context.Context, bookID, id int64) (*Review, error)
+	GetAll(ctx context.Context, bookID int64, filters Filters) ([]*Review, Metadata, error)
+	Update(ctx context.Context, review *Review) error
+	Delete(ctx context.Context, bookID, id int64) error
+}
+
+// CopyStore keeps each book's copies_total, copies_available and available in
+// step with its copies as part of every write. A copy that becomes available
+// while the book has holds waiting is set aside for the oldest of them.
+type CopyStore interface {
+	Insert(ctx context.Context, c *Copy) error
+	Get(ctx context.Context, bookID, id int64) (*Copy, error)
+	GetByBarcode(ctx context.Context, barcode string) (*Copy, error)
+	GetAll(ctx context.Context, bookID int64, status string, filters Filters) ([]*Copy, Metadata, error)
+	Update(ctx context.Context, c *Copy) error
+	Delete(ctx context.Context, bookID, id int64) error
+}
+
+// LoanStore lends each copy of a book to one user at a time: Checkout takes
+// the copy set aside for the user's ready hold or else an available copy, or
+// fails with ErrBookUnavailable if there is none, and returning the loan
+// makes the copy available again or sets it aside for the next hold.
+type LoanStore interface {
+	Checkout(ctx context.Context, loan *Loan) error
+	Get(ctx context.Context, id int64) (*Loan, error)
+	GetAll(ctx context.Context, userID int64, status string, filters Filters) ([]*Loan, Metadata, error)
+	Update(ctx context.Context, loan *Loan) error
+}
+
+// HoldStore queues users for books with no copy to lend, first come first
+// served. Holds are filled by the copy and loan stores as copies come back;
+// Expire closes the ready holds whose pickup period has run out, and
+// Unnotified and MarkNotified track which members have been told their hold
+// is ready.
+type HoldStore interface {
+	Insert(ctx context.Context, hold *Hold) error
+	Get(ctx context.Context, id int64) (*Hold, error)
+	GetAll(ctx context.Context, userID, bookID int64, status string, filters Filters) ([]*Hold, Metadata, error)
+	CountWaiting(ctx context.Context, bookID int64) (int, error)
+	Cancel(ctx context.Context, hold *Hold) error
+	Expire(ctx context.Context) ([]*Hold, error)
+	Unnotified(ctx context.Context) ([]*Hold, error)
+	MarkNotified(ctx context.Context, id int64) error
+}
+
 type Models struct {
-	Books BookModel
+	Books       BookStore
+	Genres      GenreStore
+	Webhooks    WebhookStore
+	Outbox      OutboxStore
+	Users       UserStore
+	Tokens      TokenStore
+	Permissions PermissionStore
+	Shelves     ShelfStore
+	Reviews     ReviewStore
+	Copies      CopyStore
+	Loans       LoanStore
+	Holds       HoldStore
 }
 
-func NewModels(db *sql.DB) Models {
+func NewModels(db *sql.DB, timeouts Timeouts) Models {
 	return Models{
-		Books: BookModel{DB: db},
+		Books:       BookModel{DB: db, Timeouts: timeouts},
+		Genres:      GenreModel{DB: db, Timeouts: timeouts},
+		Webhooks:    WebhookModel{DB: db, Timeouts: timeouts},
+		Outbox:      OutboxModel{DB: db, Timeouts: timeouts},
+		Users:       UserModel{DB: db, Timeouts: timeouts},
+		Tokens:      TokenModel{DB: db, Timeouts: timeouts},
+		Permissions: PermissionModel{DB: db, Timeouts: timeouts},
+		Shelves:     ShelfModel{DB: db, Timeouts: timeouts},
+		Reviews:     ReviewModel{DB: db, Timeouts: timeouts},
+		Copies:      CopyModel{DB: db, Timeouts: timeouts},
+		Loans:       LoanModel{DB: db, Timeouts: timeouts},
+		Holds:       HoldModel{DB: db, Timeouts: timeouts},
 	}
 }
@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Book events, recorded in the outbox by every book write.
+const (
+	EventBookCreated = "book.created"
+	EventBookUpdated = "book.updated"
+	EventBookDeleted = "book.deleted"
+)
+
+type OutboxModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// OutboxMessage is an event recorded in the same transaction as the write it
+// describes, waiting to be published. AggregateID is the id of the book it is
+// about; a book's messages are published one at a time in the order they
+// were written.
+type OutboxMessage struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	AggregateID int64           `json:"aggregate_id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"-"`
+	AvailableAt time.Time       `json:"-"`
+	LastError   string          `json:"-"`
+}
+
+// outboxPayload is the body published for an event: its name, when it
+// happened and data describing it.
+func outboxPayload(event string, data interface{}) (string, error) {
+	js, err := json.Marshal(map[string]interface{}{
+		"event":       event,
+		"occurred_at": time.Now().UTC().Format(time.RFC3339),
+		"data":        data,
+	})
+	return string(js), err
+}
+
+// insertOutbox records event in the outbox as part of tx. The statement is
+// the same for Postgres and SQLite.
+func insertOutbox(ctx context.Context, tx *sql.Tx, event string, aggregateID int64, data interface{}) error {
+	payload, err := outboxPayload(event, data)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO outbox (aggregate_id, event, payload)
+				VALUES ($1, $2, $3)`
+
+	_, err = tx.ExecContext(ctx, query, aggregateID, event, payload)
+	return err
+}
+
+// bookEventData is the data of a book event: the whole book, or only its id
+// once it has been deleted.
+func bookEventData(book *Book) map[string]interface{} {
+	return map[string]interface{}{"book": book}
+}
+
+func deletedBookEventData(id int64) map[string]interface{} {
+	return map[string]interface{}{"book": map[string]int64{"id": id}}
+}
+
+// Claim returns up to limit messages that are due, each the oldest still
+// unpublished for its book, and holds them back from other claims for lease.
+// SKIP LOCKED lets several relays claim side by side, and since a book's
+// later messages wait for its earlier ones, they are never published out of
+// order or at the same time.
+func (m OutboxModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	query := `
+		UPDATE outbox
+		SET available_at = NOW() + $2 * interval '1 millisecond'
+		WHERE id IN (
+			SELECT id
+			FROM outbox o
+			WHERE NOT dead AND available_at <= NOW() AND NOT EXISTS (
+				SELECT 1 FROM outbox earlier
+				WHERE earlier.aggregate_id = o.aggregate_id AND earlier.id < o.id AND NOT earlier.dead
+			)
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, created_at, aggregate_id, event, payload, attempts, available_at, last_error`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	messages := []*OutboxMessage{}
+
+	for rows.Next() {
+		var message OutboxMessage
+
+		err := rows.Scan(
+			&message.ID,
+			&message.CreatedAt,
+			&message.AggregateID,
+			&message.Event,
+			(*[]byte)(&message.Payload),
+			&message.Attempts,
+			&message.AvailableAt,
+			&message.LastError,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		messages = append(messages, &message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return messages, nil
+}
+
+// Delete removes a message once it has been published.
+func (m OutboxModel) Delete(ctx context.Context, id int64) error {
+	query := `DELETE FROM outbox
+				WHERE id = $1`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return contextError(ctx, err)
+}
+
+// Retry records a failed attempt at publishing a message, which becomes due
+// again at its AvailableAt.
+func (m OutboxModel) Retry(ctx context.Context, message *OutboxMessage) error {
+	query := `
+		UPDATE outbox
+		SET attempts = $1, available_at = $2, last_error = $3
+		WHERE id = $4`
+	args := []interface{}{message.Attempts, message.AvailableAt, message.LastError, message.ID}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return contextError(ctx, err)
+}
+
+// DeadLetter records the last failed attempt at publishing a message that
+// won't be tried again. It stays in the outbox, with its last error, until
+// someone deletes it.
+func (m OutboxModel) DeadLetter(ctx context.Context, message *OutboxMessage) error {
+	query := `
+		UPDATE outbox
+		SET dead = true, attempts = $1, last_error = $2
+		WHERE id = $3`
+	args := []interface{}{message.Attempts, message.LastError, message.ID}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return contextError(ctx, err)
+}
@@ -0,0 +1,87 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+)
+
+// Permission codes. Members need none to use the catalogue, their shelves,
+// loans and holds; staff are granted the ones their work calls for.
+const (
+	PermissionLoansReport    = "loans:report"
+	PermissionWebhooksManage = "webhooks:manage"
+)
+
+var PermissionCodes = []string{PermissionLoansReport, PermissionWebhooksManage}
+
+// Permissions are the codes a user has been granted.
+type Permissions []string
+
+func (p Permissions) Include(code string) bool {
+	for i := range p {
+		if code == p[i] {
+			return true
+		}
+	}
+	return false
+}
+
+type PermissionModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	return scanPermissions(ctx, m.DB, query, userID)
+}
+
+// AddForUser grants the user the permissions with the given codes. Codes the
+// user already has are left as they are.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return contextError(ctx, err)
+}
+
+func scanPermissions(ctx context.Context, db *sql.DB, query string, userID int64) (Permissions, error) {
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	var permissions Permissions
+
+	for rows.Next() {
+		var code string
+
+		err := rows.Scan(&code)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return permissions, nil
+}
@@ -0,0 +1,272 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"time"
+)
+
+var ErrDuplicateReview = errors.New("duplicate review")
+
+var ReviewSortSafelist = []string{"id", "rating", "created_at", "updated_at", "-id", "-rating", "-created_at", "-updated_at"}
+
+type ReviewModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Review is one user's rating of a book, with an optional write-up. A user
+// reviews a book at most once.
+type Review struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserID    int64     `json:"user_id"`
+	BookID    int64     `json:"book_id"`
+	Rating    int32     `json:"rating"`
+	Text      string    `json:"text"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Rating >= 1 && review.Rating <= 5, "rating", "must be between 1 and 5")
+	v.Check(len(review.Text) <= 10_000, "text", "must not be more than 10000 bytes long")
+}
+
+// refreshRatingsQuery recomputes a book's rating summary from its reviews.
+// Its updated_at moves too, so that conditional requests see the change.
+const refreshRatingsQuery = `
+		UPDATE books
+		SET average_rating = COALESCE((SELECT round(avg(rating), 2) FROM reviews WHERE book_id = $1), 0),
+			ratings_count = (SELECT count(*) FROM reviews WHERE book_id = $1),
+			updated_at = NOW()
+		WHERE id = $1`
+
+// lockBook holds the book's row until tx ends. Every review, copy, loan and
+// hold write takes this lock first, so that the summary each one recomputes on the
+// book includes the writes committed before it.
+func lockBook(ctx context.Context, tx *sql.Tx, bookID int64) error {
+	var id int64
+
+	err := tx.QueryRowContext(ctx, `SELECT id FROM books WHERE id = $1 FOR UPDATE`, bookID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+func (m ReviewModel) Insert(ctx context.Context, review *Review) error {
+	query := `INSERT INTO reviews (user_id, book_id, rating, text)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, created_at, updated_at, version`
+
+	args := []interface{}{review.UserID, review.BookID, review.Rating, review.Text}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = lockBook(ctx, tx, review.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateReview
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, refreshRatingsQuery, review.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (m ReviewModel) Get(ctx context.Context, bookID, id int64) (*Review, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, updated_at, user_id, book_id, rating, text, version
+				FROM reviews
+				WHERE id = $1 AND book_id = $2`
+
+	var review Review
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, bookID).Scan(reviewDest(&review)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &review, nil
+}
+
+func reviewDest(review *Review) []interface{} {
+	return []interface{}{
+		&review.ID,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+		&review.UserID,
+		&review.BookID,
+		&review.Rating,
+		&review.Text,
+		&review.Version,
+	}
+}
+
+func (m ReviewModel) GetAll(ctx context.Context, bookID int64, filters Filters) ([]*Review, Metadata, error) {
+	where := &whereClause{}
+	where.add("book_id = ?", bookID)
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), id, created_at, updated_at, user_id, book_id, rating, text, version
+			FROM reviews
+			%s
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		where, filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := []*Review{}
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, reviewDest(&review)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return reviews, metadata, nil
+}
+
+func (m ReviewModel) Update(ctx context.Context, review *Review) error {
+	query := `
+		UPDATE reviews
+		SET rating = $1, text = $2, updated_at = NOW(), version = version + 1
+		WHERE id = $3 AND book_id = $4 AND version = $5
+		RETURNING updated_at, version`
+	args := []interface{}{review.Rating, review.Text, review.ID, review.BookID, review.Version}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = lockBook(ctx, tx, review.BookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&review.UpdatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, refreshRatingsQuery, review.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (m ReviewModel) Delete(ctx context.Context, bookID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM reviews
+				WHERE id = $1 AND book_id = $2`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = lockBook(ctx, tx, bookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	result, err := tx.ExecContext(ctx, query, id, bookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, refreshRatingsQuery, bookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
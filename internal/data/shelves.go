@@ -0,0 +1,427 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"time"
+)
+
+var (
+	ErrDuplicateShelf     = errors.New("duplicate shelf")
+	ErrDuplicateShelfItem = errors.New("duplicate shelf item")
+)
+
+// Reading statuses of a book on a shelf.
+const (
+	StatusWantToRead = "want-to-read"
+	StatusReading    = "reading"
+	StatusRead       = "read"
+)
+
+var ShelfStatuses = []string{StatusWantToRead, StatusReading, StatusRead}
+
+var (
+	ShelfSortSafelist     = []string{"id", "name", "created_at", "-id", "-name", "-created_at"}
+	ShelfItemSortSafelist = []string{"id", "title", "updated_at", "pages_read", "-id", "-title", "-updated_at", "-pages_read"}
+)
+
+type ShelfModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Shelf is a named list of books belonging to one user.
+type Shelf struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    int64     `json:"-"`
+	Name      string    `json:"name"`
+	Version   int32     `json:"version"`
+}
+
+// ShelfItem is a book on a shelf, with how far the user has got with it.
+// Title is the book's, read along with the item.
+type ShelfItem struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	ShelfID    int64      `json:"shelf_id"`
+	BookID     int64      `json:"book_id"`
+	Title      string     `json:"title"`
+	Status     string     `json:"status"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	PagesRead  int32      `json:"pages_read"`
+	Version    int32      `json:"version"`
+}
+
+func ValidateShelf(v *validator.Validator, shelf *Shelf) {
+	v.Check(shelf.Name != "", "name", "must be provided")
+	v.Check(len(shelf.Name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+// ValidateShelfItem checks the item against the book it refers to, since
+// pages read can't go past the book's page count.
+func ValidateShelfItem(v *validator.Validator, item *ShelfItem, book *Book) {
+	v.Check(validator.In(item.Status, ShelfStatuses...), "status", "must be one of want-to-read, reading or read")
+
+	v.Check(item.PagesRead >= 0, "pages_read", "must not be negative")
+	if book.Pages > 0 {
+		v.Check(item.PagesRead <= int32(book.Pages), "pages_read", fmt.Sprintf("must not be greater than the book's %d pages", book.Pages))
+	}
+
+	if item.StartedAt != nil {
+		v.Check(item.Status != StatusWantToRead, "started_at", "must not be set for a book not yet started")
+		v.Check(!item.StartedAt.After(time.Now()), "started_at", "must not be in the future")
+	}
+
+	if item.FinishedAt != nil {
+		v.Check(item.Status == StatusRead, "finished_at", "must only be set for a book that has been read")
+		v.Check(!item.FinishedAt.After(time.Now()), "finished_at", "must not be in the future")
+		if item.StartedAt != nil {
+			v.Check(!item.FinishedAt.Before(*item.StartedAt), "finished_at", "must not be earlier than started_at")
+		}
+	}
+}
+
+func (m ShelfModel) Insert(ctx context.Context, shelf *Shelf) error {
+	query := `INSERT INTO shelves (user_id, name)
+				VALUES ($1, $2)
+				RETURNING id, created_at, version`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, shelf.UserID, shelf.Name).Scan(&shelf.ID, &shelf.CreatedAt, &shelf.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateShelf
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+// Get returns the shelf only if it belongs to the user, so that another
+// user's shelf looks the same as one that doesn't exist.
+func (m ShelfModel) Get(ctx context.Context, userID, id int64) (*Shelf, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, user_id, name, version
+				FROM shelves
+				WHERE id = $1 AND user_id = $2`
+
+	var shelf Shelf
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&shelf.ID,
+		&shelf.CreatedAt,
+		&shelf.UserID,
+		&shelf.Name,
+		&shelf.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &shelf, nil
+}
+
+func (m ShelfModel) GetAll(ctx context.Context, userID int64, filters Filters) ([]*Shelf, Metadata, error) {
+	where := &whereClause{}
+	where.add("user_id = ?", userID)
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), id, created_at, user_id, name, version
+			FROM shelves
+			%s
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		where, filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	shelves := []*Shelf{}
+
+	for rows.Next() {
+		var shelf Shelf
+
+		err := rows.Scan(
+			&totalRecords,
+			&shelf.ID,
+			&shelf.CreatedAt,
+			&shelf.UserID,
+			&shelf.Name,
+			&shelf.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		shelves = append(shelves, &shelf)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return shelves, metadata, nil
+}
+
+func (m ShelfModel) Update(ctx context.Context, shelf *Shelf) error {
+	query := `
+		UPDATE shelves
+		SET name = $1, version = version + 1
+		WHERE id = $2 AND user_id = $3 AND version = $4
+		RETURNING version`
+	args := []interface{}{shelf.Name, shelf.ID, shelf.UserID, shelf.Version}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&shelf.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case isUniqueViolation(err):
+			return ErrDuplicateShelf
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (m ShelfModel) Delete(ctx context.Context, userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM shelves
+				WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// shelfItemsQuery selects items along with their book's title, from a
+// subquery so that the sort columns need no table prefix.
+const shelfItemsQuery = `
+			SELECT %s id, created_at, updated_at, shelf_id, book_id, title, status,
+				started_at, finished_at, pages_read, version
+			FROM (
+				SELECT shelf_items.*, books.title
+				FROM shelf_items
+				INNER JOIN books ON books.id = shelf_items.book_id
+			) AS items
+			%s`
+
+func shelfItemDest(item *ShelfItem) []interface{} {
+	return []interface{}{
+		&item.ID,
+		&item.CreatedAt,
+		&item.UpdatedAt,
+		&item.ShelfID,
+		&item.BookID,
+		&item.Title,
+		&item.Status,
+		&item.StartedAt,
+		&item.FinishedAt,
+		&item.PagesRead,
+		&item.Version,
+	}
+}
+
+func (m ShelfModel) InsertItem(ctx context.Context, item *ShelfItem) error {
+	query := `INSERT INTO shelf_items (shelf_id, book_id, status, started_at, finished_at, pages_read)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id, created_at, updated_at, version`
+
+	args := []interface{}{item.ShelfID, item.BookID, item.Status, item.StartedAt, item.FinishedAt, item.PagesRead}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&item.ID, &item.CreatedAt, &item.UpdatedAt, &item.Version)
+	if err != nil {
+		switch {
+		case isUniqueViolation(err):
+			return ErrDuplicateShelfItem
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (m ShelfModel) GetItem(ctx context.Context, shelfID, id int64) (*ShelfItem, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(shelfItemsQuery, "", "WHERE id = $1 AND shelf_id = $2")
+
+	var item ShelfItem
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, shelfID).Scan(shelfItemDest(&item)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &item, nil
+}
+
+func (m ShelfModel) GetItems(ctx context.Context, shelfID int64, status string, filters Filters) ([]*ShelfItem, Metadata, error) {
+	where := &whereClause{}
+
+	where.add("shelf_id = ?", shelfID)
+	if status != "" {
+		where.add("status = ?", status)
+	}
+
+	query := fmt.Sprintf(shelfItemsQuery, "count(*) OVER(),", where) + fmt.Sprintf(`
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	items := []*ShelfItem{}
+
+	for rows.Next() {
+		var item ShelfItem
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, shelfItemDest(&item)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		items = append(items, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return items, metadata, nil
+}
+
+func (m ShelfModel) UpdateItem(ctx context.Context, item *ShelfItem) error {
+	query := `
+		UPDATE shelf_items
+		SET status = $1, started_at = $2, finished_at = $3, pages_read = $4,
+			updated_at = NOW(), version = version + 1
+		WHERE id = $5 AND shelf_id = $6 AND version = $7
+		RETURNING updated_at, version`
+	args := []interface{}{
+		item.Status,
+		item.StartedAt,
+		item.FinishedAt,
+		item.PagesRead,
+		item.ID,
+		item.ShelfID,
+		item.Version,
+	}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&item.UpdatedAt, &item.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (m ShelfModel) DeleteItem(ctx context.Context, shelfID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM shelf_items
+				WHERE id = $1 AND shelf_id = $2`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, shelfID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,2538 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"strings"
+	"time"
+)
+
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// sqliteGenreMatch is true when the book has the genre bound to both
+// placeholders or any genre below it, like genres && genre_descendants($n).
+const sqliteGenreMatch = `EXISTS (SELECT 1 FROM json_each(books.genres) AS bg WHERE bg.value IN (
+				WITH RECURSIVE tree(id, slug) AS (
+					SELECT id, slug FROM genres WHERE slug = %s
+					UNION
+					SELECT g.id, g.slug FROM genres g JOIN tree t ON g.parent_id = t.id
+				)
+				SELECT slug FROM tree UNION SELECT %s))`
+
+// NewSQLiteModels returns models backed by a SQLite database whose schema has
+// been created from migrations/sqlite.
+func NewSQLiteModels(db *sql.DB, timeouts Timeouts) Models {
+	return Models{
+		Books:       SQLiteBookStore{DB: db, Timeouts: timeouts},
+		Genres:      SQLiteGenreStore{DB: db, Timeouts: timeouts},
+		Webhooks:    SQLiteWebhookStore{DB: db, Timeouts: timeouts},
+		Outbox:      SQLiteOutboxStore{DB: db, Timeouts: timeouts},
+		Users:       SQLiteUserStore{DB: db, Timeouts: timeouts},
+		Tokens:      SQLiteTokenStore{DB: db, Timeouts: timeouts},
+		Permissions: SQLitePermissionStore{DB: db, Timeouts: timeouts},
+		Shelves:     SQLiteShelfStore{DB: db, Timeouts: timeouts},
+		Reviews:     SQLiteReviewStore{DB: db, Timeouts: timeouts},
+		Copies:      SQLiteCopyStore{DB: db, Timeouts: timeouts},
+		Loans:       SQLiteLoanStore{DB: db, Timeouts: timeouts},
+		Holds:       SQLiteHoldStore{DB: db, Timeouts: timeouts},
+	}
+}
+
+// jsonArray stores a string slice as a JSON array, which is how the SQLite
+// schema keeps genres and aliases.
+type jsonArray struct {
+	a *[]string
+}
+
+func sqliteArray(a *[]string) interface{} {
+	return jsonArray{a}
+}
+
+func (j jsonArray) Value() (driver.Value, error) {
+	if *j.a == nil {
+		return "[]", nil
+	}
+	js, err := json.Marshal(*j.a)
+	return string(js), err
+}
+
+func (j jsonArray) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), j.a)
+	case []byte:
+		return json.Unmarshal(src, j.a)
+	default:
+		return fmt.Errorf("cannot scan %T into a JSON array", src)
+	}
+}
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// sqliteSchedule binds the time a webhook delivery or outbox message is next
+// due with milliseconds, since retries and leases can be shorter than a
+// second. It sorts correctly against times stored to the second.
+func sqliteSchedule(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat + ".000")
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+type SQLiteBookStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+func (s SQLiteBookStore) Insert(ctx context.Context, book *Book) error {
+	query := `INSERT INTO books (title, year, pages, genres, updated_at)
+				VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)
+				RETURNING id, created_at, updated_at, version`
+
+	args := []interface{}{book.Title, book.Year, book.Pages, sqliteArray(&book.Genres)}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&book.ID, &book.CreatedAt, &book.UpdatedAt, &book.Version)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	err = insertOutbox(ctx, tx, EventBookCreated, book.ID, bookEventData(book))
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteBookStore) Get(ctx context.Context, id int64, fields ...string) (*Book, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	var book Book
+	columns, dest := bookColumns(&book, fields, sqliteArray)
+
+	query := fmt.Sprintf(`SELECT %s
+				FROM books
+				WHERE id = $1`, columns)
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, id).Scan(dest...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &book, nil
+}
+
+func (s SQLiteBookStore) Update(ctx context.Context, book *Book) error {
+	query := `
+		UPDATE books
+		SET title = $1, year = $2, pages = $3, genres = $4, updated_at = CURRENT_TIMESTAMP, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING updated_at, version`
+	args := []interface{}{
+		book.Title,
+		book.Year,
+		book.Pages,
+		sqliteArray(&book.Genres),
+		book.ID,
+		book.Version,
+	}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&book.UpdatedAt, &book.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = insertOutbox(ctx, tx, EventBookUpdated, book.ID, bookEventData(book))
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteBookStore) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM books
+				WHERE id = $1`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	err = insertOutbox(ctx, tx, EventBookDeleted, id, deletedBookEventData(id))
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteBookStore) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Book, Metadata, error) {
+	filters.sortColumns = bookSortColumns
+	where := &whereClause{}
+
+	if terms := searchTerms(title); len(terms) > 0 {
+		for i, term := range terms {
+			terms[i] = `"` + term + `"`
+		}
+		where.add("id IN (SELECT rowid FROM books_fts WHERE books_fts MATCH ?)", strings.Join(terms, " "))
+	}
+	if len(genres) > 0 {
+		matches := make([]string, len(genres))
+		for i, genre := range genres {
+			matches[i] = fmt.Sprintf(sqliteGenreMatch, where.placeholder(genre), where.placeholder(genre))
+		}
+		if filters.GenresMode == "any" {
+			where.add("(" + strings.Join(matches, " OR ") + ")")
+		} else {
+			where.add(strings.Join(matches, " AND "))
+		}
+	}
+	for _, genre := range filters.ExcludeGenres {
+		where.add("NOT " + fmt.Sprintf(sqliteGenreMatch, where.placeholder(genre), where.placeholder(genre)))
+	}
+	if filters.YearMin > 0 {
+		where.add("year >= ?", filters.YearMin)
+	}
+	if filters.YearMax > 0 {
+		where.add("year <= ?", filters.YearMax)
+	}
+	if filters.PagesMin > 0 {
+		where.add("pages >= ?", filters.PagesMin)
+	}
+	if filters.PagesMax > 0 {
+		where.add("pages <= ?", filters.PagesMax)
+	}
+	if filters.RatingMin > 0 {
+		where.add("average_rating >= ?", filters.RatingMin)
+	}
+	if filters.RatingMax > 0 {
+		where.add("average_rating <= ?", filters.RatingMax)
+	}
+	if filters.RatingsMin > 0 {
+		where.add("ratings_count >= ?", filters.RatingsMin)
+	}
+	if !filters.CreatedAfter.IsZero() {
+		where.add("created_at >= ?", sqliteTime(filters.CreatedAfter))
+	}
+	if !filters.CreatedBefore.IsZero() {
+		where.add("created_at < ?", sqliteTime(filters.CreatedBefore))
+	}
+
+	columns, _ := bookColumns(&Book{}, filters.Fields, sqliteArray)
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), %s
+			FROM books
+			%s
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		columns, where, filters.orderBy(),
+		where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	books := []*Book{}
+
+	for rows.Next() {
+		var book Book
+		_, dest := bookColumns(&book, filters.Fields, sqliteArray)
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, dest...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		books = append(books, &book)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return books, metadata, nil
+}
+
+// Changes reads the log kept by the books_log_* triggers.
+func (s SQLiteBookStore) Changes(ctx context.Context, after int64, limit int) ([]*BookChange, error) {
+	query := `SELECT id, created_at, op, book_id, genres
+				FROM book_changes
+				WHERE id > $1
+				ORDER BY id ASC
+				LIMIT $2`
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	changes := []*BookChange{}
+
+	for rows.Next() {
+		var change BookChange
+
+		err := rows.Scan(&change.ID, &change.CreatedAt, &change.Op, &change.BookID, sqliteArray(&change.Genres))
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		changes = append(changes, &change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return changes, nil
+}
+
+func (s SQLiteBookStore) PruneChanges(ctx context.Context, before time.Time) error {
+	query := `DELETE FROM book_changes
+				WHERE created_at < $1`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, query, sqliteTime(before))
+	return contextError(ctx, err)
+}
+
+type SQLiteGenreStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+func (s SQLiteGenreStore) Insert(ctx context.Context, genre *Genre) error {
+	query := `INSERT INTO genres (slug, name, aliases, parent_id)
+				VALUES ($1, $2, $3, (SELECT id FROM genres WHERE slug = $4))
+				RETURNING id, created_at, version`
+
+	args := []interface{}{genre.Slug, genre.Name, sqliteArray(&genre.Aliases), genre.Parent}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&genre.ID, &genre.CreatedAt, &genre.Version)
+	if err != nil {
+		switch {
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateGenre
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (s SQLiteGenreStore) Get(ctx context.Context, id int64) (*Genre, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `SELECT g.id, g.created_at, g.slug, g.name, g.aliases, coalesce(p.slug, ''), g.version
+				FROM genres g
+				LEFT JOIN genres p ON p.id = g.parent_id
+				WHERE g.id = $1`
+
+	var genre Genre
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, id).Scan(
+		&genre.ID,
+		&genre.CreatedAt,
+		&genre.Slug,
+		&genre.Name,
+		sqliteArray(&genre.Aliases),
+		&genre.Parent,
+		&genre.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &genre, nil
+}
+
+func (s SQLiteGenreStore) Update(ctx context.Context, genre *Genre) error {
+	query := `
+		UPDATE genres
+		SET slug = $1, name = $2, aliases = $3, parent_id = (SELECT id FROM genres WHERE slug = $4), version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+	args := []interface{}{
+		genre.Slug,
+		genre.Name,
+		sqliteArray(&genre.Aliases),
+		genre.Parent,
+		genre.ID,
+		genre.Version,
+	}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var slug string
+
+	err = tx.QueryRowContext(ctx, `SELECT slug FROM genres WHERE id = $1`, genre.ID).Scan(&slug)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&genre.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateGenre
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	if slug != genre.Slug {
+		query := `
+			UPDATE books
+			SET genres = (
+					SELECT json_group_array(CASE value WHEN $1 THEN $2 ELSE value END)
+					FROM json_each(books.genres)
+				),
+				updated_at = CURRENT_TIMESTAMP, version = version + 1
+			WHERE EXISTS (SELECT 1 FROM json_each(books.genres) WHERE value = $1)
+			RETURNING %s`
+
+		err = updateBooks(ctx, tx, query, sqliteArray, slug, genre.Slug)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteGenreStore) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM genres
+				WHERE id = $1
+				RETURNING slug`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var slug string
+
+	err = tx.QueryRowContext(ctx, query, id).Scan(&slug)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	var inUse bool
+
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM books, json_each(books.genres) WHERE value = $1)`, slug).Scan(&inUse)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if inUse {
+		return ErrGenreInUse
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteGenreStore) GetAll(ctx context.Context) ([]*Genre, error) {
+	query := `SELECT g.id, g.created_at, g.slug, g.name, g.aliases, coalesce(p.slug, ''), g.version
+				FROM genres g
+				LEFT JOIN genres p ON p.id = g.parent_id
+				ORDER BY g.slug ASC`
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	genres := []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(
+			&genre.ID,
+			&genre.CreatedAt,
+			&genre.Slug,
+			&genre.Name,
+			sqliteArray(&genre.Aliases),
+			&genre.Parent,
+			&genre.Version,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return genres, nil
+}
+
+func (s SQLiteGenreStore) Descendants(ctx context.Context, slug string) ([]string, error) {
+	query := `WITH RECURSIVE tree(id, slug) AS (
+					SELECT id, slug FROM genres WHERE slug = $1
+					UNION
+					SELECT g.id, g.slug FROM genres g JOIN tree t ON g.parent_id = t.id
+				)
+				SELECT slug FROM tree WHERE slug <> $1`
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, slug)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	descendants := []string{}
+
+	for rows.Next() {
+		var descendant string
+		if err := rows.Scan(&descendant); err != nil {
+			return nil, contextError(ctx, err)
+		}
+		descendants = append(descendants, descendant)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return descendants, nil
+}
+
+func (s SQLiteGenreStore) Normalize(ctx context.Context, names []string) ([]string, []string, error) {
+	query := `SELECT k.value, g.slug
+				FROM json_each($1) AS k
+				JOIN genres g ON g.slug = k.value OR lower(g.name) = k.value
+					OR k.value IN (SELECT a.value FROM json_each(g.aliases) AS a)`
+
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = GenreKey(name)
+	}
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, sqliteArray(&keys))
+	if err != nil {
+		return nil, nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	canonical := make(map[string]string, len(keys))
+
+	for rows.Next() {
+		var key, slug string
+		if err := rows.Scan(&key, &slug); err != nil {
+			return nil, nil, contextError(ctx, err)
+		}
+		canonical[key] = slug
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, nil, contextError(ctx, err)
+	}
+
+	slugs, unknown := resolveGenres(names, canonical)
+	return slugs, unknown, nil
+}
+
+type SQLiteWebhookStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+func (s SQLiteWebhookStore) Insert(ctx context.Context, webhook *Webhook) error {
+	query := `INSERT INTO webhooks (url, events, secret, active)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, created_at, version`
+
+	args := []interface{}{webhook.URL, sqliteArray(&webhook.Events), webhook.Secret, webhook.Active}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+	return contextError(ctx, err)
+}
+
+func (s SQLiteWebhookStore) Get(ctx context.Context, id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, url, events, secret, active, version
+				FROM webhooks
+				WHERE id = $1`
+
+	var webhook Webhook
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		sqliteArray(&webhook.Events),
+		&webhook.Secret,
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &webhook, nil
+}
+
+func (s SQLiteWebhookStore) Update(ctx context.Context, webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, events = $2, secret = $3, active = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+	args := []interface{}{
+		webhook.URL,
+		sqliteArray(&webhook.Events),
+		webhook.Secret,
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (s SQLiteWebhookStore) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM webhooks
+				WHERE id = $1`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s SQLiteWebhookStore) GetAll(ctx context.Context) ([]*Webhook, error) {
+	query := `SELECT id, created_at, url, events, secret, active, version
+				FROM webhooks
+				ORDER BY id ASC`
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			sqliteArray(&webhook.Events),
+			&webhook.Secret,
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return webhooks, nil
+}
+
+func (s SQLiteWebhookStore) Enqueue(ctx context.Context, message *OutboxMessage) (int, error) {
+	query := `INSERT OR IGNORE INTO webhook_deliveries (webhook_id, outbox_id, event, payload)
+				SELECT id, $1, $2, $3
+				FROM webhooks
+				WHERE active AND EXISTS (SELECT 1 FROM json_each(webhooks.events) WHERE value = $2)`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, message.ID, message.Event, string(message.Payload))
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), contextError(ctx, err)
+}
+
+// ClaimDeliveries selects and leases the due deliveries in one transaction,
+// which SQLite's single writer makes safe without row locks.
+func (s SQLiteWebhookStore) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `SELECT d.id, d.created_at, d.webhook_id, d.event, d.payload, d.status, d.attempts,
+				d.next_attempt_at, d.response_status, d.last_error, w.url, w.secret
+				FROM webhook_deliveries d
+				JOIN webhooks w ON w.id = d.webhook_id
+				WHERE d.status = 'pending' AND d.next_attempt_at <= $1
+				ORDER BY d.next_attempt_at, d.id
+				LIMIT $2`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	rows, err := tx.QueryContext(ctx, query, sqliteSchedule(now), limit)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+
+		err := rows.Scan(
+			&d.ID,
+			&d.CreatedAt,
+			&d.WebhookID,
+			&d.Event,
+			&payload,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&d.ResponseStatus,
+			&d.LastError,
+			&d.URL,
+			&d.Secret,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, contextError(ctx, err)
+		}
+
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, &d)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	for _, d := range deliveries {
+		d.NextAttemptAt = now.Add(lease)
+
+		_, err := tx.ExecContext(ctx, `UPDATE webhook_deliveries SET next_attempt_at = $1 WHERE id = $2`, sqliteSchedule(d.NextAttemptAt), d.ID)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return deliveries, contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteWebhookStore) UpdateDelivery(ctx context.Context, d *WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, next_attempt_at = $3, response_status = $4, last_error = $5
+		WHERE id = $6`
+	args := []interface{}{d.Status, d.Attempts, sqliteSchedule(d.NextAttemptAt), d.ResponseStatus, d.LastError, d.ID}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, query, args...)
+	return contextError(ctx, err)
+}
+
+func (s SQLiteWebhookStore) GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	where := &whereClause{}
+
+	where.add("webhook_id = ?", webhookID)
+	if status != "" {
+		where.add("status = ?", status)
+	}
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), id, created_at, webhook_id, event, payload, status, attempts,
+				next_attempt_at, response_status, last_error
+			FROM webhook_deliveries
+			%s
+			ORDER BY id DESC
+			LIMIT %s OFFSET %s`,
+		where, where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload string
+
+		err := rows.Scan(
+			&totalRecords,
+			&d.ID,
+			&d.CreatedAt,
+			&d.WebhookID,
+			&d.Event,
+			&payload,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&d.ResponseStatus,
+			&d.LastError,
+		)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, &d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return deliveries, metadata, nil
+}
+
+type SQLiteOutboxStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Claim selects and leases the due messages in one transaction, which
+// SQLite's single writer makes safe without row locks.
+func (s SQLiteOutboxStore) Claim(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	query := `SELECT id, created_at, aggregate_id, event, payload, attempts, available_at, last_error
+				FROM outbox o
+				WHERE NOT dead AND available_at <= $1 AND NOT EXISTS (
+					SELECT 1 FROM outbox earlier
+					WHERE earlier.aggregate_id = o.aggregate_id AND earlier.id < o.id AND NOT earlier.dead
+				)
+				ORDER BY id
+				LIMIT $2`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	rows, err := tx.QueryContext(ctx, query, sqliteSchedule(now), limit)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	messages := []*OutboxMessage{}
+
+	for rows.Next() {
+		var message OutboxMessage
+		var payload string
+
+		err := rows.Scan(
+			&message.ID,
+			&message.CreatedAt,
+			&message.AggregateID,
+			&message.Event,
+			&payload,
+			&message.Attempts,
+			&message.AvailableAt,
+			&message.LastError,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, contextError(ctx, err)
+		}
+
+		message.Payload = json.RawMessage(payload)
+		messages = append(messages, &message)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	for _, message := range messages {
+		message.AvailableAt = now.Add(lease)
+
+		_, err := tx.ExecContext(ctx, `UPDATE outbox SET available_at = $1 WHERE id = $2`, sqliteSchedule(message.AvailableAt), message.ID)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return messages, contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteOutboxStore) Delete(ctx context.Context, id int64) error {
+	query := `DELETE FROM outbox
+				WHERE id = $1`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, query, id)
+	return contextError(ctx, err)
+}
+
+func (s SQLiteOutboxStore) Retry(ctx context.Context, message *OutboxMessage) error {
+	query := `
+		UPDATE outbox
+		SET attempts = $1, available_at = $2, last_error = $3
+		WHERE id = $4`
+	args := []interface{}{message.Attempts, sqliteSchedule(message.AvailableAt), message.LastError, message.ID}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, query, args...)
+	return contextError(ctx, err)
+}
+
+func (s SQLiteOutboxStore) DeadLetter(ctx context.Context, message *OutboxMessage) error {
+	query := `
+		UPDATE outbox
+		SET dead = true, attempts = $1, last_error = $2
+		WHERE id = $3`
+	args := []interface{}{message.Attempts, message.LastError, message.ID}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, query, args...)
+	return contextError(ctx, err)
+}
+
+// sqliteNullTime binds an optional time the way sqliteTime binds a time.
+func sqliteNullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return sqliteTime(*t)
+}
+
+type SQLiteUserStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+func (s SQLiteUserStore) Insert(ctx context.Context, user *User) error {
+	query := `INSERT INTO users (name, email, password_hash)
+				VALUES ($1, $2, $3)
+				RETURNING id, created_at, version`
+
+	args := []interface{}{user.Name, user.Email, user.Password.hash}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateEmail
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (s SQLiteUserStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	query := `SELECT id, created_at, name, email, password_hash, version
+				FROM users
+				WHERE email = $1`
+
+	return s.get(ctx, query, email)
+}
+
+func (s SQLiteUserStore) GetForToken(ctx context.Context, scope, plaintext string) (*User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.version
+				FROM users
+				INNER JOIN tokens ON users.id = tokens.user_id
+				WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3`
+
+	return s.get(ctx, query, hash[:], scope, sqliteTime(time.Now()))
+}
+
+func (s SQLiteUserStore) get(ctx context.Context, query string, args ...interface{}) (*User, error) {
+	var user User
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &user, nil
+}
+
+type SQLiteTokenStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+func (s SQLiteTokenStore) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO tokens (hash, user_id, expiry, scope)
+				VALUES ($1, $2, $3, $4)`
+
+	args := []interface{}{token.Hash, token.UserID, sqliteTime(token.Expiry), token.Scope}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err = s.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return token, nil
+}
+
+func (s SQLiteTokenStore) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	query := `DELETE FROM tokens
+				WHERE scope = $1 AND user_id = $2`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, query, scope, userID)
+	return contextError(ctx, err)
+}
+
+type SQLitePermissionStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+func (s SQLitePermissionStore) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1`
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	return scanPermissions(ctx, s.DB, query, userID)
+}
+
+// AddForUser grants the permissions one code at a time, since SQLite has no
+// arrays to match them against at once.
+func (s SQLitePermissionStore) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+		INSERT OR IGNORE INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = $2`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, query, userID, code)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+type SQLiteShelfStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+func (s SQLiteShelfStore) Insert(ctx context.Context, shelf *Shelf) error {
+	query := `INSERT INTO shelves (user_id, name)
+				VALUES ($1, $2)
+				RETURNING id, created_at, version`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, shelf.UserID, shelf.Name).Scan(&shelf.ID, &shelf.CreatedAt, &shelf.Version)
+	if err != nil {
+		switch {
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateShelf
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (s SQLiteShelfStore) Get(ctx context.Context, userID, id int64) (*Shelf, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, user_id, name, version
+				FROM shelves
+				WHERE id = $1 AND user_id = $2`
+
+	var shelf Shelf
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&shelf.ID,
+		&shelf.CreatedAt,
+		&shelf.UserID,
+		&shelf.Name,
+		&shelf.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &shelf, nil
+}
+
+func (s SQLiteShelfStore) GetAll(ctx context.Context, userID int64, filters Filters) ([]*Shelf, Metadata, error) {
+	where := &whereClause{}
+	where.add("user_id = ?", userID)
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), id, created_at, user_id, name, version
+			FROM shelves
+			%s
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		where, filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	shelves := []*Shelf{}
+
+	for rows.Next() {
+		var shelf Shelf
+
+		err := rows.Scan(
+			&totalRecords,
+			&shelf.ID,
+			&shelf.CreatedAt,
+			&shelf.UserID,
+			&shelf.Name,
+			&shelf.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		shelves = append(shelves, &shelf)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return shelves, metadata, nil
+}
+
+func (s SQLiteShelfStore) Update(ctx context.Context, shelf *Shelf) error {
+	query := `
+		UPDATE shelves
+		SET name = $1, version = version + 1
+		WHERE id = $2 AND user_id = $3 AND version = $4
+		RETURNING version`
+	args := []interface{}{shelf.Name, shelf.ID, shelf.UserID, shelf.Version}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&shelf.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateShelf
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (s SQLiteShelfStore) Delete(ctx context.Context, userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM shelves
+				WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (s SQLiteShelfStore) InsertItem(ctx context.Context, item *ShelfItem) error {
+	query := `INSERT INTO shelf_items (shelf_id, book_id, status, started_at, finished_at, pages_read)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id, created_at, updated_at, version`
+
+	args := []interface{}{
+		item.ShelfID,
+		item.BookID,
+		item.Status,
+		sqliteNullTime(item.StartedAt),
+		sqliteNullTime(item.FinishedAt),
+		item.PagesRead,
+	}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&item.ID, &item.CreatedAt, &item.UpdatedAt, &item.Version)
+	if err != nil {
+		switch {
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateShelfItem
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (s SQLiteShelfStore) GetItem(ctx context.Context, shelfID, id int64) (*ShelfItem, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(shelfItemsQuery, "", "WHERE id = $1 AND shelf_id = $2")
+
+	var item ShelfItem
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, id, shelfID).Scan(shelfItemDest(&item)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &item, nil
+}
+
+func (s SQLiteShelfStore) GetItems(ctx context.Context, shelfID int64, status string, filters Filters) ([]*ShelfItem, Metadata, error) {
+	where := &whereClause{}
+
+	where.add("shelf_id = ?", shelfID)
+	if status != "" {
+		where.add("status = ?", status)
+	}
+
+	query := fmt.Sprintf(shelfItemsQuery, "count(*) OVER(),", where) + fmt.Sprintf(`
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	items := []*ShelfItem{}
+
+	for rows.Next() {
+		var item ShelfItem
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, shelfItemDest(&item)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		items = append(items, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return items, metadata, nil
+}
+
+func (s SQLiteShelfStore) UpdateItem(ctx context.Context, item *ShelfItem) error {
+	query := `
+		UPDATE shelf_items
+		SET status = $1, started_at = $2, finished_at = $3, pages_read = $4,
+			updated_at = CURRENT_TIMESTAMP, version = version + 1
+		WHERE id = $5 AND shelf_id = $6 AND version = $7
+		RETURNING updated_at, version`
+	args := []interface{}{
+		item.Status,
+		sqliteNullTime(item.StartedAt),
+		sqliteNullTime(item.FinishedAt),
+		item.PagesRead,
+		item.ID,
+		item.ShelfID,
+		item.Version,
+	}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&item.UpdatedAt, &item.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (s SQLiteShelfStore) DeleteItem(ctx context.Context, shelfID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM shelf_items
+				WHERE id = $1 AND shelf_id = $2`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := s.DB.ExecContext(ctx, query, id, shelfID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+type SQLiteReviewStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+const sqliteRefreshRatingsQuery = `
+		UPDATE books
+		SET average_rating = COALESCE((SELECT round(avg(rating), 2) FROM reviews WHERE book_id = $1), 0),
+			ratings_count = (SELECT count(*) FROM reviews WHERE book_id = $1),
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`
+
+// sqliteBookExists stands in for lockBook: SQLite has a single
+// writer, so the transaction needs no row lock.
+func sqliteBookExists(ctx context.Context, tx *sql.Tx, bookID int64) error {
+	var id int64
+
+	err := tx.QueryRowContext(ctx, `SELECT id FROM books WHERE id = $1`, bookID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRecordNotFound
+	}
+	return err
+}
+
+func (s SQLiteReviewStore) Insert(ctx context.Context, review *Review) error {
+	query := `INSERT INTO reviews (user_id, book_id, rating, text)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, created_at, updated_at, version`
+
+	args := []interface{}{review.UserID, review.BookID, review.Rating, review.Text}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = sqliteBookExists(ctx, tx, review.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateReview
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, sqliteRefreshRatingsQuery, review.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteReviewStore) Get(ctx context.Context, bookID, id int64) (*Review, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, updated_at, user_id, book_id, rating, text, version
+				FROM reviews
+				WHERE id = $1 AND book_id = $2`
+
+	var review Review
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, id, bookID).Scan(reviewDest(&review)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &review, nil
+}
+
+func (s SQLiteReviewStore) GetAll(ctx context.Context, bookID int64, filters Filters) ([]*Review, Metadata, error) {
+	where := &whereClause{}
+	where.add("book_id = ?", bookID)
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), id, created_at, updated_at, user_id, book_id, rating, text, version
+			FROM reviews
+			%s
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		where, filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	reviews := []*Review{}
+
+	for rows.Next() {
+		var review Review
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, reviewDest(&review)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		reviews = append(reviews, &review)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return reviews, metadata, nil
+}
+
+func (s SQLiteReviewStore) Update(ctx context.Context, review *Review) error {
+	query := `
+		UPDATE reviews
+		SET rating = $1, text = $2, updated_at = CURRENT_TIMESTAMP, version = version + 1
+		WHERE id = $3 AND book_id = $4 AND version = $5
+		RETURNING updated_at, version`
+	args := []interface{}{review.Rating, review.Text, review.ID, review.BookID, review.Version}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&review.UpdatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, sqliteRefreshRatingsQuery, review.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteReviewStore) Delete(ctx context.Context, bookID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM reviews
+				WHERE id = $1 AND book_id = $2`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, id, bookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, sqliteRefreshRatingsQuery, bookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+type SQLiteCopyStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+const sqliteRefreshCopiesQuery = `
+		UPDATE books
+		SET copies_total = (SELECT count(*) FROM copies WHERE book_id = $1),
+			copies_available = (SELECT count(*) FROM copies WHERE book_id = $1 AND status = 'available'),
+			available = EXISTS (SELECT 1 FROM copies WHERE book_id = $1 AND status = 'available'),
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`
+
+const sqliteFillHoldQuery = `
+		UPDATE holds
+		SET status = 'ready', copy_id = $2, ready_at = CURRENT_TIMESTAMP,
+			expires_at = datetime('now', '+' || pickup_seconds || ' seconds'), version = version + 1
+		WHERE id = (
+			SELECT id FROM holds
+			WHERE book_id = $1 AND status = 'waiting'
+			ORDER BY id
+			LIMIT 1
+		)`
+
+// sqliteRefreshCopies is refreshCopies for SQLite.
+func sqliteRefreshCopies(ctx context.Context, tx *sql.Tx, bookID int64) error {
+	err := fillHolds(ctx, tx, sqliteFillHoldQuery, bookID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, sqliteRefreshCopiesQuery, bookID)
+	return err
+}
+
+func (s SQLiteCopyStore) Insert(ctx context.Context, c *Copy) error {
+	query := `INSERT INTO copies (book_id, barcode, condition, location, acquired_at, status)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id, created_at, version`
+
+	args := []interface{}{c.BookID, c.Barcode, c.Condition, c.Location, sqliteTime(c.AcquiredAt), c.Status}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = sqliteBookExists(ctx, tx, c.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&c.ID, &c.CreatedAt, &c.Version)
+	if err != nil {
+		switch {
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateBarcode
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = sqliteRefreshCopies(ctx, tx, c.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteCopyStore) Get(ctx context.Context, bookID, id int64) (*Copy, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`SELECT %s
+				FROM copies
+				WHERE id = $1 AND book_id = $2`, copyColumns)
+
+	return s.get(ctx, query, id, bookID)
+}
+
+func (s SQLiteCopyStore) GetByBarcode(ctx context.Context, barcode string) (*Copy, error) {
+	query := fmt.Sprintf(`SELECT %s
+				FROM copies
+				WHERE barcode = $1`, copyColumns)
+
+	return s.get(ctx, query, barcode)
+}
+
+func (s SQLiteCopyStore) get(ctx context.Context, query string, args ...interface{}) (*Copy, error) {
+	var c Copy
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(copyDest(&c)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &c, nil
+}
+
+func (s SQLiteCopyStore) GetAll(ctx context.Context, bookID int64, status string, filters Filters) ([]*Copy, Metadata, error) {
+	where := &whereClause{}
+	where.add("book_id = ?", bookID)
+	if status != "" {
+		where.add("status = ?", status)
+	}
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), %s
+			FROM copies
+			%s
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		copyColumns, where, filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	copies := []*Copy{}
+
+	for rows.Next() {
+		var c Copy
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, copyDest(&c)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		copies = append(copies, &c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return copies, metadata, nil
+}
+
+func (s SQLiteCopyStore) Update(ctx context.Context, c *Copy) error {
+	query := `
+		UPDATE copies
+		SET barcode = $1, condition = $2, location = $3, acquired_at = $4, status = $5, version = version + 1
+		WHERE id = $6 AND book_id = $7 AND version = $8
+		RETURNING version`
+	args := []interface{}{
+		c.Barcode,
+		c.Condition,
+		c.Location,
+		sqliteTime(c.AcquiredAt),
+		c.Status,
+		c.ID,
+		c.BookID,
+		c.Version,
+	}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&c.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateBarcode
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = sqliteRefreshCopies(ctx, tx, c.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteCopyStore) Delete(ctx context.Context, bookID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM copies
+				WHERE id = $1 AND book_id = $2
+				RETURNING status`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var status string
+
+	err = tx.QueryRowContext(ctx, query, id, bookID).Scan(&status)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	switch status {
+	case CopyOnLoan:
+		return ErrCopyOnLoan
+	case CopyOnHold:
+		return ErrCopyOnHold
+	}
+
+	err = sqliteRefreshCopies(ctx, tx, bookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+type SQLiteLoanStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Checkout needs no row lock, SQLite having a single writer; the unique index
+// on open loans refuses a second one for the copy regardless.
+func (s SQLiteLoanStore) Checkout(ctx context.Context, loan *Loan) error {
+	query := `INSERT INTO loans (user_id, book_id, copy_id, due_at)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, checked_out_at, renewals, version`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `SELECT title FROM books WHERE id = $1`, loan.BookID).Scan(&loan.Title)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = takeCopy(ctx, tx, loan)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	args := []interface{}{loan.UserID, loan.BookID, loan.CopyID, sqliteTime(loan.DueAt)}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&loan.ID, &loan.CheckedOutAt, &loan.Renewals, &loan.Version)
+	if err != nil {
+		switch {
+		case isSQLiteUniqueViolation(err):
+			return ErrBookUnavailable
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = sqliteRefreshCopies(ctx, tx, loan.BookID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteLoanStore) Get(ctx context.Context, id int64) (*Loan, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(loansQuery, "", "WHERE id = $1")
+
+	var loan Loan
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, id).Scan(loanDest(&loan)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &loan, nil
+}
+
+func (s SQLiteLoanStore) GetAll(ctx context.Context, userID int64, status string, filters Filters) ([]*Loan, Metadata, error) {
+	where := &whereClause{}
+	loanFilter(where, userID, status, sqliteTime(time.Now()))
+
+	query := fmt.Sprintf(loansQuery, "count(*) OVER(),", where) + fmt.Sprintf(`
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	loans := []*Loan{}
+
+	for rows.Next() {
+		var loan Loan
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, loanDest(&loan)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		loans = append(loans, &loan)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return loans, metadata, nil
+}
+
+func (s SQLiteLoanStore) Update(ctx context.Context, loan *Loan) error {
+	query := `
+		UPDATE loans
+		SET due_at = $1, returned_at = $2, renewals = $3, version = version + 1
+		WHERE id = $4 AND version = $5 AND returned_at IS NULL
+		RETURNING version`
+	args := []interface{}{
+		sqliteTime(loan.DueAt),
+		sqliteNullTime(loan.ReturnedAt),
+		loan.Renewals,
+		loan.ID,
+		loan.Version,
+	}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&loan.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	if loan.ReturnedAt != nil {
+		_, err = tx.ExecContext(ctx, returnCopyQuery, loan.CopyID)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+
+		err = sqliteRefreshCopies(ctx, tx, loan.BookID)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+type SQLiteHoldStore struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+// Insert needs no row lock, SQLite having a single writer, for a copy not to
+// come back between the availability check and the insert.
+func (s SQLiteHoldStore) Insert(ctx context.Context, hold *Hold) error {
+	query := `INSERT INTO holds (user_id, book_id, pickup_seconds)
+				VALUES ($1, $2, $3)
+				RETURNING id, created_at, status, version`
+
+	args := []interface{}{hold.UserID, hold.BookID, int64(hold.PickupPeriod / time.Second)}
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var available bool
+
+	err = tx.QueryRowContext(ctx, `SELECT title, available FROM books WHERE id = $1`, hold.BookID).Scan(&hold.Title, &available)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	if available {
+		return ErrBookAvailable
+	}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&hold.ID, &hold.CreatedAt, &hold.Status, &hold.Version)
+	if err != nil {
+		switch {
+		case isSQLiteUniqueViolation(err):
+			return ErrDuplicateHold
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM holds WHERE book_id = $1 AND status = 'waiting'`, hold.BookID).Scan(&hold.Position)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteHoldStore) Get(ctx context.Context, id int64) (*Hold, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(holdsQuery, "", "WHERE id = $1")
+
+	var hold Hold
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, query, id).Scan(holdDest(&hold)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &hold, nil
+}
+
+func (s SQLiteHoldStore) GetAll(ctx context.Context, userID, bookID int64, status string, filters Filters) ([]*Hold, Metadata, error) {
+	where := &whereClause{}
+	holdFilter(where, userID, bookID, status)
+
+	query := fmt.Sprintf(holdsQuery, "count(*) OVER(),", where) + fmt.Sprintf(`
+			ORDER BY %s
+			LIMIT %s OFFSET %s`,
+		filters.orderBy(), where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	holds := []*Hold{}
+
+	for rows.Next() {
+		var hold Hold
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, holdDest(&hold)...)...)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		holds = append(holds, &hold)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return holds, metadata, nil
+}
+
+func (s SQLiteHoldStore) CountWaiting(ctx context.Context, bookID int64) (int, error) {
+	var waiting int
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	err := s.DB.QueryRowContext(ctx, `SELECT count(*) FROM holds WHERE book_id = $1 AND status = 'waiting'`, bookID).Scan(&waiting)
+	return waiting, contextError(ctx, err)
+}
+
+func (s SQLiteHoldStore) Cancel(ctx context.Context, hold *Hold) error {
+	query := `
+		UPDATE holds
+		SET status = 'cancelled', version = version + 1
+		WHERE id = $1 AND version = $2 AND status IN ('waiting', 'ready')
+		RETURNING version`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, query, hold.ID, hold.Version).Scan(&hold.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	if hold.Status == HoldReady && hold.CopyID != nil {
+		_, err = tx.ExecContext(ctx, releaseCopyQuery, *hold.CopyID)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+
+		err = sqliteRefreshCopies(ctx, tx, hold.BookID)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	hold.Status = HoldCancelled
+	hold.Position = 0
+	return nil
+}
+
+func (s SQLiteHoldStore) Expire(ctx context.Context) ([]*Hold, error) {
+	query := `SELECT id, user_id, book_id, copy_id
+				FROM holds
+				WHERE status = 'ready' AND expires_at < $1
+				ORDER BY id`
+
+	readCtx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(readCtx, query, sqliteTime(time.Now()))
+	if err != nil {
+		return nil, contextError(readCtx, err)
+	}
+
+	defer rows.Close()
+
+	var due []*Hold
+
+	for rows.Next() {
+		var hold Hold
+
+		err := rows.Scan(&hold.ID, &hold.UserID, &hold.BookID, &hold.CopyID)
+		if err != nil {
+			return nil, contextError(readCtx, err)
+		}
+
+		due = append(due, &hold)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(readCtx, err)
+	}
+
+	// The store's single connection is needed for the writes.
+	rows.Close()
+
+	expired := []*Hold{}
+
+	for _, hold := range due {
+		ok, err := s.expire(ctx, hold)
+		if err != nil {
+			return expired, err
+		}
+		if ok {
+			hold.Status = HoldExpired
+			expired = append(expired, hold)
+		}
+	}
+
+	return expired, nil
+}
+
+func (s SQLiteHoldStore) expire(ctx context.Context, hold *Hold) (bool, error) {
+	query := `
+		UPDATE holds
+		SET status = 'expired', version = version + 1
+		WHERE id = $1 AND status = 'ready'`
+
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, hold.ID)
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
+
+	closed, err := result.RowsAffected()
+	if err != nil || closed == 0 {
+		return false, contextError(ctx, err)
+	}
+
+	if hold.CopyID != nil {
+		_, err = tx.ExecContext(ctx, releaseCopyQuery, *hold.CopyID)
+		if err != nil {
+			return false, contextError(ctx, err)
+		}
+	}
+
+	err = sqliteRefreshCopies(ctx, tx, hold.BookID)
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
+
+	return true, contextError(ctx, tx.Commit())
+}
+
+func (s SQLiteHoldStore) Unnotified(ctx context.Context) ([]*Hold, error) {
+	query := fmt.Sprintf(holdsQuery, "", "WHERE status = 'ready' AND notified_at IS NULL ORDER BY id")
+
+	ctx, cancel := s.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	holds := []*Hold{}
+
+	for rows.Next() {
+		var hold Hold
+
+		err := rows.Scan(holdDest(&hold)...)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		holds = append(holds, &hold)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return holds, nil
+}
+
+func (s SQLiteHoldStore) MarkNotified(ctx context.Context, id int64) error {
+	ctx, cancel := s.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, `UPDATE holds SET notified_at = CURRENT_TIMESTAMP WHERE id = $1`, id)
+	return contextError(ctx, err)
+}
@@ -0,0 +1,393 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/validator"
+	"github.com/lib/pq"
+	"net/url"
+	"time"
+)
+
+// WebhookEvents are the events a webhook can subscribe to.
+var WebhookEvents = []string{EventBookCreated, EventBookUpdated, EventBookDeleted}
+
+// Delivery statuses. A pending delivery is waiting for its next attempt; one
+// that fails every attempt ends up dead.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+var DeliveryStatuses = []string{DeliveryPending, DeliverySucceeded, DeliveryDead}
+
+type WebhookModel struct {
+	DB       *sql.DB
+	Timeouts Timeouts
+}
+
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+// WebhookDelivery is one event on its way to one webhook. URL and Secret are
+// the webhook's, filled in when the delivery is claimed for sending.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	URL            string          `json:"-"`
+	Secret         string          `json:"-"`
+	outboxID       int64
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	u, err := url.Parse(webhook.URL)
+
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+
+	v.Check(len(webhook.Events) >= 1, "events", "must contain at least 1 event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+	for _, event := range webhook.Events {
+		if !validator.In(event, WebhookEvents...) {
+			v.AddError("events", fmt.Sprintf("invalid event %q", event))
+			break
+		}
+	}
+
+	v.Check(len(webhook.Secret) >= 16, "secret", "must be at least 16 bytes long")
+	v.Check(len(webhook.Secret) <= 200, "secret", "must not be more than 200 bytes long")
+}
+
+func (m WebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	query := `INSERT INTO webhooks (url, events, secret, active)
+				VALUES ($1, $2, $3, $4)
+				RETURNING id, created_at, version`
+
+	args := []interface{}{webhook.URL, pq.Array(webhook.Events), webhook.Secret, webhook.Active}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.Version)
+	return contextError(ctx, err)
+}
+
+func (m WebhookModel) Get(ctx context.Context, id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, url, events, secret, active, version
+				FROM webhooks
+				WHERE id = $1`
+
+	var webhook Webhook
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		pq.Array(&webhook.Events),
+		&webhook.Secret,
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &webhook, nil
+}
+
+func (m WebhookModel) Update(ctx context.Context, webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, events = $2, secret = $3, active = $4, version = version + 1
+		WHERE id = $5 AND version = $6
+		RETURNING version`
+	args := []interface{}{
+		webhook.URL,
+		pq.Array(webhook.Events),
+		webhook.Secret,
+		webhook.Active,
+		webhook.ID,
+		webhook.Version,
+	}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+	return nil
+}
+
+func (m WebhookModel) Delete(ctx context.Context, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `DELETE FROM webhooks
+				WHERE id = $1`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (m WebhookModel) GetAll(ctx context.Context) ([]*Webhook, error) {
+	query := `SELECT id, created_at, url, events, secret, active, version
+				FROM webhooks
+				ORDER BY id ASC`
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Secret,
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return webhooks, nil
+}
+
+// Enqueue records a pending delivery of the outbox message to every active
+// webhook subscribed to its event, and returns how many there were. A webhook
+// that already has a delivery of the message doesn't get another, so the
+// message can safely be enqueued again.
+func (m WebhookModel) Enqueue(ctx context.Context, message *OutboxMessage) (int, error) {
+	query := `INSERT INTO webhook_deliveries (webhook_id, outbox_id, event, payload)
+				SELECT id, $1, $2, $3
+				FROM webhooks
+				WHERE active AND $2 = ANY (events)
+				ON CONFLICT (webhook_id, outbox_id) DO NOTHING`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, message.ID, message.Event, string(message.Payload))
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), contextError(ctx, err)
+}
+
+// ClaimDeliveries returns up to limit pending deliveries that are due, and
+// holds each back from other claims for lease. A delivery whose sender dies
+// is picked up again once its lease runs out. SKIP LOCKED lets several API
+// servers claim side by side.
+func (m WebhookModel) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries d
+		SET next_attempt_at = NOW() + $2 * interval '1 millisecond'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND d.id IN (
+			SELECT id
+			FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at, id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.created_at, d.webhook_id, d.event, d.payload, d.status, d.attempts,
+			d.next_attempt_at, d.response_status, d.last_error, w.url, w.secret`
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var d WebhookDelivery
+
+		err := rows.Scan(
+			&d.ID,
+			&d.CreatedAt,
+			&d.WebhookID,
+			&d.Event,
+			(*[]byte)(&d.Payload),
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&d.ResponseStatus,
+			&d.LastError,
+			&d.URL,
+			&d.Secret,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		deliveries = append(deliveries, &d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return deliveries, nil
+}
+
+// UpdateDelivery records the outcome of an attempt.
+func (m WebhookModel) UpdateDelivery(ctx context.Context, d *WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, next_attempt_at = $3, response_status = $4, last_error = $5
+		WHERE id = $6`
+	args := []interface{}{d.Status, d.Attempts, d.NextAttemptAt, d.ResponseStatus, d.LastError, d.ID}
+
+	ctx, cancel := m.Timeouts.write(ctx)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return contextError(ctx, err)
+}
+
+// GetDeliveries returns a page of a webhook's deliveries, newest first,
+// optionally only those with the given status.
+func (m WebhookModel) GetDeliveries(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	where := &whereClause{}
+
+	where.add("webhook_id = ?", webhookID)
+	if status != "" {
+		where.add("status = ?", status)
+	}
+
+	query := fmt.Sprintf(`
+			SELECT count(*) OVER(), id, created_at, webhook_id, event, payload, status, attempts,
+				next_attempt_at, response_status, last_error
+			FROM webhook_deliveries
+			%s
+			ORDER BY id DESC
+			LIMIT %s OFFSET %s`,
+		where, where.placeholder(filters.limit()), where.placeholder(filters.offset()))
+
+	ctx, cancel := m.Timeouts.read(ctx)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, where.args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var d WebhookDelivery
+
+		err := rows.Scan(
+			&totalRecords,
+			&d.ID,
+			&d.CreatedAt,
+			&d.WebhookID,
+			&d.Event,
+			(*[]byte)(&d.Payload),
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&d.ResponseStatus,
+			&d.LastError,
+		)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		deliveries = append(deliveries, &d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return deliveries, metadata, nil
+}
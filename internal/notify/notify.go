@@ -0,0 +1,102 @@
+// Package notify tells users that a book they put on hold has been set aside
+// for them to collect.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier is a way of reaching users. HoldReady may be called more than once
+// for the same hold, after a crash between sending the notification and
+// recording it sent.
+type Notifier interface {
+	HoldReady(ctx context.Context, hold *data.Hold) error
+}
+
+// Notification is what a FileNotifier writes for each ready hold.
+type Notification struct {
+	Event     string    `json:"event"`
+	HoldID    int64     `json:"hold_id"`
+	UserID    int64     `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	BookID    int64     `json:"book_id"`
+	Title     string    `json:"title"`
+	Barcode   string    `json:"barcode"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EventHoldReady is the event of every Notification.
+const EventHoldReady = "hold.ready"
+
+func newNotification(hold *data.Hold) Notification {
+	n := Notification{
+		Event:   EventHoldReady,
+		HoldID:  hold.ID,
+		UserID:  hold.UserID,
+		Name:    hold.Member,
+		Email:   hold.Email,
+		BookID:  hold.BookID,
+		Title:   hold.Title,
+		Barcode: hold.Barcode,
+	}
+	if hold.ExpiresAt != nil {
+		n.ExpiresAt = *hold.ExpiresAt
+	}
+	return n
+}
+
+// LogNotifier writes each notification to a logger.
+type LogNotifier struct {
+	Logger *log.Logger
+}
+
+func (n LogNotifier) HoldReady(ctx context.Context, hold *data.Hold) error {
+	msg := newNotification(hold)
+	n.Logger.Printf("notify: %s <%s>, %q (copy %s) is ready to collect until %s",
+		msg.Name, msg.Email, msg.Title, msg.Barcode, msg.ExpiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// FileNotifier appends each notification to a file as a line of JSON, for
+// another process to deliver, and syncs it to disk before reporting it sent.
+type FileNotifier struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileNotifier(path string) (*FileNotifier, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileNotifier{file: file}, nil
+}
+
+func (n *FileNotifier) HoldReady(ctx context.Context, hold *data.Hold) error {
+	line, err := json.Marshal(newNotification(hold))
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, err = n.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return n.file.Sync()
+}
+
+func (n *FileNotifier) Close() error {
+	return n.file.Close()
+}
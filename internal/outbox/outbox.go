@@ -0,0 +1,182 @@
+// Package outbox publishes the events recorded in a data.OutboxStore. A
+// message is only deleted once every sink has taken it, so each event is
+// published at least once, and a book's events in the order they happened.
+// A message that fails MaxAttempts times is dead-lettered instead, so that
+// it no longer holds up its book's later events.
+package outbox
+
+import (
+	"context"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"log"
+	"time"
+)
+
+// Sink is somewhere events are published. Publish may be called more than
+// once for the same message, after a crash or when another sink failed, so
+// sinks should be idempotent or tolerate duplicates; the message id is
+// stable across attempts.
+type Sink interface {
+	Publish(ctx context.Context, message *data.OutboxMessage) error
+}
+
+type Config struct {
+	PollInterval time.Duration
+	BatchSize    int
+	RetryBase    time.Duration
+	RetryMax     time.Duration
+	MaxAttempts  int
+	// Lease is how long a claimed message is held back from other relays,
+	// which should cover publishing a whole batch.
+	Lease time.Duration
+}
+
+type Relay struct {
+	store  data.OutboxStore
+	logger *log.Logger
+	sinks  []Sink
+	cfg    Config
+	wake   chan struct{}
+}
+
+func New(store data.OutboxStore, logger *log.Logger, cfg Config, sinks ...Sink) *Relay {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 50
+	}
+	if cfg.RetryBase <= 0 {
+		cfg.RetryBase = time.Second
+	}
+	if cfg.RetryMax < cfg.RetryBase {
+		cfg.RetryMax = cfg.RetryBase
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = time.Minute
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 20
+	}
+
+	return &Relay{
+		store:  store,
+		logger: logger,
+		sinks:  sinks,
+		cfg:    cfg,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the relay to publish newly recorded messages without waiting
+// for the next poll.
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run publishes messages until ctx is cancelled.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := r.RunOnce(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					r.logger.Printf("outbox: %v", err)
+				}
+				break
+			}
+			// A batch holds one message per book, so a book's next message
+			// can only be claimed by the next batch.
+			if n == 0 {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// RunOnce claims one batch of messages and publishes them, returning how
+// many were claimed.
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	messages, err := r.store.Claim(ctx, r.cfg.BatchSize, r.cfg.Lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, message := range messages {
+		if ctx.Err() != nil {
+			// The rest are claimed again once their lease runs out.
+			return len(messages), nil
+		}
+		r.publish(ctx, message)
+	}
+
+	return len(messages), nil
+}
+
+func (r *Relay) publish(ctx context.Context, message *data.OutboxMessage) {
+	for _, sink := range r.sinks {
+		err := sink.Publish(ctx, message)
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		message.Attempts++
+		message.LastError = err.Error()
+
+		if message.Attempts >= r.cfg.MaxAttempts {
+			r.logger.Printf("outbox: publishing message %d (%s) failed %d times, giving up: %v",
+				message.ID, message.Event, message.Attempts, err)
+
+			err = r.store.DeadLetter(context.Background(), message)
+			if err != nil {
+				r.logger.Printf("outbox: dead-lettering message %d: %v", message.ID, err)
+			}
+			return
+		}
+
+		message.AvailableAt = time.Now().Add(r.backoff(message.Attempts))
+
+		r.logger.Printf("outbox: publishing message %d (%s) failed %d times, retrying at %s: %v",
+			message.ID, message.Event, message.Attempts, message.AvailableAt.Format(time.RFC3339), err)
+
+		err = r.store.Retry(context.Background(), message)
+		if err != nil {
+			r.logger.Printf("outbox: recording failure of message %d: %v", message.ID, err)
+		}
+		return
+	}
+
+	err := r.store.Delete(context.Background(), message.ID)
+	if err != nil {
+		r.logger.Printf("outbox: deleting published message %d: %v", message.ID, err)
+	}
+}
+
+// backoff doubles the wait from RetryBase for each failed attempt, up to
+// RetryMax.
+func (r *Relay) backoff(attempts int) time.Duration {
+	wait := r.cfg.RetryBase
+	for i := 1; i < attempts && wait < r.cfg.RetryMax; i++ {
+		wait *= 2
+	}
+	if wait > r.cfg.RetryMax {
+		wait = r.cfg.RetryMax
+	}
+	return wait
+}
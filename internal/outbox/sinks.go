@@ -0,0 +1,106 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LogSink writes each message to a logger.
+type LogSink struct {
+	Logger *log.Logger
+}
+
+func (s LogSink) Publish(ctx context.Context, message *data.OutboxMessage) error {
+	s.Logger.Printf("outbox: %s %d: %s", message.Event, message.ID, message.Payload)
+	return nil
+}
+
+// FileSink appends each message to a file as a line of JSON, and syncs it to
+// disk before reporting it published.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Publish(ctx context.Context, message *data.OutboxMessage) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// Headers set on every message an HTTPSink posts.
+const (
+	MessageIDHeader = "X-Outbox-Message-Id"
+	EventHeader     = "X-Outbox-Event"
+)
+
+// HTTPSink posts each message's payload to a URL, and takes any 2xx
+// response as success. The message id header lets the receiver drop
+// duplicates.
+type HTTPSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPSink(url string, timeout time.Duration) *HTTPSink {
+	return &HTTPSink{URL: url, Client: &http.Client{Timeout: timeout}}
+}
+
+func (s *HTTPSink) Publish(ctx context.Context, message *data.OutboxMessage) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(message.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(MessageIDHeader, strconv.FormatInt(message.ID, 10))
+	req.Header.Set(EventHeader, message.Event)
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", s.URL, res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateTarget is returned for a webhook URL whose host is, or resolves
+// to, an address that isn't reachable from the public internet.
+var ErrPrivateTarget = errors.New("webhook: target is a private, loopback or link-local address")
+
+// Public reports whether ip is an address deliveries may be sent to: not
+// loopback, private, link-local, multicast or unspecified.
+func Public(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// CheckTarget returns ErrPrivateTarget if the host of rawURL is localhost, an
+// address that isn't Public, or a name that resolves to one. A name that
+// doesn't resolve is let through: its deliveries fail until it does, and the
+// dispatcher checks the address again when it connects.
+func CheckTarget(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host := u.Hostname()
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivateTarget
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !Public(ip) {
+			return ErrPrivateTarget
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if !Public(addr.IP) {
+			return ErrPrivateTarget
+		}
+	}
+
+	return nil
+}
+
+// refusePrivate is a net.Dialer Control function that refuses connections to
+// addresses that aren't Public, whatever the name they were looked up from.
+func refusePrivate(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !Public(ip) {
+		return ErrPrivateTarget
+	}
+	return nil
+}
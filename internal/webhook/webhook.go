@@ -0,0 +1,234 @@
+// Package webhook sends the deliveries queued in a data.WebhookStore to their
+// webhooks, retrying failures with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Bug-daulet/FinalSPA/internal/data"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers set on every delivery. The signature covers the timestamp and the
+// body joined by a dot, so a receiver can reject replays of old deliveries.
+const (
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+	TimestampHeader = "X-Webhook-Timestamp"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// Config tunes a Dispatcher. Unless AllowPrivateTargets is set, deliveries
+// are never sent to an address that isn't Public.
+type Config struct {
+	MaxAttempts         int
+	RetryBase           time.Duration
+	RetryMax            time.Duration
+	Timeout             time.Duration
+	PollInterval        time.Duration
+	BatchSize           int
+	AllowPrivateTargets bool
+}
+
+type Dispatcher struct {
+	store  data.WebhookStore
+	logger *log.Logger
+	client *http.Client
+	cfg    Config
+	wake   chan struct{}
+}
+
+func New(store data.WebhookStore, logger *log.Logger, cfg Config) *Dispatcher {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 5 * time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 10
+	}
+
+	// The address is checked as the connection is made, so a name that
+	// resolves to a public address when the webhook is saved can't later
+	// be pointed at one inside the network. Proxies would connect in our
+	// place, so none are used.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	if !cfg.AllowPrivateTargets {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refusePrivate}
+		transport.DialContext = dialer.DialContext
+	}
+
+	return &Dispatcher{
+		store:  store,
+		logger: logger,
+		client: &http.Client{Transport: transport, Timeout: cfg.Timeout},
+		cfg:    cfg,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Sign returns the signature header value for body sent at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns how long to wait before the attempt after the given number
+// of failed ones: RetryBase, then doubling up to RetryMax.
+func (d *Dispatcher) Backoff(attempts int) time.Duration {
+	wait := d.cfg.RetryBase
+	for i := 1; i < attempts && wait < d.cfg.RetryMax; i++ {
+		wait *= 2
+	}
+	if wait > d.cfg.RetryMax {
+		wait = d.cfg.RetryMax
+	}
+	return wait
+}
+
+// Publish queues a delivery of an outbox message to every webhook subscribed
+// to its event, which makes the dispatcher an outbox sink. Publishing the
+// same message again queues nothing new.
+func (d *Dispatcher) Publish(ctx context.Context, message *data.OutboxMessage) error {
+	n, err := d.store.Enqueue(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		d.Notify()
+	}
+	return nil
+}
+
+// Notify wakes the dispatcher to send newly queued deliveries without waiting
+// for the next poll.
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries until ctx is cancelled. A delivery interrupted by
+// shutdown is sent again once its lease runs out.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := d.RunOnce(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					d.logger.Printf("webhook: %v", err)
+				}
+				break
+			}
+			if n < d.cfg.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// RunOnce claims one batch of due deliveries and sends them side by side,
+// returning how many there were.
+func (d *Dispatcher) RunOnce(ctx context.Context) (int, error) {
+	// A claim lasts long enough for every attempt in the batch to time out.
+	lease := d.cfg.Timeout + time.Minute
+
+	deliveries, err := d.store.ClaimDeliveries(ctx, d.cfg.BatchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery *data.WebhookDelivery) {
+			defer wg.Done()
+			d.deliver(ctx, delivery)
+		}(delivery)
+	}
+
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery *data.WebhookDelivery) {
+	status, err := d.send(ctx, delivery)
+	if ctx.Err() != nil {
+		return
+	}
+
+	delivery.Attempts++
+	delivery.ResponseStatus = status
+
+	switch {
+	case err == nil:
+		delivery.Status = data.DeliverySucceeded
+		delivery.LastError = ""
+	case delivery.Attempts >= d.cfg.MaxAttempts:
+		delivery.Status = data.DeliveryDead
+		delivery.LastError = err.Error()
+		d.logger.Printf("webhook: delivery %d to %s is dead after %d attempts: %v", delivery.ID, delivery.URL, delivery.Attempts, err)
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = time.Now().Add(d.Backoff(delivery.Attempts))
+	}
+
+	err = d.store.UpdateDelivery(context.Background(), delivery)
+	if err != nil {
+		d.logger.Printf("webhook: recording delivery %d: %v", delivery.ID, err)
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, delivery *data.WebhookDelivery) (int, error) {
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "FinalSPA-Webhooks/1.0")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver answered %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
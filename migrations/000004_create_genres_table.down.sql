@@ -0,0 +1,2 @@
+DROP FUNCTION IF EXISTS genre_descendants(text);
+DROP TABLE IF EXISTS genres;
@@ -0,0 +1,47 @@
+CREATE TABLE IF NOT EXISTS genres
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    slug       text                        NOT NULL UNIQUE,
+    name       text                        NOT NULL,
+    aliases    text[]                      NOT NULL DEFAULT '{}',
+    parent_id  bigint REFERENCES genres ON DELETE SET NULL,
+    version    integer                     NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS genres_aliases_idx ON genres USING GIN (aliases);
+
+CREATE OR REPLACE FUNCTION genre_descendants(root text) RETURNS text[] AS
+$$
+WITH RECURSIVE tree AS (
+    SELECT id, slug FROM genres WHERE slug = root
+    UNION
+    SELECT g.id, g.slug FROM genres g JOIN tree t ON g.parent_id = t.id
+)
+SELECT array_append(coalesce(array_agg(slug) FILTER (WHERE slug <> root), '{}'), root) FROM tree;
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO genres (slug, name, aliases)
+VALUES ('fiction', 'Fiction', '{}'),
+       ('non-fiction', 'Non-fiction', '{"nonfiction", "non fiction"}')
+ON CONFLICT (slug) DO NOTHING;
+
+INSERT INTO genres (slug, name, aliases, parent_id)
+VALUES ('science-fiction', 'Science Fiction', '{"sci-fi", "scifi", "science fiction", "sf"}', (SELECT id FROM genres WHERE slug = 'fiction')),
+       ('fantasy', 'Fantasy', '{}', (SELECT id FROM genres WHERE slug = 'fiction')),
+       ('mystery', 'Mystery', '{"crime", "detective"}', (SELECT id FROM genres WHERE slug = 'fiction')),
+       ('history', 'History', '{}', (SELECT id FROM genres WHERE slug = 'non-fiction')),
+       ('biography', 'Biography', '{"memoir", "autobiography"}', (SELECT id FROM genres WHERE slug = 'non-fiction'))
+ON CONFLICT (slug) DO NOTHING;
+
+UPDATE books
+SET genres = ARRAY(
+        SELECT canonical
+        FROM (SELECT coalesce((SELECT g.slug
+                               FROM genres g
+                               WHERE g.slug = lower(b.genre)
+                                  OR lower(g.name) = lower(b.genre)
+                                  OR lower(b.genre) = ANY (g.aliases)), lower(b.genre)) AS canonical,
+                     b.n
+              FROM unnest(books.genres) WITH ORDINALITY AS b(genre, n)) AS normalised
+        GROUP BY canonical
+        ORDER BY min(n));
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS books_log_change ON books;
+DROP FUNCTION IF EXISTS log_book_change();
+DROP TABLE IF EXISTS book_changes;
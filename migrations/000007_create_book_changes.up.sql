@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS book_changes
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    op         text                        NOT NULL,
+    book_id    bigint                      NOT NULL,
+    genres     text[]                      NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS book_changes_created_at_idx ON book_changes (created_at);
+
+-- Every write to books is logged in book_changes, and the new change's id is
+-- sent on the book_changes channel so that listening API servers pick it up.
+CREATE OR REPLACE FUNCTION log_book_change() RETURNS trigger AS
+$$
+DECLARE
+    change_id bigint;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO book_changes (op, book_id, genres)
+        VALUES ('deleted', OLD.id, OLD.genres)
+        RETURNING id INTO change_id;
+    ELSE
+        INSERT INTO book_changes (op, book_id, genres)
+        VALUES (CASE TG_OP WHEN 'INSERT' THEN 'created' ELSE 'updated' END, NEW.id, NEW.genres)
+        RETURNING id INTO change_id;
+    END IF;
+
+    PERFORM pg_notify('book_changes', change_id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS books_log_change ON books;
+
+CREATE TRIGGER books_log_change
+    AFTER INSERT OR UPDATE OR DELETE
+    ON books
+    FOR EACH ROW
+EXECUTE FUNCTION log_book_change();
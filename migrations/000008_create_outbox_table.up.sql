@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS outbox
+(
+    id           bigserial PRIMARY KEY,
+    created_at   timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    aggregate_id bigint                      NOT NULL,
+    event        text                        NOT NULL,
+    payload      jsonb                       NOT NULL,
+    attempts     integer                     NOT NULL DEFAULT 0,
+    available_at timestamp with time zone    NOT NULL DEFAULT NOW(),
+    last_error   text                        NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS outbox_aggregate_id_idx ON outbox (aggregate_id, id);
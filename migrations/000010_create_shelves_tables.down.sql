@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS shelf_items;
+DROP TABLE IF EXISTS shelves;
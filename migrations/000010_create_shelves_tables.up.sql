@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS shelves
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id    bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    name       text                        NOT NULL,
+    version    integer                     NOT NULL DEFAULT 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS shelves_user_id_name_idx ON shelves (user_id, lower(name));
+
+CREATE TABLE IF NOT EXISTS shelf_items
+(
+    id          bigserial PRIMARY KEY,
+    created_at  timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at  timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    shelf_id    bigint                      NOT NULL REFERENCES shelves ON DELETE CASCADE,
+    book_id     bigint                      NOT NULL REFERENCES books ON DELETE CASCADE,
+    status      text                        NOT NULL,
+    started_at  timestamp(0) with time zone,
+    finished_at timestamp(0) with time zone,
+    pages_read  integer                     NOT NULL DEFAULT 0 CHECK (pages_read >= 0),
+    version     integer                     NOT NULL DEFAULT 1,
+    UNIQUE (shelf_id, book_id)
+);
+
+CREATE INDEX IF NOT EXISTS shelf_items_book_id_idx ON shelf_items (book_id);
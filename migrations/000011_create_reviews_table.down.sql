@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS reviews;
+
+DROP INDEX IF EXISTS books_average_rating_idx;
+
+ALTER TABLE books DROP COLUMN IF EXISTS ratings_count;
+ALTER TABLE books DROP COLUMN IF EXISTS average_rating;
@@ -0,0 +1,19 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS average_rating numeric(3, 2) NOT NULL DEFAULT 0;
+ALTER TABLE books ADD COLUMN IF NOT EXISTS ratings_count integer NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS books_average_rating_idx ON books (average_rating);
+
+CREATE TABLE IF NOT EXISTS reviews
+(
+    id         bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id    bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    book_id    bigint                      NOT NULL REFERENCES books ON DELETE CASCADE,
+    rating     smallint                    NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    text       text                        NOT NULL DEFAULT '',
+    version    integer                     NOT NULL DEFAULT 1,
+    UNIQUE (user_id, book_id)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_book_id_idx ON reviews (book_id);
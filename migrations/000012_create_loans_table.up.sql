@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS loans
+(
+    id             bigserial PRIMARY KEY,
+    checked_out_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id        bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    book_id        bigint                      NOT NULL REFERENCES books ON DELETE CASCADE,
+    due_at         timestamp(0) with time zone NOT NULL,
+    returned_at    timestamp(0) with time zone,
+    renewals       integer                     NOT NULL DEFAULT 0 CHECK (renewals >= 0),
+    version        integer                     NOT NULL DEFAULT 1
+);
+
+-- A book can only be out on one loan at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS loans_open_book_id_idx ON loans (book_id) WHERE returned_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS loans_user_id_idx ON loans (user_id);
+CREATE INDEX IF NOT EXISTS loans_open_due_at_idx ON loans (due_at) WHERE returned_at IS NULL;
@@ -0,0 +1,21 @@
+DROP INDEX IF EXISTS loans_open_copy_id_idx;
+
+-- Without copies a book can only be out on one loan at a time, so all but the
+-- earliest of a book's open loans are closed before that is enforced again.
+UPDATE loans
+SET returned_at = NOW(), version = version + 1
+WHERE returned_at IS NULL
+  AND EXISTS (SELECT 1
+              FROM loans earlier
+              WHERE earlier.book_id = loans.book_id
+                AND earlier.returned_at IS NULL
+                AND earlier.id < loans.id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS loans_open_book_id_idx ON loans (book_id) WHERE returned_at IS NULL;
+
+ALTER TABLE loans DROP COLUMN IF EXISTS copy_id;
+
+ALTER TABLE books DROP COLUMN IF EXISTS copies_available;
+ALTER TABLE books DROP COLUMN IF EXISTS copies_total;
+
+DROP TABLE IF EXISTS copies;
@@ -0,0 +1,44 @@
+CREATE TABLE IF NOT EXISTS copies
+(
+    id          bigserial PRIMARY KEY,
+    created_at  timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    book_id     bigint                      NOT NULL REFERENCES books ON DELETE CASCADE,
+    barcode     text                        NOT NULL UNIQUE,
+    condition   text                        NOT NULL DEFAULT 'good' CHECK (condition IN ('new', 'good', 'fair', 'poor', 'damaged')),
+    location    text                        NOT NULL DEFAULT '',
+    acquired_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    status      text                        NOT NULL DEFAULT 'available' CHECK (status IN ('available', 'on-loan', 'in-repair', 'lost')),
+    version     integer                     NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS copies_book_id_idx ON copies (book_id);
+
+ALTER TABLE books ADD COLUMN IF NOT EXISTS copies_total integer NOT NULL DEFAULT 0;
+ALTER TABLE books ADD COLUMN IF NOT EXISTS copies_available integer NOT NULL DEFAULT 0;
+
+-- Books used to be lent as though the library had a single copy of each, so
+-- every existing book gets that copy, and its loans move onto it.
+INSERT INTO copies (book_id, barcode, acquired_at)
+SELECT id, 'B' || lpad(id::text, 8, '0'), created_at
+FROM books;
+
+ALTER TABLE loans ADD COLUMN IF NOT EXISTS copy_id bigint REFERENCES copies ON DELETE CASCADE;
+
+UPDATE loans
+SET copy_id = copies.id
+FROM copies
+WHERE copies.book_id = loans.book_id;
+
+ALTER TABLE loans ALTER COLUMN copy_id SET NOT NULL;
+
+UPDATE copies
+SET status = 'on-loan'
+WHERE id IN (SELECT copy_id FROM loans WHERE returned_at IS NULL);
+
+UPDATE books
+SET copies_total = (SELECT count(*) FROM copies WHERE book_id = books.id),
+    copies_available = (SELECT count(*) FROM copies WHERE book_id = books.id AND status = 'available');
+
+-- A copy, rather than a book, can only be out on one loan at a time.
+DROP INDEX IF EXISTS loans_open_book_id_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS loans_open_copy_id_idx ON loans (copy_id) WHERE returned_at IS NULL;
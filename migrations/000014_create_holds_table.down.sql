@@ -0,0 +1,13 @@
+ALTER TABLE books DROP COLUMN IF EXISTS available;
+
+UPDATE copies
+SET status = 'available'
+WHERE status = 'on-hold';
+
+UPDATE books
+SET copies_available = (SELECT count(*) FROM copies WHERE book_id = books.id AND status = 'available');
+
+ALTER TABLE copies DROP CONSTRAINT IF EXISTS copies_status_check;
+ALTER TABLE copies ADD CONSTRAINT copies_status_check CHECK (status IN ('available', 'on-loan', 'in-repair', 'lost'));
+
+DROP TABLE IF EXISTS holds;
@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS holds
+(
+    id             bigserial PRIMARY KEY,
+    created_at     timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id        bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    book_id        bigint                      NOT NULL REFERENCES books ON DELETE CASCADE,
+    status         text                        NOT NULL DEFAULT 'waiting' CHECK (status IN ('waiting', 'ready', 'collected', 'cancelled', 'expired')),
+    pickup_seconds integer                     NOT NULL CHECK (pickup_seconds > 0),
+    copy_id        bigint                      REFERENCES copies ON DELETE SET NULL,
+    ready_at       timestamp(0) with time zone,
+    expires_at     timestamp(0) with time zone,
+    notified_at    timestamp(0) with time zone,
+    version        integer                     NOT NULL DEFAULT 1
+);
+
+-- A user can only be in a book's queue once at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS holds_open_book_id_user_id_idx ON holds (book_id, user_id) WHERE status IN ('waiting', 'ready');
+
+CREATE INDEX IF NOT EXISTS holds_user_id_idx ON holds (user_id);
+CREATE INDEX IF NOT EXISTS holds_ready_expires_at_idx ON holds (expires_at) WHERE status = 'ready';
+
+-- Copies that come back while users are waiting are set aside for them.
+ALTER TABLE copies DROP CONSTRAINT IF EXISTS copies_status_check;
+ALTER TABLE copies ADD CONSTRAINT copies_status_check CHECK (status IN ('available', 'on-loan', 'on-hold', 'in-repair', 'lost'));
+
+ALTER TABLE books ADD COLUMN IF NOT EXISTS available boolean NOT NULL DEFAULT false;
+
+UPDATE books
+SET available = copies_available > 0;
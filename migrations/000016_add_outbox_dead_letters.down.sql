@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS webhook_deliveries_outbox_id_idx;
+
+ALTER TABLE webhook_deliveries
+    DROP COLUMN IF EXISTS outbox_id;
+
+ALTER TABLE outbox
+    DROP COLUMN IF EXISTS dead;
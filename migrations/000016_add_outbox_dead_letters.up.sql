@@ -0,0 +1,7 @@
+ALTER TABLE outbox
+    ADD COLUMN IF NOT EXISTS dead boolean NOT NULL DEFAULT false;
+
+ALTER TABLE webhook_deliveries
+    ADD COLUMN IF NOT EXISTS outbox_id bigint;
+
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_outbox_id_idx ON webhook_deliveries (webhook_id, outbox_id);
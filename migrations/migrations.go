@@ -0,0 +1,15 @@
+package migrations
+
+import "embed"
+
+// FS holds the SQL migrations so that the api binary can apply them without
+// the migrations directory being deployed next to it.
+//
+//go:embed *.sql
+var FS embed.FS
+
+// SQLiteFS holds the schema for the SQLite backend, which is applied in order
+// whenever the database file is opened.
+//
+//go:embed sqlite/*.sql
+var SQLiteFS embed.FS
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS books
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    title      TEXT     NOT NULL,
+    year       INTEGER  NOT NULL CHECK (year >= 1888),
+    pages      INTEGER  NOT NULL CHECK (pages >= 0),
+    genres     TEXT     NOT NULL DEFAULT '[]' CHECK (json_array_length(genres) BETWEEN 1 AND 5),
+    version    INTEGER  NOT NULL DEFAULT 1
+);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS books_fts USING fts5(title, content='books', content_rowid='id');
+
+CREATE TRIGGER IF NOT EXISTS books_fts_insert AFTER INSERT ON books
+BEGIN
+    INSERT INTO books_fts (rowid, title) VALUES (new.id, new.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS books_fts_delete AFTER DELETE ON books
+BEGIN
+    INSERT INTO books_fts (books_fts, rowid, title) VALUES ('delete', old.id, old.title);
+END;
+
+CREATE TRIGGER IF NOT EXISTS books_fts_update AFTER UPDATE OF title ON books
+BEGIN
+    INSERT INTO books_fts (books_fts, rowid, title) VALUES ('delete', old.id, old.title);
+    INSERT INTO books_fts (rowid, title) VALUES (new.id, new.title);
+END;
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS genres
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    slug       TEXT     NOT NULL UNIQUE,
+    name       TEXT     NOT NULL,
+    aliases    TEXT     NOT NULL DEFAULT '[]',
+    parent_id  INTEGER REFERENCES genres ON DELETE SET NULL,
+    version    INTEGER  NOT NULL DEFAULT 1
+);
+
+INSERT OR IGNORE INTO genres (slug, name, aliases)
+VALUES ('fiction', 'Fiction', '[]'),
+       ('non-fiction', 'Non-fiction', '["nonfiction", "non fiction"]');
+
+INSERT OR IGNORE INTO genres (slug, name, aliases, parent_id)
+VALUES ('science-fiction', 'Science Fiction', '["sci-fi", "scifi", "science fiction", "sf"]', (SELECT id FROM genres WHERE slug = 'fiction')),
+       ('fantasy', 'Fantasy', '[]', (SELECT id FROM genres WHERE slug = 'fiction')),
+       ('mystery', 'Mystery', '["crime", "detective"]', (SELECT id FROM genres WHERE slug = 'fiction')),
+       ('history', 'History', '[]', (SELECT id FROM genres WHERE slug = 'non-fiction')),
+       ('biography', 'Biography', '["memoir", "autobiography"]', (SELECT id FROM genres WHERE slug = 'non-fiction'));
@@ -0,0 +1,5 @@
+-- SQLite only allows a constant default when adding a column, so inserts set
+-- updated_at themselves.
+ALTER TABLE books ADD COLUMN updated_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+
+UPDATE books SET updated_at = created_at;
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    url        TEXT     NOT NULL,
+    events     TEXT     NOT NULL DEFAULT '[]',
+    secret     TEXT     NOT NULL,
+    active     BOOLEAN  NOT NULL DEFAULT 1,
+    version    INTEGER  NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at      DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    webhook_id      INTEGER  NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event           TEXT     NOT NULL,
+    payload         TEXT     NOT NULL,
+    status          TEXT     NOT NULL DEFAULT 'pending',
+    attempts        INTEGER  NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    response_status INTEGER  NOT NULL DEFAULT 0,
+    last_error      TEXT     NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
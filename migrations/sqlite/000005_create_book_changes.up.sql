@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS book_changes
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    op         TEXT     NOT NULL,
+    book_id    INTEGER  NOT NULL,
+    genres     TEXT     NOT NULL DEFAULT '[]'
+);
+
+CREATE INDEX IF NOT EXISTS book_changes_created_at_idx ON book_changes (created_at);
+
+CREATE TRIGGER IF NOT EXISTS books_log_insert AFTER INSERT ON books
+BEGIN
+    INSERT INTO book_changes (op, book_id, genres) VALUES ('created', new.id, new.genres);
+END;
+
+CREATE TRIGGER IF NOT EXISTS books_log_update AFTER UPDATE ON books
+BEGIN
+    INSERT INTO book_changes (op, book_id, genres) VALUES ('updated', new.id, new.genres);
+END;
+
+CREATE TRIGGER IF NOT EXISTS books_log_delete AFTER DELETE ON books
+BEGIN
+    INSERT INTO book_changes (op, book_id, genres) VALUES ('deleted', old.id, old.genres);
+END;
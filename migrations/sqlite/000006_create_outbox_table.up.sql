@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS outbox
+(
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    aggregate_id INTEGER  NOT NULL,
+    event        TEXT     NOT NULL,
+    payload      TEXT     NOT NULL,
+    attempts     INTEGER  NOT NULL DEFAULT 0,
+    available_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error   TEXT     NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS outbox_aggregate_id_idx ON outbox (aggregate_id, id);
@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS users
+(
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    name          TEXT     NOT NULL,
+    email         TEXT     NOT NULL UNIQUE COLLATE NOCASE,
+    password_hash BLOB     NOT NULL,
+    version       INTEGER  NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS tokens
+(
+    hash    BLOB PRIMARY KEY,
+    user_id INTEGER  NOT NULL REFERENCES users ON DELETE CASCADE,
+    expiry  DATETIME NOT NULL,
+    scope   TEXT     NOT NULL
+);
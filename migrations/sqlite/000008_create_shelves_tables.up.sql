@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS shelves
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    user_id    INTEGER  NOT NULL REFERENCES users ON DELETE CASCADE,
+    name       TEXT     NOT NULL,
+    version    INTEGER  NOT NULL DEFAULT 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS shelves_user_id_name_idx ON shelves (user_id, name COLLATE NOCASE);
+
+CREATE TABLE IF NOT EXISTS shelf_items
+(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    shelf_id    INTEGER  NOT NULL REFERENCES shelves ON DELETE CASCADE,
+    book_id     INTEGER  NOT NULL REFERENCES books ON DELETE CASCADE,
+    status      TEXT     NOT NULL,
+    started_at  DATETIME,
+    finished_at DATETIME,
+    pages_read  INTEGER  NOT NULL DEFAULT 0 CHECK (pages_read >= 0),
+    version     INTEGER  NOT NULL DEFAULT 1,
+    UNIQUE (shelf_id, book_id)
+);
+
+CREATE INDEX IF NOT EXISTS shelf_items_book_id_idx ON shelf_items (book_id);
@@ -0,0 +1,19 @@
+ALTER TABLE books ADD COLUMN average_rating REAL NOT NULL DEFAULT 0;
+ALTER TABLE books ADD COLUMN ratings_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS books_average_rating_idx ON books (average_rating);
+
+CREATE TABLE IF NOT EXISTS reviews
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    user_id    INTEGER  NOT NULL REFERENCES users ON DELETE CASCADE,
+    book_id    INTEGER  NOT NULL REFERENCES books ON DELETE CASCADE,
+    rating     INTEGER  NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    text       TEXT     NOT NULL DEFAULT '',
+    version    INTEGER  NOT NULL DEFAULT 1,
+    UNIQUE (user_id, book_id)
+);
+
+CREATE INDEX IF NOT EXISTS reviews_book_id_idx ON reviews (book_id);
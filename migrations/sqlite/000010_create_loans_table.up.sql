@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS loans
+(
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    checked_out_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    user_id        INTEGER  NOT NULL REFERENCES users ON DELETE CASCADE,
+    book_id        INTEGER  NOT NULL REFERENCES books ON DELETE CASCADE,
+    due_at         DATETIME NOT NULL,
+    returned_at    DATETIME,
+    renewals       INTEGER  NOT NULL DEFAULT 0 CHECK (renewals >= 0),
+    version        INTEGER  NOT NULL DEFAULT 1
+);
+
+-- A book can only be out on one loan at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS loans_open_book_id_idx ON loans (book_id) WHERE returned_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS loans_user_id_idx ON loans (user_id);
+CREATE INDEX IF NOT EXISTS loans_open_due_at_idx ON loans (due_at) WHERE returned_at IS NULL;
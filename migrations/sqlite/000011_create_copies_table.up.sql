@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS copies
+(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    book_id     INTEGER  NOT NULL REFERENCES books ON DELETE CASCADE,
+    barcode     TEXT     NOT NULL UNIQUE,
+    condition   TEXT     NOT NULL DEFAULT 'good' CHECK (condition IN ('new', 'good', 'fair', 'poor', 'damaged')),
+    location    TEXT     NOT NULL DEFAULT '',
+    acquired_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    status      TEXT     NOT NULL DEFAULT 'available' CHECK (status IN ('available', 'on-loan', 'in-repair', 'lost')),
+    version     INTEGER  NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS copies_book_id_idx ON copies (book_id);
+
+ALTER TABLE books ADD COLUMN copies_total INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE books ADD COLUMN copies_available INTEGER NOT NULL DEFAULT 0;
+
+-- Books used to be lent as though the library had a single copy of each, so
+-- every existing book gets that copy, and its loans move onto it.
+INSERT INTO copies (book_id, barcode, acquired_at)
+SELECT id, printf('B%08d', id), created_at
+FROM books;
+
+-- SQLite can't add a NOT NULL column without a default, so copy_id is only
+-- required by the stores.
+ALTER TABLE loans ADD COLUMN copy_id INTEGER REFERENCES copies ON DELETE CASCADE;
+
+UPDATE loans
+SET copy_id = (SELECT id FROM copies WHERE copies.book_id = loans.book_id);
+
+UPDATE copies
+SET status = 'on-loan'
+WHERE id IN (SELECT copy_id FROM loans WHERE returned_at IS NULL);
+
+UPDATE books
+SET copies_total = (SELECT count(*) FROM copies WHERE book_id = books.id),
+    copies_available = (SELECT count(*) FROM copies WHERE book_id = books.id AND status = 'available');
+
+-- A copy, rather than a book, can only be out on one loan at a time.
+DROP INDEX IF EXISTS loans_open_book_id_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS loans_open_copy_id_idx ON loans (copy_id) WHERE returned_at IS NULL;
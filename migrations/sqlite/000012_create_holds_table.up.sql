@@ -0,0 +1,51 @@
+CREATE TABLE IF NOT EXISTS holds
+(
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at     DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    user_id        INTEGER  NOT NULL REFERENCES users ON DELETE CASCADE,
+    book_id        INTEGER  NOT NULL REFERENCES books ON DELETE CASCADE,
+    status         TEXT     NOT NULL DEFAULT 'waiting' CHECK (status IN ('waiting', 'ready', 'collected', 'cancelled', 'expired')),
+    pickup_seconds INTEGER  NOT NULL CHECK (pickup_seconds > 0),
+    copy_id        INTEGER  REFERENCES copies ON DELETE SET NULL,
+    ready_at       DATETIME,
+    expires_at     DATETIME,
+    notified_at    DATETIME,
+    version        INTEGER  NOT NULL DEFAULT 1
+);
+
+-- A user can only be in a book's queue once at a time.
+CREATE UNIQUE INDEX IF NOT EXISTS holds_open_book_id_user_id_idx ON holds (book_id, user_id) WHERE status IN ('waiting', 'ready');
+
+CREATE INDEX IF NOT EXISTS holds_user_id_idx ON holds (user_id);
+CREATE INDEX IF NOT EXISTS holds_ready_expires_at_idx ON holds (expires_at) WHERE status = 'ready';
+
+-- Copies that come back while users are waiting are set aside for them.
+-- SQLite can't change a CHECK constraint, so the table is rebuilt; foreign
+-- keys are off while migrations run, which keeps the loans and holds that
+-- refer to copies from following the old table.
+CREATE TABLE copies_new
+(
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at  DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    book_id     INTEGER  NOT NULL REFERENCES books ON DELETE CASCADE,
+    barcode     TEXT     NOT NULL UNIQUE,
+    condition   TEXT     NOT NULL DEFAULT 'good' CHECK (condition IN ('new', 'good', 'fair', 'poor', 'damaged')),
+    location    TEXT     NOT NULL DEFAULT '',
+    acquired_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    status      TEXT     NOT NULL DEFAULT 'available' CHECK (status IN ('available', 'on-loan', 'on-hold', 'in-repair', 'lost')),
+    version     INTEGER  NOT NULL DEFAULT 1
+);
+
+INSERT INTO copies_new (id, created_at, book_id, barcode, condition, location, acquired_at, status, version)
+SELECT id, created_at, book_id, barcode, condition, location, acquired_at, status, version
+FROM copies;
+
+DROP TABLE copies;
+ALTER TABLE copies_new RENAME TO copies;
+
+CREATE INDEX IF NOT EXISTS copies_book_id_idx ON copies (book_id);
+
+ALTER TABLE books ADD COLUMN available BOOLEAN NOT NULL DEFAULT false;
+
+UPDATE books
+SET available = copies_available > 0;
@@ -0,0 +1,7 @@
+ALTER TABLE outbox
+    ADD COLUMN dead BOOLEAN NOT NULL DEFAULT 0;
+
+ALTER TABLE webhook_deliveries
+    ADD COLUMN outbox_id INTEGER;
+
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_outbox_id_idx ON webhook_deliveries (webhook_id, outbox_id);